@@ -1,6 +1,7 @@
 package addrmgr
 
 import (
+	"bytes"
 	"io/ioutil"
 	"math/rand"
 	"net"
@@ -10,8 +11,8 @@ import (
 	"github.com/btgsuite/btgd/wire"
 )
 
-// randAddr generates a *wire.NetAddress backed by a random IPv4/IPv6 address.
-func randAddr(t *testing.T) *wire.NetAddress {
+// randAddr generates a *wire.NetAddressV2 backed by a random IPv4/IPv6 address.
+func randAddr(t *testing.T) *wire.NetAddressV2 {
 	t.Helper()
 
 	ipv4 := rand.Intn(2) == 0
@@ -30,22 +31,52 @@ func randAddr(t *testing.T) *wire.NetAddress {
 		ip = b[:]
 	}
 
-	return &wire.NetAddress{
+	return wire.NetAddressV2FromLegacy(&wire.NetAddress{
 		Services: wire.ServiceFlag(rand.Uint64()),
 		IP:       ip,
 		Port:     uint16(rand.Uint32()),
+	})
+}
+
+// randOverlayAddrs generates a *wire.NetAddressV2 backed by a random address
+// for each of the Tor v3, I2P and CJDNS networks.
+func randOverlayAddrs(t *testing.T) []*wire.NetAddressV2 {
+	t.Helper()
+
+	var addrs []*wire.NetAddressV2
+	for _, netID := range []wire.NetworkID{wire.NetTorV3, wire.NetI2P,
+		wire.NetCJDNS} {
+
+		size := 32
+		if netID == wire.NetCJDNS {
+			size = 16
+		}
+		b := make([]byte, size)
+		if _, err := rand.Read(b); err != nil {
+			t.Fatal(err)
+		}
+		if netID == wire.NetCJDNS {
+			b[0] = 0xfc
+		}
+		addrs = append(addrs, wire.NewNetAddressV2(netID, b,
+			uint16(rand.Uint32()), wire.ServiceFlag(rand.Uint64())))
 	}
+	return addrs
 }
 
 // assertAddr ensures that the two addresses match. The timestamp is not
 // checked as it does not affect uniquely identifying a specific address.
-func assertAddr(t *testing.T, got, expected *wire.NetAddress) {
+func assertAddr(t *testing.T, got, expected *wire.NetAddressV2) {
 	if got.Services != expected.Services {
 		t.Fatalf("expected address services %v, got %v",
 			expected.Services, got.Services)
 	}
-	if !got.IP.Equal(expected.IP) {
-		t.Fatalf("expected address IP %v, got %v", expected.IP, got.IP)
+	if got.NetworkID != expected.NetworkID {
+		t.Fatalf("expected address network %v, got %v",
+			expected.NetworkID, got.NetworkID)
+	}
+	if !bytes.Equal(got.Addr, expected.Addr) {
+		t.Fatalf("expected address %x, got %x", expected.Addr, got.Addr)
 	}
 	if got.Port != expected.Port {
 		t.Fatalf("expected address port %d, got %d", expected.Port,
@@ -56,7 +87,7 @@ func assertAddr(t *testing.T, got, expected *wire.NetAddress) {
 // assertAddrs ensures that the manager's address cache matches the given
 // expected addresses.
 func assertAddrs(t *testing.T, addrMgr *AddrManager,
-	expectedAddrs map[string]*wire.NetAddress) {
+	expectedAddrs map[string]*wire.NetAddressV2) {
 
 	t.Helper()
 
@@ -96,13 +127,20 @@ func TestAddrManagerSerialization(t *testing.T) {
 	// We'll be adding 5 random addresses to the manager.
 	const numAddrs = 5
 
-	expectedAddrs := make(map[string]*wire.NetAddress, numAddrs)
+	expectedAddrs := make(map[string]*wire.NetAddressV2, numAddrs)
 	for i := 0; i < numAddrs; i++ {
 		addr := randAddr(t)
 		expectedAddrs[NetAddressKey(addr)] = addr
 		addrMgr.AddAddress(addr, randAddr(t))
 	}
 
+	// Addresses on the overlay networks must survive the round trip as
+	// well, including CJDNS addresses which look like IPv6 addresses.
+	for _, addr := range randOverlayAddrs(t) {
+		expectedAddrs[NetAddressKey(addr)] = addr
+		addrMgr.AddAddress(addr, addr)
+	}
+
 	// Now that the addresses have been added, we should be able to retrieve
 	// them.
 	assertAddrs(t, addrMgr, expectedAddrs)
@@ -141,7 +179,7 @@ func TestAddrManagerV1ToV2(t *testing.T) {
 	// each addresses' services will not be stored.
 	const numAddrs = 5
 
-	expectedAddrs := make(map[string]*wire.NetAddress, numAddrs)
+	expectedAddrs := make(map[string]*wire.NetAddressV2, numAddrs)
 	for i := 0; i < numAddrs; i++ {
 		addr := randAddr(t)
 		expectedAddrs[NetAddressKey(addr)] = addr
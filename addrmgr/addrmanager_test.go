@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"net"
 	"reflect"
+	"sort"
 	"testing"
 	"time"
 
@@ -19,7 +20,7 @@ import (
 // naTest is used to describe a test to be performed against the NetAddressKey
 // method.
 type naTest struct {
-	in   wire.NetAddress
+	in   wire.NetAddressV2
 	want string
 }
 
@@ -91,9 +92,15 @@ func addNaTests() {
 	addNaTest("fef3::4:4", 8336, "[fef3::4:4]:8336")
 }
 
+// netAddr returns a wire.NetAddressV2 for the passed IP address.
+func netAddr(ip string) wire.NetAddressV2 {
+	return *wire.NetAddressV2FromLegacy(&wire.NetAddress{IP: net.ParseIP(ip)})
+}
+
 func addNaTest(ip string, port uint16, want string) {
 	nip := net.ParseIP(ip)
-	na := *wire.NewNetAddressIPPort(nip, port, wire.SFNodeNetwork)
+	na := *wire.NetAddressV2FromLegacy(wire.NewNetAddressIPPort(nip, port,
+		wire.SFNodeNetwork))
 	test := naTest{na, want}
 	naTests = append(naTests, test)
 }
@@ -157,37 +164,37 @@ func TestAddAddressByIP(t *testing.T) {
 
 func TestAddLocalAddress(t *testing.T) {
 	var tests = []struct {
-		address  wire.NetAddress
+		address  wire.NetAddressV2
 		priority addrmgr.AddressPriority
 		valid    bool
 	}{
 		{
-			wire.NetAddress{IP: net.ParseIP("192.168.0.100")},
+			netAddr("192.168.0.100"),
 			addrmgr.InterfacePrio,
 			false,
 		},
 		{
-			wire.NetAddress{IP: net.ParseIP("204.124.1.1")},
+			netAddr("204.124.1.1"),
 			addrmgr.InterfacePrio,
 			true,
 		},
 		{
-			wire.NetAddress{IP: net.ParseIP("204.124.1.1")},
+			netAddr("204.124.1.1"),
 			addrmgr.BoundPrio,
 			true,
 		},
 		{
-			wire.NetAddress{IP: net.ParseIP("::1")},
+			netAddr("::1"),
 			addrmgr.InterfacePrio,
 			false,
 		},
 		{
-			wire.NetAddress{IP: net.ParseIP("fe80::1")},
+			netAddr("fe80::1"),
 			addrmgr.InterfacePrio,
 			false,
 		},
 		{
-			wire.NetAddress{IP: net.ParseIP("2620:100::1")},
+			netAddr("2620:100::1"),
 			addrmgr.InterfacePrio,
 			true,
 		},
@@ -197,17 +204,54 @@ func TestAddLocalAddress(t *testing.T) {
 		result := amgr.AddLocalAddress(&test.address, test.priority)
 		if result == nil && !test.valid {
 			t.Errorf("TestAddLocalAddress test #%d failed: %s should have "+
-				"been accepted", x, test.address.IP)
+				"been accepted", x, test.address.IP())
 			continue
 		}
 		if result != nil && test.valid {
 			t.Errorf("TestAddLocalAddress test #%d failed: %s should not have "+
-				"been accepted", x, test.address.IP)
+				"been accepted", x, test.address.IP())
 			continue
 		}
 	}
 }
 
+func TestLocalAddresses(t *testing.T) {
+	amgr := addrmgr.New("testlocaladdresses", nil)
+	if len(amgr.LocalAddresses()) != 0 {
+		t.Fatal("TestLocalAddresses: new address manager has local addresses")
+	}
+
+	ipv4Addr := netAddr("204.124.1.1")
+	ipv6Addr := netAddr("2620:100::1")
+	amgr.AddLocalAddress(&ipv4Addr, addrmgr.InterfacePrio)
+	amgr.AddLocalAddress(&ipv4Addr, addrmgr.BoundPrio)
+	amgr.AddLocalAddress(&ipv6Addr, addrmgr.UpnpPrio)
+
+	// Adding an address again with a higher priority raises its score.
+	wantScores := map[string]addrmgr.AddressPriority{
+		"204.124.1.1": addrmgr.BoundPrio + 1,
+		"2620:100::1": addrmgr.UpnpPrio,
+	}
+	localAddrs := amgr.LocalAddresses()
+	if len(localAddrs) != len(wantScores) {
+		t.Fatalf("TestLocalAddresses: got %d local addresses, want %d",
+			len(localAddrs), len(wantScores))
+	}
+	for _, la := range localAddrs {
+		host := la.NetAddress.Host()
+		want, ok := wantScores[host]
+		if !ok {
+			t.Errorf("TestLocalAddresses: unexpected local address %s",
+				host)
+			continue
+		}
+		if la.Score != want {
+			t.Errorf("TestLocalAddresses: got score %d for %s, want %d",
+				la.Score, host, want)
+		}
+	}
+}
+
 func TestAttempt(t *testing.T) {
 	n := addrmgr.New("testattempt", lookupFunc)
 
@@ -257,7 +301,7 @@ func TestNeedMoreAddresses(t *testing.T) {
 	if !b {
 		t.Errorf("Expected that we need more addresses")
 	}
-	addrs := make([]*wire.NetAddress, addrsToAdd)
+	addrs := make([]*wire.NetAddressV2, addrsToAdd)
 
 	var err error
 	for i := 0; i < addrsToAdd; i++ {
@@ -268,7 +312,8 @@ func TestNeedMoreAddresses(t *testing.T) {
 		}
 	}
 
-	srcAddr := wire.NewNetAddressIPPort(net.IPv4(173, 144, 173, 111), 8333, 0)
+	srcAddr := wire.NetAddressV2FromLegacy(wire.NewNetAddressIPPort(
+		net.IPv4(173, 144, 173, 111), 8333, 0))
 
 	n.AddAddresses(addrs, srcAddr)
 	numAddrs := n.NumAddresses()
@@ -285,7 +330,7 @@ func TestNeedMoreAddresses(t *testing.T) {
 func TestGood(t *testing.T) {
 	n := addrmgr.New("testgood", lookupFunc)
 	addrsToAdd := 64 * 64
-	addrs := make([]*wire.NetAddress, addrsToAdd)
+	addrs := make([]*wire.NetAddressV2, addrsToAdd)
 
 	var err error
 	for i := 0; i < addrsToAdd; i++ {
@@ -296,7 +341,8 @@ func TestGood(t *testing.T) {
 		}
 	}
 
-	srcAddr := wire.NewNetAddressIPPort(net.IPv4(173, 144, 173, 111), 8333, 0)
+	srcAddr := wire.NetAddressV2FromLegacy(wire.NewNetAddressIPPort(
+		net.IPv4(173, 144, 173, 111), 8333, 0))
 
 	n.AddAddresses(addrs, srcAddr)
 	for _, addr := range addrs {
@@ -314,6 +360,63 @@ func TestGood(t *testing.T) {
 	}
 }
 
+// TestGoodAddresses ensures only the addresses which completed a version
+// handshake and advertise the requested services are returned.
+func TestGoodAddresses(t *testing.T) {
+	n := addrmgr.New("testgoodaddresses", lookupFunc)
+	srcAddr := wire.NetAddressV2FromLegacy(wire.NewNetAddressIPPort(
+		net.IPv4(173, 144, 173, 111), 8333, 0))
+
+	addr := func(s string, services wire.ServiceFlag) *wire.NetAddressV2 {
+		na, err := n.DeserializeNetAddress(s, services)
+		if err != nil {
+			t.Fatalf("Failed to turn %s into an address: %v", s, err)
+		}
+		n.AddAddress(na, srcAddr)
+		return na
+	}
+	goodFull := addr("60.173.147.1:8333", wire.SFNodeNetwork|wire.SFNodeWitness)
+	goodNetwork := addr("60.173.147.2:8333", wire.SFNodeNetwork)
+	goodBloom := addr("60.173.147.3:8333", wire.SFNodeBloom)
+	addr("60.173.147.4:8333", wire.SFNodeNetwork)
+	n.Good(goodFull)
+	n.Good(goodNetwork)
+	n.Good(goodBloom)
+
+	tests := []struct {
+		services wire.ServiceFlag
+		since    time.Time
+		want     []string
+	}{
+		{
+			services: wire.SFNodeNetwork,
+			since:    time.Now().Add(-time.Hour),
+			want:     []string{goodFull.String(), goodNetwork.String()},
+		},
+		{
+			services: wire.SFNodeNetwork | wire.SFNodeWitness,
+			since:    time.Now().Add(-time.Hour),
+			want:     []string{goodFull.String()},
+		},
+		{
+			services: wire.SFNodeNetwork,
+			since:    time.Now().Add(time.Hour),
+			want:     nil,
+		},
+	}
+
+	for i, test := range tests {
+		var got []string
+		for _, na := range n.GoodAddresses(test.services, test.since) {
+			got = append(got, na.String())
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("#%d: got %v, want %v", i, got, test.want)
+		}
+	}
+}
+
 func TestGetAddress(t *testing.T) {
 	n := addrmgr.New("testgetaddress", lookupFunc)
 
@@ -331,8 +434,8 @@ func TestGetAddress(t *testing.T) {
 	if ka == nil {
 		t.Fatalf("Did not get an address where there is one in the pool")
 	}
-	if ka.NetAddress().IP.String() != someIP {
-		t.Errorf("Wrong IP: got %v, want %v", ka.NetAddress().IP.String(), someIP)
+	if ka.NetAddress().IP().String() != someIP {
+		t.Errorf("Wrong IP: got %v, want %v", ka.NetAddress().IP().String(), someIP)
 	}
 
 	// Mark this as a good address and get it
@@ -341,8 +444,8 @@ func TestGetAddress(t *testing.T) {
 	if ka == nil {
 		t.Fatalf("Did not get an address where there is one in the pool")
 	}
-	if ka.NetAddress().IP.String() != someIP {
-		t.Errorf("Wrong IP: got %v, want %v", ka.NetAddress().IP.String(), someIP)
+	if ka.NetAddress().IP().String() != someIP {
+		t.Errorf("Wrong IP: got %v, want %v", ka.NetAddress().IP().String(), someIP)
 	}
 
 	numAddrs := n.NumAddresses()
@@ -352,51 +455,51 @@ func TestGetAddress(t *testing.T) {
 }
 
 func TestGetBestLocalAddress(t *testing.T) {
-	localAddrs := []wire.NetAddress{
-		{IP: net.ParseIP("192.168.0.100")},
-		{IP: net.ParseIP("::1")},
-		{IP: net.ParseIP("fe80::1")},
-		{IP: net.ParseIP("2001:470::1")},
+	localAddrs := []wire.NetAddressV2{
+		netAddr("192.168.0.100"),
+		netAddr("::1"),
+		netAddr("fe80::1"),
+		netAddr("2001:470::1"),
 	}
 
 	var tests = []struct {
-		remoteAddr wire.NetAddress
-		want0      wire.NetAddress
-		want1      wire.NetAddress
-		want2      wire.NetAddress
-		want3      wire.NetAddress
+		remoteAddr wire.NetAddressV2
+		want0      wire.NetAddressV2
+		want1      wire.NetAddressV2
+		want2      wire.NetAddressV2
+		want3      wire.NetAddressV2
 	}{
 		{
 			// Remote connection from public IPv4
-			wire.NetAddress{IP: net.ParseIP("204.124.8.1")},
-			wire.NetAddress{IP: net.IPv4zero},
-			wire.NetAddress{IP: net.IPv4zero},
-			wire.NetAddress{IP: net.ParseIP("204.124.8.100")},
-			wire.NetAddress{IP: net.ParseIP("fd87:d87e:eb43:25::1")},
+			netAddr("204.124.8.1"),
+			netAddr("0.0.0.0"),
+			netAddr("0.0.0.0"),
+			netAddr("204.124.8.100"),
+			netAddr("fd87:d87e:eb43:25::1"),
 		},
 		{
 			// Remote connection from private IPv4
-			wire.NetAddress{IP: net.ParseIP("172.16.0.254")},
-			wire.NetAddress{IP: net.IPv4zero},
-			wire.NetAddress{IP: net.IPv4zero},
-			wire.NetAddress{IP: net.IPv4zero},
-			wire.NetAddress{IP: net.IPv4zero},
+			netAddr("172.16.0.254"),
+			netAddr("0.0.0.0"),
+			netAddr("0.0.0.0"),
+			netAddr("0.0.0.0"),
+			netAddr("0.0.0.0"),
 		},
 		{
 			// Remote connection from public IPv6
-			wire.NetAddress{IP: net.ParseIP("2602:100:abcd::102")},
-			wire.NetAddress{IP: net.IPv6zero},
-			wire.NetAddress{IP: net.ParseIP("2001:470::1")},
-			wire.NetAddress{IP: net.ParseIP("2001:470::1")},
-			wire.NetAddress{IP: net.ParseIP("2001:470::1")},
+			netAddr("2602:100:abcd::102"),
+			netAddr("::"),
+			netAddr("2001:470::1"),
+			netAddr("2001:470::1"),
+			netAddr("2001:470::1"),
 		},
 		/* XXX
 		{
 			// Remote connection from Tor
-			wire.NetAddress{IP: net.ParseIP("fd87:d87e:eb43::100")},
-			wire.NetAddress{IP: net.IPv4zero},
-			wire.NetAddress{IP: net.ParseIP("204.124.8.100")},
-			wire.NetAddress{IP: net.ParseIP("fd87:d87e:eb43:25::1")},
+			netAddr("fd87:d87e:eb43::100"),
+			netAddr("0.0.0.0"),
+			netAddr("204.124.8.100"),
+			netAddr("fd87:d87e:eb43:25::1"),
 		},
 		*/
 	}
@@ -406,9 +509,9 @@ func TestGetBestLocalAddress(t *testing.T) {
 	// Test against default when there's no address
 	for x, test := range tests {
 		got := amgr.GetBestLocalAddress(&test.remoteAddr)
-		if !test.want0.IP.Equal(got.IP) {
+		if !test.want0.IP().Equal(got.IP()) {
 			t.Errorf("TestGetBestLocalAddress test1 #%d failed for remote address %s: want %s got %s",
-				x, test.remoteAddr.IP, test.want1.IP, got.IP)
+				x, test.remoteAddr.IP(), test.want1.IP(), got.IP())
 			continue
 		}
 	}
@@ -420,37 +523,37 @@ func TestGetBestLocalAddress(t *testing.T) {
 	// Test against want1
 	for x, test := range tests {
 		got := amgr.GetBestLocalAddress(&test.remoteAddr)
-		if !test.want1.IP.Equal(got.IP) {
+		if !test.want1.IP().Equal(got.IP()) {
 			t.Errorf("TestGetBestLocalAddress test1 #%d failed for remote address %s: want %s got %s",
-				x, test.remoteAddr.IP, test.want1.IP, got.IP)
+				x, test.remoteAddr.IP(), test.want1.IP(), got.IP())
 			continue
 		}
 	}
 
 	// Add a public IP to the list of local addresses.
-	localAddr := wire.NetAddress{IP: net.ParseIP("204.124.8.100")}
+	localAddr := netAddr("204.124.8.100")
 	amgr.AddLocalAddress(&localAddr, addrmgr.InterfacePrio)
 
 	// Test against want2
 	for x, test := range tests {
 		got := amgr.GetBestLocalAddress(&test.remoteAddr)
-		if !test.want2.IP.Equal(got.IP) {
+		if !test.want2.IP().Equal(got.IP()) {
 			t.Errorf("TestGetBestLocalAddress test2 #%d failed for remote address %s: want %s got %s",
-				x, test.remoteAddr.IP, test.want2.IP, got.IP)
+				x, test.remoteAddr.IP(), test.want2.IP(), got.IP())
 			continue
 		}
 	}
 	/*
 		// Add a Tor generated IP address
-		localAddr = wire.NetAddress{IP: net.ParseIP("fd87:d87e:eb43:25::1")}
+		localAddr = netAddr("fd87:d87e:eb43:25::1")
 		amgr.AddLocalAddress(&localAddr, addrmgr.ManualPrio)
 
 		// Test against want3
 		for x, test := range tests {
 			got := amgr.GetBestLocalAddress(&test.remoteAddr)
-			if !test.want3.IP.Equal(got.IP) {
+			if !test.want3.IP().Equal(got.IP()) {
 				t.Errorf("TestGetBestLocalAddress test3 #%d failed for remote address %s: want %s got %s",
-					x, test.remoteAddr.IP, test.want3.IP, got.IP)
+					x, test.remoteAddr.IP(), test.want3.IP(), got.IP())
 				continue
 			}
 		}
@@ -0,0 +1,383 @@
+// Copyright (c) 2013-2016 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package addrmgr
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/bits"
+	"net"
+
+	"github.com/btgsuite/btgd/wire"
+)
+
+// The asmap format is the compressed binary trie used by Bitcoin Core to map IP
+// address prefixes to autonomous system numbers.  The file is a sequence of
+// bits, stored least significant bit first within each byte, which encodes a
+// program for a small interpreter that consumes the bits of an IPv6 (or
+// IPv4-mapped IPv6) address from the most significant bit onwards.
+
+// asmapInvalid is returned by the decoding functions when the bits being
+// decoded straddle the end of the map.
+const asmapInvalid = 0xffffffff
+
+// asmapIPBits is the number of input bits consumed by an asmap lookup.
+const asmapIPBits = 128
+
+// asmapOpcode identifies an asmap interpreter instruction.
+type asmapOpcode uint32
+
+const (
+	// asmapReturn returns the encoded ASN.
+	asmapReturn asmapOpcode = 0
+
+	// asmapJump consumes a single input bit and skips the encoded number of
+	// bits in the map when it is set.
+	asmapJump asmapOpcode = 1
+
+	// asmapMatch compares the encoded bits against the input and returns
+	// the default ASN on a mismatch.
+	asmapMatch asmapOpcode = 2
+
+	// asmapDefault sets the default ASN that is returned on a mismatch.
+	asmapDefault asmapOpcode = 3
+)
+
+var (
+	// asmapTypeBitSizes, asmapASNBitSizes, asmapMatchBitSizes and
+	// asmapJumpBitSizes define the variable length integer encodings of the
+	// respective instruction fields.
+	asmapTypeBitSizes  = []uint8{0, 0, 1}
+	asmapASNBitSizes   = []uint8{15, 16, 17, 18, 19, 20, 21, 22, 23, 24}
+	asmapMatchBitSizes = []uint8{1, 2, 3, 4, 5, 6, 7, 8}
+	asmapJumpBitSizes  = []uint8{5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+		16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30}
+)
+
+// ErrInvalidASMap describes an error where an asmap fails the sanity checks
+// performed when it is loaded.
+var ErrInvalidASMap = errors.New("invalid asmap")
+
+// ASMap maps IP addresses to the autonomous system number (ASN) that announces
+// them.  It is used to group addresses by the network operator controlling them
+// rather than by their IP prefix.
+type ASMap struct {
+	data     []byte
+	checksum string
+}
+
+// asmapReader reads bits from an asmap starting at a given bit position.
+type asmapReader struct {
+	data []byte
+	pos  int
+	end  int
+}
+
+// atEnd returns whether or not all bits have been read.
+func (r *asmapReader) atEnd() bool {
+	return r.pos >= r.end
+}
+
+// readBit returns the next bit of the map.  It MUST only be called when atEnd
+// returns false.
+func (r *asmapReader) readBit() uint32 {
+	bit := uint32(r.data[r.pos/8]>>uint(r.pos%8)) & 1
+	r.pos++
+	return bit
+}
+
+// decodeBits decodes a variable length integer using the passed minimum value
+// and exponent bit sizes.  asmapInvalid is returned when the encoding
+// straddles the end of the map.
+func (r *asmapReader) decodeBits(minVal uint32, bitSizes []uint8) uint32 {
+	val := minVal
+	for i, size := range bitSizes {
+		var bit uint32
+		if i != len(bitSizes)-1 {
+			if r.atEnd() {
+				break
+			}
+			bit = r.readBit()
+		}
+		if bit == 1 {
+			val += 1 << size
+			continue
+		}
+		for b := uint8(0); b < size; b++ {
+			if r.atEnd() {
+				return asmapInvalid
+			}
+			val += r.readBit() << (size - 1 - b)
+		}
+		return val
+	}
+	return asmapInvalid
+}
+
+// decodeType decodes an instruction opcode.
+func (r *asmapReader) decodeType() asmapOpcode {
+	return asmapOpcode(r.decodeBits(0, asmapTypeBitSizes))
+}
+
+// decodeASN decodes an autonomous system number.
+func (r *asmapReader) decodeASN() uint32 {
+	return r.decodeBits(1, asmapASNBitSizes)
+}
+
+// decodeMatch decodes the bits to match against the input.  The bits are
+// prefixed by a set marker bit.
+func (r *asmapReader) decodeMatch() uint32 {
+	return r.decodeBits(2, asmapMatchBitSizes)
+}
+
+// decodeJump decodes a jump offset in bits.
+func (r *asmapReader) decodeJump() uint32 {
+	return r.decodeBits(17, asmapJumpBitSizes)
+}
+
+// sanityCheckASMap ensures the passed map can be interpreted for any input
+// consisting of the passed number of bits.  It mirrors the checks performed by
+// Bitcoin Core so maps which are accepted there are also accepted here.
+func sanityCheckASMap(data []byte, numBits int) bool {
+	type jumpTarget struct {
+		offset int
+		bits   int
+	}
+
+	r := &asmapReader{data: data, end: len(data) * 8}
+	var jumps []jumpTarget
+	prevOpcode := asmapJump
+	hadIncompleteMatch := false
+	for !r.atEnd() {
+		if len(jumps) > 0 && r.pos >= jumps[len(jumps)-1].offset {
+			// Jump into the middle of the previous instruction.
+			return false
+		}
+
+		switch opcode := r.decodeType(); opcode {
+		case asmapReturn:
+			if prevOpcode == asmapDefault {
+				// A default directly followed by a return could
+				// be combined into a single return.
+				return false
+			}
+			if r.decodeASN() == asmapInvalid {
+				return false
+			}
+			if len(jumps) == 0 {
+				// Nothing is left to execute, so only up to 7
+				// zero padding bits may remain.
+				if r.end-r.pos > 7 {
+					return false
+				}
+				for !r.atEnd() {
+					if r.readBit() != 0 {
+						return false
+					}
+				}
+				return true
+			}
+
+			// Continue as if the last jump was taken.
+			last := jumps[len(jumps)-1]
+			if r.pos != last.offset {
+				// Unreachable code.
+				return false
+			}
+			numBits = last.bits
+			jumps = jumps[:len(jumps)-1]
+			prevOpcode = asmapJump
+
+		case asmapJump:
+			jump := r.decodeJump()
+			if jump == asmapInvalid {
+				return false
+			}
+			if int64(jump) > int64(r.end-r.pos) {
+				return false
+			}
+			if numBits == 0 {
+				return false
+			}
+			numBits--
+			offset := r.pos + int(jump)
+			if len(jumps) > 0 && offset >= jumps[len(jumps)-1].offset {
+				// Intersecting jumps.
+				return false
+			}
+			jumps = append(jumps, jumpTarget{offset, numBits})
+			prevOpcode = asmapJump
+
+		case asmapMatch:
+			match := r.decodeMatch()
+			if match == asmapInvalid {
+				return false
+			}
+			matchLen := bits.Len32(match) - 1
+			if prevOpcode != asmapMatch {
+				hadIncompleteMatch = false
+			}
+			if matchLen < 8 && hadIncompleteMatch {
+				// Only one match in a sequence of matches may be
+				// incomplete.
+				return false
+			}
+			hadIncompleteMatch = matchLen < 8
+			if numBits < matchLen {
+				return false
+			}
+			numBits -= matchLen
+			prevOpcode = asmapMatch
+
+		case asmapDefault:
+			if prevOpcode == asmapDefault {
+				// Successive defaults could be combined.
+				return false
+			}
+			if r.decodeASN() == asmapInvalid {
+				return false
+			}
+			prevOpcode = asmapDefault
+
+		default:
+			// Instruction straddles the end of the map.
+			return false
+		}
+	}
+
+	// Reached the end of the map without a return instruction.
+	return false
+}
+
+// DecodeASMap decodes an asmap in the compressed format used by Bitcoin Core.
+// ErrInvalidASMap is returned when the map fails the sanity checks.
+func DecodeASMap(data []byte) (*ASMap, error) {
+	if !sanityCheckASMap(data, asmapIPBits) {
+		return nil, ErrInvalidASMap
+	}
+	checksum := sha256.Sum256(data)
+	return &ASMap{
+		data:     data,
+		checksum: hex.EncodeToString(checksum[:]),
+	}, nil
+}
+
+// LoadASMap reads and decodes the asmap file at the passed path.
+func LoadASMap(path string) (*ASMap, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m, err := DecodeASMap(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return m, nil
+}
+
+// Checksum returns the hex encoded sha256 hash of the encoded map which
+// uniquely identifies it.
+func (m *ASMap) Checksum() string {
+	return m.checksum
+}
+
+// Lookup returns the ASN which announces the passed IP address or 0 when the
+// address is not mapped.
+func (m *ASMap) Lookup(ip net.IP) uint32 {
+	ip = ip.To16()
+	if ip == nil {
+		return 0
+	}
+
+	// The map has already passed the sanity checks, so every path through
+	// it ends with a return instruction.  The error cases below are only
+	// kept for robustness.
+	r := &asmapReader{data: m.data, end: len(m.data) * 8}
+	var defaultASN uint32
+	inputPos := 0
+	inputBit := func() uint32 {
+		bit := uint32(ip[inputPos/8]>>uint(7-inputPos%8)) & 1
+		inputPos++
+		return bit
+	}
+	for !r.atEnd() {
+		switch r.decodeType() {
+		case asmapReturn:
+			asn := r.decodeASN()
+			if asn == asmapInvalid {
+				return 0
+			}
+			return asn
+
+		case asmapJump:
+			jump := r.decodeJump()
+			if jump == asmapInvalid || inputPos >= asmapIPBits ||
+				int64(jump) >= int64(r.end-r.pos) {
+
+				return 0
+			}
+			if inputBit() == 1 {
+				r.pos += int(jump)
+			}
+
+		case asmapMatch:
+			match := r.decodeMatch()
+			if match == asmapInvalid {
+				return 0
+			}
+			matchLen := bits.Len32(match) - 1
+			if asmapIPBits-inputPos < matchLen {
+				return 0
+			}
+			for i := 0; i < matchLen; i++ {
+				want := (match >> uint(matchLen-1-i)) & 1
+				if inputBit() != want {
+					return defaultASN
+				}
+			}
+
+		case asmapDefault:
+			defaultASN = r.decodeASN()
+			if defaultASN == asmapInvalid {
+				return 0
+			}
+
+		default:
+			return 0
+		}
+	}
+	return 0
+}
+
+// mappedIP returns the IPv4 or IPv6 address that determines the ASN of the
+// passed address.  IPv4 addresses embedded in tunneling and translation
+// addresses are extracted.  Nil is returned for addresses which do not map
+// to an ASN, such as Tor, I2P and CJDNS addresses.
+func mappedIP(na *wire.NetAddressV2) net.IP {
+	if !IsRoutable(na) || IsOnionCatTor(na) || IsTorV3(na) || IsI2P(na) ||
+		IsCJDNS(na) {
+
+		return nil
+	}
+	ip := na.IP()
+	switch {
+	case IsIPv4(na):
+		return ip
+	case IsRFC6145(na) || IsRFC6052(na):
+		return net.IP(ip[12:16]).To16()
+	case IsRFC3964(na):
+		return net.IP(ip[2:6]).To16()
+	case IsRFC4380(na):
+		v4 := make(net.IP, 4)
+		for i, b := range ip[12:16] {
+			v4[i] = b ^ 0xff
+		}
+		return v4.To16()
+	}
+	return ip
+}
@@ -0,0 +1,218 @@
+// Copyright (c) 2013-2016 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package addrmgr_test
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/btgsuite/btgd/addrmgr"
+	"github.com/btgsuite/btgd/wire"
+)
+
+// asmapWriter builds asmaps in the compressed format used by Bitcoin Core for
+// testing purposes.
+type asmapWriter struct {
+	bits []bool
+}
+
+// encode appends the variable length encoding of val using the passed minimum
+// value and exponent bit sizes.
+func (w *asmapWriter) encode(val, minVal uint32, bitSizes []uint8) {
+	val -= minVal
+	for i, size := range bitSizes {
+		if i != len(bitSizes)-1 {
+			if val >= 1<<size {
+				w.bits = append(w.bits, true)
+				val -= 1 << size
+				continue
+			}
+			w.bits = append(w.bits, false)
+		}
+		for b := int(size) - 1; b >= 0; b-- {
+			w.bits = append(w.bits, (val>>uint(b))&1 == 1)
+		}
+		return
+	}
+}
+
+// opcode appends an instruction opcode.
+func (w *asmapWriter) opcode(op uint32) {
+	w.encode(op, 0, []uint8{0, 0, 1})
+}
+
+// ret appends a return instruction for the passed ASN.
+func (w *asmapWriter) ret(asn uint32) {
+	w.opcode(0)
+	w.encode(asn, 1, []uint8{15, 16, 17, 18, 19, 20, 21, 22, 23, 24})
+}
+
+// jump appends a jump instruction which skips the passed number of bits.
+func (w *asmapWriter) jump(offset uint32) {
+	w.opcode(1)
+	w.encode(offset, 17, []uint8{5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+		16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30})
+}
+
+// match appends match instructions for the passed input bits using at most 8
+// bits per instruction.
+func (w *asmapWriter) match(input []bool) {
+	for len(input) > 0 {
+		n := len(input)
+		if n > 8 {
+			n = 8
+		}
+		val := uint32(1)
+		for _, bit := range input[:n] {
+			val <<= 1
+			if bit {
+				val |= 1
+			}
+		}
+		w.opcode(2)
+		w.encode(val, 2, []uint8{1, 2, 3, 4, 5, 6, 7, 8})
+		input = input[n:]
+	}
+}
+
+// bytes returns the encoded map.
+func (w *asmapWriter) bytes() []byte {
+	data := make([]byte, (len(w.bits)+7)/8)
+	for i, bit := range w.bits {
+		if bit {
+			data[i/8] |= 1 << uint(i%8)
+		}
+	}
+	return data
+}
+
+// ipBits returns the bits of the passed IP address in its 16-byte form
+// starting at the passed bit offset.
+func ipBits(ip net.IP, prefixLen, offset int) []bool {
+	ip = ip.To16()
+	bits := make([]bool, 0, prefixLen-offset)
+	for i := offset; i < prefixLen; i++ {
+		bits = append(bits, ip[i/8]>>uint(7-i%8)&1 == 1)
+	}
+	return bits
+}
+
+// testASMap returns an asmap which maps 1.2.0.0/16 to AS 64512, 4a00:1234::/32
+// to AS 64513 and addresses with the first bit set to AS 64514.  All other
+// addresses are unmapped.
+func testASMap() []byte {
+	// The program first jumps on the first input bit.  Addresses with the
+	// first bit cleared then jump on the second bit which is cleared for
+	// IPv4-mapped addresses and set for the IPv6 prefix.
+	var ipv4 asmapWriter
+	ipv4.match(ipBits(net.ParseIP("1.2.0.0"), 96+16, 2))
+	ipv4.ret(64512)
+
+	var ipv6 asmapWriter
+	ipv6.match(ipBits(net.ParseIP("4a00:1234::"), 32, 2))
+	ipv6.ret(64513)
+
+	var w asmapWriter
+	var left asmapWriter
+	left.jump(uint32(len(ipv4.bits)))
+	left.bits = append(left.bits, ipv4.bits...)
+	left.bits = append(left.bits, ipv6.bits...)
+	w.jump(uint32(len(left.bits)))
+	w.bits = append(w.bits, left.bits...)
+	w.ret(64514)
+	return w.bytes()
+}
+
+// TestASMap ensures asmaps are decoded and looked up as expected.
+func TestASMap(t *testing.T) {
+	m, err := addrmgr.DecodeASMap(testASMap())
+	if err != nil {
+		t.Fatalf("DecodeASMap: unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		ip  string
+		asn uint32
+	}{
+		{ip: "1.2.3.4", asn: 64512},
+		{ip: "1.2.255.255", asn: 64512},
+		{ip: "1.3.0.1", asn: 0},
+		{ip: "4a00:1234::1", asn: 64513},
+		{ip: "4a00:1235::1", asn: 0},
+		{ip: "8000::1", asn: 64514},
+		{ip: "fe80::1", asn: 64514},
+	}
+	for _, test := range tests {
+		asn := m.Lookup(net.ParseIP(test.ip))
+		if asn != test.asn {
+			t.Errorf("Lookup(%s): got %d, want %d", test.ip, asn,
+				test.asn)
+		}
+	}
+
+	// Maps which do not pass the sanity checks must be rejected.
+	invalid := [][]byte{
+		nil,
+		{0xff},
+		append(testASMap(), 0x00),
+		testASMap()[:4],
+	}
+	for i, data := range invalid {
+		if _, err := addrmgr.DecodeASMap(data); err == nil {
+			t.Errorf("DecodeASMap #%d: expected error", i)
+		}
+	}
+}
+
+// TestASMapGroupKey ensures the address manager groups addresses by ASN when
+// an asmap is in use.
+func TestASMapGroupKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "asmap")
+	if err != nil {
+		t.Fatalf("TempDir: unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ip_asn.map")
+	if err := ioutil.WriteFile(path, testASMap(), 0644); err != nil {
+		t.Fatalf("WriteFile: unexpected error: %v", err)
+	}
+	m, err := addrmgr.LoadASMap(path)
+	if err != nil {
+		t.Fatalf("LoadASMap: unexpected error: %v", err)
+	}
+
+	n := addrmgr.New(dir, lookupFunc)
+	n.SetASMap(m)
+
+	tests := []struct {
+		ip    string
+		group string
+		asn   uint32
+	}{
+		{ip: "1.2.3.4", group: "as64512", asn: 64512},
+		{ip: "1.3.3.4", group: "1.3.0.0"},
+		{ip: "4a00:1234::1", group: "as64513", asn: 64513},
+		{ip: "4a00:1235::1", group: "4a00:1235::"},
+		// 6to4 addresses are mapped using the embedded IPv4 address.
+		{ip: "2002:102:304::1", group: "as64512", asn: 64512},
+		// Tor addresses are never mapped.
+		{ip: "fd87:d87e:eb43:1234::1", group: "tor:2"},
+	}
+	for _, test := range tests {
+		na := wire.NetAddressV2FromLegacy(wire.NewNetAddressIPPort(
+			net.ParseIP(test.ip), 8333, 0))
+		if group := n.GroupKey(na); group != test.group {
+			t.Errorf("GroupKey(%s): got %s, want %s", test.ip, group,
+				test.group)
+		}
+		if asn := n.MappedAS(na); asn != test.asn {
+			t.Errorf("MappedAS(%s): got %d, want %d", test.ip, asn,
+				test.asn)
+		}
+	}
+}
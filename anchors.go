@@ -0,0 +1,64 @@
+// Copyright (c) 2013-2017 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/btgsuite/btgd/jsonfile"
+)
+
+// anchorsVersion is the current version of the serialized anchors format.
+const anchorsVersion = 1
+
+// serializedAnchors is the on-disk representation of the anchors file.
+type serializedAnchors struct {
+	Version   int      `json:"version"`
+	Addresses []string `json:"addresses"`
+}
+
+// readAnchors reads the addresses of the block-relay-only peers stored in the
+// anchors file at the passed path and then removes the file so a bad set of
+// anchors is not reused if the node is restarted before they are replaced.  A
+// missing file is not an error and results in no addresses.
+func readAnchors(path string) ([]string, error) {
+	r, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var sa serializedAnchors
+	err = json.NewDecoder(r).Decode(&sa)
+	r.Close()
+	if removeErr := os.Remove(path); removeErr != nil {
+		srvrLog.Warnf("Unable to remove anchors file %s: %v", path,
+			removeErr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode %s: %v", path, err)
+	}
+	if sa.Version != anchorsVersion {
+		return nil, fmt.Errorf("unknown anchors version %d in %s",
+			sa.Version, path)
+	}
+	return sa.Addresses, nil
+}
+
+// writeAnchors writes the passed addresses of block-relay-only peers to the
+// anchors file at the passed path so they are reconnected first on the next
+// start.
+func writeAnchors(path string, addrs []string) error {
+	sa := serializedAnchors{
+		Version:   anchorsVersion,
+		Addresses: addrs,
+	}
+
+	return jsonfile.Write(path, &sa)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestAnchors ensures anchors written to disk are read back and that the file
+// is removed once it has been read.
+func TestAnchors(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "anchors")
+	if err != nil {
+		t.Fatalf("Failed creating a temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	path := filepath.Join(tmpDir, anchorsFilename)
+
+	addrs, err := readAnchors(path)
+	if err != nil || len(addrs) != 0 {
+		t.Fatalf("readAnchors: got (%v, %v) for missing file", addrs, err)
+	}
+
+	want := []string{"1.2.3.4:8338", "[2001:db8::1]:8338"}
+	if err := writeAnchors(path, want); err != nil {
+		t.Fatalf("writeAnchors: unexpected error: %v", err)
+	}
+	addrs, err = readAnchors(path)
+	if err != nil {
+		t.Fatalf("readAnchors: unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(addrs, want) {
+		t.Fatalf("readAnchors: got %v, want %v", addrs, want)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("readAnchors: anchors file was not removed")
+	}
+}
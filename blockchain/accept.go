@@ -8,6 +8,7 @@ import (
 	"fmt"
 
 	"github.com/btgsuite/btgd/database"
+	"github.com/btgsuite/btgd/wire"
 	btcutil "github.com/btgsuite/btgutil"
 )
 
@@ -41,6 +42,7 @@ func (b *BlockChain) maybeAcceptBlock(block *btcutil.Block, flags BehaviorFlags)
 	// position of the block within the block chain.
 	err := b.checkBlockContext(block, prevNode, flags)
 	if err != nil {
+		b.maybeMarkHeaderInvalid(block.Hash(), err)
 		return false, err
 	}
 
@@ -60,14 +62,20 @@ func (b *BlockChain) maybeAcceptBlock(block *btcutil.Block, flags BehaviorFlags)
 		return false, err
 	}
 
-	// Create a new block node for the block and add it to the node index. Even
-	// if the block ultimately gets connected to the main chain, it starts out
-	// on a side chain.
+	// Create a new block node for the block and add it to the node index
+	// unless its header is already known. Even if the block ultimately gets
+	// connected to the main chain, it starts out on a side chain.
 	blockHeader := &block.MsgBlock().Header
-	newNode := newBlockNode(blockHeader, prevNode)
-	newNode.status = statusDataStored
-
-	b.index.AddNode(newNode)
+	newNode := b.index.LookupNode(block.Hash())
+	if newNode == nil {
+		newNode = newBlockNode(blockHeader, prevNode)
+		newNode.status = statusDataStored
+		b.index.AddNode(newNode)
+		b.maybeUpdateBestHeader(newNode)
+	} else {
+		b.index.UnsetStatusFlags(newNode, statusHeadersOnly)
+		b.index.SetStatusFlags(newNode, statusDataStored)
+	}
 	err = b.index.flushToDB()
 	if err != nil {
 		return false, err
@@ -90,3 +98,41 @@ func (b *BlockChain) maybeAcceptBlock(block *btcutil.Block, flags BehaviorFlags)
 
 	return isMainChain, nil
 }
+
+// maybeAcceptBlockHeader potentially accepts a block header into the block
+// index as a header whose block data has not been downloaded yet.  It performs
+// the validation checks which depend on the position of the header within the
+// block chain, such as the required difficulty, before adding it.
+//
+// The flags are passed to checkBlockHeaderContext.  See its documentation for
+// how the flags modify its behavior.
+//
+// This function MUST be called with the chain state lock held (for writes).
+func (b *BlockChain) maybeAcceptBlockHeader(header *wire.BlockHeader, flags BehaviorFlags) error {
+	prevHash := &header.PrevBlock
+	prevNode := b.index.LookupNode(prevHash)
+	if prevNode == nil {
+		str := fmt.Sprintf("previous block %s is unknown", prevHash)
+		return ruleError(ErrPreviousBlockUnknown, str)
+	} else if b.index.NodeStatus(prevNode).KnownInvalid() {
+		str := fmt.Sprintf("previous block %s is known to be invalid", prevHash)
+		return ruleError(ErrInvalidAncestorBlock, str)
+	}
+
+	// The header must pass all of the validation rules which depend on its
+	// position within the block chain.
+	err := b.checkBlockHeaderContext(header, prevNode, flags)
+	if err != nil {
+		return err
+	}
+
+	// Add a node for the header to the block index.  The index is written
+	// to the database along with the next block, since headers are cheap
+	// to download again.
+	node := newBlockNode(header, prevNode)
+	node.status = statusHeadersOnly
+	b.index.AddNode(node)
+	b.maybeUpdateBestHeader(node)
+
+	return nil
+}
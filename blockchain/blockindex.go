@@ -33,12 +33,28 @@ const (
 	// has failed validation, thus the block is also invalid.
 	statusInvalidAncestor
 
+	// statusHeadersOnly indicates that the block header has been validated
+	// and added to the block index, but the block data has not been
+	// downloaded yet.  It is unset once the block data is stored.
+	statusHeadersOnly
+
+	// statusParked indicates that the block is the first block of a side
+	// chain which was parked instead of becoming the main chain because
+	// reorganizing to it would disconnect more blocks than allowed.  The
+	// block and its descendants are not considered for the main chain or
+	// the best header until the side chain is activated manually.
+	statusParked
+
 	// statusNone indicates that the block has no validation state flags set.
 	//
 	// NOTE: This must be defined last in order to avoid influencing iota.
 	statusNone blockStatus = 0
 )
 
+// statusExcluded houses the status flags which exclude a block and all of its
+// descendants from the main chain candidates and the best header.
+const statusExcluded = statusValidateFailed | statusInvalidAncestor | statusParked
+
 // HaveData returns whether the full block data is stored in the database. This
 // will return false for a block node where only the header is downloaded or
 // kept.
@@ -239,6 +255,14 @@ type blockIndex struct {
 	sync.RWMutex
 	index map[chainhash.Hash]*blockNode
 	dirty map[*blockNode]struct{}
+
+	// tips is the set of nodes in the index which have no children.
+	tips map[*blockNode]struct{}
+
+	// exclusionChanges counts the changes of the status flags which
+	// exclude blocks from the main chain candidates and the best header,
+	// so state derived from them can be cached until they change again.
+	exclusionChanges uint64
 }
 
 // newBlockIndex returns a new empty instance of a block index.  The index will
@@ -250,6 +274,7 @@ func newBlockIndex(db database.DB, chainParams *chaincfg.Params) *blockIndex {
 		chainParams: chainParams,
 		index:       make(map[chainhash.Hash]*blockNode),
 		dirty:       make(map[*blockNode]struct{}),
+		tips:        make(map[*blockNode]struct{}),
 	}
 }
 
@@ -286,11 +311,17 @@ func (bi *blockIndex) AddNode(node *blockNode) {
 }
 
 // addNode adds the provided node to the block index, but does not mark it as
-// dirty. This can be used while initializing the block index.
+// dirty. This can be used while initializing the block index.  The node
+// replaces its parent in the set of chain tips, so parents must be added
+// before their children.
 //
 // This function is NOT safe for concurrent access.
 func (bi *blockIndex) addNode(node *blockNode) {
 	bi.index[node.hash] = node
+	if node.parent != nil {
+		delete(bi.tips, node.parent)
+	}
+	bi.tips[node] = struct{}{}
 }
 
 // NodeStatus provides concurrent-safe access to the status field of a node.
@@ -310,6 +341,9 @@ func (bi *blockIndex) NodeStatus(node *blockNode) blockStatus {
 // This function is safe for concurrent access.
 func (bi *blockIndex) SetStatusFlags(node *blockNode, flags blockStatus) {
 	bi.Lock()
+	if flags&statusExcluded&^node.status != 0 {
+		bi.exclusionChanges++
+	}
 	node.status |= flags
 	bi.dirty[node] = struct{}{}
 	bi.Unlock()
@@ -321,11 +355,25 @@ func (bi *blockIndex) SetStatusFlags(node *blockNode, flags blockStatus) {
 // This function is safe for concurrent access.
 func (bi *blockIndex) UnsetStatusFlags(node *blockNode, flags blockStatus) {
 	bi.Lock()
+	if flags&statusExcluded&node.status != 0 {
+		bi.exclusionChanges++
+	}
 	node.status &^= flags
 	bi.dirty[node] = struct{}{}
 	bi.Unlock()
 }
 
+// ExclusionChanges returns the number of times the status flags which exclude
+// blocks from the main chain candidates and the best header were changed.
+//
+// This function is safe for concurrent access.
+func (bi *blockIndex) ExclusionChanges() uint64 {
+	bi.RLock()
+	changes := bi.exclusionChanges
+	bi.RUnlock()
+	return changes
+}
+
 // flushToDB writes all dirty block nodes to the database. If all writes
 // succeed, this clears the dirty set.
 func (bi *blockIndex) flushToDB() error {
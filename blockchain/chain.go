@@ -8,6 +8,7 @@ package blockchain
 import (
 	"container/list"
 	"fmt"
+	"math/big"
 	"sync"
 	"time"
 
@@ -23,6 +24,12 @@ const (
 	// maxOrphanBlocks is the maximum number of orphan blocks that can be
 	// queued.
 	maxOrphanBlocks = 100
+
+	// headerWorkThresholdBlocks is the number of blocks at the difficulty
+	// of the main chain tip by which the work of a chain of block headers
+	// may fall short of the main chain before its headers are presynced
+	// instead of stored.
+	headerWorkThresholdBlocks = 144
 )
 
 // BlockLocator is used to help locate a specific block.  The algorithm for
@@ -101,6 +108,10 @@ type BlockChain struct {
 	sigCache            *txscript.SigCache
 	indexManager        IndexManager
 	hashCache           *txscript.HashCache
+	maxReorgDepth       int32
+	assumeValid         *chainhash.Hash
+	utxoCache           *utxoCache
+	pipeline            *validationPipeline
 
 	// The following fields are calculated based upon the provided chain
 	// parameters.  They are also set when the instance is created and
@@ -123,8 +134,24 @@ type BlockChain struct {
 	//
 	// bestChain tracks the current active chain by making use of an
 	// efficient chain view into the block index.
-	index     *blockIndex
-	bestChain *chainView
+	//
+	// bestHeader is the most-work header known to the block index which
+	// is not known to be invalid or part of a parked side chain.  It is
+	// the tip of the chain which is being downloaded while the block data
+	// lags behind the headers.  It is kept up to date as nodes are added
+	// and only found again in the entire block index once the exclusion
+	// changes of the index differ from bestHeaderChanges.
+	//
+	// excludedFlags caches the status flags which exclude the side chain
+	// nodes visited by excludedStatus from the main chain candidates and
+	// the best header.  It is only valid while the exclusion changes of
+	// the index match excludedChanges.
+	index             *blockIndex
+	bestChain         *chainView
+	bestHeader        *blockNode
+	bestHeaderChanges uint64
+	excludedFlags     map[*blockNode]blockStatus
+	excludedChanges   uint64
 
 	// These fields are related to handling of orphan blocks.  They are
 	// protected by a combination of the chain lock and the orphan lock.
@@ -138,6 +165,17 @@ type BlockChain struct {
 	nextCheckpoint *chaincfg.Checkpoint
 	checkpointNode *blockNode
 
+	// These fields are related to assumed valid handling.  The chain which
+	// ends at the assumed valid block is created once its header is known
+	// and whether the block is part of the best header chain is only
+	// determined again when the best header changes.  They are protected
+	// by the assumed valid lock since they are updated while the chain
+	// lock is held for reads.
+	assumeValidLock   sync.Mutex
+	assumeValidChain  *chainView
+	assumeValidHeader *blockNode
+	assumeValidActive bool
+
 	// The state is used as a fairly efficient way to cache information
 	// about the current best chain state that is returned to callers when
 	// requested.  It operates on the principle of MVCC such that any time a
@@ -622,14 +660,6 @@ func (b *BlockChain) connectBlock(node *blockNode, block *btcutil.Block,
 			return err
 		}
 
-		// Update the utxo set using the state of the utxo view.  This
-		// entails removing all of the utxos spent and adding the new
-		// ones created by the block.
-		err = dbPutUtxoView(dbTx, view)
-		if err != nil {
-			return err
-		}
-
 		// Update the transaction spend journal by adding a record for
 		// the block that contains all txos spent by it.
 		err = dbPutSpendJournalEntry(dbTx, block.Hash(), stxos)
@@ -653,8 +683,11 @@ func (b *BlockChain) connectBlock(node *blockNode, block *btcutil.Block,
 		return err
 	}
 
-	// Prune fully spent entries and mark all entries in the view unmodified
-	// now that the modifications have been committed to the database.
+	// Update the utxo cache using the state of the utxo view.  This entails
+	// removing all of the utxos spent and adding the new ones created by
+	// the block.  Then prune fully spent entries and mark all entries in
+	// the view unmodified now that the modifications have been committed.
+	b.utxoCache.commit(view)
 	view.commit()
 
 	// This node is now the end of the best chain.
@@ -669,6 +702,11 @@ func (b *BlockChain) connectBlock(node *blockNode, block *btcutil.Block,
 	b.stateSnapshot = state
 	b.stateLock.Unlock()
 
+	// Write the utxo cache to the database when it grew too large.
+	if err := b.maybeFlushUtxoCache(); err != nil {
+		return err
+	}
+
 	// Notify the caller that the block was connected to the main chain.
 	// The caller would typically want to react with actions such as
 	// updating wallets.
@@ -727,17 +765,23 @@ func (b *BlockChain) disconnectBlock(node *blockNode, block *btcutil.Block, view
 			return err
 		}
 
-		// Remove the block hash and height from the block index which
-		// tracks the main chain.
-		err = dbRemoveBlockIndex(dbTx, block.Hash(), node.height)
+		// The utxo cache is flushed before the main chain is
+		// reorganized, so the utxo set in the database is updated
+		// directly along with the block it is consistent with.  This
+		// ensures that block is always part of the main chain, even
+		// when the reorganization is interrupted by a crash.
+		err = dbPutUtxoView(dbTx, view)
+		if err != nil {
+			return err
+		}
+		err = dbPutUtxoStateConsistency(dbTx, &prevNode.hash)
 		if err != nil {
 			return err
 		}
 
-		// Update the utxo set using the state of the utxo view.  This
-		// entails restoring all of the utxos spent and removing the new
-		// ones created by the block.
-		err = dbPutUtxoView(dbTx, view)
+		// Remove the block hash and height from the block index which
+		// tracks the main chain.
+		err = dbRemoveBlockIndex(dbTx, block.Hash(), node.height)
 		if err != nil {
 			return err
 		}
@@ -772,13 +816,20 @@ func (b *BlockChain) disconnectBlock(node *blockNode, block *btcutil.Block, view
 		return err
 	}
 
-	// Prune fully spent entries and mark all entries in the view unmodified
-	// now that the modifications have been committed to the database.
+	// Drop the entries written to the database from the utxo cache.  Then
+	// prune fully spent entries and mark all entries in the view unmodified
+	// now that the modifications have been committed.
+	b.utxoCache.evict(view)
 	view.commit()
 
 	// This node's parent is now the end of the best chain.
 	b.bestChain.SetTip(node.parent)
 
+	// The excluding flags cached for side chain nodes stop at the main
+	// chain, so they no longer cover the ancestors of the side chains
+	// which fork from the disconnected block.
+	b.excludedFlags = nil
+
 	// Update the state for the best block.  Notice how this replaces the
 	// entire struct instead of updating the existing one.  This effectively
 	// allows the old version to act as a snapshot which callers can use
@@ -788,6 +839,11 @@ func (b *BlockChain) disconnectBlock(node *blockNode, block *btcutil.Block, view
 	b.stateSnapshot = state
 	b.stateLock.Unlock()
 
+	// Write the utxo cache to the database when it grew too large.
+	if err := b.maybeFlushUtxoCache(); err != nil {
+		return err
+	}
+
 	// Notify the caller that the block was disconnected from the main
 	// chain.  The caller would typically want to react with actions such as
 	// updating wallets.
@@ -848,6 +904,16 @@ func (b *BlockChain) reorganizeChain(detachNodes, attachNodes *list.List) error
 		}
 	}
 
+	// Flush the utxo cache before disconnecting any blocks, which write
+	// their changes to the utxo set in the database directly, so the block
+	// the utxo set in the database is consistent with always remains part
+	// of the main chain and can be recovered from after a crash.
+	if detachNodes.Len() != 0 {
+		if err := b.utxoCache.flush(&tip.hash); err != nil {
+			return err
+		}
+	}
+
 	// Track the old and new best chains heads.
 	oldBest := tip
 	newBest := tip
@@ -886,7 +952,7 @@ func (b *BlockChain) reorganizeChain(detachNodes, attachNodes *list.List) error
 
 		// Load all of the utxos referenced by the block that aren't
 		// already in the view.
-		err = view.fetchInputUtxos(b.db, block)
+		err = view.fetchInputUtxos(b.utxoCache, block)
 		if err != nil {
 			return err
 		}
@@ -953,7 +1019,7 @@ func (b *BlockChain) reorganizeChain(detachNodes, attachNodes *list.List) error
 		// checkConnectBlock gets skipped, we still need to update the UTXO
 		// view.
 		if b.index.NodeStatus(n).KnownValid() {
-			err = view.fetchInputUtxos(b.db, block)
+			err = view.fetchInputUtxos(b.utxoCache, block)
 			if err != nil {
 				return err
 			}
@@ -1005,7 +1071,7 @@ func (b *BlockChain) reorganizeChain(detachNodes, attachNodes *list.List) error
 
 		// Load all of the utxos referenced by the block that aren't
 		// already in the view.
-		err := view.fetchInputUtxos(b.db, block)
+		err := view.fetchInputUtxos(b.utxoCache, block)
 		if err != nil {
 			return err
 		}
@@ -1032,7 +1098,7 @@ func (b *BlockChain) reorganizeChain(detachNodes, attachNodes *list.List) error
 
 		// Load all of the utxos referenced by the block that aren't
 		// already in the view.
-		err := view.fetchInputUtxos(b.db, block)
+		err := view.fetchInputUtxos(b.utxoCache, block)
 		if err != nil {
 			return err
 		}
@@ -1131,7 +1197,7 @@ func (b *BlockChain) connectBestChain(node *blockNode, block *btcutil.Block, fla
 		// utxos, spend them, and add the new utxos being created by
 		// this block.
 		if fastAdd {
-			err := view.fetchInputUtxos(b.db, block)
+			err := view.fetchInputUtxos(b.utxoCache, block)
 			if err != nil {
 				return false, err
 			}
@@ -1191,6 +1257,42 @@ func (b *BlockChain) connectBestChain(node *blockNode, block *btcutil.Block, fla
 		return false, nil
 	}
 
+	// Blocks which extend a parked side chain keep it parked.  The caller
+	// was already notified when it was parked.
+	if b.excludedStatus(node)&statusParked != 0 {
+		log.Debugf("Block %v extends a parked side chain", node.hash)
+		return false, nil
+	}
+
+	// Park the side chain instead of reorganizing to it when that would
+	// disconnect more blocks than allowed.  Manually invalidating the main
+	// chain or marking the side chain precious still activates it.
+	if reorg := b.deepReorg(node); reorg != nil {
+		log.Warnf("DEEP REORG: Block %v extends a side chain with more "+
+			"work which forks the chain at height %d/block %v, but "+
+			"reorganizing would disconnect %d blocks (max %d)",
+			node.hash, reorg.ForkHeight, reorg.ForkHash, reorg.Depth,
+			b.maxReorgDepth)
+
+		// Exclude the side chain from the main chain candidates and the
+		// best header until it is activated manually.
+		b.parkSideChain(node)
+		b.updateBestHeader()
+		if writeErr := b.index.flushToDB(); writeErr != nil {
+			log.Warnf("Error flushing block index changes to disk: %v",
+				writeErr)
+		}
+
+		// Notify the caller that the reorganization was not performed.
+		// The caller would typically want to react by halting anything
+		// which relies on the finality of recent blocks.
+		b.chainLock.Unlock()
+		b.sendNotification(NTDeepReorg, reorg)
+		b.chainLock.Lock()
+
+		return false, nil
+	}
+
 	// We're extending (or creating) a side chain and the cumulative work
 	// for this new side chain is more than the old best chain, so this side
 	// chain needs to become the main chain.  In order to accomplish that,
@@ -1215,6 +1317,65 @@ func (b *BlockChain) connectBestChain(node *blockNode, block *btcutil.Block, fla
 	return err == nil, err
 }
 
+// deepReorg returns a description of the reorganization to the side chain which
+// ends at the passed node when it would disconnect more main chain blocks than
+// the configured maximum reorganization depth.  It returns nil when there is
+// no limit or the reorganization is within it.
+//
+// This function MUST be called with the chain state lock held (for reads).
+func (b *BlockChain) deepReorg(node *blockNode) *DeepReorg {
+	if b.maxReorgDepth <= 0 {
+		return nil
+	}
+	fork := b.bestChain.FindFork(node)
+	depth := b.bestChain.Tip().height - fork.height
+	if depth <= b.maxReorgDepth {
+		return nil
+	}
+	return &DeepReorg{
+		ForkHash:   fork.hash,
+		ForkHeight: fork.height,
+		TipHash:    node.hash,
+		TipHeight:  node.height,
+		Depth:      depth,
+	}
+}
+
+// sideChainRoot returns the first block of the side chain the passed node is
+// part of, which is the child of the block where it forks from the main chain.
+// It returns nil when the node is part of the main chain.
+//
+// This function MUST be called with the chain state lock held (for reads).
+func (b *BlockChain) sideChainRoot(node *blockNode) *blockNode {
+	var root *blockNode
+	for n := node; n != nil && !b.bestChain.Contains(n); n = n.parent {
+		root = n
+	}
+	return root
+}
+
+// parkSideChain marks the side chain the passed node is part of as parked, so
+// neither it nor any of the blocks and headers which extend it are considered
+// for the main chain or the best header.
+//
+// This function MUST be called with the chain state lock held (for writes).
+func (b *BlockChain) parkSideChain(node *blockNode) {
+	if root := b.sideChainRoot(node); root != nil {
+		b.index.SetStatusFlags(root, statusParked)
+	}
+}
+
+// unparkSideChain removes the parked status from the side chain the passed
+// node is part of.
+//
+// This function MUST be called with the chain state lock held (for writes).
+func (b *BlockChain) unparkSideChain(node *blockNode) {
+	root := b.sideChainRoot(node)
+	if root != nil && b.index.NodeStatus(root)&statusParked != 0 {
+		b.index.UnsetStatusFlags(root, statusParked)
+	}
+}
+
 // isCurrent returns whether or not the chain believes it is current.  Several
 // factors are used to guess, but the key factors that allow the chain to
 // believe it is current are:
@@ -1278,6 +1439,210 @@ func (b *BlockChain) HeaderByHash(hash *chainhash.Hash) (wire.BlockHeader, error
 	return node.Header(), nil
 }
 
+// maybeUpdateBestHeader makes the passed node the best header when it has more
+// cumulative work than the current best header and neither it nor any of its
+// ancestors are known to be invalid or part of a parked side chain.
+//
+// This function MUST be called with the chain state lock held (for writes).
+func (b *BlockChain) maybeUpdateBestHeader(node *blockNode) {
+	b.updateBestHeader()
+	if node.workSum.Cmp(b.bestHeader.workSum) <= 0 {
+		return
+	}
+
+	// Nodes which extend the best header are never excluded, which avoids
+	// walking back to the main chain for every header during the initial
+	// sync.
+	if node.parent != b.bestHeader && b.excludedStatus(node) != 0 {
+		return
+	}
+	b.bestHeader = node
+}
+
+// excludedStatus returns the status flags which exclude the passed node from
+// the main chain candidates and the best header, which are those of the node
+// and all of its ancestors which are not part of the main chain.  The flags of
+// the visited nodes are cached until the excluding flags of any node in the
+// block index change, so extending a side chain does not walk it back to the
+// main chain again.
+//
+// This function MUST be called with the chain state lock held (for writes).
+func (b *BlockChain) excludedStatus(node *blockNode) blockStatus {
+	changes := b.index.ExclusionChanges()
+	if b.excludedFlags == nil || changes != b.excludedChanges {
+		b.excludedFlags = make(map[*blockNode]blockStatus)
+		b.excludedChanges = changes
+	}
+
+	var path []*blockNode
+	var status blockStatus
+	for n := node; n != nil && !b.bestChain.Contains(n); n = n.parent {
+		if flags, ok := b.excludedFlags[n]; ok {
+			status = flags
+			break
+		}
+		path = append(path, n)
+	}
+	for i := len(path) - 1; i >= 0; i-- {
+		status |= b.index.NodeStatus(path[i]) & statusExcluded
+		b.excludedFlags[path[i]] = status
+	}
+	return status
+}
+
+// findBestHeader returns the most-work node in the block index which is not
+// known to be invalid or part of a parked side chain.  The tip of the main
+// chain is returned when no other node has more work.
+//
+// This function MUST be called with the chain state lock held (for reads).
+func (b *BlockChain) findBestHeader() *blockNode {
+	best := b.bestChain.Tip()
+	var candidates []*blockNode
+	b.index.RLock()
+	for _, node := range b.index.index {
+		if node.workSum.Cmp(best.workSum) > 0 {
+			candidates = append(candidates, node)
+		}
+	}
+	b.index.RUnlock()
+
+	for _, node := range candidates {
+		if node.workSum.Cmp(best.workSum) <= 0 {
+			continue
+		}
+		if b.excludedStatus(node) == 0 {
+			best = node
+		}
+	}
+	return best
+}
+
+// updateBestHeader finds the best header in the entire block index again when
+// blocks were excluded from it or included in it again since it was last found,
+// such as when they were invalidated, reconsidered, parked or unparked.
+// Otherwise the best header is kept up to date as nodes are added, and only the
+// tip of the main chain is preferred over it when they have the same amount of
+// work.
+//
+// This function MUST be called with the chain state lock held (for writes).
+func (b *BlockChain) updateBestHeader() {
+	changes := b.index.ExclusionChanges()
+	if b.bestHeader == nil || changes != b.bestHeaderChanges {
+		b.bestHeader = b.findBestHeader()
+		b.bestHeaderChanges = changes
+		return
+	}
+	if tip := b.bestChain.Tip(); tip.workSum.Cmp(b.bestHeader.workSum) >= 0 {
+		b.bestHeader = tip
+	}
+}
+
+// BestHeader returns the hash and height of the most-work header known to the
+// block index which is not known to be invalid or part of a parked side chain.
+// This is the tip of the main chain unless headers of blocks which are yet to
+// be downloaded and connected are known.
+//
+// This function is safe for concurrent access.
+func (b *BlockChain) BestHeader() (chainhash.Hash, int32) {
+	b.chainLock.RLock()
+	defer b.chainLock.RUnlock()
+
+	return b.bestHeader.hash, b.bestHeader.height
+}
+
+// FindForkHeight returns the height of the latest ancestor of the block with
+// the given hash which is part of the main chain.  This is the height of the
+// block itself when it is part of the main chain.
+//
+// This function is safe for concurrent access.
+func (b *BlockChain) FindForkHeight(hash *chainhash.Hash) (int32, error) {
+	b.chainLock.RLock()
+	defer b.chainLock.RUnlock()
+
+	node := b.index.LookupNode(hash)
+	if node == nil {
+		return 0, fmt.Errorf("block %s is not known", hash)
+	}
+	fork := b.bestChain.FindFork(node)
+	if fork == nil {
+		return 0, fmt.Errorf("block %s does not fork from the main "+
+			"chain", hash)
+	}
+	return fork.height, nil
+}
+
+// HeaderChainWork returns the height of the block or header with the given
+// hash and the total amount of work of the chain up to and including it.
+//
+// This function is safe for concurrent access.
+func (b *BlockChain) HeaderChainWork(hash *chainhash.Hash) (int32, *big.Int, error) {
+	b.chainLock.RLock()
+	defer b.chainLock.RUnlock()
+
+	node := b.index.LookupNode(hash)
+	if node == nil {
+		return 0, nil, fmt.Errorf("block %s is not known", hash)
+	}
+	return node.height, new(big.Int).Set(node.workSum), nil
+}
+
+// HeaderWorkThreshold returns the amount of work a chain of block headers must
+// have before its headers are stored in the block index.  It is the greater of
+// the minimum chain work of the network and the work of the best header chain
+// less the work of a day of blocks at its difficulty, so chains which fork
+// recently are stored right away.  The sync manager presyncs the headers of
+// chains with less work to protect against low-work header spam.
+//
+// This function is safe for concurrent access.
+func (b *BlockChain) HeaderWorkThreshold() *big.Int {
+	b.chainLock.RLock()
+	defer b.chainLock.RUnlock()
+
+	best := b.bestHeader
+	threshold := new(big.Int).Mul(CalcWork(best.bits),
+		big.NewInt(headerWorkThresholdBlocks))
+	threshold.Sub(best.workSum, threshold)
+	if threshold.Sign() < 0 {
+		threshold.SetInt64(0)
+	}
+	minWork := b.chainParams.MinimumChainWork
+	if minWork != nil && minWork.Cmp(threshold) > 0 {
+		threshold.Set(minWork)
+	}
+	return threshold
+}
+
+// HeaderChainHashes returns the hashes of up to maxHashes ancestors of the
+// block with the given hash, including the block itself, starting at the given
+// height and ordered by height.  The block and its ancestors may be headers
+// whose block data has not been downloaded yet.
+//
+// This function is safe for concurrent access.
+func (b *BlockChain) HeaderChainHashes(hash *chainhash.Hash, startHeight int32,
+	maxHashes int) ([]chainhash.Hash, error) {
+
+	b.chainLock.RLock()
+	defer b.chainLock.RUnlock()
+
+	node := b.index.LookupNode(hash)
+	if node == nil {
+		return nil, fmt.Errorf("block %s is not known", hash)
+	}
+	if startHeight < 0 || startHeight > node.height || maxHashes <= 0 {
+		return nil, nil
+	}
+
+	endHeight := node.height
+	if int64(endHeight)-int64(startHeight) >= int64(maxHashes) {
+		endHeight = startHeight + int32(maxHashes) - 1
+	}
+	hashes := make([]chainhash.Hash, endHeight-startHeight+1)
+	for n := node.Ancestor(endHeight); n != nil && n.height >= startHeight; n = n.parent {
+		hashes[n.height-startHeight] = n.hash
+	}
+	return hashes, nil
+}
+
 // MainChainHasBlock returns whether or not the block with the given hash is in
 // the main chain.
 //
@@ -1711,6 +2076,33 @@ type Config struct {
 	// This field can be nil if the caller is not interested in using a
 	// signature cache.
 	HashCache *txscript.HashCache
+
+	// MaxReorgDepth is the maximum number of main chain blocks which are
+	// disconnected in order to reorganize to a side chain with more work.
+	// Side chains which fork deeper are stored, but not activated, and an
+	// NTDeepReorg notification is sent instead.
+	//
+	// This field can be zero if the caller does not wish to limit the
+	// depth of reorganizations.
+	MaxReorgDepth int32
+
+	// AssumeValid is the hash of a block whose ancestors, and the block
+	// itself, are assumed to have valid scripts when it is part of the
+	// best known header chain, buried under at least two weeks worth of
+	// work, and the best header chain has the minimum chain work.  All
+	// other rules are still enforced for these blocks and, unlike
+	// checkpoints, the block does not affect which chain is selected.
+	//
+	// This field can be nil if the caller does not wish to skip script
+	// validation.
+	AssumeValid *chainhash.Hash
+
+	// UtxoCacheMaxSize is the maximum number of bytes the cache of the
+	// unspent transaction outputs of the main chain uses before it is
+	// written to the database.
+	//
+	// This field can be zero to write the outputs after every block.
+	UtxoCacheMaxSize uint64
 }
 
 // New returns a BlockChain instance using the provided configuration details.
@@ -1761,6 +2153,10 @@ func New(config *Config) (*BlockChain, error) {
 		blocksPerRetarget:   int32(targetTimespan / targetTimePerBlock),
 		index:               newBlockIndex(config.DB, params),
 		hashCache:           config.HashCache,
+		maxReorgDepth:       config.MaxReorgDepth,
+		assumeValid:         config.AssumeValid,
+		utxoCache:           newUtxoCache(config.DB, config.UtxoCacheMaxSize),
+		pipeline:            newValidationPipeline(),
 		bestChain:           newChainView(nil),
 		orphans:             make(map[chainhash.Hash]*orphanBlock),
 		prevOrphans:         make(map[chainhash.Hash][]*orphanBlock),
@@ -1775,11 +2171,23 @@ func New(config *Config) (*BlockChain, error) {
 		return nil, err
 	}
 
+	b.updateBestHeader()
+	if b.assumeValid != nil {
+		log.Infof("Assuming the scripts of block %v and its ancestors "+
+			"are valid", b.assumeValid)
+	}
+
 	// Perform any upgrades to the various chain-specific buckets as needed.
 	if err := b.maybeUpgradeDbBuckets(config.Interrupt); err != nil {
 		return nil, err
 	}
 
+	// Recover the utxo set when the utxo cache was not flushed before the
+	// last shutdown.
+	if err := b.initUtxoCache(config.Interrupt); err != nil {
+		return nil, err
+	}
+
 	// Initialize and catch up all of the currently active optional indexes
 	// as needed.
 	if config.IndexManager != nil {
@@ -111,6 +111,565 @@ func TestHaveBlock(t *testing.T) {
 	}
 }
 
+// TestProcessBlockHeader ensures headers are added to the block index before
+// their blocks, the best header tracks the most-work header chain and the
+// blocks are connected once they are processed.
+func TestProcessBlockHeader(t *testing.T) {
+	// (genesis block) -> 1 -> 2 -> 3 -> 4
+	blocks, err := loadBlocks("blk_0_to_4.dat.bz2")
+	if err != nil {
+		t.Fatalf("Error loading file: %v\n", err)
+	}
+
+	chain, teardownFunc, err := chainSetup("processblockheader",
+		&chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatalf("Failed to setup chain instance: %v", err)
+	}
+	defer teardownFunc()
+	chain.TstSetCoinbaseMaturity(1)
+
+	for i := 1; i < len(blocks); i++ {
+		header := &blocks[i].MsgBlock().Header
+		if err := chain.ProcessBlockHeader(header, BFNone); err != nil {
+			t.Fatalf("ProcessBlockHeader fail on block %v: %v", i, err)
+		}
+
+		// Processing a header again is not an error.
+		if err := chain.ProcessBlockHeader(header, BFNone); err != nil {
+			t.Fatalf("ProcessBlockHeader fail on known block %v: %v",
+				i, err)
+		}
+	}
+
+	// Headers which do not connect are rejected.
+	err = chain.ProcessBlockHeader(&Block100000.Header, BFNone)
+	if rerr, ok := err.(RuleError); !ok ||
+		rerr.ErrorCode != ErrPreviousBlockUnknown {
+
+		t.Fatalf("ProcessBlockHeader: got %v, want %v", err,
+			ErrPreviousBlockUnknown)
+	}
+
+	// The blocks of the headers are not known yet, but the best header is
+	// the final one.
+	tipHash := blocks[len(blocks)-1].Hash()
+	haveBlock, err := chain.HaveBlock(tipHash)
+	if err != nil || haveBlock {
+		t.Fatalf("HaveBlock: got %v (err %v), want false", haveBlock, err)
+	}
+	bestHash, bestHeight := chain.BestHeader()
+	if bestHash != *tipHash || bestHeight != 4 {
+		t.Fatalf("BestHeader: got %v (height %d), want %v (height 4)",
+			bestHash, bestHeight, tipHash)
+	}
+	forkHeight, err := chain.FindForkHeight(tipHash)
+	if err != nil || forkHeight != 0 {
+		t.Fatalf("FindForkHeight: got %d (err %v), want 0", forkHeight,
+			err)
+	}
+	hashes, err := chain.HeaderChainHashes(tipHash, 2, 10)
+	if err != nil {
+		t.Fatalf("HeaderChainHashes: unexpected error: %v", err)
+	}
+	wantHashes := []chainhash.Hash{*blocks[2].Hash(), *blocks[3].Hash(),
+		*blocks[4].Hash()}
+	if !reflect.DeepEqual(hashes, wantHashes) {
+		t.Fatalf("HeaderChainHashes: got %v, want %v", hashes, wantHashes)
+	}
+
+	// Blocks which build on a header without block data are orphans.
+	_, isOrphan, err := chain.ProcessBlock(blocks[2], BFNone)
+	if err != nil || !isOrphan {
+		t.Fatalf("ProcessBlock: got orphan %v (err %v), want orphan",
+			isOrphan, err)
+	}
+
+	// Connect the blocks.
+	for i := 1; i < len(blocks); i++ {
+		if i == 2 {
+			continue
+		}
+		_, isOrphan, err := chain.ProcessBlock(blocks[i], BFNone)
+		if err != nil || isOrphan {
+			t.Fatalf("ProcessBlock fail on block %v: orphan %v, "+
+				"err %v", i, isOrphan, err)
+		}
+	}
+	best := chain.BestSnapshot()
+	if best.Hash != *tipHash {
+		t.Fatalf("BestSnapshot: got %v, want %v", best.Hash, tipHash)
+	}
+	bestHash, _ = chain.BestHeader()
+	if bestHash != *tipHash {
+		t.Fatalf("BestHeader: got %v, want %v", bestHash, tipHash)
+	}
+}
+
+// TestInvalidateBlock ensures manually invalidated blocks are disconnected in
+// favor of the best valid chain, that reconsidering them reverses it and that
+// precious blocks are preferred over blocks with the same amount of work.
+func TestInvalidateBlock(t *testing.T) {
+	// (genesis block) -> 1 -> 2 -> 3 -> 4
+	//                          \-> 3a
+	var blocks []*btcutil.Block
+	for _, file := range []string{"blk_0_to_4.dat.bz2", "blk_3A.dat.bz2"} {
+		blockTmp, err := loadBlocks(file)
+		if err != nil {
+			t.Fatalf("Error loading file: %v\n", err)
+		}
+		blocks = append(blocks, blockTmp...)
+	}
+
+	chain, teardownFunc, err := chainSetup("invalidateblock",
+		&chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatalf("Failed to setup chain instance: %v", err)
+	}
+	defer teardownFunc()
+	chain.TstSetCoinbaseMaturity(1)
+
+	for i := 1; i < len(blocks); i++ {
+		_, isOrphan, err := chain.ProcessBlock(blocks[i], BFNone)
+		if err != nil || isOrphan {
+			t.Fatalf("ProcessBlock fail on block %v: orphan %v, "+
+				"err %v", i, isOrphan, err)
+		}
+	}
+	block3, block4, block3a := blocks[3].Hash(), blocks[4].Hash(),
+		blocks[5].Hash()
+
+	assertTip := func(step string, want *chainhash.Hash, height int32) {
+		t.Helper()
+		best := chain.BestSnapshot()
+		if best.Hash != *want || best.Height != height {
+			t.Fatalf("%s: got tip %v (height %d), want %v (height %d)",
+				step, best.Hash, best.Height, want, height)
+		}
+	}
+	assertTip("initial", block4, 4)
+
+	// Invalidating block 3 reorganizes to the side chain.
+	if err := chain.InvalidateBlock(block3); err != nil {
+		t.Fatalf("InvalidateBlock: unexpected error: %v", err)
+	}
+	assertTip("invalidate 3", block3a, 3)
+	node := chain.index.LookupNode(block4)
+	if !chain.index.NodeStatus(node).KnownInvalid() {
+		t.Fatal("InvalidateBlock: descendant of block 3 is not invalid")
+	}
+
+	// Blocks building on an invalidated block are rejected.
+	_, _, err = chain.ProcessBlock(blocks[4], BFNone)
+	if err == nil {
+		t.Fatal("ProcessBlock: expected error for invalidated chain")
+	}
+
+	// Reconsidering block 3 moves back to the chain with the most work.
+	if err := chain.ReconsiderBlock(block3); err != nil {
+		t.Fatalf("ReconsiderBlock: unexpected error: %v", err)
+	}
+	assertTip("reconsider 3", block4, 4)
+
+	// Invalidating the tip leaves two chains with the same work and the
+	// first seen one remains the main chain.
+	if err := chain.InvalidateBlock(block4); err != nil {
+		t.Fatalf("InvalidateBlock: unexpected error: %v", err)
+	}
+	assertTip("invalidate 4", block3, 3)
+
+	// Precious blocks are preferred over blocks with the same work.
+	if err := chain.PreciousBlock(block3a); err != nil {
+		t.Fatalf("PreciousBlock: unexpected error: %v", err)
+	}
+	assertTip("precious 3a", block3a, 3)
+	if err := chain.PreciousBlock(block3); err != nil {
+		t.Fatalf("PreciousBlock: unexpected error: %v", err)
+	}
+	assertTip("precious 3", block3, 3)
+
+	// Blocks with less work than the tip are not made precious.
+	if err := chain.PreciousBlock(blocks[2].Hash()); err != nil {
+		t.Fatalf("PreciousBlock: unexpected error: %v", err)
+	}
+	assertTip("precious 2", block3, 3)
+
+	// Unknown blocks and the genesis block can't be invalidated.
+	if err := chain.InvalidateBlock(&chainhash.Hash{}); err == nil {
+		t.Fatal("InvalidateBlock: expected error for unknown block")
+	}
+	if err := chain.InvalidateBlock(blocks[0].Hash()); err == nil {
+		t.Fatal("InvalidateBlock: expected error for genesis block")
+	}
+}
+
+// TestChainTips ensures the tips of the main chain, side chains and header
+// chains are tracked along with the status of their branches.
+func TestChainTips(t *testing.T) {
+	// (genesis block) -> 1 -> 2 -> 3 -> 4
+	//                          \-> 3a
+	var blocks []*btcutil.Block
+	for _, file := range []string{"blk_0_to_4.dat.bz2", "blk_3A.dat.bz2"} {
+		blockTmp, err := loadBlocks(file)
+		if err != nil {
+			t.Fatalf("Error loading file: %v\n", err)
+		}
+		blocks = append(blocks, blockTmp...)
+	}
+
+	chain, teardownFunc, err := chainSetup("chaintips",
+		&chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatalf("Failed to setup chain instance: %v", err)
+	}
+	defer teardownFunc()
+	chain.TstSetCoinbaseMaturity(1)
+
+	processBlock := func(i int) {
+		t.Helper()
+		_, isOrphan, err := chain.ProcessBlock(blocks[i], BFNone)
+		if err != nil || isOrphan {
+			t.Fatalf("ProcessBlock fail on block %v: orphan %v, "+
+				"err %v", i, isOrphan, err)
+		}
+	}
+	assertTips := func(step string, want []ChainTip) {
+		t.Helper()
+		got := chain.ChainTips()
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: got tips %+v, want %+v", step, got, want)
+		}
+	}
+	heights := []int32{0, 1, 2, 3, 4, 3}
+	tip := func(i int, branchLen int32, status ChainTipStatus) ChainTip {
+		return ChainTip{
+			Height:    heights[i],
+			Hash:      *blocks[i].Hash(),
+			BranchLen: branchLen,
+			Status:    status,
+		}
+	}
+
+	assertTips("genesis", []ChainTip{tip(0, 0, ChainTipActive)})
+
+	// Side chain blocks are stored without being fully validated, and the
+	// tip of the main chain remains a tip while only the header of its
+	// child is known.
+	for i := 1; i <= 3; i++ {
+		processBlock(i)
+	}
+	processBlock(5)
+	err = chain.ProcessBlockHeader(&blocks[4].MsgBlock().Header, BFNone)
+	if err != nil {
+		t.Fatalf("ProcessBlockHeader: unexpected error: %v", err)
+	}
+	assertTips("header 4", []ChainTip{
+		tip(4, 1, ChainTipHeadersOnly),
+		tip(3, 0, ChainTipActive),
+		tip(5, 1, ChainTipValidHeaders),
+	})
+
+	processBlock(4)
+	assertTips("block 4", []ChainTip{
+		tip(4, 0, ChainTipActive),
+		tip(5, 1, ChainTipValidHeaders),
+	})
+
+	// Invalidating block 3 validates the side chain while reorganizing to
+	// it, which leaves a valid fork once block 3 is reconsidered.
+	if err := chain.InvalidateBlock(blocks[3].Hash()); err != nil {
+		t.Fatalf("InvalidateBlock: unexpected error: %v", err)
+	}
+	assertTips("invalidate 3", []ChainTip{
+		tip(4, 2, ChainTipInvalid),
+		tip(5, 0, ChainTipActive),
+	})
+	if err := chain.ReconsiderBlock(blocks[3].Hash()); err != nil {
+		t.Fatalf("ReconsiderBlock: unexpected error: %v", err)
+	}
+	assertTips("reconsider 3", []ChainTip{
+		tip(4, 0, ChainTipActive),
+		tip(5, 1, ChainTipValidFork),
+	})
+}
+
+// TestDeepReorg ensures reorganizations which would disconnect more main chain
+// blocks than the maximum reorganization depth are detected.
+func TestDeepReorg(t *testing.T) {
+	// Construct a synthetic block chain with a block index consisting of
+	// the following structure.
+	// 	genesis -> 1  -> 2  -> 3  -> 4  -> 5
+	// 	                  \-> 3a -> 4a -> 5a -> 6a
+	chain := newFakeChain(&chaincfg.MainNetParams)
+	branch0Nodes := chainedNodes(chain.bestChain.Genesis(), 5)
+	branch1Nodes := chainedNodes(branch0Nodes[1], 4)
+	chain.bestChain.SetTip(tstTip(branch0Nodes))
+
+	tests := []struct {
+		name          string
+		maxReorgDepth int32
+		node          *blockNode
+		depth         int32 // zero when the reorg is allowed
+	}{
+		{
+			name: "no limit",
+			node: tstTip(branch1Nodes),
+		},
+		{
+			name:          "within limit",
+			maxReorgDepth: 3,
+			node:          tstTip(branch1Nodes),
+		},
+		{
+			name:          "beyond limit",
+			maxReorgDepth: 2,
+			node:          tstTip(branch1Nodes),
+			depth:         3,
+		},
+		{
+			name:          "beyond limit from earlier side chain block",
+			maxReorgDepth: 2,
+			node:          branch1Nodes[0],
+			depth:         3,
+		},
+	}
+	for _, test := range tests {
+		chain.maxReorgDepth = test.maxReorgDepth
+		reorg := chain.deepReorg(test.node)
+		if test.depth == 0 {
+			if reorg != nil {
+				t.Errorf("%s: unexpected deep reorg %+v", test.name,
+					reorg)
+			}
+			continue
+		}
+		want := &DeepReorg{
+			ForkHash:   branch0Nodes[1].hash,
+			ForkHeight: 2,
+			TipHash:    test.node.hash,
+			TipHeight:  test.node.height,
+			Depth:      test.depth,
+		}
+		if !reflect.DeepEqual(reorg, want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, reorg, want)
+		}
+	}
+}
+
+// TestParkedSideChain ensures side chains which are parked because they fork
+// too deep are neither used as the best header nor activated implicitly, and
+// that they are activated by invalidating the main chain or marking them
+// precious.
+func TestParkedSideChain(t *testing.T) {
+	// (genesis block) -> 1 -> 2 -> 3  -> 4
+	//                          \-> 3a -> 4a -> 5a
+	var blocks []*btcutil.Block
+	for _, file := range []string{"blk_0_to_4.dat.bz2", "blk_3A.dat.bz2",
+		"blk_4A.dat.bz2", "blk_5A.dat.bz2"} {
+
+		blockTmp, err := loadBlocks(file)
+		if err != nil {
+			t.Fatalf("Error loading file: %v\n", err)
+		}
+		blocks = append(blocks, blockTmp...)
+	}
+	block1, block4, block5a := blocks[1].Hash(), blocks[4].Hash(),
+		blocks[7].Hash()
+
+	// setup returns a chain with the main chain ending at block 4 and the
+	// side chain ending at block 5a parked.
+	setup := func(t *testing.T, dbName string) (*BlockChain, func()) {
+		chain, teardownFunc, err := chainSetup(dbName,
+			&chaincfg.MainNetParams)
+		if err != nil {
+			t.Fatalf("Failed to setup chain instance: %v", err)
+		}
+		chain.TstSetCoinbaseMaturity(1)
+		chain.maxReorgDepth = 1
+
+		for i := 1; i < len(blocks); i++ {
+			_, isOrphan, err := chain.ProcessBlock(blocks[i], BFNone)
+			if err != nil || isOrphan {
+				teardownFunc()
+				t.Fatalf("ProcessBlock fail on block %v: orphan "+
+					"%v, err %v", i, isOrphan, err)
+			}
+		}
+		return chain, teardownFunc
+	}
+
+	assertBest := func(t *testing.T, step string, chain *BlockChain,
+		want *chainhash.Hash) {
+
+		t.Helper()
+		if best := chain.BestSnapshot(); best.Hash != *want {
+			t.Fatalf("%s: got tip %v, want %v", step, best.Hash, want)
+		}
+		if hash, _ := chain.BestHeader(); hash != *want {
+			t.Fatalf("%s: got best header %v, want %v", step, hash,
+				want)
+		}
+	}
+
+	// Each case uses its own database, which must be torn down before the
+	// next one is created since they share the same test directory.
+	t.Run("invalidate", func(t *testing.T) {
+		chain, teardownFunc := setup(t, "parkedsidechain")
+		defer teardownFunc()
+
+		// The side chain has more work, but it is neither connected
+		// nor the best header, so the sync manager does not try to
+		// download it.
+		assertBest(t, "parked", chain, block4)
+
+		// Reconsidering an unrelated block does not activate it.
+		if err := chain.ReconsiderBlock(block1); err != nil {
+			t.Fatalf("ReconsiderBlock: unexpected error: %v", err)
+		}
+		assertBest(t, "reconsider 1", chain, block4)
+
+		// The side chain remains parked after restarting.
+		restarted, err := New(&Config{
+			DB:          chain.db,
+			ChainParams: chain.chainParams,
+			TimeSource:  NewMedianTime(),
+		})
+		if err != nil {
+			t.Fatalf("New: unexpected error: %v", err)
+		}
+		assertBest(t, "restart", restarted, block4)
+
+		// Invalidating the main chain after the fork activates it.
+		if err := chain.InvalidateBlock(block4); err != nil {
+			t.Fatalf("InvalidateBlock: unexpected error: %v", err)
+		}
+		assertBest(t, "invalidate 4", chain, block5a)
+	})
+
+	// Marking the tip of the parked side chain precious activates it.
+	t.Run("precious", func(t *testing.T) {
+		chain, teardownFunc := setup(t, "parkedsidechainprecious")
+		defer teardownFunc()
+
+		if err := chain.PreciousBlock(block5a); err != nil {
+			t.Fatalf("PreciousBlock: unexpected error: %v", err)
+		}
+		assertBest(t, "precious 5a", chain, block5a)
+	})
+}
+
+// addFakeHeaders adds the passed number of fake headers with the proof of work
+// limit as their difficulty to the block index of the passed chain, starting
+// with a child of the passed parent.  The timestamps are offset by the passed
+// number of seconds, so headers of different branches differ.
+func addFakeHeaders(chain *BlockChain, parent *blockNode, numNodes int,
+	offset int64) []*blockNode {
+
+	nodes := make([]*blockNode, 0, numNodes)
+	for i := 0; i < numNodes; i++ {
+		timestamp := time.Unix(int64(parent.height)+offset, 0)
+		parent = newFakeNode(parent, 4, chain.chainParams.PowLimitBits,
+			timestamp)
+		chain.index.AddNode(parent)
+		chain.maybeUpdateBestHeader(parent)
+		nodes = append(nodes, parent)
+	}
+	return nodes
+}
+
+// TestBestHeader ensures the best header is kept up to date as headers are
+// added and is only found in the entire block index again when blocks are
+// excluded from it or included in it again.
+func TestBestHeader(t *testing.T) {
+	// genesis -> 1 -> 2  -> 3
+	//              \-> 2a -> 3a -> 4a -> 5a
+	chain := newFakeChain(&chaincfg.MainNetParams)
+	addNodes := func(parent *blockNode, numNodes int, offset int64) []*blockNode {
+		return addFakeHeaders(chain, parent, numNodes, offset)
+	}
+	assertBestHeader := func(step string, want *blockNode) {
+		t.Helper()
+		if hash, height := chain.BestHeader(); hash != want.hash {
+			t.Fatalf("%s: got best header %v (height %d), want %v "+
+				"(height %d)", step, hash, height, want.hash,
+				want.height)
+		}
+	}
+
+	mainNodes := addNodes(chain.bestChain.Genesis(), 3, 0)
+	chain.bestChain.SetTip(tstTip(mainNodes))
+	assertBestHeader("main chain", tstTip(mainNodes))
+
+	sideNodes := addNodes(mainNodes[0], 3, 1000)
+	assertBestHeader("side chain", tstTip(sideNodes))
+	changes := chain.index.ExclusionChanges()
+
+	// Invalidating the side chain excludes it, including the headers
+	// which are added to it afterwards.
+	chain.index.SetStatusFlags(sideNodes[0], statusValidateFailed)
+	chain.index.SetStatusFlags(sideNodes[0], statusValidateFailed)
+	if got := chain.index.ExclusionChanges(); got != changes+1 {
+		t.Fatalf("got %d exclusion changes, want %d", got, changes+1)
+	}
+	chain.updateBestHeader()
+	assertBestHeader("invalid side chain", tstTip(mainNodes))
+	sideNodes = append(sideNodes, addNodes(tstTip(sideNodes), 1, 1000)...)
+	assertBestHeader("extended invalid side chain", tstTip(mainNodes))
+
+	// Reconsidering the side chain includes it again.
+	chain.index.UnsetStatusFlags(sideNodes[0], statusValidateFailed)
+	chain.updateBestHeader()
+	assertBestHeader("reconsidered side chain", tstTip(sideNodes))
+}
+
+// TestParkedSideChainNotification ensures the caller is notified once when a
+// side chain is parked, but not again for the blocks which extend it.
+func TestParkedSideChainNotification(t *testing.T) {
+	// genesis -> 1 -> 2  -> 3
+	//              \-> 2a -> 3a -> 4a -> 5a
+	chain, teardownFunc, err := chainSetup("parkednotification",
+		&chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatalf("Failed to setup chain instance: %v", err)
+	}
+	defer teardownFunc()
+	chain.maxReorgDepth = 1
+
+	mainNodes := addFakeHeaders(chain, chain.bestChain.Genesis(), 3, 0)
+	chain.bestChain.SetTip(tstTip(mainNodes))
+	sideNodes := addFakeHeaders(chain, mainNodes[0], 4, 1000)
+
+	var reorgs []*DeepReorg
+	chain.Subscribe(func(n *Notification) {
+		if n.Type == NTDeepReorg {
+			reorgs = append(reorgs, n.Data.(*DeepReorg))
+		}
+	})
+
+	// Block 4a is the first with more work than the main chain, so the
+	// side chain is parked with it.  Block 5a extends the parked chain.
+	chain.chainLock.Lock()
+	for _, node := range sideNodes {
+		block := btcutil.NewBlock(&wire.MsgBlock{Header: node.Header()})
+		isMainChain, err := chain.connectBestChain(node, block, BFNone)
+		if err != nil || isMainChain {
+			chain.chainLock.Unlock()
+			t.Fatalf("connectBestChain %v: got main chain %v (err %v)",
+				node.hash, isMainChain, err)
+		}
+	}
+	chain.chainLock.Unlock()
+
+	if len(reorgs) != 1 || reorgs[0].TipHash != sideNodes[2].hash {
+		t.Fatalf("got deep reorg notifications %+v, want one for %v",
+			reorgs, sideNodes[2].hash)
+	}
+	if hash, _ := chain.BestHeader(); hash != tstTip(mainNodes).hash {
+		t.Fatalf("got best header %v, want %v", hash,
+			tstTip(mainNodes).hash)
+	}
+}
+
 // TestCalcSequenceLock tests the LockTimeToSequence function, and the
 // CalcSequenceLock method of a Chain instance. The tests exercise several
 // combinations of inputs to the CalcSequenceLock function in order to ensure
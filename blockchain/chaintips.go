@@ -0,0 +1,134 @@
+// Copyright (c) 2013-2017 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package blockchain
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/btgsuite/btgd/chaincfg/chainhash"
+)
+
+// ChainTipStatus describes the state of the branch which ends at a chain tip.
+type ChainTipStatus byte
+
+// These constants are used to identify specific chain tip states.
+const (
+	// ChainTipActive is the status of the tip of the main chain.
+	ChainTipActive ChainTipStatus = iota
+
+	// ChainTipValidFork is the status of a tip whose branch is not part of
+	// the main chain and has been fully validated.
+	ChainTipValidFork
+
+	// ChainTipValidHeaders is the status of a tip whose branch is not part
+	// of the main chain and has all of its blocks stored, but some of them
+	// have not been fully validated.
+	ChainTipValidHeaders
+
+	// ChainTipHeadersOnly is the status of a tip whose branch contains
+	// headers of blocks which have not been downloaded.
+	ChainTipHeadersOnly
+
+	// ChainTipInvalid is the status of a tip whose branch contains at least
+	// one block which is known to be invalid.
+	ChainTipInvalid
+)
+
+// chainTipStatusStrings is a map of ChainTipStatus values back to the names
+// used by the getchaintips RPC.
+var chainTipStatusStrings = map[ChainTipStatus]string{
+	ChainTipActive:       "active",
+	ChainTipValidFork:    "valid-fork",
+	ChainTipValidHeaders: "valid-headers",
+	ChainTipHeadersOnly:  "headers-only",
+	ChainTipInvalid:      "invalid",
+}
+
+// String returns the ChainTipStatus as a human-readable name.
+func (s ChainTipStatus) String() string {
+	if str := chainTipStatusStrings[s]; str != "" {
+		return str
+	}
+	return fmt.Sprintf("Unknown ChainTipStatus (%d)", int(s))
+}
+
+// ChainTip describes a block in the block index which has no known children.
+type ChainTip struct {
+	// Height is the height of the tip.
+	Height int32
+
+	// Hash is the hash of the tip.
+	Hash chainhash.Hash
+
+	// BranchLen is the number of blocks from the latest ancestor of the tip
+	// which is part of the main chain to the tip.  It is zero for the tip
+	// of the main chain.
+	BranchLen int32
+
+	// Status is the state of the branch which ends at the tip.
+	Status ChainTipStatus
+}
+
+// chainTipStatus returns the state of the branch which ends at the passed tip
+// and forks from the main chain at the passed fork node.
+//
+// This function MUST be called with the chain state lock held (for reads).
+func (b *BlockChain) chainTipStatus(tip, fork *blockNode) ChainTipStatus {
+	status := ChainTipValidFork
+	for n := tip; n != fork; n = n.parent {
+		nodeStatus := b.index.NodeStatus(n)
+		switch {
+		case nodeStatus.KnownInvalid():
+			return ChainTipInvalid
+		case !nodeStatus.HaveData():
+			status = ChainTipHeadersOnly
+		case !nodeStatus.KnownValid() && status == ChainTipValidFork:
+			status = ChainTipValidHeaders
+		}
+	}
+	return status
+}
+
+// ChainTips returns all known blocks which have no children, which includes
+// the tip of the main chain and the tips of all side chains and header
+// chains, ordered by descending height.
+//
+// This function is safe for concurrent access.
+func (b *BlockChain) ChainTips() []ChainTip {
+	b.chainLock.RLock()
+	defer b.chainLock.RUnlock()
+
+	// The tip of the main chain is always included, even when headers or
+	// invalid blocks building on it are known.
+	mainTip := b.bestChain.Tip()
+	nodes := []*blockNode{mainTip}
+	b.index.RLock()
+	for node := range b.index.tips {
+		if node != mainTip {
+			nodes = append(nodes, node)
+		}
+	}
+	b.index.RUnlock()
+
+	tips := make([]ChainTip, 0, len(nodes))
+	for _, node := range nodes {
+		tip := ChainTip{
+			Height: node.height,
+			Hash:   node.hash,
+			Status: ChainTipActive,
+		}
+		if node != mainTip {
+			fork := b.bestChain.FindFork(node)
+			tip.BranchLen = node.height - fork.height
+			tip.Status = b.chainTipStatus(node, fork)
+		}
+		tips = append(tips, tip)
+	}
+	sort.SliceStable(tips, func(i, j int) bool {
+		return tips[i].Height > tips[j].Height
+	})
+	return tips
+}
@@ -0,0 +1,281 @@
+// Copyright (c) 2013-2017 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package blockchain
+
+import (
+	"container/list"
+	"fmt"
+	"sort"
+
+	"github.com/btgsuite/btgd/chaincfg/chainhash"
+)
+
+// descendants returns all nodes in the block index which descend from the
+// passed node ordered by height.
+//
+// This function MUST be called with the chain state lock held (for reads).
+func (b *BlockChain) descendants(node *blockNode) []*blockNode {
+	var candidates []*blockNode
+	b.index.RLock()
+	for _, n := range b.index.index {
+		if n.height > node.height {
+			candidates = append(candidates, n)
+		}
+	}
+	b.index.RUnlock()
+
+	// Visit the candidates by height so the parent of each node has been
+	// visited before the node itself.
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].height < candidates[j].height
+	})
+	found := map[*blockNode]struct{}{node: {}}
+	var descendants []*blockNode
+	for _, n := range candidates {
+		if _, ok := found[n.parent]; ok {
+			found[n] = struct{}{}
+			descendants = append(descendants, n)
+		}
+	}
+	return descendants
+}
+
+// isChainCandidate returns whether the main chain can be reorganized to end at
+// the passed node, which is the case when the data of the node and all of its
+// ancestors which are not part of the main chain is stored, none of them is
+// known to be invalid and they are not part of a parked side chain.
+//
+// This function MUST be called with the chain state lock held (for reads).
+func (b *BlockChain) isChainCandidate(node *blockNode) bool {
+	for n := node; n != nil && !b.bestChain.Contains(n); n = n.parent {
+		status := b.index.NodeStatus(n)
+		if !status.HaveData() || status.KnownInvalid() ||
+			status&statusParked != 0 {
+
+			return false
+		}
+	}
+	return true
+}
+
+// findBestChainTip returns the most-work node which is a candidate for the tip
+// of the main chain.  The tip of the main chain is returned when no other
+// candidate has more work.
+//
+// This function MUST be called with the chain state lock held (for reads).
+func (b *BlockChain) findBestChainTip() *blockNode {
+	tip := b.bestChain.Tip()
+	var candidates []*blockNode
+	b.index.RLock()
+	for _, node := range b.index.index {
+		if node.workSum.Cmp(tip.workSum) > 0 {
+			candidates = append(candidates, node)
+		}
+	}
+	b.index.RUnlock()
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].workSum.Cmp(candidates[j].workSum) > 0
+	})
+	for _, node := range candidates {
+		if b.isChainCandidate(node) {
+			return node
+		}
+	}
+	return tip
+}
+
+// activateBestChain reorganizes the main chain to end at the most-work
+// candidate.  Blocks which turn out to violate the rules while reorganizing
+// are marked as invalid and the next best candidate is tried.
+//
+// This function may modify node statuses in the block index without flushing.
+//
+// This function MUST be called with the chain state lock held (for writes).
+func (b *BlockChain) activateBestChain() error {
+	for {
+		best := b.findBestChainTip()
+		if best == b.bestChain.Tip() {
+			return nil
+		}
+
+		detachNodes, attachNodes := b.getReorganizeNodes(best)
+		err := b.reorganizeChain(detachNodes, attachNodes)
+		if err != nil {
+			if _, ok := err.(RuleError); !ok {
+				return err
+			}
+			log.Warnf("Unable to reorganize to block %v: %v",
+				best.hash, err)
+		}
+	}
+}
+
+// unparkSideChainsBelow removes the parked status from all side chains which
+// fork from the main chain below the passed main chain node.
+//
+// This function MUST be called with the chain state lock held (for writes).
+func (b *BlockChain) unparkSideChainsBelow(node *blockNode) {
+	var parked []*blockNode
+	b.index.RLock()
+	for _, n := range b.index.index {
+		if n.status&statusParked != 0 && n.parent.height < node.height {
+			parked = append(parked, n)
+		}
+	}
+	b.index.RUnlock()
+
+	for _, n := range parked {
+		b.index.UnsetStatusFlags(n, statusParked)
+	}
+}
+
+// lookupBlockNode returns the block index node of the block with the passed
+// hash or an error when the block is not known.
+func (b *BlockChain) lookupBlockNode(hash *chainhash.Hash) (*blockNode, error) {
+	node := b.index.LookupNode(hash)
+	if node == nil {
+		return nil, fmt.Errorf("block %s is not known", hash)
+	}
+	return node, nil
+}
+
+// InvalidateBlock manually marks the block with the passed hash as invalid
+// along with all of its descendants.  When the block is part of the main
+// chain, the blocks from the tip back to and including it are disconnected and
+// the main chain is reorganized to the most-work chain which is still valid.
+// The block remains invalid until it is reconsidered with ReconsiderBlock.
+//
+// This function is safe for concurrent access.
+func (b *BlockChain) InvalidateBlock(hash *chainhash.Hash) error {
+	b.chainLock.Lock()
+	defer b.chainLock.Unlock()
+
+	node, err := b.lookupBlockNode(hash)
+	if err != nil {
+		return err
+	}
+	if node.parent == nil {
+		return fmt.Errorf("the genesis block %s can't be invalidated", hash)
+	}
+
+	b.index.SetStatusFlags(node, statusValidateFailed)
+	for _, n := range b.descendants(node) {
+		b.index.SetStatusFlags(n, statusInvalidAncestor)
+	}
+
+	// Disconnect the invalidated blocks from the main chain before moving
+	// to the best chain which is still valid.  Side chains which were
+	// parked because they fork from the main chain below the invalidated
+	// block may become the main chain again since invalidating it is a
+	// deliberate decision to abandon the blocks after the fork.
+	if b.bestChain.Contains(node) {
+		b.unparkSideChainsBelow(node)
+
+		detachNodes := list.New()
+		for n := b.bestChain.Tip(); n != node.parent; n = n.parent {
+			detachNodes.PushBack(n)
+		}
+		err = b.reorganizeChain(detachNodes, list.New())
+	}
+	if err == nil {
+		err = b.activateBestChain()
+	}
+	b.updateBestHeader()
+
+	if writeErr := b.index.flushToDB(); writeErr != nil {
+		log.Warnf("Error flushing block index changes to disk: %v",
+			writeErr)
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Invalidated block %v (height %d)", hash, node.height)
+	return nil
+}
+
+// ReconsiderBlock removes the invalidity status from the block with the passed
+// hash along with its ancestors and descendants, which reverses InvalidateBlock
+// and also allows blocks which previously failed validation to be validated
+// again.  The main chain is reorganized to the most-work chain afterwards.
+//
+// This function is safe for concurrent access.
+func (b *BlockChain) ReconsiderBlock(hash *chainhash.Hash) error {
+	b.chainLock.Lock()
+	defer b.chainLock.Unlock()
+
+	node, err := b.lookupBlockNode(hash)
+	if err != nil {
+		return err
+	}
+
+	const invalidFlags = statusValidateFailed | statusInvalidAncestor
+	for _, n := range append(b.descendants(node), node) {
+		if b.index.NodeStatus(n).KnownInvalid() {
+			b.index.UnsetStatusFlags(n, invalidFlags)
+		}
+	}
+	for n := node.parent; n != nil; n = n.parent {
+		if b.index.NodeStatus(n).KnownInvalid() {
+			b.index.UnsetStatusFlags(n, invalidFlags)
+		}
+	}
+
+	err = b.activateBestChain()
+	b.updateBestHeader()
+
+	if writeErr := b.index.flushToDB(); writeErr != nil {
+		log.Warnf("Error flushing block index changes to disk: %v",
+			writeErr)
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Reconsidered block %v (height %d)", hash, node.height)
+	return nil
+}
+
+// PreciousBlock treats the block with the passed hash as if it was received
+// before any other block with the same amount of cumulative work.  The main
+// chain is reorganized to end at the block when it has as much work as the
+// current tip and it is a valid candidate.  Since chains with the same amount
+// of work never replace the main chain, the block is preferred until a chain
+// with more work is found.
+//
+// This function is safe for concurrent access.
+func (b *BlockChain) PreciousBlock(hash *chainhash.Hash) error {
+	b.chainLock.Lock()
+	defer b.chainLock.Unlock()
+
+	node, err := b.lookupBlockNode(hash)
+	if err != nil {
+		return err
+	}
+
+	// Marking a block of a parked side chain precious activates the side
+	// chain.
+	b.unparkSideChain(node)
+
+	// Reorganize to the block unless it is already part of the main chain,
+	// has less work than the tip or can't be connected.
+	if !b.bestChain.Contains(node) &&
+		node.workSum.Cmp(b.bestChain.Tip().workSum) >= 0 &&
+		b.isChainCandidate(node) {
+
+		detachNodes, attachNodes := b.getReorganizeNodes(node)
+		log.Infof("REORGANIZE: Precious block %v is causing a "+
+			"reorganize.", node.hash)
+		err = b.reorganizeChain(detachNodes, attachNodes)
+	}
+	b.updateBestHeader()
+
+	if writeErr := b.index.flushToDB(); writeErr != nil {
+		log.Warnf("Error flushing block index changes to disk: %v",
+			writeErr)
+	}
+	return err
+}
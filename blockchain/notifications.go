@@ -6,6 +6,8 @@ package blockchain
 
 import (
 	"fmt"
+
+	"github.com/btgsuite/btgd/chaincfg/chainhash"
 )
 
 // NotificationType represents the type of a notification message.
@@ -29,6 +31,11 @@ const (
 	// NTBlockDisconnected indicates the associated block was disconnected
 	// from the main chain.
 	NTBlockDisconnected
+
+	// NTDeepReorg indicates a side chain with more work than the main chain
+	// was not activated because reorganizing to it would disconnect more
+	// blocks than the configured maximum reorganization depth.
+	NTDeepReorg
 )
 
 // notificationTypeStrings is a map of notification types back to their constant
@@ -37,6 +44,7 @@ var notificationTypeStrings = map[NotificationType]string{
 	NTBlockAccepted:     "NTBlockAccepted",
 	NTBlockConnected:    "NTBlockConnected",
 	NTBlockDisconnected: "NTBlockDisconnected",
+	NTDeepReorg:         "NTDeepReorg",
 }
 
 // String returns the NotificationType in human-readable form.
@@ -53,11 +61,30 @@ func (n NotificationType) String() string {
 // 	- NTBlockAccepted:     *btcutil.Block
 // 	- NTBlockConnected:    *btcutil.Block
 // 	- NTBlockDisconnected: *btcutil.Block
+// 	- NTDeepReorg:         *DeepReorg
 type Notification struct {
 	Type NotificationType
 	Data interface{}
 }
 
+// DeepReorg describes a side chain which was parked instead of becoming the
+// main chain because it forks from the main chain deeper than the maximum
+// reorganization depth.
+type DeepReorg struct {
+	// ForkHash and ForkHeight identify the latest block the side chain has
+	// in common with the main chain.
+	ForkHash   chainhash.Hash
+	ForkHeight int32
+
+	// TipHash and TipHeight identify the tip of the parked side chain.
+	TipHash   chainhash.Hash
+	TipHeight int32
+
+	// Depth is the number of main chain blocks which would have been
+	// disconnected by the reorganization.
+	Depth int32
+}
+
 // Subscribe to block chain notifications. Registers a callback to be executed
 // when various events take place. See the documentation on Notification and
 // NotificationType for details on the types and contents of notifications.
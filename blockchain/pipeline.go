@@ -0,0 +1,288 @@
+// Copyright (c) 2013-2017 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package blockchain
+
+import (
+	"sync"
+
+	"github.com/btgsuite/btgd/txscript"
+	"github.com/btgsuite/btgd/wire"
+	btcutil "github.com/btgsuite/btgutil"
+)
+
+// maxPipelinedBlocks is the maximum number of blocks the validation pipeline
+// tracks at once.  It bounds the memory used for the blocks which are
+// validated ahead of being processed and the outputs they create.
+const maxPipelinedBlocks = 512
+
+// pipelineBlock houses a block which is validated by the validation pipeline
+// along with the state of its validation.
+type pipelineBlock struct {
+	block         *btcutil.Block
+	flags         BehaviorFlags
+	runScripts    bool
+	scriptFlags   txscript.ScriptFlags
+	sanityChecked bool
+}
+
+// validationPipeline validates blocks ahead of them being processed while the
+// blocks they build on are still being downloaded or connected.  The context
+// free sanity checks of each block are performed and the scripts of all inputs
+// spending outputs which are either in the utxo set or created by blocks
+// earlier in the pipeline are validated, which populates the signature and
+// sighash caches.  Connecting the blocks remains sequential and performs the
+// full validation, so the pipeline only ever saves work and never affects
+// whether a block is considered valid.
+type validationPipeline struct {
+	mtx     sync.Mutex
+	queue   []*pipelineBlock
+	blocks  map[*btcutil.Block]*pipelineBlock
+	outputs map[wire.OutPoint]*UtxoEntry
+	running bool
+	wg      sync.WaitGroup
+
+	// quit is closed when the pipeline is cancelled.  It identifies the
+	// goroutine validating the queued blocks so a goroutine which is still
+	// finishing a block after the pipeline was cancelled discards its
+	// results.
+	quit chan struct{}
+}
+
+// newValidationPipeline returns a new empty validation pipeline.
+func newValidationPipeline() *validationPipeline {
+	return &validationPipeline{
+		blocks:  make(map[*btcutil.Block]*pipelineBlock),
+		outputs: make(map[wire.OutPoint]*UtxoEntry),
+		quit:    make(chan struct{}),
+	}
+}
+
+// sanityChecked returns whether the pipeline performed the sanity checks of
+// the passed block with the passed behavior flags and they passed.
+//
+// This function is safe for concurrent access.
+func (p *validationPipeline) sanityChecked(block *btcutil.Block, flags BehaviorFlags) bool {
+	p.mtx.Lock()
+	item := p.blocks[block]
+	checked := item != nil && item.sanityChecked && item.flags == flags
+	p.mtx.Unlock()
+	return checked
+}
+
+// removeOutputs removes the outputs created by the passed block from the
+// outputs available to later blocks in the pipeline.
+//
+// This function MUST be called with the pipeline lock held.
+func (p *validationPipeline) removeOutputs(block *btcutil.Block) {
+	for _, tx := range block.Transactions() {
+		prevOut := wire.OutPoint{Hash: *tx.Hash()}
+		for txOutIdx := range tx.MsgTx().TxOut {
+			prevOut.Index = uint32(txOutIdx)
+			delete(p.outputs, prevOut)
+		}
+	}
+}
+
+// remove stops tracking the passed block once it has been processed.  Its
+// outputs are available from the utxo set from then on when it was connected.
+//
+// This function is safe for concurrent access.
+func (p *validationPipeline) remove(block *btcutil.Block) {
+	p.mtx.Lock()
+	if _, ok := p.blocks[block]; ok {
+		delete(p.blocks, block)
+		p.removeOutputs(block)
+	}
+	p.mtx.Unlock()
+}
+
+// cancel stops validating the queued blocks and forgets all tracked blocks.
+//
+// This function MUST be called with the pipeline lock held.
+func (p *validationPipeline) cancel() {
+	close(p.quit)
+	p.quit = make(chan struct{})
+	p.queue = nil
+	p.blocks = make(map[*btcutil.Block]*pipelineBlock)
+	p.outputs = make(map[wire.OutPoint]*UtxoEntry)
+	p.running = false
+}
+
+// next returns the next queued block to validate for the goroutine identified
+// by the passed quit channel.  It returns nil when the goroutine should exit
+// because the queue is empty or the pipeline was cancelled.
+//
+// This function is safe for concurrent access.
+func (p *validationPipeline) next(quit chan struct{}) *pipelineBlock {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if quit != p.quit {
+		return nil
+	}
+	for len(p.queue) > 0 {
+		item := p.queue[0]
+		p.queue[0] = nil
+		p.queue = p.queue[1:]
+
+		// Skip blocks which were processed in the mean time.
+		if p.blocks[item.block] == item {
+			return item
+		}
+	}
+	p.running = false
+	return nil
+}
+
+// runPipeline validates the queued blocks in order until the queue is empty or
+// the pipeline identified by the passed quit channel is cancelled.  It must be
+// run as a goroutine.
+func (b *BlockChain) runPipeline(quit chan struct{}) {
+	p := b.pipeline
+	defer p.wg.Done()
+
+	for item := p.next(quit); item != nil; item = p.next(quit) {
+		err := b.prevalidateBlock(item, quit)
+		if err == nil || err == errInterruptRequested {
+			continue
+		}
+
+		// The blocks after a block which failed validation can't be
+		// connected either, so stop validating them.  Processing the
+		// block reports the error.
+		log.Debugf("Cancelling validation pipeline: block %v failed "+
+			"validation: %v", item.block.Hash(), err)
+		p.mtx.Lock()
+		if quit == p.quit {
+			p.cancel()
+		}
+		p.mtx.Unlock()
+		return
+	}
+}
+
+// prevalidateBlock performs the sanity checks of the passed block and
+// validates the scripts of all of its inputs which spend known outputs.
+// errInterruptRequested is returned when the pipeline identified by the passed
+// quit channel is cancelled in the mean time.
+func (b *BlockChain) prevalidateBlock(item *pipelineBlock, quit chan struct{}) error {
+	p := b.pipeline
+	block := item.block
+	err := checkBlockSanity(block, b.chainParams, b.timeSource, item.flags)
+	if err != nil {
+		return err
+	}
+
+	// Make the outputs created by the block available to the blocks after
+	// it in the pipeline.
+	p.mtx.Lock()
+	if quit != p.quit {
+		p.mtx.Unlock()
+		return errInterruptRequested
+	}
+	item.sanityChecked = true
+	view := NewUtxoViewpoint()
+	for _, tx := range block.Transactions() {
+		view.AddTxOuts(tx, block.Height())
+	}
+	for outpoint, entry := range view.entries {
+		p.outputs[outpoint] = entry
+	}
+	p.mtx.Unlock()
+	if !item.runScripts {
+		return nil
+	}
+
+	// Look up the outputs spent by the block which are either created by
+	// blocks in the pipeline or are part of the utxo set.  Outputs which
+	// are created by blocks that have not been received yet are unknown,
+	// so the scripts of the inputs spending them are left to be validated
+	// when the block is connected.
+	view = NewUtxoViewpoint()
+	missing := make(map[wire.OutPoint]struct{})
+	p.mtx.Lock()
+	for _, tx := range block.Transactions()[1:] {
+		for _, txIn := range tx.MsgTx().TxIn {
+			outpoint := txIn.PreviousOutPoint
+			if entry, ok := p.outputs[outpoint]; ok {
+				view.entries[outpoint] = entry
+				continue
+			}
+			missing[outpoint] = struct{}{}
+		}
+	}
+	p.mtx.Unlock()
+	if err := view.fetchUtxosMain(b.utxoCache, missing); err != nil {
+		return err
+	}
+
+	items := blockValidateItems(block, item.scriptFlags, b.hashCache)
+	known := items[:0]
+	for _, txVI := range items {
+		if view.LookupEntry(txVI.txIn.PreviousOutPoint) != nil {
+			known = append(known, txVI)
+		}
+	}
+	validator := newTxValidator(view, item.scriptFlags, b.sigCache,
+		b.hashCache)
+	validator.interrupt = quit
+	return validator.Validate(known)
+}
+
+// PrevalidateBlock queues the passed block to be validated ahead of being
+// processed with ProcessBlock using the passed behavior flags.  The context
+// free checks of the block are performed and the scripts of the inputs which
+// spend known outputs are validated concurrently with processing other
+// blocks, so processing the block later on is mostly a matter of connecting
+// it.  Blocks should be queued in the order they are going to be connected.
+//
+// The scripts are only validated when the header of the block is known, since
+// the script flags depend on the position of the block in the chain.  A block
+// which fails validation cancels the pipeline, as does CancelPrevalidation.
+// Either way, processing the block fully validates it.
+//
+// This function is safe for concurrent access.
+func (b *BlockChain) PrevalidateBlock(block *btcutil.Block, flags BehaviorFlags) {
+	item := &pipelineBlock{block: block, flags: flags}
+	b.chainLock.RLock()
+	node := b.index.LookupNode(block.Hash())
+	if node != nil && node.parent != nil {
+		block.SetHeight(node.height)
+		if flags&BFFastAdd != BFFastAdd && b.scriptsRequired(node) {
+			scriptFlags, err := b.blockScriptFlags(node)
+			if err == nil {
+				item.runScripts = true
+				item.scriptFlags = scriptFlags
+			}
+		}
+	}
+	b.chainLock.RUnlock()
+
+	p := b.pipeline
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if _, ok := p.blocks[block]; ok || len(p.blocks) >= maxPipelinedBlocks {
+		return
+	}
+	p.blocks[block] = item
+	p.queue = append(p.queue, item)
+	if !p.running {
+		p.running = true
+		p.wg.Add(1)
+		go b.runPipeline(p.quit)
+	}
+}
+
+// CancelPrevalidation stops validating the blocks queued with PrevalidateBlock
+// and forgets about them.  It should be called when the queued blocks are not
+// going to be processed, such as when one of them was rejected.
+//
+// This function is safe for concurrent access.
+func (b *BlockChain) CancelPrevalidation() {
+	b.pipeline.mtx.Lock()
+	b.pipeline.cancel()
+	b.pipeline.mtx.Unlock()
+}
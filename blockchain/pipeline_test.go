@@ -0,0 +1,96 @@
+// Copyright (c) 2013-2017 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package blockchain
+
+import (
+	"testing"
+
+	"github.com/btgsuite/btgd/chaincfg"
+	"github.com/btgsuite/btgd/chaincfg/chainhash"
+	"github.com/btgsuite/btgd/wire"
+	btcutil "github.com/btgsuite/btgutil"
+)
+
+// TestValidationPipeline ensures blocks are validated ahead of being processed
+// and that a block which fails validation cancels the pipeline.
+func TestValidationPipeline(t *testing.T) {
+	// (genesis block) -> 1 -> 2 -> 3 -> 4
+	blocks, err := loadBlocks("blk_0_to_4.dat.bz2")
+	if err != nil {
+		t.Fatalf("Error loading file: %v\n", err)
+	}
+
+	chain, teardownFunc, err := chainSetup("validationpipeline",
+		&chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatalf("Failed to setup chain instance: %v", err)
+	}
+	defer teardownFunc()
+	chain.TstSetCoinbaseMaturity(1)
+	p := chain.pipeline
+
+	// Validate the blocks ahead of processing them once their headers are
+	// known, so their scripts are validated as well.
+	for i := 1; i < len(blocks); i++ {
+		header := &blocks[i].MsgBlock().Header
+		if err := chain.ProcessBlockHeader(header, BFNone); err != nil {
+			t.Fatalf("ProcessBlockHeader fail on block %v: %v", i, err)
+		}
+	}
+	for i := 1; i < len(blocks); i++ {
+		chain.PrevalidateBlock(blocks[i], BFNone)
+	}
+	p.wg.Wait()
+	for i := 1; i < len(blocks); i++ {
+		if !p.sanityChecked(blocks[i], BFNone) {
+			t.Fatalf("block %v was not validated", i)
+		}
+		if !p.blocks[blocks[i]].runScripts {
+			t.Fatalf("scripts of block %v were not validated", i)
+		}
+		if p.sanityChecked(blocks[i], BFFastAdd) {
+			t.Fatalf("block %v was validated with other flags", i)
+		}
+	}
+	coinbase := wire.OutPoint{Hash: *blocks[4].Transactions()[0].Hash()}
+	if _, ok := p.outputs[coinbase]; !ok {
+		t.Fatalf("output %v was not made available", coinbase)
+	}
+
+	// Processing the blocks stops tracking them.
+	for i := 1; i < len(blocks); i++ {
+		_, isOrphan, err := chain.ProcessBlock(blocks[i], BFNone)
+		if err != nil || isOrphan {
+			t.Fatalf("ProcessBlock fail on block %v: orphan %v, "+
+				"err %v", i, isOrphan, err)
+		}
+	}
+	if len(p.blocks) != 0 || len(p.outputs) != 0 {
+		t.Fatalf("pipeline still tracks %d blocks and %d outputs",
+			len(p.blocks), len(p.outputs))
+	}
+
+	// A block which fails the sanity checks cancels the pipeline, which
+	// forgets about the blocks validated before it.
+	valid := btcutil.NewBlock(blocks[1].MsgBlock())
+	msgBlock := *blocks[2].MsgBlock()
+	msgBlock.Header.MerkleRoot = chainhash.Hash{}
+	invalid := btcutil.NewBlock(&msgBlock)
+	chain.PrevalidateBlock(valid, BFNone)
+	chain.PrevalidateBlock(invalid, BFNone)
+	p.wg.Wait()
+	if len(p.blocks) != 0 || len(p.queue) != 0 || p.running {
+		t.Fatalf("pipeline was not cancelled: %d blocks, %d queued, "+
+			"running %v", len(p.blocks), len(p.queue), p.running)
+	}
+
+	// Cancelling the pipeline forgets about queued blocks.
+	chain.PrevalidateBlock(valid, BFNone)
+	chain.CancelPrevalidation()
+	p.wg.Wait()
+	if p.sanityChecked(valid, BFNone) || len(p.blocks) != 0 {
+		t.Fatal("pipeline still tracks blocks after cancelling")
+	}
+}
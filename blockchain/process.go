@@ -10,6 +10,7 @@ import (
 
 	"github.com/btgsuite/btgd/chaincfg/chainhash"
 	"github.com/btgsuite/btgd/database"
+	"github.com/btgsuite/btgd/wire"
 	btcutil "github.com/btgsuite/btgutil"
 )
 
@@ -39,8 +40,9 @@ const (
 // This function is safe for concurrent access.
 func (b *BlockChain) blockExists(hash *chainhash.Hash) (bool, error) {
 	// Check block index first (could be main chain or side chain blocks).
-	if b.index.HaveBlock(hash) {
-		return true, nil
+	// Blocks for which only the header is known do not exist yet.
+	if node := b.index.LookupNode(hash); node != nil {
+		return b.index.NodeStatus(node).HaveData(), nil
 	}
 
 	// Check in the database.
@@ -129,6 +131,40 @@ func (b *BlockChain) processOrphans(hash *chainhash.Hash, flags BehaviorFlags) e
 	return nil
 }
 
+// maybeMarkHeaderInvalid marks the known header of a block which was rejected
+// with the passed error as invalid, so neither the block nor the blocks which
+// build on it are downloaded again.  Errors which may be caused by mutating a
+// valid block without changing its hash, such as duplicating transactions or
+// adding witness data, do not show the block to be invalid since the valid
+// block may still be received from another peer, so they are ignored.  The
+// same applies to blocks which are only too far in the future for now.
+//
+// This function MUST be called with the chain state lock held (for writes).
+func (b *BlockChain) maybeMarkHeaderInvalid(hash *chainhash.Hash, err error) {
+	rerr, ok := err.(RuleError)
+	if !ok {
+		return
+	}
+	switch rerr.ErrorCode {
+	case ErrBadMerkleRoot, ErrDuplicateTx, ErrBlockTooBig,
+		ErrBlockWeightTooHigh, ErrUnexpectedWitness,
+		ErrInvalidWitnessCommitment, ErrWitnessCommitmentMismatch,
+		ErrTimeTooNew:
+
+		return
+	}
+
+	node := b.index.LookupNode(hash)
+	if node == nil || b.index.NodeStatus(node).KnownInvalid() {
+		return
+	}
+	b.index.SetStatusFlags(node, statusValidateFailed)
+	if writeErr := b.index.flushToDB(); writeErr != nil {
+		log.Warnf("Error flushing block index changes to disk: %v",
+			writeErr)
+	}
+}
+
 // ProcessBlock is the main workhorse for handling insertion of new blocks into
 // the block chain.  It includes functionality such as rejecting duplicate
 // blocks, ensuring blocks follow all rules, orphan handling, and insertion into
@@ -143,8 +179,13 @@ func (b *BlockChain) ProcessBlock(block *btcutil.Block, flags BehaviorFlags) (bo
 	b.chainLock.Lock()
 	defer b.chainLock.Unlock()
 
+	// Blocks which turn out to be invalid exclude the headers which build
+	// on them from the best header.
+	defer b.updateBestHeader()
+
 	blockHash := block.Hash()
 	log.Tracef("Processing block %v", blockHash)
+	defer b.pipeline.remove(block)
 
 	// The block must not already exist in the main chain or side chains.
 	exists, err := b.blockExists(blockHash)
@@ -162,10 +203,14 @@ func (b *BlockChain) ProcessBlock(block *btcutil.Block, flags BehaviorFlags) (bo
 		return false, false, ruleError(ErrDuplicateBlock, str)
 	}
 
-	// Perform preliminary sanity checks on the block and its transactions.
-	err = checkBlockSanity(block, b.chainParams, b.timeSource, flags)
-	if err != nil {
-		return false, false, err
+	// Perform preliminary sanity checks on the block and its transactions
+	// unless the validation pipeline already performed them.
+	if !b.pipeline.sanityChecked(block, flags) {
+		err = checkBlockSanity(block, b.chainParams, b.timeSource, flags)
+		if err != nil {
+			b.maybeMarkHeaderInvalid(blockHash, err)
+			return false, false, err
+		}
 	}
 
 	// Find the previous checkpoint and perform some additional checks based
@@ -225,3 +270,55 @@ func (b *BlockChain) ProcessBlock(block *btcutil.Block, flags BehaviorFlags) (bo
 
 	return isMainChain, false, nil
 }
+
+// ProcessBlockHeader validates the passed block header and adds it to the block
+// index as a header whose block data has not been downloaded yet.  This allows
+// the header chain to be downloaded and validated, including the proof of work
+// and the required difficulty, before the blocks it describes.  Headers which
+// are already known are ignored, and headers which do not connect to a header
+// in the block index are rejected.
+//
+// The most-work chain of headers is available via BestHeader.
+//
+// This function is safe for concurrent access.
+func (b *BlockChain) ProcessBlockHeader(header *wire.BlockHeader, flags BehaviorFlags) error {
+	b.chainLock.Lock()
+	defer b.chainLock.Unlock()
+
+	// Nothing to do for headers which are already known unless they are
+	// known to be invalid.
+	blockHash := header.BlockHash()
+	if node := b.index.LookupNode(&blockHash); node != nil {
+		if b.index.NodeStatus(node).KnownInvalid() {
+			str := fmt.Sprintf("block %v is known to be invalid",
+				blockHash)
+			return ruleError(ErrInvalidAncestorBlock, str)
+		}
+		return nil
+	}
+
+	// Perform preliminary sanity checks on the header.
+	err := checkBlockHeaderSanity(header, b.chainParams.PowLimit,
+		b.timeSource, flags)
+	if err != nil {
+		return err
+	}
+
+	// Ensure the header timestamp is after the previous checkpoint
+	// timestamp.
+	checkpointNode, err := b.findPreviousCheckpoint()
+	if err != nil {
+		return err
+	}
+	if checkpointNode != nil {
+		checkpointTime := time.Unix(checkpointNode.timestamp, 0)
+		if header.Timestamp.Before(checkpointTime) {
+			str := fmt.Sprintf("block %v has timestamp %v before "+
+				"last checkpoint timestamp %v", blockHash,
+				header.Timestamp, checkpointTime)
+			return ruleError(ErrCheckpointTimeTooOld, str)
+		}
+	}
+
+	return b.maybeAcceptBlockHeader(header, flags)
+}
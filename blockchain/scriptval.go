@@ -30,6 +30,7 @@ type txValidator struct {
 	validateChan chan *txValidateItem
 	quitChan     chan struct{}
 	resultChan   chan error
+	interrupt    <-chan struct{}
 	utxoView     *UtxoViewpoint
 	flags        txscript.ScriptFlags
 	sigCache     *txscript.SigCache
@@ -114,7 +115,8 @@ out:
 }
 
 // Validate validates the scripts for all of the passed transaction inputs using
-// multiple goroutines.
+// multiple goroutines.  It stops early with errInterruptRequested when the
+// interrupt channel of the validator is closed.
 func (v *txValidator) Validate(items []*txValidateItem) error {
 	if len(items) == 0 {
 		return nil
@@ -164,6 +166,10 @@ func (v *txValidator) Validate(items []*txValidateItem) error {
 				close(v.quitChan)
 				return err
 			}
+
+		case <-v.interrupt:
+			close(v.quitChan)
+			return errInterruptRequested
 		}
 	}
 
@@ -238,11 +244,12 @@ func ValidateTransactionScripts(tx *btcutil.Tx, utxoView *UtxoViewpoint,
 	return validator.Validate(txValItems)
 }
 
-// checkBlockScripts executes and validates the scripts for all transactions in
-// the passed block using multiple goroutines.
-func checkBlockScripts(block *btcutil.Block, utxoView *UtxoViewpoint,
-	scriptFlags txscript.ScriptFlags, sigCache *txscript.SigCache,
-	hashCache *txscript.HashCache) error {
+// blockValidateItems returns the items to validate the scripts for all
+// transaction inputs in the passed block.  The sighash midstates of witness
+// transactions are added to the HashCache, if present, when segwit is active
+// according to the script flags.
+func blockValidateItems(block *btcutil.Block, scriptFlags txscript.ScriptFlags,
+	hashCache *txscript.HashCache) []*txValidateItem {
 
 	// First determine if segwit is active according to the scriptFlags. If
 	// it isn't then we don't need to interact with the HashCache.
@@ -293,6 +300,17 @@ func checkBlockScripts(block *btcutil.Block, utxoView *UtxoViewpoint,
 			txValItems = append(txValItems, txVI)
 		}
 	}
+	return txValItems
+}
+
+// checkBlockScripts executes and validates the scripts for all transactions in
+// the passed block using multiple goroutines.
+func checkBlockScripts(block *btcutil.Block, utxoView *UtxoViewpoint,
+	scriptFlags txscript.ScriptFlags, sigCache *txscript.SigCache,
+	hashCache *txscript.HashCache) error {
+
+	segwitActive := scriptFlags&txscript.ScriptVerifyWitness == txscript.ScriptVerifyWitness
+	txValItems := blockValidateItems(block, scriptFlags, hashCache)
 
 	// Validate all of the inputs.
 	validator := newTxValidator(utxoView, scriptFlags, sigCache, hashCache)
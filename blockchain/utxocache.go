@@ -0,0 +1,388 @@
+// Copyright (c) 2015-2016 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package blockchain
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/btgsuite/btgd/chaincfg/chainhash"
+	"github.com/btgsuite/btgd/database"
+	"github.com/btgsuite/btgd/txscript"
+	"github.com/btgsuite/btgd/wire"
+	btcutil "github.com/btgsuite/btgutil"
+)
+
+const (
+	// utxoEntryOverhead is the approximate number of bytes a cached utxo
+	// entry uses in addition to its public key script.  It accounts for
+	// the outpoint key, the pointer to and the contents of the entry and
+	// the overhead of the map bucket holding them.
+	utxoEntryOverhead = 128
+
+	// utxoFlushBatchSize is the maximum number of utxo set entries which
+	// are written to the database in a single database transaction when
+	// the utxo cache is flushed.
+	utxoFlushBatchSize = 100000
+)
+
+// utxoCache is a size-bounded cache of the utxo set in the database which
+// reflects the state of the end of the main chain.  Modified entries are only
+// written to the database once the cache grows beyond its maximum size, before
+// the main chain is reorganized and on shutdown, which avoids writing outputs
+// that are spent shortly after they were created at all.  Blocks disconnected
+// while reorganizing the main chain bypass the cache and update the database
+// directly.
+//
+// The database records the hash of the block the utxo set it contains was last
+// flushed at, so the blocks connected after it can be replayed on startup when
+// the cache was not flushed due to a crash.
+type utxoCache struct {
+	db      database.DB
+	maxSize uint64
+
+	mtx     sync.Mutex
+	entries map[wire.OutPoint]*UtxoEntry
+	size    uint64
+}
+
+// newUtxoCache returns a new empty utxo cache in front of the utxo set in the
+// passed database which is flushed once it uses more than maxSize bytes.
+func newUtxoCache(db database.DB, maxSize uint64) *utxoCache {
+	return &utxoCache{
+		db:      db,
+		maxSize: maxSize,
+		entries: make(map[wire.OutPoint]*UtxoEntry),
+	}
+}
+
+// entrySize returns the approximate number of bytes the passed cached entry
+// uses.
+func entrySize(entry *UtxoEntry) uint64 {
+	return utxoEntryOverhead + uint64(len(entry.pkScript))
+}
+
+// setEntry replaces the cached entry for the passed outpoint.
+//
+// This function MUST be called with the cache lock held.
+func (c *utxoCache) setEntry(outpoint wire.OutPoint, entry *UtxoEntry) {
+	if cached := c.entries[outpoint]; cached != nil {
+		c.size -= entrySize(cached)
+	}
+	c.entries[outpoint] = entry
+	c.size += entrySize(entry)
+}
+
+// removeEntry removes the cached entry for the passed outpoint.
+//
+// This function MUST be called with the cache lock held.
+func (c *utxoCache) removeEntry(outpoint wire.OutPoint) {
+	if cached := c.entries[outpoint]; cached != nil {
+		c.size -= entrySize(cached)
+		delete(c.entries, outpoint)
+	}
+}
+
+// fetchEntries adds copies of the entries for the passed outpoints to the view.
+// Entries which are not cached are loaded from the database and cached.  Spent
+// outputs, or those which otherwise don't exist, result in a nil entry in the
+// view.
+//
+// This function is safe for concurrent access.
+func (c *utxoCache) fetchEntries(view *UtxoViewpoint, outpoints map[wire.OutPoint]struct{}) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	var missing []wire.OutPoint
+	for outpoint := range outpoints {
+		entry, ok := c.entries[outpoint]
+		if !ok {
+			missing = append(missing, outpoint)
+			continue
+		}
+		if entry.IsSpent() {
+			view.entries[outpoint] = nil
+			continue
+		}
+		view.entries[outpoint] = entry.viewClone()
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	return c.db.View(func(dbTx database.Tx) error {
+		for _, outpoint := range missing {
+			entry, err := dbFetchUtxoEntry(dbTx, outpoint)
+			if err != nil {
+				return err
+			}
+			if entry == nil {
+				view.entries[outpoint] = nil
+				continue
+			}
+
+			c.setEntry(outpoint, entry)
+			view.entries[outpoint] = entry.viewClone()
+		}
+		return nil
+	})
+}
+
+// viewClone returns a copy of the cached entry which only carries the flags
+// that are meaningful in a view.
+func (entry *UtxoEntry) viewClone() *UtxoEntry {
+	clone := entry.Clone()
+	clone.packedFlags &= tfCoinBase
+	return clone
+}
+
+// commit applies the entries of the passed view which were modified by
+// connecting or disconnecting a block to the cache.  Outputs which are created
+// while they are not cached don't exist in the database, so they are cached as
+// fresh and forgotten again when they are spent before the cache is flushed.
+//
+// This function is safe for concurrent access.
+func (c *utxoCache) commit(view *UtxoViewpoint) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	for outpoint, entry := range view.entries {
+		if entry == nil || !entry.isModified() {
+			continue
+		}
+
+		cached := c.entries[outpoint]
+		if entry.IsSpent() {
+			if cached != nil && cached.packedFlags&tfFresh == tfFresh {
+				c.removeEntry(outpoint)
+				continue
+			}
+
+			// Keep the spent entry until the cache is flushed so it
+			// is removed from the database.
+			c.setEntry(outpoint, &UtxoEntry{
+				packedFlags: tfSpent | tfModified,
+			})
+			continue
+		}
+
+		clone := entry.viewClone()
+		clone.packedFlags |= tfModified
+		if cached == nil || cached.packedFlags&tfFresh == tfFresh {
+			clone.packedFlags |= tfFresh
+		}
+		c.setEntry(outpoint, clone)
+	}
+}
+
+// evict removes the entries of the passed view which were modified by
+// disconnecting a block from the cache after they were written to the database
+// directly, so they are loaded from the database again when needed.  The cache
+// must not hold modified entries for any of them, which is ensured by flushing
+// it before the main chain is reorganized.
+//
+// This function is safe for concurrent access.
+func (c *utxoCache) evict(view *UtxoViewpoint) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	for outpoint, entry := range view.entries {
+		if entry != nil && entry.isModified() {
+			c.removeEntry(outpoint)
+		}
+	}
+}
+
+// replayBlock applies the outputs spent and created by the passed block, which
+// is connected to the main chain after the block the utxo set in the database
+// was last flushed at, to the cache.  Since the database may already reflect
+// some of these changes when flushing was interrupted, none of the entries are
+// considered fresh, which makes replaying the same block again harmless.
+//
+// This function is safe for concurrent access.
+func (c *utxoCache) replayBlock(block *btcutil.Block) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	for _, tx := range block.Transactions() {
+		isCoinBase := IsCoinBase(tx)
+		if !isCoinBase {
+			for _, txIn := range tx.MsgTx().TxIn {
+				c.setEntry(txIn.PreviousOutPoint, &UtxoEntry{
+					packedFlags: tfSpent | tfModified,
+				})
+			}
+		}
+
+		packedFlags := tfModified
+		if isCoinBase {
+			packedFlags |= tfCoinBase
+		}
+		prevOut := wire.OutPoint{Hash: *tx.Hash()}
+		for txOutIdx, txOut := range tx.MsgTx().TxOut {
+			if txscript.IsUnspendable(txOut.PkScript) {
+				continue
+			}
+
+			prevOut.Index = uint32(txOutIdx)
+			c.setEntry(prevOut, &UtxoEntry{
+				amount:      txOut.Value,
+				pkScript:    txOut.PkScript,
+				blockHeight: block.Height(),
+				packedFlags: packedFlags,
+			})
+		}
+	}
+}
+
+// needsFlush returns whether the cache uses more than its maximum size.
+//
+// This function is safe for concurrent access.
+func (c *utxoCache) needsFlush() bool {
+	c.mtx.Lock()
+	needsFlush := c.size > c.maxSize
+	c.mtx.Unlock()
+	return needsFlush
+}
+
+// flush writes all modified entries to the database in batches, records the
+// passed hash of the tip of the main chain as the block the utxo set in the
+// database is consistent with and empties the cache.
+//
+// This function is safe for concurrent access.
+func (c *utxoCache) flush(bestHash *chainhash.Hash) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	var modified []wire.OutPoint
+	for outpoint, entry := range c.entries {
+		if entry.isModified() {
+			modified = append(modified, outpoint)
+		}
+	}
+
+	// The consistency hash is written along with the last batch, so the
+	// blocks since the previous flush are replayed on startup when any of
+	// the batches could not be written.
+	for {
+		batch := modified
+		if len(batch) > utxoFlushBatchSize {
+			batch = batch[:utxoFlushBatchSize]
+		}
+		modified = modified[len(batch):]
+
+		err := c.db.Update(func(dbTx database.Tx) error {
+			for _, outpoint := range batch {
+				err := dbPutUtxoEntry(dbTx, outpoint,
+					c.entries[outpoint])
+				if err != nil {
+					return err
+				}
+			}
+			if len(modified) != 0 {
+				return nil
+			}
+			return dbPutUtxoStateConsistency(dbTx, bestHash)
+		})
+		if err != nil {
+			return err
+		}
+		if len(modified) == 0 {
+			break
+		}
+	}
+
+	c.entries = make(map[wire.OutPoint]*UtxoEntry)
+	c.size = 0
+	return nil
+}
+
+// initUtxoCache makes the utxo set consistent with the end of the main chain by
+// replaying the blocks connected after the block the utxo set in the database
+// was last flushed at.  This is needed when the utxo cache was not flushed on
+// shutdown.
+func (b *BlockChain) initUtxoCache(interrupt <-chan struct{}) error {
+	tip := b.bestChain.Tip()
+	var consistentHash *chainhash.Hash
+	err := b.db.View(func(dbTx database.Tx) error {
+		var err error
+		consistentHash, err = dbFetchUtxoStateConsistency(dbTx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// Databases created before the utxo cache was introduced keep the
+	// utxo set consistent with the end of the main chain.
+	if consistentHash == nil {
+		return b.db.Update(func(dbTx database.Tx) error {
+			return dbPutUtxoStateConsistency(dbTx, &tip.hash)
+		})
+	}
+	if *consistentHash == tip.hash {
+		return nil
+	}
+
+	// The main chain is only reorganized after flushing and disconnected
+	// blocks update the block the utxo set is consistent with along with
+	// the best chain state, so it must be part of the main chain.
+	node := b.index.LookupNode(consistentHash)
+	if node == nil || !b.bestChain.Contains(node) {
+		return AssertError(fmt.Sprintf("initUtxoCache: utxo set is "+
+			"consistent with block %v which is not part of the main "+
+			"chain", consistentHash))
+	}
+
+	log.Infof("Replaying %d blocks to recover the utxo set from block %v "+
+		"(height %d)", tip.height-node.height, node.hash, node.height)
+	for n := b.bestChain.Next(node); n != nil; n = b.bestChain.Next(n) {
+		if interruptRequested(interrupt) {
+			return errInterruptRequested
+		}
+
+		var block *btcutil.Block
+		err := b.db.View(func(dbTx database.Tx) error {
+			var err error
+			block, err = dbFetchBlockByNode(dbTx, n)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		b.utxoCache.replayBlock(block)
+
+		if b.utxoCache.needsFlush() {
+			if err := b.utxoCache.flush(&n.hash); err != nil {
+				return err
+			}
+		}
+	}
+	return b.utxoCache.flush(&tip.hash)
+}
+
+// maybeFlushUtxoCache flushes the utxo cache when it uses more than its maximum
+// size.
+//
+// This function MUST be called with the chain state lock held (for writes).
+func (b *BlockChain) maybeFlushUtxoCache() error {
+	if !b.utxoCache.needsFlush() {
+		return nil
+	}
+	return b.utxoCache.flush(&b.bestChain.Tip().hash)
+}
+
+// FlushUtxoCache writes all unspent transaction outputs which were modified
+// since the utxo cache was last flushed to the database.  It should be called
+// on shutdown so the blocks connected since the last flush don't need to be
+// replayed on the next start.
+//
+// This function is safe for concurrent access.
+func (b *BlockChain) FlushUtxoCache() error {
+	b.chainLock.Lock()
+	defer b.chainLock.Unlock()
+
+	return b.utxoCache.flush(&b.bestChain.Tip().hash)
+}
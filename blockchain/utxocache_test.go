@@ -0,0 +1,258 @@
+// Copyright (c) 2015-2016 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package blockchain
+
+import (
+	"testing"
+
+	"github.com/btgsuite/btgd/chaincfg"
+	"github.com/btgsuite/btgd/chaincfg/chainhash"
+	"github.com/btgsuite/btgd/database"
+	"github.com/btgsuite/btgd/wire"
+	btcutil "github.com/btgsuite/btgutil"
+)
+
+// dbUtxoEntry returns the entry for the passed outpoint in the utxo set in the
+// database.
+func dbUtxoEntry(t *testing.T, db database.DB, outpoint wire.OutPoint) *UtxoEntry {
+	t.Helper()
+	var entry *UtxoEntry
+	err := db.View(func(dbTx database.Tx) error {
+		var err error
+		entry, err = dbFetchUtxoEntry(dbTx, outpoint)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("dbFetchUtxoEntry: unexpected error: %v", err)
+	}
+	return entry
+}
+
+// dbUtxoStateConsistency returns the hash of the block the utxo set in the
+// database is consistent with.
+func dbUtxoStateConsistency(t *testing.T, db database.DB) *chainhash.Hash {
+	t.Helper()
+	var hash *chainhash.Hash
+	err := db.View(func(dbTx database.Tx) error {
+		var err error
+		hash, err = dbFetchUtxoStateConsistency(dbTx)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("dbFetchUtxoStateConsistency: unexpected error: %v", err)
+	}
+	return hash
+}
+
+// TestUtxoCache ensures outputs which are created and spent between flushes
+// never reach the database while all other modifications are written when the
+// cache is flushed.
+func TestUtxoCache(t *testing.T) {
+	chain, teardownFunc, err := chainSetup("utxocache",
+		&chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatalf("Failed to setup chain instance: %v", err)
+	}
+	defer teardownFunc()
+	cache := newUtxoCache(chain.db, 1<<20)
+
+	tx := btcutil.NewTx(&wire.MsgTx{
+		TxOut: []*wire.TxOut{
+			{Value: 1000, PkScript: []byte{0x51}},
+			{Value: 2000, PkScript: []byte{0x52}},
+		},
+	})
+	out0 := wire.OutPoint{Hash: *tx.Hash(), Index: 0}
+	out1 := wire.OutPoint{Hash: *tx.Hash(), Index: 1}
+	spend := func(outpoint wire.OutPoint) {
+		t.Helper()
+		view := NewUtxoViewpoint()
+		err := view.fetchUtxosMain(cache,
+			map[wire.OutPoint]struct{}{outpoint: {}})
+		if err != nil {
+			t.Fatalf("fetchUtxosMain: unexpected error: %v", err)
+		}
+		entry := view.LookupEntry(outpoint)
+		if entry == nil {
+			t.Fatalf("output %v is not available", outpoint)
+		}
+		entry.Spend()
+		cache.commit(view)
+	}
+
+	// New outputs are cached as fresh.
+	view := NewUtxoViewpoint()
+	view.AddTxOuts(tx, 100)
+	cache.commit(view)
+	for _, outpoint := range []wire.OutPoint{out0, out1} {
+		entry := cache.entries[outpoint]
+		if entry == nil || entry.packedFlags&tfFresh == 0 {
+			t.Fatalf("output %v is not cached as fresh", outpoint)
+		}
+	}
+
+	// Spending a fresh output forgets it.
+	spend(out0)
+	if _, ok := cache.entries[out0]; ok {
+		t.Fatal("spent fresh output is still cached")
+	}
+
+	// Flushing writes the remaining output and empties the cache.
+	bestHash := chainhash.Hash{0x01}
+	if err := cache.flush(&bestHash); err != nil {
+		t.Fatalf("flush: unexpected error: %v", err)
+	}
+	if len(cache.entries) != 0 || cache.size != 0 {
+		t.Fatalf("flushed cache is not empty: %d entries, size %d",
+			len(cache.entries), cache.size)
+	}
+	if dbUtxoEntry(t, chain.db, out0) != nil {
+		t.Fatal("spent fresh output was written to the database")
+	}
+	entry := dbUtxoEntry(t, chain.db, out1)
+	if entry == nil || entry.Amount() != 2000 || entry.BlockHeight() != 100 {
+		t.Fatalf("unexpected output in the database: %+v", entry)
+	}
+	if hash := dbUtxoStateConsistency(t, chain.db); *hash != bestHash {
+		t.Fatalf("got consistency hash %v, want %v", hash, bestHash)
+	}
+
+	// Spending an output loaded from the database keeps it cached until
+	// the next flush removes it from the database.
+	spend(out1)
+	entry = cache.entries[out1]
+	if entry == nil || !entry.IsSpent() || entry.packedFlags&tfFresh != 0 {
+		t.Fatalf("spent output is not cached as spent: %+v", entry)
+	}
+	view = NewUtxoViewpoint()
+	err = view.fetchUtxosMain(cache, map[wire.OutPoint]struct{}{out1: {}})
+	if err != nil {
+		t.Fatalf("fetchUtxosMain: unexpected error: %v", err)
+	}
+	if view.LookupEntry(out1) != nil {
+		t.Fatal("spent output is available")
+	}
+	if err := cache.flush(&bestHash); err != nil {
+		t.Fatalf("flush: unexpected error: %v", err)
+	}
+	if dbUtxoEntry(t, chain.db, out1) != nil {
+		t.Fatal("spent output was not removed from the database")
+	}
+}
+
+// TestUtxoCacheRecovery ensures the utxo set is recovered by replaying blocks
+// when the utxo cache was not flushed before shutting down.
+func TestUtxoCacheRecovery(t *testing.T) {
+	// (genesis block) -> 1 -> 2 -> 3 -> 4
+	//                          \-> 3a
+	blocks, err := loadBlocks("blk_0_to_4.dat.bz2")
+	if err != nil {
+		t.Fatalf("Error loading file: %v\n", err)
+	}
+	sideBlocks, err := loadBlocks("blk_3A.dat.bz2")
+	if err != nil {
+		t.Fatalf("Error loading file: %v\n", err)
+	}
+
+	chain, teardownFunc, err := chainSetup("utxocacherecovery",
+		&chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatalf("Failed to setup chain instance: %v", err)
+	}
+	defer teardownFunc()
+	chain.TstSetCoinbaseMaturity(1)
+	chain.utxoCache.maxSize = 1 << 20
+
+	for i := 1; i < len(blocks); i++ {
+		_, isOrphan, err := chain.ProcessBlock(blocks[i], BFNone)
+		if err != nil || isOrphan {
+			t.Fatalf("ProcessBlock fail on block %v: orphan %v, "+
+				"err %v", i, isOrphan, err)
+		}
+	}
+
+	// Nothing was written to the utxo set in the database yet.
+	genesisHash := chain.chainParams.GenesisHash
+	if hash := dbUtxoStateConsistency(t, chain.db); *hash != *genesisHash {
+		t.Fatalf("got consistency hash %v, want %v", hash, genesisHash)
+	}
+	coinbase := wire.OutPoint{Hash: *blocks[4].Transactions()[0].Hash()}
+	if entry, _ := chain.FetchUtxoEntry(coinbase); entry == nil {
+		t.Fatalf("output %v is not available", coinbase)
+	}
+	if dbUtxoEntry(t, chain.db, coinbase) != nil {
+		t.Fatal("output was written to the database before flushing")
+	}
+
+	var allBlocks []*btcutil.Block
+	allBlocks = append(allBlocks, blocks[1:]...)
+	allBlocks = append(allBlocks, sideBlocks...)
+
+	// restart creates a new chain instance from the database without
+	// flushing the utxo cache first, as happens after a crash, and ensures
+	// the utxo set in the database matches the passed chain instance
+	// afterwards.
+	restart := func(step string, tip *btcutil.Block) {
+		t.Helper()
+		_, err := New(&Config{
+			DB:          chain.db,
+			ChainParams: chain.chainParams,
+			TimeSource:  NewMedianTime(),
+		})
+		if err != nil {
+			t.Fatalf("%s: New: unexpected error: %v", step, err)
+		}
+		hash := dbUtxoStateConsistency(t, chain.db)
+		if *hash != *tip.Hash() {
+			t.Fatalf("%s: got consistency hash %v, want %v", step,
+				hash, tip.Hash())
+		}
+		for _, block := range allBlocks {
+			for _, tx := range block.Transactions() {
+				outpoint := wire.OutPoint{Hash: *tx.Hash()}
+				want, err := chain.FetchUtxoEntry(outpoint)
+				if err != nil {
+					t.Fatalf("%s: FetchUtxoEntry: unexpected "+
+						"error: %v", step, err)
+				}
+				got := dbUtxoEntry(t, chain.db, outpoint)
+				if (got == nil) != (want == nil) {
+					t.Fatalf("%s: output %v: got %+v, want %+v",
+						step, outpoint, got, want)
+				}
+			}
+		}
+	}
+
+	// Creating a new chain instance from the database replays the blocks
+	// since the genesis block.
+	restart("replay", blocks[4])
+
+	// Blocks which are disconnected update the block the utxo set in the
+	// database is consistent with, so it remains part of the main chain
+	// when the node crashes after invalidating the tip.
+	if _, _, err := chain.ProcessBlock(sideBlocks[0], BFNone); err != nil {
+		t.Fatalf("ProcessBlock: unexpected error: %v", err)
+	}
+	if err := chain.InvalidateBlock(blocks[4].Hash()); err != nil {
+		t.Fatalf("InvalidateBlock: unexpected error: %v", err)
+	}
+	if hash := dbUtxoStateConsistency(t, chain.db); *hash != *blocks[3].Hash() {
+		t.Fatalf("got consistency hash %v, want %v", hash,
+			blocks[3].Hash())
+	}
+	restart("invalidate tip", blocks[3])
+
+	// The same applies when the node crashes after reorganizing to a side
+	// chain, in which case the blocks after the fork point are replayed.
+	if err := chain.InvalidateBlock(blocks[3].Hash()); err != nil {
+		t.Fatalf("InvalidateBlock: unexpected error: %v", err)
+	}
+	if hash := dbUtxoStateConsistency(t, chain.db); *hash != *blocks[2].Hash() {
+		t.Fatalf("got consistency hash %v, want %v", hash,
+			blocks[2].Hash())
+	}
+	restart("reorganize", sideBlocks[0])
+}
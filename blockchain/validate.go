@@ -41,6 +41,13 @@ const (
 	// baseSubsidy is the starting subsidy amount for mined blocks.  This
 	// value is halved every SubsidyHalvingInterval blocks.
 	baseSubsidy = 50 * btcutil.SatoshiPerBitcoin
+
+	// assumeValidBurial is the amount of time the best header chain must
+	// extend past the assumed valid block, measured in blocks at the
+	// difficulty of the best header, before scripts are skipped.  This
+	// ensures the assumed valid block is part of a chain which has been
+	// built on for long enough that it is unlikely to be fake.
+	assumeValidBurial = 2 * 7 * 24 * time.Hour
 )
 
 var (
@@ -343,6 +350,13 @@ func CheckProofOfWork(block *btcutil.Block, powLimit *big.Int) error {
 	return checkProofOfWork(&block.MsgBlock().Header, powLimit, BFNone)
 }
 
+// CheckHeaderProofOfWork ensures the block header bits which indicate the
+// target difficulty is in min/max range and that the block hash is less than
+// the target difficulty as claimed.
+func CheckHeaderProofOfWork(header *wire.BlockHeader, powLimit *big.Int) error {
+	return checkProofOfWork(header, powLimit, BFNone)
+}
+
 // CountSigOps returns the number of signature operations for all transaction
 // input and output scripts in the provided transaction.  This uses the
 // quicker, but imprecise, signature operation counting mechanism from
@@ -846,7 +860,7 @@ func (b *BlockChain) checkBIP0030(node *blockNode, block *btcutil.Block, view *U
 			fetchSet[prevOut] = struct{}{}
 		}
 	}
-	err := view.fetchUtxos(b.db, fetchSet)
+	err := view.fetchUtxos(b.utxoCache, fetchSet)
 	if err != nil {
 		return err
 	}
@@ -971,6 +985,121 @@ func CheckTransactionInputs(tx *btcutil.Tx, txHeight int32, utxoView *UtxoViewpo
 	return txFeeInSatoshi, nil
 }
 
+// scriptsRequired returns whether the scripts of the block represented by the
+// passed node need to be validated.  Blocks before the latest known good
+// checkpoint are verified via the checkpoint instead and the scripts of the
+// blocks up to the assumed valid block are assumed to be valid.
+//
+// This function MUST be called with the chain state lock held (for reads).
+func (b *BlockChain) scriptsRequired(node *blockNode) bool {
+	checkpoint := b.LatestCheckpoint()
+	if checkpoint != nil && node.height <= checkpoint.Height {
+		return false
+	}
+	return !b.isAssumedValid(node)
+}
+
+// isAssumedValid returns whether the scripts of the block represented by the
+// passed node are assumed to be valid, which is the case when it is the
+// assumed valid block or one of its ancestors, the assumed valid block is
+// part of the best known header chain and buried deep enough in it, and the
+// best known header chain has at least the minimum chain work.
+//
+// This function MUST be called with the chain state lock held (for reads).
+func (b *BlockChain) isAssumedValid(node *blockNode) bool {
+	if b.assumeValid == nil {
+		return false
+	}
+
+	b.assumeValidLock.Lock()
+	defer b.assumeValidLock.Unlock()
+
+	if b.assumeValidChain == nil {
+		avNode := b.index.LookupNode(b.assumeValid)
+		if avNode == nil {
+			return false
+		}
+		b.assumeValidChain = newChainView(avNode)
+	}
+	if b.assumeValidHeader != b.bestHeader {
+		avNode := b.assumeValidChain.Tip()
+		b.assumeValidHeader = b.bestHeader
+		b.assumeValidActive = b.bestHeader != nil &&
+			b.bestHeader.Ancestor(avNode.height) == avNode &&
+			b.isAssumeValidSafe(avNode, b.bestHeader)
+	}
+	return b.assumeValidActive && b.assumeValidChain.Contains(node)
+}
+
+// isAssumeValidSafe returns whether the best header chain ending at the passed
+// best header has at least the minimum chain work and the passed assumed valid
+// block is buried under at least assumeValidBurial of work in it.
+//
+// This function MUST be called with the chain state lock held (for reads).
+func (b *BlockChain) isAssumeValidSafe(avNode, bestHeader *blockNode) bool {
+	minWork := b.chainParams.MinimumChainWork
+	if minWork != nil && bestHeader.workSum.Cmp(minWork) < 0 {
+		return false
+	}
+
+	// The work on top of the assumed valid block is measured in the time
+	// it takes to produce it at the difficulty of the best header.
+	targetTimePerBlock := int64(b.chainParams.TargetTimePerBlock)
+	burialWork := new(big.Int).Sub(bestHeader.workSum, avNode.workSum)
+	burialWork.Mul(burialWork, big.NewInt(targetTimePerBlock))
+	requiredWork := new(big.Int).Mul(CalcWork(bestHeader.bits),
+		big.NewInt(int64(assumeValidBurial)))
+	return burialWork.Cmp(requiredWork) > 0
+}
+
+// blockScriptFlags returns the script flags which are enforced when validating
+// the scripts of the block represented by the passed node.
+//
+// This function MUST be called with the chain state lock held (for reads).
+func (b *BlockChain) blockScriptFlags(node *blockNode) (txscript.ScriptFlags, error) {
+	// Blocks created after the BIP0016 activation time need to have the
+	// pay-to-script-hash checks enabled.
+	var scriptFlags txscript.ScriptFlags
+	if node.timestamp >= txscript.Bip16Activation.Unix() {
+		scriptFlags |= txscript.ScriptBip16
+	}
+
+	// Enforce DER signatures for block versions 3+ once the historical
+	// activation threshold has been reached.  This is part of BIP0066.
+	if node.version >= 3 && node.height >= b.chainParams.BIP0066Height {
+		scriptFlags |= txscript.ScriptVerifyDERSignatures
+	}
+
+	// Enforce CHECKLOCKTIMEVERIFY for block versions 4+ once the historical
+	// activation threshold has been reached.  This is part of BIP0065.
+	if node.version >= 4 && node.height >= b.chainParams.BIP0065Height {
+		scriptFlags |= txscript.ScriptVerifyCheckLockTimeVerify
+	}
+
+	// Enforce CHECKSEQUENCEVERIFY once the soft-fork deployment is fully
+	// active.
+	csvState, err := b.deploymentState(node.parent, chaincfg.DeploymentCSV)
+	if err != nil {
+		return 0, err
+	}
+	if csvState == ThresholdActive {
+		scriptFlags |= txscript.ScriptVerifyCheckSequenceVerify
+	}
+
+	// Enforce the segwit soft-fork package once the soft-fork has shifted
+	// into the "active" version bits state.
+	segwitState, err := b.deploymentState(node.parent, chaincfg.DeploymentSegwit)
+	if err != nil {
+		return 0, err
+	}
+	if segwitState == ThresholdActive {
+		scriptFlags |= txscript.ScriptVerifyWitness
+		scriptFlags |= txscript.ScriptStrictMultiSig
+	}
+
+	return scriptFlags, nil
+}
+
 // checkConnectBlock performs several checks to confirm connecting the passed
 // block to the chain represented by the passed view does not violate any rules.
 // In addition, the passed view is updated to spend all of the referenced
@@ -1042,7 +1171,7 @@ func (b *BlockChain) checkConnectBlock(node *blockNode, block *btcutil.Block, vi
 	//
 	// These utxo entries are needed for verification of things such as
 	// transaction inputs, counting pay-to-script-hashes, and scripts.
-	err := view.fetchInputUtxos(b.db, block)
+	err := view.fetchInputUtxos(b.utxoCache, block)
 	if err != nil {
 		return err
 	}
@@ -1150,47 +1279,20 @@ func (b *BlockChain) checkConnectBlock(node *blockNode, block *btcutil.Block, vi
 	// Don't run scripts if this node is before the latest known good
 	// checkpoint since the validity is verified via the checkpoints (all
 	// transactions are included in the merkle root hash and any changes
-	// will therefore be detected by the next checkpoint).  This is a huge
-	// optimization because running the scripts is the most time consuming
-	// portion of block handling.
-	checkpoint := b.LatestCheckpoint()
-	runScripts := true
-	if checkpoint != nil && node.height <= checkpoint.Height {
-		runScripts = false
-	}
-
-	// Blocks created after the BIP0016 activation time need to have the
-	// pay-to-script-hash checks enabled.
-	var scriptFlags txscript.ScriptFlags
-	if enforceBIP0016 {
-		scriptFlags |= txscript.ScriptBip16
-	}
-
-	// Enforce DER signatures for block versions 3+ once the historical
-	// activation threshold has been reached.  This is part of BIP0066.
-	blockHeader := &block.MsgBlock().Header
-	if blockHeader.Version >= 3 && node.height >= b.chainParams.BIP0066Height {
-		scriptFlags |= txscript.ScriptVerifyDERSignatures
-	}
-
-	// Enforce CHECKLOCKTIMEVERIFY for block versions 4+ once the historical
-	// activation threshold has been reached.  This is part of BIP0065.
-	if blockHeader.Version >= 4 && node.height >= b.chainParams.BIP0065Height {
-		scriptFlags |= txscript.ScriptVerifyCheckLockTimeVerify
-	}
-
-	// Enforce CHECKSEQUENCEVERIFY during all block validation checks once
-	// the soft-fork deployment is fully active.
+	// will therefore be detected by the next checkpoint).  The same
+	// applies to the ancestors of the assumed valid block when it is part
+	// of the best header chain.  This is a huge optimization because
+	// running the scripts is the most time consuming portion of block
+	// handling.
+	runScripts := b.scriptsRequired(node)
+
+	// Enforce the relative sequence number based lock-times once the CSV
+	// soft-fork deployment is fully active.
 	csvState, err := b.deploymentState(node.parent, chaincfg.DeploymentCSV)
 	if err != nil {
 		return err
 	}
 	if csvState == ThresholdActive {
-		// If the CSV soft-fork is now active, then modify the
-		// scriptFlags to ensure that the CSV op code is properly
-		// validated during the script checks bleow.
-		scriptFlags |= txscript.ScriptVerifyCheckSequenceVerify
-
 		// We obtain the MTP of the *previous* block in order to
 		// determine if transactions in the current block are final.
 		medianTime := node.parent.CalcPastMedianTime()
@@ -1218,19 +1320,16 @@ func (b *BlockChain) checkConnectBlock(node *blockNode, block *btcutil.Block, vi
 		}
 	}
 
-	// Enforce the segwit soft-fork package once the soft-fork has shifted
-	// into the "active" version bits state.
-	if enforceSegWit {
-		scriptFlags |= txscript.ScriptVerifyWitness
-		scriptFlags |= txscript.ScriptStrictMultiSig
-	}
-
 	// Now that the inexpensive checks are done and have passed, verify the
 	// transactions are actually allowed to spend the coins by running the
 	// expensive ECDSA signature check scripts.  Doing this last helps
 	// prevent CPU exhaustion attacks.
 	if runScripts {
-		err := checkBlockScripts(block, view, scriptFlags, b.sigCache,
+		scriptFlags, err := b.blockScriptFlags(node)
+		if err != nil {
+			return err
+		}
+		err = checkBlockScripts(block, view, scriptFlags, b.sigCache,
 			b.hashCache)
 		if err != nil {
 			return err
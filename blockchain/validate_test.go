@@ -6,6 +6,7 @@ package blockchain
 
 import (
 	"math"
+	"math/big"
 	"reflect"
 	"testing"
 	"time"
@@ -487,3 +488,139 @@ var Block100000 = wire.MsgBlock{
 		},
 	},
 }
+
+// TestAssumeValid ensures the scripts of the assumed valid block and its
+// ancestors are only skipped while it is part of the best header chain, buried
+// deep enough in it and the best header chain has the minimum chain work.
+func TestAssumeValid(t *testing.T) {
+	// chainedWorkNodes returns the passed number of nodes which build on
+	// the passed parent at the proof of work limit.
+	params := chaincfg.MainNetParams
+	chainedWorkNodes := func(parent *blockNode, numNodes int) []*blockNode {
+		nodes := make([]*blockNode, 0, numNodes)
+		for i := 0; i < numNodes; i++ {
+			parent = newFakeNode(parent, 1, params.PowLimitBits,
+				time.Unix(int64(i), 0))
+			nodes = append(nodes, parent)
+		}
+		return nodes
+	}
+
+	// Construct a synthetic block chain with a block index consisting of
+	// the following structure, where the assumed valid block is 4 and the
+	// main branch extends burialBlocks + 1 blocks past it.
+	// 	genesis -> 1  -> 2  -> 3  -> 4  -> ... -> 2021
+	// 	                  \-> 3a -> 4a -> 5a -> 6a
+	burialBlocks := int(assumeValidBurial / params.TargetTimePerBlock)
+	chain := newFakeChain(&params)
+	branch0Nodes := chainedWorkNodes(chain.bestChain.Genesis(),
+		5+burialBlocks)
+	branch1Nodes := chainedWorkNodes(branch0Nodes[1], 4)
+	for _, node := range append(branch0Nodes, branch1Nodes...) {
+		chain.index.AddNode(node)
+	}
+	unknownHash := chainhash.Hash{0x01}
+	bestWork := tstTip(branch0Nodes).workSum
+	aboveBestWork := new(big.Int).Add(bestWork, big.NewInt(1))
+
+	tests := []struct {
+		name        string
+		assumeValid *chainhash.Hash
+		minWork     *big.Int
+		bestHeader  *blockNode
+		node        *blockNode
+		required    bool
+	}{
+		{
+			name:       "disabled",
+			bestHeader: tstTip(branch0Nodes),
+			node:       branch0Nodes[0],
+			required:   true,
+		},
+		{
+			name:        "unknown block",
+			assumeValid: &unknownHash,
+			bestHeader:  tstTip(branch0Nodes),
+			node:        branch0Nodes[0],
+			required:    true,
+		},
+		{
+			name:        "ancestor",
+			assumeValid: &branch0Nodes[3].hash,
+			bestHeader:  tstTip(branch0Nodes),
+			node:        branch0Nodes[1],
+			required:    false,
+		},
+		{
+			name:        "assumed valid block",
+			assumeValid: &branch0Nodes[3].hash,
+			bestHeader:  tstTip(branch0Nodes),
+			node:        branch0Nodes[3],
+			required:    false,
+		},
+		{
+			name:        "descendant",
+			assumeValid: &branch0Nodes[3].hash,
+			bestHeader:  tstTip(branch0Nodes),
+			node:        branch0Nodes[4],
+			required:    true,
+		},
+		{
+			name:        "side chain",
+			assumeValid: &branch0Nodes[3].hash,
+			bestHeader:  tstTip(branch0Nodes),
+			node:        branch1Nodes[0],
+			required:    true,
+		},
+		{
+			name:        "not in best header chain",
+			assumeValid: &branch0Nodes[3].hash,
+			bestHeader:  tstTip(branch1Nodes),
+			node:        branch0Nodes[1],
+			required:    true,
+		},
+		{
+			name:        "best header chain changed back",
+			assumeValid: &branch0Nodes[3].hash,
+			bestHeader:  tstTip(branch0Nodes),
+			node:        branch0Nodes[1],
+			required:    false,
+		},
+		{
+			name:        "not buried deep enough",
+			assumeValid: &branch0Nodes[3].hash,
+			bestHeader:  branch0Nodes[3+burialBlocks],
+			node:        branch0Nodes[1],
+			required:    true,
+		},
+		{
+			name:        "minimum chain work",
+			assumeValid: &branch0Nodes[3].hash,
+			minWork:     bestWork,
+			bestHeader:  tstTip(branch0Nodes),
+			node:        branch0Nodes[1],
+			required:    false,
+		},
+		{
+			name:        "below minimum chain work",
+			assumeValid: &branch0Nodes[3].hash,
+			minWork:     aboveBestWork,
+			bestHeader:  tstTip(branch0Nodes),
+			node:        branch0Nodes[1],
+			required:    true,
+		},
+	}
+
+	for _, test := range tests {
+		params.MinimumChainWork = test.minWork
+		chain.assumeValid = test.assumeValid
+		chain.assumeValidChain = nil
+		chain.assumeValidHeader = nil
+		chain.bestHeader = test.bestHeader
+		required := chain.scriptsRequired(test.node)
+		if required != test.required {
+			t.Errorf("%s: got scripts required %v, want %v",
+				test.name, required, test.required)
+		}
+	}
+}
@@ -6,6 +6,7 @@ package blockchain
 
 import (
 	"math"
+	"strings"
 
 	"github.com/btgsuite/btgd/chaincfg"
 )
@@ -299,3 +300,26 @@ func (b *BlockChain) warnUnknownVersions(node *blockNode) error {
 
 	return nil
 }
+
+// Warnings returns a human-readable description of the warnings raised about
+// unknown rules having activated or unknown block versions being mined.  An
+// empty string is returned when there are none.
+//
+// This function is safe for concurrent access.
+func (b *BlockChain) Warnings() string {
+	b.chainLock.RLock()
+	rulesWarned := b.unknownRulesWarned
+	versionsWarned := b.unknownVersionsWarned
+	b.chainLock.RUnlock()
+
+	var warnings []string
+	if rulesWarned {
+		warnings = append(warnings, "Unknown new rules activated")
+	}
+	if versionsWarned {
+		warnings = append(warnings, "Unknown block versions are being "+
+			"mined, so new rules might be in effect.  Are you "+
+			"running the latest version of the software?")
+	}
+	return strings.Join(warnings, "  ")
+}
@@ -0,0 +1,317 @@
+// Copyright (c) 2013-2016 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcec
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"math/big"
+	"sync"
+)
+
+// ElligatorSwift encodes secp256k1 public keys as 64 bytes which are
+// indistinguishable from uniformly random data as described in BIP0324.  A
+// public key is encoded as a pair of field elements (u, t) which the XSwiftEC
+// function maps to the x coordinate of the key.
+
+// EllSwiftPubKeyLen is the length of an ElligatorSwift encoded public key.
+const EllSwiftPubKeyLen = 64
+
+// ellswiftECDHTag is the tag of the hash used to derive the shared secret of
+// an ElligatorSwift ECDH key exchange.
+const ellswiftECDHTag = "bip324_ellswift_xonly_ecdh"
+
+var (
+	// ErrEllSwiftPrivKey is returned when a private key is not a valid
+	// secp256k1 scalar.
+	ErrEllSwiftPrivKey = errors.New("invalid private key")
+
+	// ellswiftC is sqrt(-3) mod p, ellswiftC3 is (1-sqrt(-3))/2 mod p and
+	// ellswiftC4 is (1+sqrt(-3))/2 mod p.  They are computed on first use.
+	ellswiftC, ellswiftC3, ellswiftC4 *big.Int
+	ellswiftOnce                      sync.Once
+)
+
+// ellswiftField provides the modular arithmetic over the secp256k1 field used
+// by the ElligatorSwift functions.
+type ellswiftField struct {
+	p *big.Int
+}
+
+// newEllswiftField returns the secp256k1 field and initializes the constants
+// used by the ElligatorSwift functions.
+func newEllswiftField() ellswiftField {
+	f := ellswiftField{p: S256().P}
+	ellswiftOnce.Do(func() {
+		ellswiftC = f.sqrt(f.neg(big.NewInt(3)))
+		half := f.inv(big.NewInt(2))
+		ellswiftC3 = f.mul(f.sub(big.NewInt(1), ellswiftC), half)
+		ellswiftC4 = f.mul(f.add(big.NewInt(1), ellswiftC), half)
+	})
+	return f
+}
+
+func (f ellswiftField) mod(a *big.Int) *big.Int {
+	return a.Mod(a, f.p)
+}
+
+func (f ellswiftField) add(a, b *big.Int) *big.Int {
+	return f.mod(new(big.Int).Add(a, b))
+}
+
+func (f ellswiftField) sub(a, b *big.Int) *big.Int {
+	return f.mod(new(big.Int).Sub(a, b))
+}
+
+func (f ellswiftField) mul(a, b *big.Int) *big.Int {
+	return f.mod(new(big.Int).Mul(a, b))
+}
+
+func (f ellswiftField) neg(a *big.Int) *big.Int {
+	return f.mod(new(big.Int).Neg(a))
+}
+
+func (f ellswiftField) inv(a *big.Int) *big.Int {
+	return new(big.Int).ModInverse(a, f.p)
+}
+
+func (f ellswiftField) div(a, b *big.Int) *big.Int {
+	return f.mul(a, f.inv(b))
+}
+
+// sqrt returns the square root a^((p+1)/4) of a or nil when a is not a
+// square.
+func (f ellswiftField) sqrt(a *big.Int) *big.Int {
+	return new(big.Int).ModSqrt(a, f.p)
+}
+
+// putFieldBytes writes the passed value to the 32-byte buffer as a
+// big-endian number padded with leading zeros.
+func putFieldBytes(buf []byte, a *big.Int) {
+	b := a.Bytes()
+	copy(buf[32-len(b):], b)
+}
+
+// curveRHS returns x^3 + 7.
+func (f ellswiftField) curveRHS(x *big.Int) *big.Int {
+	return f.add(f.mul(f.mul(x, x), x), big.NewInt(7))
+}
+
+// isValidX returns whether x is the x coordinate of a point on the curve.
+func (f ellswiftField) isValidX(x *big.Int) bool {
+	return big.Jacobi(f.curveRHS(x), f.p) >= 0
+}
+
+// xswiftec returns the x coordinate the field elements (u, t) decode to.
+func (f ellswiftField) xswiftec(u, t *big.Int) *big.Int {
+	u, t = f.mod(new(big.Int).Set(u)), f.mod(new(big.Int).Set(t))
+	if u.Sign() == 0 {
+		u.SetInt64(1)
+	}
+	if t.Sign() == 0 {
+		t.SetInt64(1)
+	}
+	u3b := f.curveRHS(u)
+	if f.add(u3b, f.mul(t, t)).Sign() == 0 {
+		t = f.add(t, t)
+	}
+
+	x := f.div(f.sub(u3b, f.mul(t, t)), f.add(t, t))
+	y := f.div(f.add(x, t), f.mul(ellswiftC, u))
+
+	// x3 = u + 4*Y^2
+	x3 := f.add(u, f.mul(big.NewInt(4), f.mul(y, y)))
+	if f.isValidX(x3) {
+		return x3
+	}
+
+	// x2 = (-X/Y - u)/2
+	half := f.inv(big.NewInt(2))
+	xy := f.div(x, y)
+	x2 := f.mul(f.sub(f.neg(xy), u), half)
+	if f.isValidX(x2) {
+		return x2
+	}
+
+	// x1 = (X/Y - u)/2
+	return f.mul(f.sub(xy, u), half)
+}
+
+// xswiftecInv returns a field element t such that xswiftec(u, t) = x or nil
+// if no such t exists for the selected case.  The case in [0, 8) selects
+// which of the up to 8 preimages is returned.
+func (f ellswiftField) xswiftecInv(x, u *big.Int, c int) *big.Int {
+	var s, v *big.Int
+	if c&2 == 0 {
+		// Encodings for which -x-u is a valid x coordinate decode to a
+		// different x coordinate since the x3 formula has priority.
+		if f.isValidX(f.sub(f.neg(x), u)) {
+			return nil
+		}
+		v = x
+		s = f.div(f.neg(f.curveRHS(u)),
+			f.add(f.add(f.mul(u, u), f.mul(u, v)), f.mul(v, v)))
+	} else {
+		s = f.sub(x, u)
+		if s.Sign() == 0 {
+			return nil
+		}
+		q := f.add(f.mul(big.NewInt(4), f.curveRHS(u)),
+			f.mul(big.NewInt(3), f.mul(s, f.mul(u, u))))
+		r := f.sqrt(f.neg(f.mul(s, q)))
+		if r == nil {
+			return nil
+		}
+		if c&1 == 1 && r.Sign() == 0 {
+			return nil
+		}
+		v = f.mul(f.sub(f.div(r, s), u), f.inv(big.NewInt(2)))
+	}
+
+	// Without c&2 the case selects the x1 (c&1 = 0) or x2 (c&1 = 1)
+	// formula, otherwise it selects the sign of X/Y for the x3 formula.
+	// The sign of t is selected by c&4.
+	w := f.sqrt(s)
+	if w == nil {
+		return nil
+	}
+	switch c & 5 {
+	case 0:
+		return f.neg(f.mul(w, f.add(f.mul(ellswiftC3, u), v)))
+	case 1:
+		return f.mul(w, f.add(f.mul(ellswiftC4, u), v))
+	case 4:
+		return f.mul(w, f.add(f.mul(ellswiftC3, u), v))
+	default:
+		return f.neg(f.mul(w, f.add(f.mul(ellswiftC4, u), v)))
+	}
+}
+
+// XSwiftEC returns the x coordinate of the point the ElligatorSwift encoding
+// (u, t) decodes to.  The field elements are 32-byte big-endian values which
+// are reduced modulo the field prime.
+func XSwiftEC(u, t *[32]byte) [32]byte {
+	f := newEllswiftField()
+	x := f.xswiftec(new(big.Int).SetBytes(u[:]), new(big.Int).SetBytes(t[:]))
+	var out [32]byte
+	putFieldBytes(out[:], x)
+	return out
+}
+
+// XSwiftECInv returns t such that XSwiftEC(u, t) decodes to x.  The case in
+// [0, 8) selects which of the up to 8 preimages is returned.  False is
+// returned if no preimage exists for the case.
+func XSwiftECInv(x, u *[32]byte, c int) ([32]byte, bool) {
+	f := newEllswiftField()
+	var out [32]byte
+	t := f.xswiftecInv(new(big.Int).SetBytes(x[:]),
+		new(big.Int).SetBytes(u[:]), c)
+	if t == nil {
+		return out, false
+	}
+	putFieldBytes(out[:], t)
+	return out, true
+}
+
+// EllSwiftDecode returns the public key encoded by the passed ElligatorSwift
+// encoding.  The y coordinate of the key has the same parity as t.
+func EllSwiftDecode(enc *[EllSwiftPubKeyLen]byte) *PublicKey {
+	curve := S256()
+	f := newEllswiftField()
+	u := new(big.Int).SetBytes(enc[:32])
+	t := new(big.Int).SetBytes(enc[32:])
+	x := f.xswiftec(u, t)
+	y := f.sqrt(f.curveRHS(x))
+	if isOdd(y) != isOdd(f.mod(t)) {
+		y = f.neg(y)
+	}
+	return &PublicKey{Curve: curve, X: x, Y: y}
+}
+
+// EllSwiftEncode returns a randomized ElligatorSwift encoding of the passed
+// public key.
+func EllSwiftEncode(pubKey *PublicKey) ([EllSwiftPubKeyLen]byte, error) {
+	f := newEllswiftField()
+	var enc [EllSwiftPubKeyLen]byte
+	var rnd [33]byte
+	for {
+		if _, err := rand.Read(rnd[:]); err != nil {
+			return enc, err
+		}
+		u := f.mod(new(big.Int).SetBytes(rnd[:32]))
+		if u.Sign() == 0 {
+			continue
+		}
+		t := f.xswiftecInv(pubKey.X, u, int(rnd[32]&7))
+		if t == nil {
+			continue
+		}
+		if isOdd(t) != isOdd(pubKey.Y) {
+			t = f.neg(t)
+		}
+		putFieldBytes(enc[:32], u)
+		putFieldBytes(enc[32:], t)
+		return enc, nil
+	}
+}
+
+// NewEllSwiftPrivateKey generates a private key along with a randomized
+// ElligatorSwift encoding of its public key.
+func NewEllSwiftPrivateKey() (*PrivateKey, [EllSwiftPubKeyLen]byte, error) {
+	priv, err := NewPrivateKey(S256())
+	if err != nil {
+		return nil, [EllSwiftPubKeyLen]byte{}, err
+	}
+	enc, err := EllSwiftEncode(priv.PubKey())
+	if err != nil {
+		return nil, [EllSwiftPubKeyLen]byte{}, err
+	}
+	return priv, enc, nil
+}
+
+// EllSwiftECDHXOnly returns the x coordinate of the product of the private
+// key and the public key encoded by the passed ElligatorSwift encoding.
+func EllSwiftECDHXOnly(theirs *[EllSwiftPubKeyLen]byte,
+	priv *PrivateKey) ([32]byte, error) {
+
+	var out [32]byte
+	if priv.D.Sign() <= 0 || priv.D.Cmp(S256().N) >= 0 {
+		return out, ErrEllSwiftPrivKey
+	}
+	pub := EllSwiftDecode(theirs)
+	var k [32]byte
+	putFieldBytes(k[:], priv.D)
+	x, _ := S256().ScalarMult(pub.X, pub.Y, k[:])
+	putFieldBytes(out[:], x)
+	return out, nil
+}
+
+// V2ECDH returns the shared secret of the BIP0324 key exchange between the
+// passed private key, whose ElligatorSwift encoded public key is ours, and the
+// ElligatorSwift encoded public key of the other party.  Initiating specifies
+// whether we initiated the connection.
+func V2ECDH(priv *PrivateKey, theirs, ours *[EllSwiftPubKeyLen]byte,
+	initiating bool) ([32]byte, error) {
+
+	x, err := EllSwiftECDHXOnly(theirs, priv)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	initiator, responder := theirs, ours
+	if initiating {
+		initiator, responder = ours, theirs
+	}
+	tag := sha256.Sum256([]byte(ellswiftECDHTag))
+	h := sha256.New()
+	h.Write(tag[:])
+	h.Write(tag[:])
+	h.Write(initiator[:])
+	h.Write(responder[:])
+	h.Write(x[:])
+	var secret [32]byte
+	copy(secret[:], h.Sum(nil))
+	return secret, nil
+}
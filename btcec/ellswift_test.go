@@ -0,0 +1,301 @@
+// Copyright (c) 2013-2016 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcec
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"math/big"
+	"testing"
+)
+
+// TestXSwiftEC ensures ElligatorSwift encodings decode to the expected x
+// coordinates.
+func TestXSwiftEC(t *testing.T) {
+	tests := []struct {
+		name string
+		enc  string
+		x    string
+	}{{
+		// u and t of zero are both replaced with one.  This and the
+		// following vectors up to the field reductions are from the
+		// BIP0324 ellswift decoding test vectors.
+		name: "zero",
+		enc: "000000000000000000000000000000000000000000000000000000" +
+			"000000000000000000000000000000000000000000000000000000" +
+			"00000000000000000000",
+		x: "edd1fd3e327ce90cc7a3542614289aee9682003e9cf7dcc9cf2ca97" +
+			"43be5aa0c",
+	}, {
+		name: "zero u 1",
+		enc: "000000000000000000000000000000000000000000000000000000" +
+			"000000000001d3475bf7655b0fb2d852921035b2ef607f49069b974" +
+			"54e6795251062741771",
+		x: "b5da00b73cd6560520e7c364086e7cd23a34bf60d0e707be9fc34d4" +
+			"cd5fdfa2c",
+	}, {
+		name: "zero u 2",
+		enc: "000000000000000000000000000000000000000000000000000000" +
+			"000000000082277c4a71f9d22e66ece523f8fa08741a7c0912c66a6" +
+			"9ce68514bfd3515b49f",
+		x: "f482f2e241753ad0fb89150d8491dc1e34ff0b8acfbb442cfe999e2" +
+			"e5e6fd1d2",
+	}, {
+		name: "zero u 3",
+		enc: "000000000000000000000000000000000000000000000000000000" +
+			"00000000008421cc930e77c9f514b6915c3dbe2a94c6d8f690b5b73" +
+			"9864ba6789fb8a55dd0",
+		x: "9f59c40275f5085a006f05dae77eb98c6fd0db1ab4a72ac47eae90a" +
+			"4fc9e57e0",
+	}, {
+		name: "zero u 4",
+		enc: "000000000000000000000000000000000000000000000000000000" +
+			"0000000000bde70df51939b94c9c24979fa7dd04ebd9b3572da7802" +
+			"290438af2a681895441",
+		x: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa" +
+			"9fffffd6b",
+	}, {
+		name: "zero u 5",
+		enc: "000000000000000000000000000000000000000000000000000000" +
+			"0000000000d19c182d2759cd99824228d94799f8c6557c38a1c0d67" +
+			"79b9d4b729c6f1ccc42",
+		x: "70720db7e238d04121f5b1afd8cc5ad9d18944c6bdc94881f502b7a" +
+			"3af3aecff",
+	}, {
+		// Field elements equal to the prime reduce to zero, which is
+		// replaced with one.
+		name: "t is prime",
+		enc: "000000000000000000000000000000000000000000000000000000" +
+			"0000000000fffffffffffffffffffffffffffffffffffffffffffff" +
+			"ffffffffffefffffc2f",
+		x: "edd1fd3e327ce90cc7a3542614289aee9682003e9cf7dcc9cf2ca97" +
+			"43be5aa0c",
+	}, {
+		name: "u is prime",
+		enc: "fffffffffffffffffffffffffffffffffffffffffffffffffffff" +
+			"ffefffffc2f0000000000000000000000000000000000000000000" +
+			"000000000000000000000",
+		x: "edd1fd3e327ce90cc7a3542614289aee9682003e9cf7dcc9cf2ca97" +
+			"43be5aa0c",
+	}}
+	for _, test := range tests {
+		enc, _ := hex.DecodeString(test.enc)
+		var u, tt [32]byte
+		copy(u[:], enc[:32])
+		copy(tt[:], enc[32:])
+		x := XSwiftEC(&u, &tt)
+		if got := hex.EncodeToString(x[:]); got != test.x {
+			t.Errorf("%s: got x %s, want %s", test.name, got, test.x)
+		}
+	}
+
+	// The square root of -3 used by the mapping must match the constant
+	// used by other implementations.
+	newEllswiftField()
+	want := "a2d2ba93507f1df233770c2a797962cc61f6d15da14ecd47d8d27ae1cd5f852"
+	if got := ellswiftC.Text(16); got != want {
+		t.Errorf("sqrt(-3): got %s, want %s", got, want)
+	}
+}
+
+// TestXSwiftECInv ensures XSwiftECInv returns the expected preimage for each
+// case and every preimage it finds decodes back to the original x coordinate.
+func TestXSwiftECInv(t *testing.T) {
+	// The vector is from the BIP0324 xswiftec_inv test vectors.  Empty
+	// preimages indicate cases without a preimage.
+	tests := []struct {
+		u     string
+		x     string
+		cases [8]string
+	}{{
+		u: "05ff6bdad900fc3261bc7fe34e2fb0f569f06e091ae437d3a52e9da0c" +
+			"bfb9590",
+		x: "80cdf63774ec7022c89a5a8558e373a279170285e0ab27412dbce510b" +
+			"dfe23fc",
+		cases: [8]string{
+			"", "",
+			"45654798ece071ba79286d04f7f3eb1c3f1d17dd883610f2ad2efd82a287466b",
+			"0aeaa886f6b76c7158452418cbf5033adc5747e9e9b5d3b2303db96936528557",
+			"", "",
+			"ba9ab867131f8e4586d792fb080c14e3c0e2e82277c9ef0d52d1027c5d78b5c4",
+			"f51557790948938ea7badbe7340afcc523a8b816164a2c4dcfc24695c9ad76d8",
+		},
+	}}
+	for i, test := range tests {
+		var u, x [32]byte
+		ub, _ := hex.DecodeString(test.u)
+		xb, _ := hex.DecodeString(test.x)
+		copy(u[:], ub)
+		copy(x[:], xb)
+		for c, want := range test.cases {
+			tt, ok := XSwiftECInv(&x, &u, c)
+			got := ""
+			if ok {
+				got = hex.EncodeToString(tt[:])
+			}
+			if got != want {
+				t.Errorf("#%d case %d: got t %q, want %q", i, c,
+					got, want)
+			}
+		}
+	}
+
+	curve := S256()
+	var found int
+	for i := 0; i < 32; i++ {
+		priv, err := NewPrivateKey(curve)
+		if err != nil {
+			t.Fatalf("NewPrivateKey: unexpected error: %v", err)
+		}
+		var x, u [32]byte
+		putFieldBytes(x[:], priv.PublicKey.X)
+		if _, err := rand.Read(u[:]); err != nil {
+			t.Fatalf("rand.Read: unexpected error: %v", err)
+		}
+		for c := 0; c < 8; c++ {
+			tt, ok := XSwiftECInv(&x, &u, c)
+			if !ok {
+				continue
+			}
+			found++
+			if got := XSwiftEC(&u, &tt); got != x {
+				t.Fatalf("case %d: got x %x, want %x", c, got, x)
+			}
+		}
+	}
+	if found == 0 {
+		t.Fatal("XSwiftECInv: no preimages found")
+	}
+}
+
+// TestEllSwiftECDHVectors ensures the shared secrets of the key exchanges of
+// the BIP0324 packet encoding test vectors are derived.
+func TestEllSwiftECDHVectors(t *testing.T) {
+	tests := []struct {
+		priv       string
+		ours       string
+		theirs     string
+		initiating bool
+		secret     string
+	}{{
+		priv: "61062ea5071d800bbfd59e2e8b53d47d194b095ae5a4df04936b4977" +
+			"2ef0d4d7",
+		ours: "ec0adff257bbfe500c188c80b4fdd640f6b45a482bbc15fc7cef5931" +
+			"deff0aa186f6eb9bba7b85dc4dcc28b28722de1e3d9108b985e29670" +
+			"45668f66098e475b",
+		theirs: "a4a94dfce69b4a2a0a099313d10f9f7e7d649d60501c9e1d274c30" +
+			"0e0d89aafaffffffffffffffffffffffffffffffffffffffffffffff" +
+			"ffffffffff8faf88d5",
+		initiating: true,
+		secret: "c6992a117f5edbea70c3f511d32d26b9798be4b81a62eaee1a5aca" +
+			"a8459a3592",
+	}, {
+		priv: "1f9c581b35231838f0f17cf0c979835baccb7f3abbbb96ffcc318ab7" +
+			"1e6e126f",
+		ours: "a1855e10e94e00baa23041d916e259f7044e491da6171269694763f0" +
+			"18c7e63693d29575dcb464ac816baa1be353ba12e3876cba7628bd0b" +
+			"d8e755e721eb0140",
+		theirs: "ffffffffffffffffffffffffffffffffffffffffffffffffffffff" +
+			"fefffffc2f000000000000000000000000000000000000000000000" +
+			"00000000000000000000",
+		initiating: false,
+		secret: "a0138f564f74d0ad70bc337dacc9d0bf1d2349364caf1188a1e6e8" +
+			"ddb3b7b184",
+	}, {
+		priv: "6c77432d1fda31e9f942f8af44607e10f3ad38a65f8a4bddae823e5e" +
+			"ff90dc38",
+		ours: "d2685070c1e6376e633e825296634fd461fa9e5bdf2109bcebd735e5" +
+			"a91f3e587c5cb782abb797fbf6bb5074fd1542a474f2a45b673763ec" +
+			"2db7fb99b737bbb9",
+		theirs: "56bd0c06f10352c3a1a9f4b4c92f6fa2b26df124b57878353c1fc6" +
+			"91c51abea77c8817daeeb9fa546b77c8daf79d89b22b0e1b87574ece" +
+			"42371f00237aa9d83a",
+		initiating: false,
+		secret: "1918b741ef5f9d1d7670b050c152b4a4ead2c31be9aecb0681c0cd" +
+			"4324150853",
+	}}
+	curve := S256()
+	for i, test := range tests {
+		d, _ := hex.DecodeString(test.priv)
+		priv, pub := PrivKeyFromBytes(curve, d)
+		var ours, theirs [EllSwiftPubKeyLen]byte
+		oursBytes, _ := hex.DecodeString(test.ours)
+		theirsBytes, _ := hex.DecodeString(test.theirs)
+		copy(ours[:], oursBytes)
+		copy(theirs[:], theirsBytes)
+
+		// The encoding of our public key is x-only.
+		if got := EllSwiftDecode(&ours); got.X.Cmp(pub.X) != 0 {
+			t.Errorf("#%d: got x %x, want %x", i, got.X, pub.X)
+		}
+		secret, err := V2ECDH(priv, &theirs, &ours, test.initiating)
+		if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+			continue
+		}
+		if got := hex.EncodeToString(secret[:]); got != test.secret {
+			t.Errorf("#%d: got secret %s, want %s", i, got,
+				test.secret)
+		}
+	}
+}
+
+// TestEllSwiftECDH ensures encoded public keys decode to the original key and
+// both parties of a key exchange derive the same shared secret.
+func TestEllSwiftECDH(t *testing.T) {
+	privA, encA, err := NewEllSwiftPrivateKey()
+	if err != nil {
+		t.Fatalf("NewEllSwiftPrivateKey: unexpected error: %v", err)
+	}
+	privB, encB, err := NewEllSwiftPrivateKey()
+	if err != nil {
+		t.Fatalf("NewEllSwiftPrivateKey: unexpected error: %v", err)
+	}
+
+	// Encodings are randomized, but always decode to the same key.
+	encA2, err := EllSwiftEncode(privA.PubKey())
+	if err != nil {
+		t.Fatalf("EllSwiftEncode: unexpected error: %v", err)
+	}
+	if encA == encA2 {
+		t.Error("EllSwiftEncode: encodings are not randomized")
+	}
+	for _, enc := range [][64]byte{encA, encA2} {
+		pub := EllSwiftDecode(&enc)
+		if !pub.IsEqual(privA.PubKey()) {
+			t.Errorf("EllSwiftDecode: got %x, want %x",
+				pub.SerializeCompressed(),
+				privA.PubKey().SerializeCompressed())
+		}
+	}
+
+	secretA, err := V2ECDH(privA, &encB, &encA, true)
+	if err != nil {
+		t.Fatalf("V2ECDH: unexpected error: %v", err)
+	}
+	secretB, err := V2ECDH(privB, &encA, &encB, false)
+	if err != nil {
+		t.Fatalf("V2ECDH: unexpected error: %v", err)
+	}
+	if secretA != secretB {
+		t.Fatalf("V2ECDH: secrets differ: %x != %x", secretA, secretB)
+	}
+
+	// The shared secret commits to the roles of the parties.
+	secretC, err := V2ECDH(privB, &encA, &encB, true)
+	if err != nil {
+		t.Fatalf("V2ECDH: unexpected error: %v", err)
+	}
+	if bytes.Equal(secretA[:], secretC[:]) {
+		t.Fatal("V2ECDH: secret does not depend on the initiator")
+	}
+
+	// Invalid private keys are rejected.
+	bad := &PrivateKey{D: new(big.Int)}
+	if _, err := V2ECDH(bad, &encA, &encB, true); err != ErrEllSwiftPrivKey {
+		t.Fatalf("V2ECDH: got %v, want %v", err, ErrEllSwiftPrivKey)
+	}
+}
@@ -112,6 +112,7 @@ type GetBlockChainInfoResult struct {
 	Pruned               bool                                `json:"pruned"`
 	PruneHeight          int32                               `json:"pruneheight,omitempty"`
 	ChainWork            string                              `json:"chainwork,omitempty"`
+	StaleTip             bool                                `json:"staletip"`
 	SoftForks            []*SoftForkDescription              `json:"softforks"`
 	Bip9SoftForks        map[string]*Bip9SoftForkDescription `json:"bip9_softforks"`
 }
@@ -175,23 +176,47 @@ type GetBlockTemplateResult struct {
 	RejectReasion string   `json:"reject-reason,omitempty"`
 }
 
+// GetChainTipsResult models the data returned from the getchaintips command.
+type GetChainTipsResult struct {
+	Height    int32  `json:"height"`
+	Hash      string `json:"hash"`
+	BranchLen int32  `json:"branchlen"`
+	Status    string `json:"status"`
+}
+
+// MempoolFees models the fees of a transaction in the memory pool returned
+// from the getmempoolentry, getmempoolancestors and getmempooldescendants
+// commands.
+type MempoolFees struct {
+	Base       float64 `json:"base"`
+	Modified   float64 `json:"modified"`
+	Ancestor   float64 `json:"ancestor"`
+	Descendant float64 `json:"descendant"`
+}
+
 // GetMempoolEntryResult models the data returned from the getmempoolentry
-// command.
+// command and the verbose getmempoolancestors and getmempooldescendants
+// commands.
 type GetMempoolEntryResult struct {
-	Size             int32    `json:"size"`
-	Fee              float64  `json:"fee"`
-	ModifiedFee      float64  `json:"modifiedfee"`
-	Time             int64    `json:"time"`
-	Height           int64    `json:"height"`
-	StartingPriority float64  `json:"startingpriority"`
-	CurrentPriority  float64  `json:"currentpriority"`
-	DescendantCount  int64    `json:"descendantcount"`
-	DescendantSize   int64    `json:"descendantsize"`
-	DescendantFees   float64  `json:"descendantfees"`
-	AncestorCount    int64    `json:"ancestorcount"`
-	AncestorSize     int64    `json:"ancestorsize"`
-	AncestorFees     float64  `json:"ancestorfees"`
-	Depends          []string `json:"depends"`
+	Size              int32       `json:"size"`
+	Vsize             int32       `json:"vsize"`
+	Weight            int32       `json:"weight"`
+	Fee               float64     `json:"fee"`
+	ModifiedFee       float64     `json:"modifiedfee"`
+	Time              int64       `json:"time"`
+	Height            int64       `json:"height"`
+	StartingPriority  float64     `json:"startingpriority"`
+	CurrentPriority   float64     `json:"currentpriority"`
+	DescendantCount   int64       `json:"descendantcount"`
+	DescendantSize    int64       `json:"descendantsize"`
+	DescendantFees    float64     `json:"descendantfees"`
+	AncestorCount     int64       `json:"ancestorcount"`
+	AncestorSize      int64       `json:"ancestorsize"`
+	AncestorFees      float64     `json:"ancestorfees"`
+	Fees              MempoolFees `json:"fees"`
+	Depends           []string    `json:"depends"`
+	SpentBy           []string    `json:"spentby"`
+	BIP125Replaceable bool        `json:"bip125-replaceable"`
 }
 
 // GetMempoolInfoResult models the data returned from the getmempoolinfo
@@ -228,6 +253,8 @@ type GetNetworkInfoResult struct {
 	LocalRelay      bool                   `json:"localrelay"`
 	TimeOffset      int64                  `json:"timeoffset"`
 	Connections     int32                  `json:"connections"`
+	ConnectionsIn   int32                  `json:"connections_in"`
+	ConnectionsOut  int32                  `json:"connections_out"`
 	NetworkActive   bool                   `json:"networkactive"`
 	Networks        []NetworksResult       `json:"networks"`
 	RelayFee        float64                `json:"relayfee"`
@@ -238,27 +265,29 @@ type GetNetworkInfoResult struct {
 
 // GetPeerInfoResult models the data returned from the getpeerinfo command.
 type GetPeerInfoResult struct {
-	ID             int32   `json:"id"`
-	Addr           string  `json:"addr"`
-	AddrLocal      string  `json:"addrlocal,omitempty"`
-	Services       string  `json:"services"`
-	RelayTxes      bool    `json:"relaytxes"`
-	LastSend       int64   `json:"lastsend"`
-	LastRecv       int64   `json:"lastrecv"`
-	BytesSent      uint64  `json:"bytessent"`
-	BytesRecv      uint64  `json:"bytesrecv"`
-	ConnTime       int64   `json:"conntime"`
-	TimeOffset     int64   `json:"timeoffset"`
-	PingTime       float64 `json:"pingtime"`
-	PingWait       float64 `json:"pingwait,omitempty"`
-	Version        uint32  `json:"version"`
-	SubVer         string  `json:"subver"`
-	Inbound        bool    `json:"inbound"`
-	StartingHeight int32   `json:"startingheight"`
-	CurrentHeight  int32   `json:"currentheight,omitempty"`
-	BanScore       int32   `json:"banscore"`
-	FeeFilter      int64   `json:"feefilter"`
-	SyncNode       bool    `json:"syncnode"`
+	ID             int32    `json:"id"`
+	Addr           string   `json:"addr"`
+	AddrLocal      string   `json:"addrlocal,omitempty"`
+	Services       string   `json:"services"`
+	RelayTxes      bool     `json:"relaytxes"`
+	LastSend       int64    `json:"lastsend"`
+	LastRecv       int64    `json:"lastrecv"`
+	BytesSent      uint64   `json:"bytessent"`
+	BytesRecv      uint64   `json:"bytesrecv"`
+	ConnTime       int64    `json:"conntime"`
+	TimeOffset     int64    `json:"timeoffset"`
+	PingTime       float64  `json:"pingtime"`
+	PingWait       float64  `json:"pingwait,omitempty"`
+	Version        uint32   `json:"version"`
+	SubVer         string   `json:"subver"`
+	Inbound        bool     `json:"inbound"`
+	StartingHeight int32    `json:"startingheight"`
+	CurrentHeight  int32    `json:"currentheight,omitempty"`
+	BanScore       int32    `json:"banscore"`
+	FeeFilter      int64    `json:"feefilter"`
+	SyncNode       bool     `json:"syncnode"`
+	MappedAS       uint32   `json:"mapped_as,omitempty"`
+	Permissions    []string `json:"permissions"`
 }
 
 // GetRawMempoolVerboseResult models the data returned from the getrawmempool
@@ -269,6 +298,7 @@ type GetRawMempoolVerboseResult struct {
 	Vsize            int32    `json:"vsize"`
 	Weight           int32    `json:"weight"`
 	Fee              float64  `json:"fee"`
+	ModifiedFee      float64  `json:"modifiedfee"`
 	Time             int64    `json:"time"`
 	Height           int64    `json:"height"`
 	StartingPriority float64  `json:"startingpriority"`
@@ -276,6 +306,16 @@ type GetRawMempoolVerboseResult struct {
 	Depends          []string `json:"depends"`
 }
 
+// ListBannedResult models the data returned from the listbanned command.
+type ListBannedResult struct {
+	Address       string `json:"address"`
+	BanCreated    int64  `json:"ban_created"`
+	BannedUntil   int64  `json:"banned_until"`
+	BanDuration   int64  `json:"ban_duration"`
+	TimeRemaining int64  `json:"time_remaining"`
+	BanReason     string `json:"ban_reason"`
+}
+
 // ScriptPubKeyResult models the scriptPubKey data of a tx script.  It is
 // defined separately since it is used by multiple commands.
 type ScriptPubKeyResult struct {
@@ -295,11 +335,24 @@ type GetTxOutResult struct {
 	Coinbase      bool               `json:"coinbase"`
 }
 
+// UploadTarget models the uploadtarget field of the getnettotals command.
+type UploadTarget struct {
+	TimeFrame             int64  `json:"timeframe"`
+	Target                uint64 `json:"target"`
+	TargetReached         bool   `json:"target_reached"`
+	ServeHistoricalBlocks bool   `json:"serve_historical_blocks"`
+	BytesLeftInCycle      uint64 `json:"bytes_left_in_cycle"`
+	TimeLeftInCycle       int64  `json:"time_left_in_cycle"`
+}
+
 // GetNetTotalsResult models the data returned from the getnettotals command.
 type GetNetTotalsResult struct {
-	TotalBytesRecv uint64 `json:"totalbytesrecv"`
-	TotalBytesSent uint64 `json:"totalbytessent"`
-	TimeMillis     int64  `json:"timemillis"`
+	TotalBytesRecv       uint64       `json:"totalbytesrecv"`
+	TotalBytesSent       uint64       `json:"totalbytessent"`
+	TimeMillis           int64        `json:"timemillis"`
+	InboundIPRejected    uint64       `json:"inboundiprejected"`
+	InboundGroupRejected uint64       `json:"inboundgrouprejected"`
+	UploadTarget         UploadTarget `json:"uploadtarget"`
 }
 
 // ScriptSig models a signature script.  It is defined separately since it only
@@ -547,6 +600,24 @@ type TxRawDecodeResult struct {
 	Vout     []Vout `json:"vout"`
 }
 
+// TestMempoolAcceptFees models the fees field of the results returned by the
+// testmempoolaccept command.
+type TestMempoolAcceptFees struct {
+	Base float64 `json:"base"`
+}
+
+// TestMempoolAcceptResult models the data returned for each transaction by the
+// testmempoolaccept command.
+type TestMempoolAcceptResult struct {
+	Txid          string                 `json:"txid"`
+	Wtxid         string                 `json:"wtxid"`
+	Allowed       bool                   `json:"allowed"`
+	Vsize         int32                  `json:"vsize,omitempty"`
+	Fees          *TestMempoolAcceptFees `json:"fees,omitempty"`
+	RejectReason  string                 `json:"reject-reason,omitempty"`
+	RejectDetails string                 `json:"reject-details,omitempty"`
+}
+
 // ValidateAddressChainResult models the data returned by the chain server
 // validateaddress command.
 type ValidateAddressChainResult struct {
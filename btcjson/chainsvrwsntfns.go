@@ -31,6 +31,12 @@ const (
 	// disconnected.
 	FilteredBlockDisconnectedNtfnMethod = "filteredblockdisconnected"
 
+	// DeepReorgNtfnMethod is the method used for notifications from the
+	// chain server that a side chain with more work than the main chain
+	// was not activated because it forks deeper than the maximum
+	// reorganization depth.
+	DeepReorgNtfnMethod = "deepreorg"
+
 	// RecvTxNtfnMethod is the legacy, deprecated method used for
 	// notifications from the chain server that a transaction which pays to
 	// a registered address has been processed.
@@ -153,6 +159,27 @@ func NewFilteredBlockDisconnectedNtfn(height int32, header string) *FilteredBloc
 	}
 }
 
+// DeepReorgNtfn defines the deepreorg JSON-RPC notification.
+type DeepReorgNtfn struct {
+	ForkHash   string
+	ForkHeight int32
+	TipHash    string
+	TipHeight  int32
+	Depth      int32
+}
+
+// NewDeepReorgNtfn returns a new instance which can be used to issue a
+// deepreorg JSON-RPC notification.
+func NewDeepReorgNtfn(forkHash string, forkHeight int32, tipHash string, tipHeight int32, depth int32) *DeepReorgNtfn {
+	return &DeepReorgNtfn{
+		ForkHash:   forkHash,
+		ForkHeight: forkHeight,
+		TipHash:    tipHash,
+		TipHeight:  tipHeight,
+		Depth:      depth,
+	}
+}
+
 // BlockDetails describes details of a tx in a block.
 type BlockDetails struct {
 	Height int32  `json:"height"`
@@ -294,6 +321,7 @@ func init() {
 	MustRegisterCmd(BlockDisconnectedNtfnMethod, (*BlockDisconnectedNtfn)(nil), flags)
 	MustRegisterCmd(FilteredBlockConnectedNtfnMethod, (*FilteredBlockConnectedNtfn)(nil), flags)
 	MustRegisterCmd(FilteredBlockDisconnectedNtfnMethod, (*FilteredBlockDisconnectedNtfn)(nil), flags)
+	MustRegisterCmd(DeepReorgNtfnMethod, (*DeepReorgNtfn)(nil), flags)
 	MustRegisterCmd(RecvTxNtfnMethod, (*RecvTxNtfn)(nil), flags)
 	MustRegisterCmd(RedeemingTxNtfnMethod, (*RedeemingTxNtfn)(nil), flags)
 	MustRegisterCmd(RescanFinishedNtfnMethod, (*RescanFinishedNtfn)(nil), flags)
@@ -88,6 +88,23 @@ func TestChainSvrWsNtfns(t *testing.T) {
 				Header: "header",
 			},
 		},
+		{
+			name: "deepreorg",
+			newNtfn: func() (interface{}, error) {
+				return btcjson.NewCmd("deepreorg", "123", 100000, "456", 100007, 6)
+			},
+			staticNtfn: func() interface{} {
+				return btcjson.NewDeepReorgNtfn("123", 100000, "456", 100007, 6)
+			},
+			marshalled: `{"jsonrpc":"1.0","method":"deepreorg","params":["123",100000,"456",100007,6],"id":null}`,
+			unmarshalled: &btcjson.DeepReorgNtfn{
+				ForkHash:   "123",
+				ForkHeight: 100000,
+				TipHash:    "456",
+				TipHeight:  100007,
+				Depth:      6,
+			},
+		},
 		{
 			name: "recvtx",
 			newNtfn: func() (interface{}, error) {
@@ -181,6 +181,19 @@ type Params struct {
 	// Checkpoints ordered from oldest to newest.
 	Checkpoints []Checkpoint
 
+	// AssumeValid is the hash of a block whose ancestors are assumed to
+	// have valid scripts when it is part of the best known header chain.
+	// Unlike checkpoints, it does not affect which chain is selected and
+	// all other rules are still enforced.  It is nil when script
+	// validation is never skipped.
+	AssumeValid *chainhash.Hash
+
+	// MinimumChainWork is the amount of work the best chain is known to
+	// have at least.  The headers of chains with less work are not stored
+	// in the block index, which prevents low-work header spam during the
+	// initial sync.  It is nil when there is no known minimum.
+	MinimumChainWork *big.Int
+
 	// These fields are related to voting on consensus rule changes as
 	// defined by BIP0009.
 	//
@@ -280,6 +293,13 @@ var MainNetParams = Params{
 		{537000, newHashFromStr("00000001ec9a914fbedbdf9bb8d1a908a56c2f9d5133361dbcec4d6e1e127afb")},
 	},
 
+	// Block 537000.  It should be moved forward with each release.
+	AssumeValid: newHashFromStr("00000001ec9a914fbedbdf9bb8d1a908a56c2f9d5133361dbcec4d6e1e127afb"),
+
+	// The minimum chain work is not known yet.  Until it is, the headers
+	// of chains which do not include the latest checkpoint are not stored.
+	MinimumChainWork: nil,
+
 	// Consensus rule change deployments.
 	//
 	// The miner confirmation window is defined as:
@@ -372,6 +392,13 @@ var RegressionNetParams = Params{
 	// Checkpoints ordered from oldest to newest.
 	Checkpoints: nil,
 
+	// Script validation is never skipped.
+	AssumeValid: nil,
+
+	// Header chains are only required to have work close to the main
+	// chain.
+	MinimumChainWork: nil,
+
 	// Consensus rule change deployments.
 	//
 	// The miner confirmation window is defined as:
@@ -470,6 +497,13 @@ var TestNet3Params = Params{
 		{44000, newHashFromStr("0000815745f2fcf4a0b2baf8a04e0fdcf3a08bcea8972c1f1fdf3e9f995f4795")},
 	},
 
+	// Block 44000.  It should be moved forward with each release.
+	AssumeValid: newHashFromStr("0000815745f2fcf4a0b2baf8a04e0fdcf3a08bcea8972c1f1fdf3e9f995f4795"),
+
+	// The minimum chain work is not known yet.  Until it is, the headers
+	// of chains which do not include the latest checkpoint are not stored.
+	MinimumChainWork: nil,
+
 	// Consensus rule change deployments.
 	//
 	// The miner confirmation window is defined as:
@@ -566,6 +600,13 @@ var SimNetParams = Params{
 	// Checkpoints ordered from oldest to newest.
 	Checkpoints: nil,
 
+	// Script validation is never skipped.
+	AssumeValid: nil,
+
+	// Header chains are only required to have work close to the main
+	// chain.
+	MinimumChainWork: nil,
+
 	// Consensus rule change deployments.
 	//
 	// The miner confirmation window is defined as:
@@ -40,6 +40,9 @@ const (
 	defaultLogDirname            = "logs"
 	defaultLogFilename           = "btgd.log"
 	defaultMaxPeers              = 125
+	defaultMaxInboundPerIP       = 3
+	defaultMaxInboundPerGroup    = 10
+	defaultBlockRelayPeers       = 2
 	defaultBanDuration           = time.Hour * 24
 	defaultBanThreshold          = 100
 	defaultConnectTimeout        = time.Second * 30
@@ -61,6 +64,7 @@ const (
 	defaultMaxOrphanTransactions = 100
 	defaultMaxOrphanTxSize       = 100000
 	defaultSigCacheMaxSize       = 100000
+	defaultUtxoCacheMaxSizeMiB   = 250
 	sampleConfigFilename         = "sample-btgd.conf"
 	defaultTxIndex               = false
 	defaultAddrIndex             = false
@@ -102,10 +106,16 @@ type config struct {
 	DisableListen        bool          `long:"nolisten" description:"Disable listening for incoming connections -- NOTE: Listening is automatically disabled if the --connect or --proxy options are used without also specifying listen interfaces via --listen"`
 	Listeners            []string      `long:"listen" description:"Add an interface/port to listen for connections (default all interfaces port: 8333, testnet: 18333)"`
 	MaxPeers             int           `long:"maxpeers" description:"Max number of inbound and outbound peers"`
+	MaxInboundPerIP      int           `long:"maxinboundperip" description:"Max number of inbound peers from a single IP address -- 0 disables the limit"`
+	MaxInboundPerGroup   int           `long:"maxinboundpergroup" description:"Max number of inbound peers from a single network group (/16 for IPv4, /32 for IPv6) -- 0 disables the limit"`
+	BlockRelayPeers      int           `long:"blockrelaypeers" description:"Number of additional outbound peers which only relay blocks and do not relay transactions or addresses"`
+	MaxUploadTarget      uint64        `long:"maxuploadtarget" description:"Try to keep the upload traffic to peers under the given target in MiB per 24h -- Historical blocks are no longer served to peers without the download permission once the target is reached -- 0 disables the limit"`
+	ASMap                string        `long:"asmap" description:"Path to an asmap file in the Bitcoin Core format used to group peers by autonomous system number instead of IP prefix"`
 	DisableBanning       bool          `long:"nobanning" description:"Disable banning of misbehaving peers"`
 	BanDuration          time.Duration `long:"banduration" description:"How long to ban misbehaving peers.  Valid time units are {s, m, h}.  Minimum 1 second"`
 	BanThreshold         uint32        `long:"banthreshold" description:"Maximum allowed ban score before disconnecting and banning misbehaving peers."`
-	Whitelists           []string      `long:"whitelist" description:"Add an IP network or IP that will not be banned. (eg. 192.168.1.0/24 or ::1)"`
+	Whitelists           []string      `long:"whitelist" description:"Add an IP network or IP whose peers are granted permissions.  Format: '[<permissions>@]<IP or network>' -- Permissions are a comma separated list of {noban, relay, forcerelay, mempool, download, addr} and default to noban,relay,mempool,download (eg. 192.168.1.0/24 or relay,mempool@::1)"`
+	WhiteBinds           []string      `long:"whitebind" description:"Listen on an interface/port whose peers are granted permissions.  Format: '[<permissions>@]<host>:<port>' -- Permissions are the same as for --whitelist (eg. noban@127.0.0.1:8338)"`
 	AgentBlacklist       []string      `long:"agentblacklist" description:"A comma separated list of user-agent substrings which will cause btcd to reject any peers whose user-agent contains any of the blacklisted substrings."`
 	AgentWhitelist       []string      `long:"agentwhitelist" description:"A comma separated list of user-agent substrings which will cause btcd to require all peers' user-agents to contain one of the whitelisted substrings. The blacklist is applied before the blacklist, and an empty whitelist will allow all agents that do not fail the blacklist."`
 	RPCUser              string        `short:"u" long:"rpcuser" description:"Username for RPC connections"`
@@ -131,16 +141,26 @@ type config struct {
 	OnionProxyPass       string        `long:"onionpass" default-mask:"-" description:"Password for onion proxy server"`
 	NoOnion              bool          `long:"noonion" description:"Disable connecting to tor hidden services"`
 	TorIsolation         bool          `long:"torisolation" description:"Enable Tor stream isolation by randomizing user credentials for each connection."`
+	TorControl           string        `long:"torcontrol" description:"Tor control port used to create an onion service which accepts inbound connections over Tor (eg. 127.0.0.1:9051)"`
+	TorPassword          string        `long:"torpassword" default-mask:"-" description:"Password for the Tor control port -- cookie authentication is used when not set"`
+	OnlyNets             []string      `long:"onlynet" description:"Only make automatic outbound connections to peers on the given network {ipv4, ipv6, onion, i2p, cjdns} -- May be specified multiple times"`
 	TestNet3             bool          `long:"testnet" description:"Use the test network"`
 	RegressionTest       bool          `long:"regtest" description:"Use the regression test network"`
 	SimNet               bool          `long:"simnet" description:"Use the simulation test network"`
 	AddCheckpoints       []string      `long:"addcheckpoint" description:"Add a custom checkpoint.  Format: '<height>:<hash>'"`
 	DisableCheckpoints   bool          `long:"nocheckpoints" description:"Disable built-in checkpoints.  Don't do this unless you know what you're doing."`
+	AssumeValid          string        `long:"assumevalid" description:"Skip script validation for the given block and its ancestors when it is buried in the best header chain -- 0 validates all scripts (default: network-specific)"`
+	MaxReorgDepth        int32         `long:"maxreorgdepth" description:"Do not reorganize to a chain with more work which would disconnect more than this many blocks, notify RPC websocket clients instead (0 to disable)"`
 	DbType               string        `long:"dbtype" description:"Database backend to use for the Block Chain"`
 	Profile              string        `long:"profile" description:"Enable HTTP profiling on given port -- NOTE port must be between 1024 and 65536"`
 	CPUProfile           string        `long:"cpuprofile" description:"Write CPU profile to the specified file"`
 	DebugLevel           string        `short:"d" long:"debuglevel" description:"Logging level for all subsystems {trace, debug, info, warn, error, critical} -- You may also specify <subsystem>=<level>,<subsystem2>=<level>,... to set the log level for individual subsystems -- Use show to list available subsystems"`
 	Upnp                 bool          `long:"upnp" description:"Use UPnP to map our listening port outside of NAT"`
+	NATPMP               bool          `long:"natpmp" description:"Use PCP or NAT-PMP to map our listening port outside of NAT"`
+	DNSSeederHost        string        `long:"dnsseederhost" description:"Act as a DNS seed by answering DNS queries for this host name with the addresses of good peers"`
+	DNSSeederListeners   []string      `long:"dnsseederlisten" description:"Add an interface/port to answer DNS seeder queries on (default all interfaces port: 53)"`
+	DNSSeederNS          string        `long:"dnsseederns" description:"Host name of the name server the DNS seeder host name is delegated to"`
+	V2Transport          bool          `long:"v2transport" description:"Use the BIP0324 v2 encrypted transport protocol with peers which support it"`
 	MinRelayTxFee        float64       `long:"minrelaytxfee" description:"The minimum transaction fee in BTC/kB to be considered a non-zero fee."`
 	FreeTxRelayLimit     float64       `long:"limitfreerelay" description:"Limit relay of transactions with no transaction fee to the given amount in thousands of bytes per minute"`
 	NoRelayPriority      bool          `long:"norelaypriority" description:"Do not require free or low-fee transactions to have high priority for relaying"`
@@ -158,6 +178,7 @@ type config struct {
 	NoCFilters           bool          `long:"nocfilters" description:"Disable committed filtering (CF) support"`
 	DropCfIndex          bool          `long:"dropcfindex" description:"Deletes the index used for committed filtering (CF) support from the database on start up and then exits."`
 	SigCacheMaxSize      uint          `long:"sigcachemaxsize" description:"The maximum number of entries in the signature verification cache"`
+	UtxoCacheMaxSizeMiB  uint          `long:"utxocachemaxsize" description:"The maximum size in MiB of the in-memory cache of unspent transaction outputs before it is written to the database"`
 	BlocksOnly           bool          `long:"blocksonly" description:"Do not accept transactions from remote peers."`
 	TxIndex              bool          `long:"txindex" description:"Maintain a full hash-based transaction index which makes all transactions available via the getrawtransaction RPC"`
 	DropTxIndex          bool          `long:"droptxindex" description:"Deletes the hash-based transaction index from the database on start up and then exits."`
@@ -170,9 +191,13 @@ type config struct {
 	oniondial            func(string, string, time.Duration) (net.Conn, error)
 	dial                 func(string, string, time.Duration) (net.Conn, error)
 	addCheckpoints       []chaincfg.Checkpoint
+	assumeValid          *chainhash.Hash
 	miningAddrs          []btcutil.Address
 	minRelayTxFee        btcutil.Amount
-	whitelists           []*net.IPNet
+	whitelists           []netWhitelist
+	whitebinds           []netWhitebind
+	onlyNets             map[string]struct{}
+	proxyIsolation       bool
 }
 
 // serviceOptions defines the configuration options for the daemon as a service on
@@ -409,6 +434,9 @@ func loadConfig() (*config, []string, error) {
 		ConfigFile:           defaultConfigFile,
 		DebugLevel:           defaultLogLevel,
 		MaxPeers:             defaultMaxPeers,
+		MaxInboundPerIP:      defaultMaxInboundPerIP,
+		MaxInboundPerGroup:   defaultMaxInboundPerGroup,
+		BlockRelayPeers:      defaultBlockRelayPeers,
 		BanDuration:          defaultBanDuration,
 		BanThreshold:         defaultBanThreshold,
 		RPCMaxClients:        defaultMaxRPCClients,
@@ -429,6 +457,7 @@ func loadConfig() (*config, []string, error) {
 		BlockPrioritySize:    mempool.DefaultBlockPrioritySize,
 		MaxOrphanTxs:         defaultMaxOrphanTransactions,
 		SigCacheMaxSize:      defaultSigCacheMaxSize,
+		UtxoCacheMaxSizeMiB:  defaultUtxoCacheMaxSizeMiB,
 		Generate:             defaultGenerate,
 		TxIndex:              defaultTxIndex,
 		AddrIndex:            defaultAddrIndex,
@@ -592,6 +621,10 @@ func loadConfig() (*config, []string, error) {
 	cfg.LogDir = cleanAndExpandPath(cfg.LogDir)
 	cfg.LogDir = filepath.Join(cfg.LogDir, netName(activeNetParams))
 
+	if cfg.ASMap != "" {
+		cfg.ASMap = cleanAndExpandPath(cfg.ASMap)
+	}
+
 	// Special show command to list supported subsystems and exit.
 	if cfg.DebugLevel == "show" {
 		fmt.Println("Supported subsystems", supportedSubsystems())
@@ -632,6 +665,27 @@ func loadConfig() (*config, []string, error) {
 		}
 	}
 
+	// The inbound connection limits may not be negative.
+	if cfg.MaxInboundPerIP < 0 || cfg.MaxInboundPerGroup < 0 {
+		str := "%s: The maxinboundperip and maxinboundpergroup " +
+			"options may not be negative -- parsed [%d, %d]"
+		err := fmt.Errorf(str, funcName, cfg.MaxInboundPerIP,
+			cfg.MaxInboundPerGroup)
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, usageMessage)
+		return nil, nil, err
+	}
+
+	// The number of block-relay-only peers may not be negative.
+	if cfg.BlockRelayPeers < 0 {
+		str := "%s: The blockrelaypeers option may not be negative " +
+			"-- parsed [%d]"
+		err := fmt.Errorf(str, funcName, cfg.BlockRelayPeers)
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, usageMessage)
+		return nil, nil, err
+	}
+
 	// Don't allow ban durations that are too short.
 	if cfg.BanDuration < time.Second {
 		str := "%s: The banduration option may not be less than 1s -- parsed [%v]"
@@ -641,36 +695,50 @@ func loadConfig() (*config, []string, error) {
 		return nil, nil, err
 	}
 
-	// Validate any given whitelisted IP addresses and networks.
-	if len(cfg.Whitelists) > 0 {
-		var ip net.IP
-		cfg.whitelists = make([]*net.IPNet, 0, len(cfg.Whitelists))
+	// Validate any given whitelisted IP addresses and networks along with
+	// the permissions they grant.
+	for _, entry := range cfg.Whitelists {
+		wl, err := parseWhitelist(entry)
+		if err != nil {
+			str := "%s: The whitelist value of '%s' is invalid: %v"
+			err := fmt.Errorf(str, funcName, entry, err)
+			fmt.Fprintln(os.Stderr, err)
+			fmt.Fprintln(os.Stderr, usageMessage)
+			return nil, nil, err
+		}
+		cfg.whitelists = append(cfg.whitelists, wl)
+	}
+
+	// Validate any given whitelisted bind addresses along with the
+	// permissions they grant.
+	for _, entry := range cfg.WhiteBinds {
+		wb, err := parseWhitebind(entry)
+		if err != nil {
+			str := "%s: The whitebind value of '%s' is invalid: %v"
+			err := fmt.Errorf(str, funcName, entry, err)
+			fmt.Fprintln(os.Stderr, err)
+			fmt.Fprintln(os.Stderr, usageMessage)
+			return nil, nil, err
+		}
+		cfg.whitebinds = append(cfg.whitebinds, wb)
+	}
 
-		for _, addr := range cfg.Whitelists {
-			_, ipnet, err := net.ParseCIDR(addr)
-			if err != nil {
-				ip = net.ParseIP(addr)
-				if ip == nil {
-					str := "%s: The whitelist value of '%s' is invalid"
-					err = fmt.Errorf(str, funcName, addr)
-					fmt.Fprintln(os.Stderr, err)
-					fmt.Fprintln(os.Stderr, usageMessage)
-					return nil, nil, err
-				}
-				var bits int
-				if ip.To4() == nil {
-					// IPv6
-					bits = 128
-				} else {
-					bits = 32
-				}
-				ipnet = &net.IPNet{
-					IP:   ip,
-					Mask: net.CIDRMask(bits, bits),
-				}
-			}
-			cfg.whitelists = append(cfg.whitelists, ipnet)
+	// Validate the networks automatic outbound connections are limited to.
+	for _, name := range cfg.OnlyNets {
+		name = strings.ToLower(name)
+		if !isSupportedNetwork(name) {
+			str := "%s: The onlynet value of '%s' is invalid -- " +
+				"supported networks are %s"
+			err := fmt.Errorf(str, funcName, name,
+				strings.Join(supportedNetworks, ", "))
+			fmt.Fprintln(os.Stderr, err)
+			fmt.Fprintln(os.Stderr, usageMessage)
+			return nil, nil, err
+		}
+		if cfg.onlyNets == nil {
+			cfg.onlyNets = make(map[string]struct{})
 		}
+		cfg.onlyNets[name] = struct{}{}
 	}
 
 	// --addPeer and --connect do not mix.
@@ -683,9 +751,10 @@ func loadConfig() (*config, []string, error) {
 		return nil, nil, err
 	}
 
-	// --proxy or --connect without --listen disables listening.
+	// --proxy or --connect without --listen or --whitebind disables
+	// listening.
 	if (cfg.Proxy != "" || len(cfg.ConnectPeers) > 0) &&
-		len(cfg.Listeners) == 0 {
+		len(cfg.Listeners) == 0 && len(cfg.whitebinds) == 0 {
 		cfg.DisableListen = true
 	}
 
@@ -696,12 +765,16 @@ func loadConfig() (*config, []string, error) {
 
 	// Add the default listener if none were specified. The default
 	// listener is all addresses on the listen port for the network
-	// we are to connect to.
-	if len(cfg.Listeners) == 0 {
+	// we are to connect to.  Whitelisted bind addresses are listened on
+	// in addition to the listeners.
+	if len(cfg.Listeners) == 0 && len(cfg.whitebinds) == 0 {
 		cfg.Listeners = []string{
 			net.JoinHostPort("", activeNetParams.DefaultPort),
 		}
 	}
+	for _, wb := range cfg.whitebinds {
+		cfg.Listeners = append(cfg.Listeners, wb.addr)
+	}
 
 	// Check to make sure limited and admin users don't have the same username
 	if cfg.RPCUser == cfg.RPCLimitUser && cfg.RPCUser != "" {
@@ -791,6 +864,16 @@ func loadConfig() (*config, []string, error) {
 		return nil, nil, err
 	}
 
+	// The maximum reorganization depth can't be negative.
+	if cfg.MaxReorgDepth < 0 {
+		str := "%s: The maxreorgdepth option may not be less than 0 " +
+			"-- parsed [%d]"
+		err := fmt.Errorf(str, funcName, cfg.MaxReorgDepth)
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, usageMessage)
+		return nil, nil, err
+	}
+
 	// Limit the max orphan count to a sane vlue.
 	if cfg.MaxOrphanTxs < 0 {
 		str := "%s: The maxorphantx option may not be less than 0 " +
@@ -909,6 +992,29 @@ func loadConfig() (*config, []string, error) {
 	cfg.RPCListeners = normalizeAddresses(cfg.RPCListeners,
 		activeNetParams.rpcPort)
 
+	// The DNS seeder listens on the DNS port of all interfaces by default.
+	if cfg.DNSSeederHost != "" {
+		if !isValidDNSName(cfg.DNSSeederHost) {
+			str := "%s: the DNS seeder host name '%s' is invalid"
+			err := fmt.Errorf(str, funcName, cfg.DNSSeederHost)
+			fmt.Fprintln(os.Stderr, err)
+			fmt.Fprintln(os.Stderr, usageMessage)
+			return nil, nil, err
+		}
+		if cfg.DNSSeederNS != "" && !isValidDNSName(cfg.DNSSeederNS) {
+			str := "%s: the DNS seeder name server '%s' is invalid"
+			err := fmt.Errorf(str, funcName, cfg.DNSSeederNS)
+			fmt.Fprintln(os.Stderr, err)
+			fmt.Fprintln(os.Stderr, usageMessage)
+			return nil, nil, err
+		}
+		if len(cfg.DNSSeederListeners) == 0 {
+			cfg.DNSSeederListeners = []string{":53"}
+		}
+		cfg.DNSSeederListeners = normalizeAddresses(
+			cfg.DNSSeederListeners, "53")
+	}
+
 	// Only allow TLS to be disabled if the RPC is bound to localhost
 	// addresses.
 	if !cfg.DisableRPC && cfg.DisableTLS {
@@ -965,6 +1071,45 @@ func loadConfig() (*config, []string, error) {
 		return nil, nil, err
 	}
 
+	// Determine the block whose ancestors are assumed to have valid
+	// scripts.
+	cfg.assumeValid = activeNetParams.AssumeValid
+	switch cfg.AssumeValid {
+	case "":
+	case "0":
+		cfg.assumeValid = nil
+	default:
+		cfg.assumeValid, err = chainhash.NewHashFromStr(cfg.AssumeValid)
+		if err != nil {
+			str := "%s: Invalid assumevalid block hash %q: %v"
+			err := fmt.Errorf(str, funcName, cfg.AssumeValid, err)
+			fmt.Fprintln(os.Stderr, err)
+			fmt.Fprintln(os.Stderr, usageMessage)
+			return nil, nil, err
+		}
+	}
+
+	// An onion service may only be created when listening for inbound
+	// connections and Tor has not been disabled.
+	if cfg.TorControl != "" {
+		if cfg.DisableListen || cfg.NoOnion {
+			str := "%s: the --torcontrol option requires listening " +
+				"for inbound connections and may not be used " +
+				"with --noonion"
+			err := fmt.Errorf(str, funcName)
+			fmt.Fprintln(os.Stderr, err)
+			fmt.Fprintln(os.Stderr, usageMessage)
+			return nil, nil, err
+		}
+		if _, _, err := net.SplitHostPort(cfg.TorControl); err != nil {
+			str := "%s: Tor control address '%s' is invalid: %v"
+			err := fmt.Errorf(str, funcName, cfg.TorControl, err)
+			fmt.Fprintln(os.Stderr, err)
+			fmt.Fprintln(os.Stderr, usageMessage)
+			return nil, nil, err
+		}
+	}
+
 	// Tor stream isolation requires either proxy or onion proxy to be set.
 	if cfg.TorIsolation && cfg.Proxy == "" && cfg.OnionProxy == "" {
 		str := "%s: Tor stream isolation requires either proxy or " +
@@ -1004,6 +1149,7 @@ func loadConfig() (*config, []string, error) {
 			fmt.Fprintln(os.Stderr, "Tor isolation set -- "+
 				"overriding specified proxy user credentials")
 		}
+		cfg.proxyIsolation = torIsolation
 
 		proxy := &socks.Proxy{
 			Addr:         cfg.Proxy,
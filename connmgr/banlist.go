@@ -0,0 +1,320 @@
+// Copyright (c) 2016 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package connmgr
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/btgsuite/btgd/jsonfile"
+)
+
+// banListVersion is the current version of the serialized ban list format.
+const banListVersion = 1
+
+var (
+	// ErrNotBanned is returned when attempting to remove a ban for a host
+	// or subnet that is not currently banned.
+	ErrNotBanned = errors.New("address or subnet is not banned")
+
+	// ErrBannedAddr is used to indicate that an automatically selected
+	// outbound address is banned and will not be dialed.
+	ErrBannedAddr = errors.New("address is banned")
+)
+
+// BanEntry describes a single banned IP address or subnet.
+type BanEntry struct {
+	// Subnet is the banned network.  Single hosts are represented by a
+	// network with a full length mask.
+	Subnet *net.IPNet
+
+	// Created is the time the ban was put in place.
+	Created time.Time
+
+	// Until is the time the ban expires.
+	Until time.Time
+
+	// Reason is a short human-readable description of why the ban was
+	// created.
+	Reason string
+}
+
+// serializedBanEntry is the on-disk representation of a BanEntry.
+type serializedBanEntry struct {
+	Subnet  string `json:"subnet"`
+	Created int64  `json:"created"`
+	Until   int64  `json:"until"`
+	Reason  string `json:"reason"`
+}
+
+// serializedBanList is the on-disk representation of a BanList.
+type serializedBanList struct {
+	Version int                  `json:"version"`
+	Entries []serializedBanEntry `json:"entries"`
+}
+
+// BanList houses the set of banned IP addresses and subnets along with their
+// expiration times.  When a file path is provided, every modification is
+// written back to disk so bans survive restarts.
+type BanList struct {
+	mtx     sync.Mutex
+	path    string
+	entries map[string]*BanEntry
+}
+
+// ParseSubnet parses the passed string as either a CIDR subnet (for example
+// 192.168.1.0/24) or a single IP address, in which case a network with a full
+// length mask is returned.
+func ParseSubnet(s string) (*net.IPNet, error) {
+	if _, ipnet, err := net.ParseCIDR(s); err == nil {
+		return ipnet, nil
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address or subnet '%s'", s)
+	}
+	return singleHostNet(ip), nil
+}
+
+// singleHostNet returns a network which only contains the passed IP address.
+func singleHostNet(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// addrIP returns the IP address associated with the passed network address or
+// nil when it does not refer to an IP address, such as for onion addresses.
+func addrIP(addr net.Addr) net.IP {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// sweepExpired removes all bans that have expired as of the passed time and
+// returns whether or not any were removed.
+//
+// This function MUST be called with the ban list lock held (for writes).
+func (b *BanList) sweepExpired(now time.Time) bool {
+	var removed bool
+	for key, entry := range b.entries {
+		if !now.Before(entry.Until) {
+			log.Infof("Ban for %s has expired", key)
+			delete(b.entries, key)
+			removed = true
+		}
+	}
+	return removed
+}
+
+// save writes the ban list to its backing file.  It does nothing when the ban
+// list was created without a file path.
+//
+// This function MUST be called with the ban list lock held (for reads).
+func (b *BanList) save() error {
+	if b.path == "" {
+		return nil
+	}
+
+	sbl := serializedBanList{
+		Version: banListVersion,
+		Entries: make([]serializedBanEntry, 0, len(b.entries)),
+	}
+	for key, entry := range b.entries {
+		sbl.Entries = append(sbl.Entries, serializedBanEntry{
+			Subnet:  key,
+			Created: entry.Created.Unix(),
+			Until:   entry.Until.Unix(),
+			Reason:  entry.Reason,
+		})
+	}
+
+	return jsonfile.Write(b.path, &sbl)
+}
+
+// Load reads the bans stored in the backing file, discarding any that have
+// already expired.  A missing file is not an error.
+//
+// This function is safe for concurrent access.
+func (b *BanList) Load() error {
+	if b.path == "" {
+		return nil
+	}
+
+	r, err := os.Open(b.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer r.Close()
+
+	var sbl serializedBanList
+	if err := json.NewDecoder(r).Decode(&sbl); err != nil {
+		return fmt.Errorf("unable to decode %s: %v", b.path, err)
+	}
+	if sbl.Version != banListVersion {
+		return fmt.Errorf("unknown ban list version %d in %s",
+			sbl.Version, b.path)
+	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	for _, sbe := range sbl.Entries {
+		subnet, err := ParseSubnet(sbe.Subnet)
+		if err != nil {
+			log.Warnf("Skipping invalid ban list entry: %v", err)
+			continue
+		}
+		b.entries[subnet.String()] = &BanEntry{
+			Subnet:  subnet,
+			Created: time.Unix(sbe.Created, 0),
+			Until:   time.Unix(sbe.Until, 0),
+			Reason:  sbe.Reason,
+		}
+	}
+	b.sweepExpired(time.Now())
+
+	log.Infof("Loaded %d banned addresses and subnets from '%s'",
+		len(b.entries), b.path)
+	return nil
+}
+
+// Ban bans the passed subnet until the provided time, replacing any existing
+// ban for the same subnet.
+//
+// This function is safe for concurrent access.
+func (b *BanList) Ban(subnet *net.IPNet, until time.Time, reason string) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	key := subnet.String()
+	b.entries[key] = &BanEntry{
+		Subnet:  subnet,
+		Created: time.Now(),
+		Until:   until,
+		Reason:  reason,
+	}
+	return b.save()
+}
+
+// BanIP bans the single passed IP address until the provided time.
+//
+// This function is safe for concurrent access.
+func (b *BanList) BanIP(ip net.IP, until time.Time, reason string) error {
+	return b.Ban(singleHostNet(ip), until, reason)
+}
+
+// Unban removes the ban for the passed subnet.  ErrNotBanned is returned when
+// there is no ban for exactly that subnet.
+//
+// This function is safe for concurrent access.
+func (b *BanList) Unban(subnet *net.IPNet) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	key := subnet.String()
+	if _, ok := b.entries[key]; !ok {
+		return ErrNotBanned
+	}
+	delete(b.entries, key)
+	return b.save()
+}
+
+// Clear removes all bans.
+//
+// This function is safe for concurrent access.
+func (b *BanList) Clear() error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.entries = make(map[string]*BanEntry)
+	return b.save()
+}
+
+// IsBanned returns whether or not the passed IP address is covered by an
+// unexpired ban along with the time the longest applicable ban ends.
+//
+// This function is safe for concurrent access.
+func (b *BanList) IsBanned(ip net.IP) (bool, time.Time) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	now := time.Now()
+	if b.sweepExpired(now) {
+		if err := b.save(); err != nil {
+			log.Errorf("Unable to save ban list: %v", err)
+		}
+	}
+
+	var banned bool
+	var until time.Time
+	for _, entry := range b.entries {
+		if entry.Subnet.Contains(ip) {
+			banned = true
+			if entry.Until.After(until) {
+				until = entry.Until
+			}
+		}
+	}
+	return banned, until
+}
+
+// IsBannedAddr returns whether or not the IP address of the passed network
+// address is banned.  Addresses which do not have an IP address, such as
+// onion addresses, are never considered banned.
+//
+// This function is safe for concurrent access.
+func (b *BanList) IsBannedAddr(addr net.Addr) bool {
+	ip := addrIP(addr)
+	if ip == nil {
+		return false
+	}
+	banned, _ := b.IsBanned(ip)
+	return banned
+}
+
+// Entries returns a copy of all unexpired bans sorted by their subnet.
+//
+// This function is safe for concurrent access.
+func (b *BanList) Entries() []BanEntry {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.sweepExpired(time.Now())
+	entries := make([]BanEntry, 0, len(b.entries))
+	for _, entry := range b.entries {
+		entries = append(entries, *entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Subnet.String() < entries[j].Subnet.String()
+	})
+	return entries
+}
+
+// NewBanList returns a new empty ban list which is persisted to the passed
+// file path.  An empty path results in a ban list which is only kept in
+// memory.  Call Load to read any previously saved bans.
+func NewBanList(path string) *BanList {
+	return &BanList{
+		path:    path,
+		entries: make(map[string]*BanEntry),
+	}
+}
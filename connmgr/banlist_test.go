@@ -0,0 +1,199 @@
+// Copyright (c) 2016 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package connmgr
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestParseSubnet ensures both CIDR subnets and single IP addresses are parsed
+// into the expected networks.
+func TestParseSubnet(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "192.168.1.0/24", want: "192.168.1.0/24"},
+		{in: "192.168.1.77/24", want: "192.168.1.0/24"},
+		{in: "10.0.0.1", want: "10.0.0.1/32"},
+		{in: "2001:db8::1", want: "2001:db8::1/128"},
+		{in: "2001:db8::/32", want: "2001:db8::/32"},
+		{in: "not-an-ip", wantErr: true},
+		{in: "10.0.0.1/33", wantErr: true},
+	}
+
+	for _, test := range tests {
+		subnet, err := ParseSubnet(test.in)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("ParseSubnet(%q): expected error", test.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseSubnet(%q): unexpected error: %v", test.in,
+				err)
+			continue
+		}
+		if subnet.String() != test.want {
+			t.Errorf("ParseSubnet(%q): got %s, want %s", test.in,
+				subnet, test.want)
+		}
+	}
+}
+
+// TestBanList ensures banning, unbanning, expiry and subnet matching behave as
+// expected.
+func TestBanList(t *testing.T) {
+	bl := NewBanList("")
+	future := time.Now().Add(time.Hour)
+
+	subnet, _ := ParseSubnet("10.1.0.0/16")
+	if err := bl.Ban(subnet, future, "test"); err != nil {
+		t.Fatalf("Ban: unexpected error: %v", err)
+	}
+	if err := bl.BanIP(net.ParseIP("192.168.0.1"), future, "test"); err != nil {
+		t.Fatalf("BanIP: unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		ip     string
+		banned bool
+	}{
+		{ip: "10.1.2.3", banned: true},
+		{ip: "10.2.0.1", banned: false},
+		{ip: "192.168.0.1", banned: true},
+		{ip: "::ffff:192.168.0.1", banned: true},
+		{ip: "192.168.0.2", banned: false},
+	}
+	for _, test := range tests {
+		banned, until := bl.IsBanned(net.ParseIP(test.ip))
+		if banned != test.banned {
+			t.Errorf("IsBanned(%s): got %v, want %v", test.ip, banned,
+				test.banned)
+		}
+		if banned && !until.Equal(future) {
+			t.Errorf("IsBanned(%s): got until %v, want %v", test.ip,
+				until, future)
+		}
+	}
+
+	addr := &net.TCPAddr{IP: net.ParseIP("10.1.9.9"), Port: 8338}
+	if !bl.IsBannedAddr(addr) {
+		t.Errorf("IsBannedAddr(%s): expected address to be banned", addr)
+	}
+
+	if len(bl.Entries()) != 2 {
+		t.Fatalf("Entries: got %d entries, want 2", len(bl.Entries()))
+	}
+
+	// Unbanning an address inside a banned subnet must fail since only
+	// exact matches are removed.
+	single, _ := ParseSubnet("10.1.2.3")
+	if err := bl.Unban(single); err != ErrNotBanned {
+		t.Errorf("Unban: got %v, want %v", err, ErrNotBanned)
+	}
+	if err := bl.Unban(subnet); err != nil {
+		t.Errorf("Unban: unexpected error: %v", err)
+	}
+	if banned, _ := bl.IsBanned(net.ParseIP("10.1.2.3")); banned {
+		t.Errorf("IsBanned: address still banned after unban")
+	}
+
+	// Expired bans must no longer apply and be removed.
+	expired, _ := ParseSubnet("172.16.0.0/12")
+	bl.Ban(expired, time.Now().Add(-time.Second), "test")
+	if banned, _ := bl.IsBanned(net.ParseIP("172.16.0.1")); banned {
+		t.Errorf("IsBanned: expired ban still applies")
+	}
+	if len(bl.Entries()) != 1 {
+		t.Errorf("Entries: got %d entries, want 1", len(bl.Entries()))
+	}
+
+	if err := bl.Clear(); err != nil {
+		t.Fatalf("Clear: unexpected error: %v", err)
+	}
+	if len(bl.Entries()) != 0 {
+		t.Errorf("Entries: got %d entries after clear, want 0",
+			len(bl.Entries()))
+	}
+}
+
+// TestBanListPersistence ensures bans written to disk are restored by a new
+// ban list instance.
+func TestBanListPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "banlist")
+	if err != nil {
+		t.Fatalf("TempDir: unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "banlist.json")
+
+	bl := NewBanList(path)
+	if err := bl.Load(); err != nil {
+		t.Fatalf("Load: unexpected error with missing file: %v", err)
+	}
+	subnet, _ := ParseSubnet("2001:db8::/32")
+	until := time.Unix(time.Now().Add(time.Hour).Unix(), 0)
+	if err := bl.Ban(subnet, until, "manually added"); err != nil {
+		t.Fatalf("Ban: unexpected error: %v", err)
+	}
+
+	restored := NewBanList(path)
+	if err := restored.Load(); err != nil {
+		t.Fatalf("Load: unexpected error: %v", err)
+	}
+	entries := restored.Entries()
+	if len(entries) != 1 {
+		t.Fatalf("Entries: got %d entries, want 1", len(entries))
+	}
+	entry := entries[0]
+	if entry.Subnet.String() != subnet.String() ||
+		!entry.Until.Equal(until) || entry.Reason != "manually added" {
+
+		t.Fatalf("Entries: unexpected restored entry %+v", entry)
+	}
+}
+
+// TestBannedNewConnReq ensures addresses which are banned are never dialed
+// automatically.
+func TestBannedNewConnReq(t *testing.T) {
+	bl := NewBanList("")
+	bl.BanIP(net.ParseIP("127.0.0.1"), time.Now().Add(time.Hour), "test")
+
+	dialed := make(chan net.Addr, 1)
+	cmgr, err := New(&Config{
+		TargetOutbound: 1,
+		RetryDuration:  time.Millisecond,
+		Dial: func(addr net.Addr) (net.Conn, error) {
+			dialed <- addr
+			return mockDialer(addr)
+		},
+		GetNewAddress: func() (net.Addr, error) {
+			return &net.TCPAddr{
+				IP:   net.ParseIP("127.0.0.1"),
+				Port: 18555,
+			}, nil
+		},
+		BanList: bl,
+	})
+	if err != nil {
+		t.Fatalf("New error: %v", err)
+	}
+	cmgr.Start()
+	defer cmgr.Stop()
+
+	select {
+	case addr := <-dialed:
+		t.Fatalf("banned address %v was dialed", addr)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
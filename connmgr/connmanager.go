@@ -142,6 +142,11 @@ type Config struct {
 
 	// Dial connects to the address on the named network. It cannot be nil.
 	Dial func(net.Addr) (net.Conn, error)
+
+	// BanList is consulted before dialing addresses returned by
+	// GetNewAddress so that banned hosts and subnets are never connected
+	// to automatically.  It may be nil if bans should not be enforced.
+	BanList *BanList
 }
 
 // registerPending is used to register a pending connection attempt. By
@@ -399,6 +404,14 @@ func (cm *ConnManager) NewConnReq() {
 
 	c.Addr = addr
 
+	if cm.cfg.BanList != nil && cm.cfg.BanList.IsBannedAddr(addr) {
+		select {
+		case cm.requests <- handleFailed{c, ErrBannedAddr}:
+		case <-cm.quit:
+		}
+		return
+	}
+
 	cm.Connect(c)
 }
 
@@ -0,0 +1,216 @@
+// Copyright (c) 2016 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package connmgr
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	// evictProtectNetGroups is the number of peers with distinct network
+	// groups that are protected from eviction.
+	evictProtectNetGroups = 4
+
+	// evictProtectPing is the number of peers with the lowest minimum ping
+	// times that are protected from eviction.
+	evictProtectPing = 8
+
+	// evictProtectTxRelay is the number of peers that most recently relayed
+	// novel transactions that are protected from eviction.
+	evictProtectTxRelay = 4
+
+	// evictProtectBlockRelay is the number of peers that most recently
+	// relayed novel blocks that are protected from eviction.
+	evictProtectBlockRelay = 4
+)
+
+// EvictionCandidate describes an inbound peer which may be disconnected to
+// make room for a new inbound connection.
+type EvictionCandidate struct {
+	// ID uniquely identifies the peer.
+	ID int32
+
+	// ConnTime is the time the connection was established.
+	ConnTime time.Time
+
+	// MinPingTime is the fastest ping time observed for the peer.  A zero
+	// value indicates no ping has completed and is treated as the slowest
+	// possible ping.
+	MinPingTime time.Duration
+
+	// LastBlockTime is the last time the peer relayed a block that was not
+	// previously known.
+	LastBlockTime time.Time
+
+	// LastTxTime is the last time the peer relayed a transaction that was
+	// not previously known.
+	LastTxTime time.Time
+
+	// RelevantServices indicates whether the peer advertises the services
+	// required of outbound peers.
+	RelevantServices bool
+
+	// RelayTxes indicates whether the peer wants transactions relayed to
+	// it.
+	RelayTxes bool
+
+	// BloomFilter indicates whether the peer has loaded a bloom filter.
+	BloomFilter bool
+
+	// KeyedNetGroup identifies the network group of the peer.  It should be
+	// derived from the network group using a secret key so that attackers
+	// are unable to predict which groups will be protected.
+	KeyedNetGroup uint64
+
+	// PreferEvict indicates the peer should be evicted ahead of any other
+	// candidate when one must be chosen.
+	PreferEvict bool
+}
+
+// eraseLastK sorts the candidates using the passed comparison function and
+// removes up to k of the candidates that sort last, returning the remaining
+// candidates.  Ties are broken by peer ID so the results are deterministic.
+func eraseLastK(candidates []EvictionCandidate, k int,
+	less func(a, b *EvictionCandidate) bool) []EvictionCandidate {
+
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := &candidates[i], &candidates[j]
+		if less(a, b) {
+			return true
+		}
+		if less(b, a) {
+			return false
+		}
+		return a.ID < b.ID
+	})
+	if k > len(candidates) {
+		k = len(candidates)
+	}
+	return candidates[:len(candidates)-k]
+}
+
+// minPing returns the minimum ping time of the candidate with unknown ping
+// times mapped to the maximum possible duration.
+func minPing(c *EvictionCandidate) time.Duration {
+	if c.MinPingTime <= 0 {
+		return time.Duration(1<<63 - 1)
+	}
+	return c.MinPingTime
+}
+
+// SelectPeerToEvict implements the inbound peer eviction logic used by Bitcoin
+// Core.  The candidates should only include inbound peers which are eligible
+// for eviction, for example excluding whitelisted peers.
+//
+// Peers are protected from eviction in the following order, with each step
+// only considering the peers which were not protected by the previous steps:
+//
+//   - The peers with the highest keyed network group values
+//   - The peers with the lowest minimum ping times
+//   - The peers which most recently relayed novel transactions
+//   - The peers which most recently relayed novel blocks
+//   - The half of the remaining peers which have been connected the longest
+//
+// The youngest peer of the network group with the most remaining connections
+// is then selected for eviction.  The second return value is false when every
+// candidate is protected and therefore no peer should be evicted.
+func SelectPeerToEvict(candidates []EvictionCandidate) (int32, bool) {
+	// Work on a copy since the slice is reordered and shrunk as peers are
+	// protected.
+	remaining := make([]EvictionCandidate, len(candidates))
+	copy(remaining, candidates)
+
+	// Protect peers in the network groups with the highest keyed values
+	// which an attacker is unable to predict since the values are keyed.
+	remaining = eraseLastK(remaining, evictProtectNetGroups,
+		func(a, b *EvictionCandidate) bool {
+			return a.KeyedNetGroup < b.KeyedNetGroup
+		})
+
+	// Protect the peers with the lowest ping times since an attacker
+	// can't easily manufacture network proximity.
+	remaining = eraseLastK(remaining, evictProtectPing,
+		func(a, b *EvictionCandidate) bool {
+			return minPing(a) > minPing(b)
+		})
+
+	// Protect the peers which most recently sent novel transactions
+	// since an attacker can't do that without paying fees.
+	remaining = eraseLastK(remaining, evictProtectTxRelay,
+		func(a, b *EvictionCandidate) bool {
+			if !a.LastTxTime.Equal(b.LastTxTime) {
+				return a.LastTxTime.Before(b.LastTxTime)
+			}
+			if a.RelayTxes != b.RelayTxes {
+				return b.RelayTxes
+			}
+			if a.BloomFilter != b.BloomFilter {
+				return a.BloomFilter
+			}
+			return a.ConnTime.After(b.ConnTime)
+		})
+
+	// Protect the peers which most recently sent novel blocks since an
+	// attacker can't do that without mining.
+	remaining = eraseLastK(remaining, evictProtectBlockRelay,
+		func(a, b *EvictionCandidate) bool {
+			if !a.LastBlockTime.Equal(b.LastBlockTime) {
+				return a.LastBlockTime.Before(b.LastBlockTime)
+			}
+			if a.RelevantServices != b.RelevantServices {
+				return b.RelevantServices
+			}
+			return a.ConnTime.After(b.ConnTime)
+		})
+
+	// Protect the half of the remaining peers which have been connected
+	// the longest.  This leaves the candidates sorted from youngest to
+	// oldest connection which is relied on below.
+	remaining = eraseLastK(remaining, len(remaining)/2,
+		func(a, b *EvictionCandidate) bool {
+			return a.ConnTime.After(b.ConnTime)
+		})
+
+	if len(remaining) == 0 {
+		return 0, false
+	}
+
+	// Only consider the peers which are preferred for eviction if there
+	// are any.
+	var preferred []EvictionCandidate
+	for _, c := range remaining {
+		if c.PreferEvict {
+			preferred = append(preferred, c)
+		}
+	}
+	if len(preferred) > 0 {
+		remaining = preferred
+	}
+
+	// Identify the network group with the most connections, preferring
+	// the group with the youngest member on ties.  Since the candidates
+	// are ordered from youngest to oldest, the first member of each group
+	// is its youngest.
+	groups := make(map[uint64][]EvictionCandidate)
+	var mostGroup uint64
+	var mostCount int
+	var mostTime time.Time
+	for _, c := range remaining {
+		group := append(groups[c.KeyedNetGroup], c)
+		groups[c.KeyedNetGroup] = group
+		groupTime := group[0].ConnTime
+		if len(group) > mostCount ||
+			(len(group) == mostCount && groupTime.After(mostTime)) {
+
+			mostGroup = c.KeyedNetGroup
+			mostCount = len(group)
+			mostTime = groupTime
+		}
+	}
+
+	// Evict the youngest peer of the most represented group.
+	return groups[mostGroup][0].ID, true
+}
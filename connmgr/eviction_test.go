@@ -0,0 +1,215 @@
+// Copyright (c) 2016 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package connmgr
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// randomCandidates returns a synthetic set of eviction candidates spread over
+// the passed number of network groups with random connection times, ping
+// times and relay behavior.
+func randomCandidates(rng *rand.Rand, num, numGroups int) []EvictionCandidate {
+	base := time.Unix(1500000000, 0)
+	candidates := make([]EvictionCandidate, 0, num)
+	for i := 0; i < num; i++ {
+		c := EvictionCandidate{
+			ID:               int32(i),
+			ConnTime:         base.Add(time.Duration(rng.Intn(86400)) * time.Second),
+			MinPingTime:      time.Duration(rng.Intn(1000)) * time.Millisecond,
+			RelevantServices: rng.Intn(2) == 0,
+			RelayTxes:        rng.Intn(2) == 0,
+			BloomFilter:      rng.Intn(2) == 0,
+			KeyedNetGroup:    uint64(rng.Intn(numGroups)),
+		}
+		if rng.Intn(3) == 0 {
+			c.LastTxTime = base.Add(time.Duration(rng.Intn(86400)) * time.Second)
+		}
+		if rng.Intn(3) == 0 {
+			c.LastBlockTime = base.Add(time.Duration(rng.Intn(86400)) * time.Second)
+		}
+		candidates = append(candidates, c)
+	}
+	return candidates
+}
+
+// evictAll repeatedly selects and removes peers until none are selected or only
+// the passed minimum number of candidates remain and returns the set of evicted
+// peer IDs.
+func evictAll(candidates []EvictionCandidate, min int) map[int32]struct{} {
+	evicted := make(map[int32]struct{})
+	for len(candidates) > min {
+		id, ok := SelectPeerToEvict(candidates)
+		if !ok {
+			return evicted
+		}
+		evicted[id] = struct{}{}
+		for i := range candidates {
+			if candidates[i].ID == id {
+				candidates = append(candidates[:i], candidates[i+1:]...)
+				break
+			}
+		}
+	}
+	return evicted
+}
+
+// TestSelectPeerToEvictProtected ensures no peer is evicted when every
+// candidate is covered by one of the protections.
+func TestSelectPeerToEvictProtected(t *testing.T) {
+	if _, ok := SelectPeerToEvict(nil); ok {
+		t.Fatal("SelectPeerToEvict: evicted a peer from an empty set")
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	numProtected := evictProtectNetGroups + evictProtectPing +
+		evictProtectTxRelay + evictProtectBlockRelay
+	candidates := randomCandidates(rng, numProtected, 3)
+	if id, ok := SelectPeerToEvict(candidates); ok {
+		t.Fatalf("SelectPeerToEvict: evicted peer %d with only %d "+
+			"candidates", id, numProtected)
+	}
+
+	candidates = randomCandidates(rng, numProtected+1, 3)
+	if _, ok := SelectPeerToEvict(candidates); !ok {
+		t.Fatalf("SelectPeerToEvict: no peer evicted with %d "+
+			"candidates", numProtected+1)
+	}
+}
+
+// TestSelectPeerToEvictNetGroup ensures peers are evicted from the most
+// represented network group so an attacker controlling a single network
+// group is unable to occupy all inbound slots.
+func TestSelectPeerToEvictNetGroup(t *testing.T) {
+	base := time.Unix(1500000000, 0)
+	var candidates []EvictionCandidate
+
+	// Honest peers in distinct network groups which connected first.
+	for i := 0; i < 10; i++ {
+		candidates = append(candidates, EvictionCandidate{
+			ID:            int32(i),
+			ConnTime:      base.Add(time.Duration(i) * time.Second),
+			MinPingTime:   time.Duration(50+i) * time.Millisecond,
+			KeyedNetGroup: uint64(i),
+		})
+	}
+
+	// Attacker peers which all share a network group and have the best
+	// ping times.
+	for i := 10; i < 40; i++ {
+		candidates = append(candidates, EvictionCandidate{
+			ID:            int32(i),
+			ConnTime:      base.Add(time.Duration(i) * time.Minute),
+			MinPingTime:   time.Millisecond,
+			KeyedNetGroup: 1000,
+		})
+	}
+
+	id, ok := SelectPeerToEvict(candidates)
+	if !ok {
+		t.Fatal("SelectPeerToEvict: no peer evicted")
+	}
+	if id < 10 {
+		t.Fatalf("SelectPeerToEvict: evicted honest peer %d", id)
+	}
+}
+
+// TestSelectPeerToEvictPreferEvict ensures peers which are preferred for
+// eviction are selected over peers in the most represented network group.
+func TestSelectPeerToEvictPreferEvict(t *testing.T) {
+	base := time.Unix(1500000000, 0)
+	var candidates []EvictionCandidate
+	for i := 0; i < 40; i++ {
+		candidates = append(candidates, EvictionCandidate{
+			ID:            int32(i),
+			ConnTime:      base.Add(time.Duration(i) * time.Second),
+			MinPingTime:   time.Duration(i+1) * time.Millisecond,
+			KeyedNetGroup: uint64(i % 2),
+		})
+	}
+
+	// Peer 30 is neither protected nor the youngest member of the most
+	// represented network group, so it is only evicted when preferred.
+	candidates[30].PreferEvict = true
+
+	id, ok := SelectPeerToEvict(candidates)
+	if !ok || id != 30 {
+		t.Fatalf("SelectPeerToEvict: got (%d, %v), want (30, true)", id,
+			ok)
+	}
+
+	candidates[30].PreferEvict = false
+	id, ok = SelectPeerToEvict(candidates)
+	if !ok || id == 30 {
+		t.Fatalf("SelectPeerToEvict: got (%d, %v), want peer other "+
+			"than 30", id, ok)
+	}
+}
+
+// TestSelectPeerToEvictProtections ensures the peers covered by each of the
+// individual protections are never evicted from synthetic peer sets.
+func TestSelectPeerToEvictProtections(t *testing.T) {
+	tests := []struct {
+		name    string
+		protect func(c *EvictionCandidate)
+	}{
+		{
+			name: "highest netgroup",
+			protect: func(c *EvictionCandidate) {
+				c.KeyedNetGroup = 1 << 62
+			},
+		},
+		{
+			name: "lowest ping",
+			protect: func(c *EvictionCandidate) {
+				c.MinPingTime = time.Microsecond
+			},
+		},
+		{
+			name: "novel transaction",
+			protect: func(c *EvictionCandidate) {
+				c.LastTxTime = time.Unix(1600000000, 0)
+			},
+		},
+		{
+			name: "novel block",
+			protect: func(c *EvictionCandidate) {
+				c.LastBlockTime = time.Unix(1600000000, 0)
+			},
+		},
+		{
+			name: "longest connection",
+			protect: func(c *EvictionCandidate) {
+				c.ConnTime = time.Unix(1400000000, 0)
+			},
+		},
+	}
+
+	// The longest connected half of the peers left after the other
+	// protections is only protected while at least two peers are left,
+	// so stop evicting before that point.
+	numProtected := evictProtectNetGroups + evictProtectPing +
+		evictProtectTxRelay + evictProtectBlockRelay
+	for _, test := range tests {
+		for seed := int64(0); seed < 20; seed++ {
+			rng := rand.New(rand.NewSource(seed))
+			candidates := randomCandidates(rng, 100, 5)
+			target := candidates[rng.Intn(len(candidates))].ID
+			test.protect(&candidates[target])
+
+			evicted := evictAll(candidates, numProtected+2)
+			if _, ok := evicted[target]; ok {
+				t.Errorf("%s (seed %d): protected peer %d was "+
+					"evicted", test.name, seed, target)
+			}
+			if len(evicted) == 0 {
+				t.Errorf("%s (seed %d): no peers evicted",
+					test.name, seed)
+			}
+		}
+	}
+}
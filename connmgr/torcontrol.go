@@ -0,0 +1,307 @@
+// Copyright (c) 2013-2016 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package connmgr
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strings"
+)
+
+const (
+	// torControlOK is the status code of successful Tor control replies.
+	torControlOK = 250
+
+	// torCookieLen is the length of the Tor authentication cookie.
+	torCookieLen = 32
+
+	// torNonceLen is the length of the client nonce used with safe cookie
+	// authentication.
+	torNonceLen = 32
+
+	// torServerHashKey and torClientHashKey are the HMAC keys used to
+	// prove knowledge of the authentication cookie with safe cookie
+	// authentication.
+	torServerHashKey = "Tor safe cookie authentication server-to-controller hash"
+	torClientHashKey = "Tor safe cookie authentication controller-to-server hash"
+)
+
+var (
+	// ErrTorControlNoAuthMethod indicates none of the authentication
+	// methods offered by the Tor control port are supported or
+	// configured.
+	ErrTorControlNoAuthMethod = errors.New("no supported tor control " +
+		"authentication method")
+
+	// ErrTorControlServerHash indicates the server hash returned during
+	// safe cookie authentication does not match the cookie, which means
+	// the control port is not run by the Tor instance owning the cookie.
+	ErrTorControlServerHash = errors.New("invalid tor control server hash")
+
+	// ErrTorControlInvalidResponse indicates the Tor control port returned
+	// a reply in an unexpected format.
+	ErrTorControlInvalidResponse = errors.New("invalid tor control response")
+)
+
+// TorControl is a client for the Tor control protocol.  It is used to
+// authenticate to a Tor instance and manage the ephemeral onion services that
+// allow inbound connections over Tor.
+//
+// The methods are not safe for concurrent access.
+type TorControl struct {
+	conn *textproto.Conn
+}
+
+// NewTorControl returns a Tor control client which uses the passed connection
+// to a Tor control port.
+func NewTorControl(conn net.Conn) *TorControl {
+	return &TorControl{conn: textproto.NewConn(conn)}
+}
+
+// DialTorControl connects to the Tor control port at the passed address.
+func DialTorControl(addr string) (*TorControl, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewTorControl(conn), nil
+}
+
+// Close closes the connection to the Tor control port.  Any ephemeral onion
+// services created by the client which have not been removed are removed by
+// Tor once the connection is closed.
+func (c *TorControl) Close() error {
+	return c.conn.Close()
+}
+
+// command sends the passed command and returns the lines of the successful
+// reply.  The final "OK" line of multi-line replies is omitted.
+func (c *TorControl) command(format string, args ...interface{}) ([]string, error) {
+	id, err := c.conn.Cmd(format, args...)
+	if err != nil {
+		return nil, err
+	}
+	c.conn.StartResponse(id)
+	defer c.conn.EndResponse(id)
+
+	_, msg, err := c.conn.ReadResponse(torControlOK)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(msg, "\n")
+	if len(lines) > 1 && lines[len(lines)-1] == "OK" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines, nil
+}
+
+// Authenticate authenticates to the Tor control port.  The authentication
+// methods offered by Tor are queried and, in order of preference, no
+// authentication, a hashed password when a password is passed, safe cookie or
+// plain cookie authentication is used.
+func (c *TorControl) Authenticate(password string) error {
+	lines, err := c.command("PROTOCOLINFO 1")
+	if err != nil {
+		return err
+	}
+	methods := make(map[string]bool)
+	var cookieFile string
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "AUTH ") {
+			continue
+		}
+		args := parseTorReplyArgs(line[len("AUTH "):])
+		for _, method := range strings.Split(args["METHODS"], ",") {
+			methods[method] = true
+		}
+		cookieFile = args["COOKIEFILE"]
+	}
+
+	switch {
+	case methods["NULL"]:
+		_, err = c.command("AUTHENTICATE")
+		return err
+
+	case methods["HASHEDPASSWORD"] && password != "":
+		_, err = c.command("AUTHENTICATE %s", quoteTorString(password))
+		return err
+
+	case methods["SAFECOOKIE"] && cookieFile != "":
+		return c.authenticateSafeCookie(cookieFile)
+
+	case methods["COOKIE"] && cookieFile != "":
+		cookie, err := readTorCookie(cookieFile)
+		if err != nil {
+			return err
+		}
+		_, err = c.command("AUTHENTICATE %x", cookie)
+		return err
+	}
+	return ErrTorControlNoAuthMethod
+}
+
+// authenticateSafeCookie authenticates using the SAFECOOKIE method which
+// proves knowledge of the cookie stored in the passed file without revealing
+// it and ensures the control port belongs to the Tor instance that wrote the
+// cookie.
+func (c *TorControl) authenticateSafeCookie(cookieFile string) error {
+	cookie, err := readTorCookie(cookieFile)
+	if err != nil {
+		return err
+	}
+	clientNonce := make([]byte, torNonceLen)
+	if _, err := rand.Read(clientNonce); err != nil {
+		return err
+	}
+
+	lines, err := c.command("AUTHCHALLENGE SAFECOOKIE %x", clientNonce)
+	if err != nil {
+		return err
+	}
+	if len(lines) != 1 || !strings.HasPrefix(lines[0], "AUTHCHALLENGE ") {
+		return ErrTorControlInvalidResponse
+	}
+	args := parseTorReplyArgs(lines[0][len("AUTHCHALLENGE "):])
+	serverHash, err := hex.DecodeString(args["SERVERHASH"])
+	if err != nil {
+		return ErrTorControlInvalidResponse
+	}
+	serverNonce, err := hex.DecodeString(args["SERVERNONCE"])
+	if err != nil {
+		return ErrTorControlInvalidResponse
+	}
+
+	msg := make([]byte, 0, len(cookie)+len(clientNonce)+len(serverNonce))
+	msg = append(msg, cookie...)
+	msg = append(msg, clientNonce...)
+	msg = append(msg, serverNonce...)
+	if !hmac.Equal(serverHash, torCookieHash(torServerHashKey, msg)) {
+		return ErrTorControlServerHash
+	}
+
+	_, err = c.command("AUTHENTICATE %x", torCookieHash(torClientHashKey, msg))
+	return err
+}
+
+// AddOnion creates an ephemeral v3 onion service which forwards connections
+// to the passed virtual port to the passed target address.  A new key is
+// generated when privateKey is empty, otherwise it must be a key previously
+// returned by AddOnion.  The service ID, which is the onion address without
+// the ".onion" suffix, and the private key of the service are returned.
+func (c *TorControl) AddOnion(privateKey string, virtPort uint16,
+	target string) (string, string, error) {
+
+	keyArg := "NEW:ED25519-V3"
+	if privateKey != "" {
+		keyArg = privateKey
+	}
+	lines, err := c.command("ADD_ONION %s Port=%d,%s", keyArg, virtPort,
+		target)
+	if err != nil {
+		return "", "", err
+	}
+
+	var serviceID string
+	for _, line := range lines {
+		switch {
+		case strings.HasPrefix(line, "ServiceID="):
+			serviceID = line[len("ServiceID="):]
+		case strings.HasPrefix(line, "PrivateKey="):
+			privateKey = line[len("PrivateKey="):]
+		}
+	}
+	if serviceID == "" || privateKey == "" {
+		return "", "", ErrTorControlInvalidResponse
+	}
+	return serviceID, privateKey, nil
+}
+
+// DelOnion removes the ephemeral onion service with the passed service ID.
+func (c *TorControl) DelOnion(serviceID string) error {
+	_, err := c.command("DEL_ONION %s", serviceID)
+	return err
+}
+
+// readTorCookie reads the Tor authentication cookie from the passed file.
+func readTorCookie(path string) ([]byte, error) {
+	cookie, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(cookie) != torCookieLen {
+		return nil, fmt.Errorf("tor cookie file %s has invalid length %d",
+			path, len(cookie))
+	}
+	return cookie, nil
+}
+
+// torCookieHash returns the HMAC-SHA256 of the passed message using the passed
+// key.
+func torCookieHash(key string, msg []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(msg)
+	return mac.Sum(nil)
+}
+
+// quoteTorString returns the passed string as a quoted string as defined by
+// the Tor control protocol.
+func quoteTorString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		if s[i] == '"' || s[i] == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(s[i])
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// parseTorReplyArgs parses the space separated KEY=VALUE pairs of a Tor
+// control reply line.  Values may be quoted strings.
+func parseTorReplyArgs(s string) map[string]string {
+	args := make(map[string]string)
+	for len(s) > 0 {
+		s = strings.TrimLeft(s, " ")
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			break
+		}
+		key := s[:eq]
+		s = s[eq+1:]
+
+		var value strings.Builder
+		if strings.HasPrefix(s, `"`) {
+			i := 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				value.WriteByte(s[i])
+			}
+			s = s[i:]
+			if len(s) > 0 {
+				s = s[1:]
+			}
+		} else {
+			end := strings.IndexByte(s, ' ')
+			if end < 0 {
+				end = len(s)
+			}
+			value.WriteString(s[:end])
+			s = s[end:]
+		}
+		args[key] = value.String()
+	}
+	return args
+}
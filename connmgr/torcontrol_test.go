@@ -0,0 +1,240 @@
+// Copyright (c) 2013-2016 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package connmgr
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeTorControl is a minimal Tor control port server used to test the
+// control client.  It accepts a single connection and answers commands with
+// canned replies.
+type fakeTorControl struct {
+	listener    net.Listener
+	methods     string
+	cookieFile  string
+	cookie      []byte
+	password    string
+	serverNonce []byte
+	badHash     bool
+	commands    chan string
+	done        chan struct{}
+}
+
+// newFakeTorControl starts a fake control port which offers the passed
+// authentication methods.
+func newFakeTorControl(t *testing.T, methods string) *fakeTorControl {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: unexpected error: %v", err)
+	}
+	s := &fakeTorControl{
+		listener:    listener,
+		methods:     methods,
+		serverNonce: bytes.Repeat([]byte{0x02}, torNonceLen),
+		commands:    make(chan string, 16),
+		done:        make(chan struct{}),
+	}
+	go s.serve()
+	return s
+}
+
+// serve accepts a single connection and replies to its commands until the
+// connection is closed.
+func (s *fakeTorControl) serve() {
+	defer close(s.done)
+	conn, err := s.listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	tc := textproto.NewConn(conn)
+	var clientNonce []byte
+	for {
+		line, err := tc.ReadLine()
+		if err != nil {
+			return
+		}
+		s.commands <- line
+		fields := strings.Fields(line)
+		switch fields[0] {
+		case "PROTOCOLINFO":
+			tc.PrintfLine("250-PROTOCOLINFO 1")
+			tc.PrintfLine("250-AUTH METHODS=%s COOKIEFILE=%s", s.methods,
+				quoteTorString(s.cookieFile))
+			tc.PrintfLine(`250-VERSION Tor="0.4.5.6"`)
+			tc.PrintfLine("250 OK")
+
+		case "AUTHCHALLENGE":
+			clientNonce, _ = hex.DecodeString(fields[2])
+			msg := append(append(append([]byte{}, s.cookie...),
+				clientNonce...), s.serverNonce...)
+			hash := torCookieHash(torServerHashKey, msg)
+			if s.badHash {
+				hash[0] ^= 0xff
+			}
+			tc.PrintfLine("250 AUTHCHALLENGE SERVERHASH=%x SERVERNONCE=%x",
+				hash, s.serverNonce)
+
+		case "AUTHENTICATE":
+			want := "AUTHENTICATE"
+			switch {
+			case strings.Contains(s.methods, "NULL"):
+			case s.password != "":
+				want += " " + quoteTorString(s.password)
+			case clientNonce != nil:
+				msg := append(append(append([]byte{}, s.cookie...),
+					clientNonce...), s.serverNonce...)
+				want += " " + hex.EncodeToString(torCookieHash(
+					torClientHashKey, msg))
+			default:
+				want += " " + hex.EncodeToString(s.cookie)
+			}
+			if line != want {
+				tc.PrintfLine("515 Authentication failed")
+				continue
+			}
+			tc.PrintfLine("250 OK")
+
+		case "ADD_ONION":
+			tc.PrintfLine("250-ServiceID=" +
+				"pg6mmjiyjmcrsslvykfwnntlaru7p5svn6y2ymmju6nubxndf4pscryd")
+			if strings.HasPrefix(fields[1], "NEW:") {
+				tc.PrintfLine("250-PrivateKey=ED25519-V3:c2VjcmV0")
+			}
+			tc.PrintfLine("250 OK")
+
+		case "DEL_ONION":
+			tc.PrintfLine("250 OK")
+
+		default:
+			tc.PrintfLine("510 Unrecognized command")
+		}
+	}
+}
+
+// TestTorControl ensures the Tor control client authenticates with each of
+// the supported methods and manages onion services as expected.
+func TestTorControl(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torcontrol")
+	if err != nil {
+		t.Fatalf("TempDir: unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	cookieFile := filepath.Join(dir, "control_auth_cookie")
+	cookie := bytes.Repeat([]byte{0x01}, torCookieLen)
+	if err := ioutil.WriteFile(cookieFile, cookie, 0600); err != nil {
+		t.Fatalf("WriteFile: unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		methods  string
+		password string
+		badHash  bool
+		wantErr  bool
+	}{
+		{name: "null", methods: "NULL"},
+		{name: "hashed password", methods: "HASHEDPASSWORD",
+			password: `pass "word"\`},
+		{name: "safe cookie", methods: "COOKIE,SAFECOOKIE"},
+		{name: "cookie", methods: "COOKIE"},
+		{name: "bad server hash", methods: "SAFECOOKIE", badHash: true,
+			wantErr: true},
+		{name: "no password", methods: "HASHEDPASSWORD", wantErr: true},
+	}
+	for _, test := range tests {
+		s := newFakeTorControl(t, test.methods)
+		s.cookieFile = cookieFile
+		s.cookie = cookie
+		s.password = test.password
+		s.badHash = test.badHash
+
+		c, err := DialTorControl(s.listener.Addr().String())
+		if err != nil {
+			t.Fatalf("%s: DialTorControl: unexpected error: %v",
+				test.name, err)
+		}
+		err = c.Authenticate(test.password)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: Authenticate: expected error", test.name)
+			}
+			c.Close()
+			s.listener.Close()
+			<-s.done
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: Authenticate: unexpected error: %v", test.name,
+				err)
+			c.Close()
+			s.listener.Close()
+			<-s.done
+			continue
+		}
+
+		serviceID, key, err := c.AddOnion("", 8338, "127.0.0.1:8338")
+		if err != nil {
+			t.Fatalf("%s: AddOnion: unexpected error: %v", test.name, err)
+		}
+		if serviceID != "pg6mmjiyjmcrsslvykfwnntlaru7p5svn6y2ymmju6nubxndf4pscryd" ||
+			key != "ED25519-V3:c2VjcmV0" {
+
+			t.Errorf("%s: AddOnion: got (%s, %s)", test.name, serviceID,
+				key)
+		}
+
+		// Reusing the key must return the passed key since Tor does not
+		// include it in the reply.
+		_, key2, err := c.AddOnion(key, 8338, "127.0.0.1:8338")
+		if err != nil || key2 != key {
+			t.Errorf("%s: AddOnion with key: got (%s, %v)", test.name,
+				key2, err)
+		}
+		if err := c.DelOnion(serviceID); err != nil {
+			t.Errorf("%s: DelOnion: unexpected error: %v", test.name, err)
+		}
+		c.Close()
+		s.listener.Close()
+		<-s.done
+
+		// Ensure the expected commands were sent.
+		close(s.commands)
+		var cmds []string
+		for cmd := range s.commands {
+			cmds = append(cmds, strings.Fields(cmd)[0])
+		}
+		want := "PROTOCOLINFO AUTHENTICATE ADD_ONION ADD_ONION DEL_ONION"
+		if strings.Contains(test.methods, "SAFECOOKIE") {
+			want = "PROTOCOLINFO AUTHCHALLENGE AUTHENTICATE ADD_ONION " +
+				"ADD_ONION DEL_ONION"
+		}
+		if got := strings.Join(cmds, " "); got != want {
+			t.Errorf("%s: got commands %q, want %q", test.name, got, want)
+		}
+	}
+}
+
+// TestParseTorReplyArgs ensures key value pairs in Tor control replies are
+// parsed with quoted strings unescaped.
+func TestParseTorReplyArgs(t *testing.T) {
+	args := parseTorReplyArgs(`METHODS=COOKIE,SAFECOOKIE ` +
+		`COOKIEFILE="/var/lib/tor/a \"b\"\\c"`)
+	if args["METHODS"] != "COOKIE,SAFECOOKIE" {
+		t.Errorf("METHODS: got %q", args["METHODS"])
+	}
+	if args["COOKIEFILE"] != `/var/lib/tor/a "b"\c` {
+		t.Errorf("COOKIEFILE: got %q", args["COOKIEFILE"])
+	}
+}
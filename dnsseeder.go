@@ -0,0 +1,399 @@
+// Copyright (c) 2013-2017 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btgsuite/btgd/addrmgr"
+	"github.com/btgsuite/btgd/wire"
+)
+
+const (
+	// dnsSeederGoodAge is the maximum time since an address last completed
+	// a version handshake for it to be returned by the DNS seeder.
+	dnsSeederGoodAge = 24 * time.Hour
+
+	// dnsSeederCacheTime is the time the addresses returned for a set of
+	// services are cached before they are fetched from the address manager
+	// again.
+	dnsSeederCacheTime = time.Minute
+
+	// dnsSeederTTL is the time in seconds resolvers may cache the
+	// addresses returned by the DNS seeder.
+	dnsSeederTTL = 60
+
+	// dnsSeederMaxAnswers is the maximum number of addresses returned in a
+	// single response.
+	dnsSeederMaxAnswers = 25
+
+	// dnsMaxUDPSize is the maximum size of a DNS message sent over UDP by
+	// resolvers which don't support EDNS.
+	dnsMaxUDPSize = 512
+
+	// dnsHeaderSize is the size of the header of a DNS message.
+	dnsHeaderSize = 12
+)
+
+// The following constants are the DNS record types, classes and response codes
+// used by the DNS seeder.
+const (
+	dnsTypeA    = 1
+	dnsTypeNS   = 2
+	dnsTypeSOA  = 6
+	dnsTypeAAAA = 28
+	dnsTypeANY  = 255
+
+	dnsClassIN  = 1
+	dnsClassANY = 255
+
+	dnsRcodeSuccess  = 0
+	dnsRcodeFormErr  = 1
+	dnsRcodeNXDomain = 3
+	dnsRcodeNotImp   = 4
+	dnsRcodeRefused  = 5
+)
+
+// dnsSeederCacheEntry houses the addresses returned by the DNS seeder for a
+// set of services.
+type dnsSeederCacheEntry struct {
+	ipv4    []net.IP
+	ipv6    []net.IP
+	expires time.Time
+}
+
+// dnsSeeder answers DNS queries for the A and AAAA records of a host name with
+// the addresses of good peers from the address manager, which makes the node
+// act as a DNS seed.  Subdomains of the form x<services in hex> return only
+// the peers which advertise the services as used by connmgr.SeedFromDNS.
+type dnsSeeder struct {
+	host  string
+	ns    string
+	port  uint16
+	amgr  *addrmgr.AddrManager
+	conns []net.PacketConn
+	wg    sync.WaitGroup
+
+	// cache houses the addresses recently returned for each set of
+	// services.  It is protected by mtx.
+	mtx   sync.Mutex
+	cache map[wire.ServiceFlag]*dnsSeederCacheEntry
+}
+
+// newDNSSeeder returns a DNS seeder which answers queries for the passed host
+// name on the passed listen addresses.  Only addresses on the passed port are
+// returned since clients connect to the seeded addresses on the default port
+// of the network.  The name server is returned for NS queries of the host name
+// when it is not empty.
+func newDNSSeeder(host, ns string, listenAddrs []string, port uint16,
+	amgr *addrmgr.AddrManager) (*dnsSeeder, error) {
+
+	d := &dnsSeeder{
+		host:  strings.TrimSuffix(strings.ToLower(host), "."),
+		ns:    strings.TrimSuffix(strings.ToLower(ns), "."),
+		port:  port,
+		amgr:  amgr,
+		cache: make(map[wire.ServiceFlag]*dnsSeederCacheEntry),
+	}
+	for _, addr := range listenAddrs {
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			for _, conn := range d.conns {
+				conn.Close()
+			}
+			return nil, err
+		}
+		d.conns = append(d.conns, conn)
+	}
+	return d, nil
+}
+
+// Start begins answering DNS queries on all listen addresses.
+func (d *dnsSeeder) Start() {
+	for _, conn := range d.conns {
+		d.wg.Add(1)
+		go d.serve(conn)
+	}
+}
+
+// Stop stops answering DNS queries and waits for the listeners to finish.
+func (d *dnsSeeder) Stop() {
+	for _, conn := range d.conns {
+		conn.Close()
+	}
+	d.wg.Wait()
+}
+
+// serve answers the DNS queries received on the passed connection until it is
+// closed.
+//
+// It must be run as a goroutine.
+func (d *dnsSeeder) serve(conn net.PacketConn) {
+	defer d.wg.Done()
+
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		resp := d.handleQuery(buf[:n])
+		if resp == nil {
+			continue
+		}
+		if _, err := conn.WriteTo(resp, addr); err != nil {
+			srvrLog.Debugf("Unable to answer DNS query from %s: %v",
+				addr, err)
+		}
+	}
+}
+
+// isValidDNSName returns whether the passed host name can be encoded in a DNS
+// message.
+func isValidDNSName(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+	}
+	return true
+}
+
+// parseDNSName parses the uncompressed domain name at the passed offset of a
+// DNS message and returns it along with the offset following it.
+func parseDNSName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	for {
+		if off >= len(msg) {
+			return "", 0, errors.New("domain name out of range")
+		}
+		n := int(msg[off])
+		off++
+		if n == 0 {
+			break
+		}
+		// Compression is not used in the question of queries.
+		if n&0xc0 != 0 || off+n > len(msg) {
+			return "", 0, errors.New("invalid domain name label")
+		}
+		labels = append(labels, string(msg[off:off+n]))
+		off += n
+	}
+	return strings.Join(labels, "."), off, nil
+}
+
+// appendDNSName appends the uncompressed encoding of the passed domain name.
+func appendDNSName(b []byte, name string) []byte {
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+		}
+	}
+	return append(b, 0)
+}
+
+// appendDNSRecord appends a resource record with the passed encoded owner
+// name, type, time to live and data.
+func appendDNSRecord(b, name []byte, rrType uint16, ttl uint32,
+	data []byte) []byte {
+
+	var fixed [10]byte
+	binary.BigEndian.PutUint16(fixed[0:2], rrType)
+	binary.BigEndian.PutUint16(fixed[2:4], dnsClassIN)
+	binary.BigEndian.PutUint32(fixed[4:8], ttl)
+	binary.BigEndian.PutUint16(fixed[8:10], uint16(len(data)))
+	b = append(b, name...)
+	b = append(b, fixed[:]...)
+	return append(b, data...)
+}
+
+// services returns the services the peers returned for the passed name must
+// advertise and whether the name is served by the seeder.
+func (d *dnsSeeder) services(name string) (wire.ServiceFlag, bool) {
+	if name == d.host {
+		return wire.SFNodeNetwork, true
+	}
+	label := strings.TrimSuffix(name, "."+d.host)
+	if label == name || len(label) < 2 || label[0] != 'x' {
+		return 0, false
+	}
+	services, err := strconv.ParseUint(label[1:], 16, 64)
+	if err != nil {
+		return 0, false
+	}
+	return wire.ServiceFlag(services) | wire.SFNodeNetwork, true
+}
+
+// addresses returns the IPv4 and IPv6 addresses of the good peers which
+// advertise the passed services in random order.
+func (d *dnsSeeder) addresses(services wire.ServiceFlag) ([]net.IP, []net.IP) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	entry, ok := d.cache[services]
+	if !ok || time.Now().After(entry.expires) {
+		// Remove the expired entries so queries for many different
+		// services can't grow the cache without bound.
+		for s, e := range d.cache {
+			if time.Now().After(e.expires) {
+				delete(d.cache, s)
+			}
+		}
+
+		entry = &dnsSeederCacheEntry{
+			expires: time.Now().Add(dnsSeederCacheTime),
+		}
+		since := time.Now().Add(-dnsSeederGoodAge)
+		for _, na := range d.amgr.GoodAddresses(services, since) {
+			if na.Port != d.port || !addrmgr.IsRoutable(na) {
+				continue
+			}
+			switch na.NetworkID {
+			case wire.NetIPv4:
+				entry.ipv4 = append(entry.ipv4, na.IP().To4())
+			case wire.NetIPv6:
+				entry.ipv6 = append(entry.ipv6, na.IP())
+			}
+		}
+		d.cache[services] = entry
+	}
+
+	shuffle := func(ips []net.IP) []net.IP {
+		shuffled := make([]net.IP, len(ips))
+		for i, j := range rand.Perm(len(ips)) {
+			shuffled[i] = ips[j]
+		}
+		return shuffled
+	}
+	return shuffle(entry.ipv4), shuffle(entry.ipv6)
+}
+
+// soaRecord returns the data of the SOA record of the host name of the seeder.
+func (d *dnsSeeder) soaRecord() []byte {
+	mname := d.ns
+	if mname == "" {
+		mname = d.host
+	}
+	data := appendDNSName(nil, mname)
+	data = appendDNSName(data, "hostmaster."+d.host)
+	var fixed [20]byte
+	binary.BigEndian.PutUint32(fixed[0:4], uint32(time.Now().Unix()/60))
+	binary.BigEndian.PutUint32(fixed[4:8], 604800)
+	binary.BigEndian.PutUint32(fixed[8:12], 86400)
+	binary.BigEndian.PutUint32(fixed[12:16], 2592000)
+	binary.BigEndian.PutUint32(fixed[16:20], dnsSeederTTL)
+	return append(data, fixed[:]...)
+}
+
+// handleQuery returns the response to the passed DNS query or nil when the
+// message should not be answered.
+func (d *dnsSeeder) handleQuery(req []byte) []byte {
+	// Ignore messages which are too short to reply to and responses.
+	if len(req) < dnsHeaderSize || req[2]&0x80 != 0 {
+		return nil
+	}
+
+	// The response echoes the ID, opcode and recursion desired flag of the
+	// query.  It only contains the header until the question is parsed.
+	resp := make([]byte, dnsHeaderSize, dnsMaxUDPSize)
+	copy(resp[0:2], req[0:2])
+	resp[2] = 0x80 | req[2]&0x79
+	reply := func(rcode byte) []byte {
+		resp[3] = rcode
+		return resp
+	}
+
+	opcode := (req[2] >> 3) & 0x0f
+	if opcode != 0 {
+		return reply(dnsRcodeNotImp)
+	}
+	if binary.BigEndian.Uint16(req[4:6]) != 1 {
+		return reply(dnsRcodeFormErr)
+	}
+	name, off, err := parseDNSName(req, dnsHeaderSize)
+	if err != nil || off+4 > len(req) {
+		return reply(dnsRcodeFormErr)
+	}
+	qtype := binary.BigEndian.Uint16(req[off : off+2])
+	qclass := binary.BigEndian.Uint16(req[off+2 : off+4])
+	resp = append(resp, req[dnsHeaderSize:off+4]...)
+	binary.BigEndian.PutUint16(resp[4:6], 1)
+
+	// Refuse queries for names outside of the zone of the seeder.
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	if name != d.host && !strings.HasSuffix(name, "."+d.host) {
+		return reply(dnsRcodeRefused)
+	}
+
+	// The seeder is authoritative for its zone.
+	resp[2] |= 0x04
+	services, ok := d.services(name)
+	rcode := byte(dnsRcodeSuccess)
+	if !ok {
+		rcode = dnsRcodeNXDomain
+	}
+
+	// Answers refer to the name of the question by pointing to it.
+	namePtr := []byte{0xc0, dnsHeaderSize}
+	var answers int
+	addAnswer := func(rrType uint16, ttl uint32, data []byte) bool {
+		if answers >= dnsSeederMaxAnswers ||
+			len(resp)+len(namePtr)+10+len(data) > dnsMaxUDPSize {
+			return false
+		}
+		resp = appendDNSRecord(resp, namePtr, rrType, ttl, data)
+		answers++
+		return true
+	}
+	if ok && (qclass == dnsClassIN || qclass == dnsClassANY) {
+		ipv4, ipv6 := d.addresses(services)
+		if qtype == dnsTypeA || qtype == dnsTypeANY {
+			for _, ip := range ipv4 {
+				if !addAnswer(dnsTypeA, dnsSeederTTL, ip) {
+					break
+				}
+			}
+		}
+		if qtype == dnsTypeAAAA || qtype == dnsTypeANY {
+			for _, ip := range ipv6 {
+				if !addAnswer(dnsTypeAAAA, dnsSeederTTL, ip) {
+					break
+				}
+			}
+		}
+		if name == d.host && d.ns != "" &&
+			(qtype == dnsTypeNS || qtype == dnsTypeANY) {
+			addAnswer(dnsTypeNS, 86400, appendDNSName(nil, d.ns))
+		}
+		if name == d.host && (qtype == dnsTypeSOA || qtype == dnsTypeANY) {
+			addAnswer(dnsTypeSOA, dnsSeederTTL, d.soaRecord())
+		}
+	}
+	binary.BigEndian.PutUint16(resp[6:8], uint16(answers))
+
+	// Negative responses include the SOA record of the zone so resolvers
+	// know how long to cache them.
+	if answers == 0 {
+		resp = appendDNSRecord(resp, appendDNSName(nil, d.host),
+			dnsTypeSOA, dnsSeederTTL, d.soaRecord())
+		binary.BigEndian.PutUint16(resp[8:10], 1)
+	}
+	return reply(rcode)
+}
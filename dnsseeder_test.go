@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/btgsuite/btgd/addrmgr"
+	"github.com/btgsuite/btgd/wire"
+)
+
+// newTestDNSSeeder returns a DNS seeder for seed.example.com which listens on
+// the loopback interface and serves the passed good addresses along with an
+// address which never completed a version handshake.
+func newTestDNSSeeder(t *testing.T, good map[string]wire.ServiceFlag) (*dnsSeeder, func()) {
+	dir, err := ioutil.TempDir("", "dnsseeder")
+	if err != nil {
+		t.Fatalf("TempDir: unexpected error: %v", err)
+	}
+	amgr := addrmgr.New(dir, nil)
+	srcAddr := wire.NetAddressV2FromLegacy(wire.NewNetAddressIPPort(
+		net.IPv4(173, 144, 173, 111), 8338, 0))
+	add := func(addr string, services wire.ServiceFlag) *wire.NetAddressV2 {
+		na, err := amgr.DeserializeNetAddress(addr, services)
+		if err != nil {
+			t.Fatalf("DeserializeNetAddress: unexpected error: %v", err)
+		}
+		amgr.AddAddress(na, srcAddr)
+		return na
+	}
+	for addr, services := range good {
+		amgr.Good(add(addr, services))
+	}
+	add("60.1.1.99:8338", wire.SFNodeNetwork)
+
+	d, err := newDNSSeeder("Seed.Example.com.", "ns.example.com",
+		[]string{"127.0.0.1:0"}, 8338, amgr)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("newDNSSeeder: unexpected error: %v", err)
+	}
+	d.Start()
+	return d, func() {
+		d.Stop()
+		os.RemoveAll(dir)
+	}
+}
+
+// dnsQuery returns a DNS query for the passed name and type.
+func dnsQuery(name string, qtype uint16) []byte {
+	req := []byte{0x12, 0x34, 0x01, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	req = appendDNSName(req, name)
+	var tail [4]byte
+	binary.BigEndian.PutUint16(tail[0:2], qtype)
+	binary.BigEndian.PutUint16(tail[2:4], dnsClassIN)
+	return append(req, tail[:]...)
+}
+
+// TestDNSSeederLookup ensures a resolver receives the addresses of the good
+// peers which serve the full chain on the default port and that the service
+// subdomains filter them.
+func TestDNSSeederLookup(t *testing.T) {
+	d, cleanup := newTestDNSSeeder(t, map[string]wire.ServiceFlag{
+		"60.1.1.1:8338":      wire.SFNodeNetwork,
+		"60.1.1.2:8338":      wire.SFNodeNetwork | wire.SFNodeWitness,
+		"60.1.1.3:8338":      wire.SFNodeWitness,
+		"60.1.1.4:18338":     wire.SFNodeNetwork,
+		"10.1.1.5:8338":      wire.SFNodeNetwork,
+		"[2001:db9::6]:8338": wire.SFNodeNetwork | wire.SFNodeWitness,
+	})
+	defer cleanup()
+
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "udp",
+				d.conns[0].LocalAddr().String())
+		},
+	}
+
+	tests := []struct {
+		host string
+		want []string
+	}{
+		{
+			host: "seed.example.com",
+			want: []string{"2001:db9::6", "60.1.1.1", "60.1.1.2"},
+		},
+		{
+			host: "x9.seed.example.com",
+			want: []string{"2001:db9::6", "60.1.1.2"},
+		},
+		{
+			host: "x400.seed.example.com",
+			want: nil,
+		},
+	}
+	for _, test := range tests {
+		addrs, err := resolver.LookupIPAddr(context.Background(), test.host)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%s: expected error, got %v", test.host, addrs)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.host, err)
+			continue
+		}
+		var got []string
+		for _, addr := range addrs {
+			got = append(got, addr.IP.String())
+		}
+		sort.Strings(got)
+		if len(got) != len(test.want) {
+			t.Errorf("%s: got %v, want %v", test.host, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("%s: got %v, want %v", test.host, got,
+					test.want)
+				break
+			}
+		}
+	}
+}
+
+// TestDNSSeederResponseCodes ensures queries outside of the zone are refused,
+// unknown names within the zone don't exist, malformed queries are rejected and
+// the records of the zone itself are returned.
+func TestDNSSeederResponseCodes(t *testing.T) {
+	d, cleanup := newTestDNSSeeder(t, nil)
+	defer cleanup()
+
+	tests := []struct {
+		name    string
+		req     []byte
+		rcode   byte
+		answers uint16
+		qtype   uint16
+	}{
+		{
+			name:  "outside of zone",
+			req:   dnsQuery("example.org", dnsTypeA),
+			rcode: dnsRcodeRefused,
+		},
+		{
+			name:  "unknown name",
+			req:   dnsQuery("www.seed.example.com", dnsTypeA),
+			rcode: dnsRcodeNXDomain,
+		},
+		{
+			name:  "invalid service bits",
+			req:   dnsQuery("xzz.seed.example.com", dnsTypeA),
+			rcode: dnsRcodeNXDomain,
+		},
+		{
+			name:  "truncated question",
+			req:   dnsQuery("seed.example.com", dnsTypeA)[:20],
+			rcode: dnsRcodeFormErr,
+		},
+		{
+			name:    "name server",
+			req:     dnsQuery("seed.example.com", dnsTypeNS),
+			rcode:   dnsRcodeSuccess,
+			answers: 1,
+			qtype:   dnsTypeNS,
+		},
+		{
+			name:    "start of authority",
+			req:     dnsQuery("SEED.Example.com", dnsTypeSOA),
+			rcode:   dnsRcodeSuccess,
+			answers: 1,
+			qtype:   dnsTypeSOA,
+		},
+		{
+			name:  "no good addresses",
+			req:   dnsQuery("seed.example.com", dnsTypeA),
+			rcode: dnsRcodeSuccess,
+		},
+	}
+
+	for _, test := range tests {
+		resp := d.handleQuery(test.req)
+		if len(resp) < dnsHeaderSize {
+			t.Errorf("%s: short response %x", test.name, resp)
+			continue
+		}
+		if resp[0] != 0x12 || resp[1] != 0x34 || resp[2]&0x80 == 0 {
+			t.Errorf("%s: invalid response header %x", test.name,
+				resp[:dnsHeaderSize])
+		}
+		if rcode := resp[3] & 0x0f; rcode != test.rcode {
+			t.Errorf("%s: got rcode %d, want %d", test.name, rcode,
+				test.rcode)
+		}
+		answers := binary.BigEndian.Uint16(resp[6:8])
+		if answers != test.answers {
+			t.Errorf("%s: got %d answers, want %d", test.name,
+				answers, test.answers)
+			continue
+		}
+		if answers == 0 {
+			continue
+		}
+
+		// The answer follows the question and points to its name.
+		_, off, err := parseDNSName(resp, dnsHeaderSize)
+		if err != nil {
+			t.Errorf("%s: invalid question: %v", test.name, err)
+			continue
+		}
+		off += 4
+		if resp[off] != 0xc0 || resp[off+1] != dnsHeaderSize {
+			t.Errorf("%s: answer does not point to question", test.name)
+		}
+		if qtype := binary.BigEndian.Uint16(resp[off+2:]); qtype != test.qtype {
+			t.Errorf("%s: got answer type %d, want %d", test.name,
+				qtype, test.qtype)
+		}
+	}
+
+	// Responses are ignored.
+	resp := dnsQuery("seed.example.com", dnsTypeA)
+	resp[2] |= 0x80
+	if d.handleQuery(resp) != nil {
+		t.Error("response was answered")
+	}
+}
@@ -34,13 +34,37 @@ Application Options:
       --listen=             Add an interface/port to listen for connections
                             (default all interfaces port: 8333, testnet: 18333)
       --maxpeers=           Max number of inbound and outbound peers (125)
+      --maxinboundperip=    Max number of inbound peers from a single IP
+                            address -- 0 disables the limit (3)
+      --maxinboundpergroup= Max number of inbound peers from a single network
+                            group (/16 for IPv4, /32 for IPv6) -- 0 disables
+                            the limit (10)
+      --blockrelaypeers=    Number of additional outbound peers which only
+                            relay blocks and do not relay transactions or
+                            addresses (2)
+      --maxuploadtarget=    Try to keep the upload traffic to peers under the
+                            given target in MiB per 24h -- Historical blocks
+                            are no longer served to peers without the download
+                            permission once the target is reached -- 0
+                            disables the limit
+      --asmap=              Path to an asmap file in the Bitcoin Core format
+                            used to group peers by autonomous system number
+                            instead of IP prefix
       --nobanning           Disable banning of misbehaving peers
       --banduration=        How long to ban misbehaving peers.  Valid time units
                             are {s, m, h}.  Minimum 1 second (24h0m0s)
       --banthreshold=       Maximum allowed ban score before disconnecting and
                             banning misbehaving peers.
-      --whitelist=          Add an IP network or IP that will not be banned.
-                            (eg. 192.168.1.0/24 or ::1)
+      --whitelist=          Add an IP network or IP whose peers are granted
+                            permissions.  Format: '[<permissions>@]<IP or
+                            network>' -- Permissions are a comma separated list
+                            of {noban, relay, forcerelay, mempool, download,
+                            addr} and default to noban,relay,mempool,download
+                            (eg. 192.168.1.0/24 or relay,mempool@::1)
+      --whitebind=          Listen on an interface/port whose peers are granted
+                            permissions.  Format: '[<permissions>@]<host>:<port>'
+                            -- Permissions are the same as for --whitelist (eg.
+                            noban@127.0.0.1:8338)
   -u, --rpcuser=            Username for RPC connections
   -P, --rpcpass=            Password for RPC connections
       --rpclimituser=       Username for limited RPC connections
@@ -73,12 +97,28 @@ Application Options:
       --noonion             Disable connecting to tor hidden services
       --torisolation        Enable Tor stream isolation by randomizing user
                             credentials for each connection.
+      --torcontrol=         Tor control port used to create an onion service
+                            which accepts inbound connections over Tor (eg.
+                            127.0.0.1:9051)
+      --torpassword=        Password for the Tor control port -- cookie
+                            authentication is used when not set
+      --onlynet=            Only make automatic outbound connections to peers
+                            on the given network {ipv4, ipv6, onion, i2p,
+                            cjdns} -- May be specified multiple times
       --testnet             Use the test network
       --regtest             Use the regression test network
       --simnet              Use the simulation test network
       --addcheckpoint=      Add a custom checkpoint.  Format: '<height>:<hash>'
       --nocheckpoints       Disable built-in checkpoints.  Don't do this unless
                             you know what you're doing.
+      --assumevalid=        Skip script validation for the given block and its
+                            ancestors when it is buried in the best header
+                            chain -- 0 validates all scripts (default:
+                            network-specific)
+      --maxreorgdepth=      Do not reorganize to a chain with more work which
+                            would disconnect more than this many blocks,
+                            notify RPC websocket clients instead (0 to
+                            disable)
       --uacomment=          Comment to add to the user agent --
                             See BIP 14 for more information.
       --dbtype=             Database backend to use for the Block Chain (ffldb)
@@ -91,6 +131,16 @@ Application Options:
                             the log level for individual subsystems -- Use show
                             to list available subsystems (info)
       --upnp                Use UPnP to map our listening port outside of NAT
+      --natpmp              Use PCP or NAT-PMP to map our listening port outside
+                            of NAT
+      --dnsseederhost=      Act as a DNS seed by answering DNS queries for this
+                            host name with the addresses of good peers
+      --dnsseederlisten=    Add an interface/port to answer DNS seeder queries
+                            on (default all interfaces port: 53)
+      --dnsseederns=        Host name of the name server the DNS seeder host
+                            name is delegated to
+      --v2transport         Use the BIP0324 v2 encrypted transport protocol
+                            with peers which support it
       --minrelaytxfee=      The minimum transaction fee in BTC/kB to be
                             considered a non-zero fee.
       --limitfreerelay=     Limit relay of transactions with no transaction fee
@@ -115,6 +165,9 @@ Application Options:
       --nocfilters          Disable committed filtering (CF) support.
       --sigcachemaxsize=    The maximum number of entries in the signature
                             verification cache.
+      --utxocachemaxsize=   The maximum size in MiB of the in-memory cache of
+                            unspent transaction outputs before it is written
+                            to the database (default: 250)
       --blocksonly          Do not accept transactions from remote peers.
       --relaynonstd         Relay non-standard transactions regardless of the
                             default settings for the active network.
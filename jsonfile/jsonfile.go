@@ -0,0 +1,38 @@
+// Copyright (c) 2013-2017 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// Package jsonfile provides crash-safe writing of JSON encoded files.
+package jsonfile
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// Write writes the JSON encoding of the passed value to the file at the passed
+// path.  The encoding is written to a temporary file which is synced to disk
+// and then renamed over the file, so a crash while writing leaves either the
+// previous or the new file behind rather than a corrupted one.
+func Write(path string, v interface{}) error {
+	tmpPath := path + ".tmp"
+	w, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		w.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := w.Sync(); err != nil {
+		w.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := w.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
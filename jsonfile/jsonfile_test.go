@@ -0,0 +1,70 @@
+// Copyright (c) 2013-2017 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package jsonfile
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestWrite ensures values are written to and replace the file without
+// leaving the temporary file behind, and a failed write leaves the previous
+// file intact.
+func TestWrite(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "jsonfile")
+	if err != nil {
+		t.Fatalf("Failed creating a temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	path := filepath.Join(tmpDir, "test.json")
+
+	type value struct {
+		Version int      `json:"version"`
+		Entries []string `json:"entries"`
+	}
+	read := func() value {
+		t.Helper()
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("ReadFile: unexpected error: %v", err)
+		}
+		var v value
+		if err := json.Unmarshal(buf, &v); err != nil {
+			t.Fatalf("Unmarshal: unexpected error: %v", err)
+		}
+		return v
+	}
+
+	for _, want := range []value{
+		{Version: 1, Entries: []string{"a", "b"}},
+		{Version: 1, Entries: []string{"c"}},
+	} {
+		if err := Write(path, &want); err != nil {
+			t.Fatalf("Write: unexpected error: %v", err)
+		}
+		if got := read(); !reflect.DeepEqual(got, want) {
+			t.Fatalf("Write: got %v, want %v", got, want)
+		}
+		if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+			t.Fatal("Write: temporary file was left behind")
+		}
+	}
+
+	// Values which fail to encode do not replace the file.
+	if err := Write(path, make(chan int)); err == nil {
+		t.Fatal("Write: expected error for unsupported value")
+	}
+	want := value{Version: 1, Entries: []string{"c"}}
+	if got := read(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Write: got %v after failed write, want %v", got, want)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Fatal("Write: temporary file was left behind")
+	}
+}
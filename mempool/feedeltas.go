@@ -0,0 +1,189 @@
+// Copyright (c) 2013-2016 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package mempool
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/btgsuite/btgd/chaincfg/chainhash"
+	"github.com/btgsuite/btgd/jsonfile"
+)
+
+// feeDeltasVersion is the current version of the serialized fee deltas format.
+const feeDeltasVersion = 1
+
+// serializedFeeDelta is the on-disk representation of the fee delta of a
+// single transaction.
+type serializedFeeDelta struct {
+	TxID  string `json:"txid"`
+	Delta int64  `json:"delta"`
+}
+
+// serializedFeeDeltas is the on-disk representation of all fee deltas.
+type serializedFeeDeltas struct {
+	Version int                  `json:"version"`
+	Entries []serializedFeeDelta `json:"entries"`
+}
+
+// modifiedFee returns the fee of the transaction adjusted by the fee delta it
+// was prioritised with.
+func (txD *TxDesc) modifiedFee() int64 {
+	return txD.Fee + txD.FeeDelta
+}
+
+// modifiedFeePerKB returns the fee per kilobyte of the transaction adjusted by
+// the fee delta it was prioritised with.
+func (txD *TxDesc) modifiedFeePerKB() int64 {
+	if txD.FeeDelta == 0 {
+		return txD.FeePerKB
+	}
+	return txD.modifiedFee() * 1000 / GetTxVirtualSize(txD.Tx)
+}
+
+// saveFeeDeltas writes the fee deltas to the file configured by FeeDeltasFile.
+// It does nothing when no file is configured.
+//
+// This function MUST be called with the mempool lock held (for reads).
+func (mp *TxPool) saveFeeDeltas() error {
+	path := mp.cfg.FeeDeltasFile
+	if path == "" {
+		return nil
+	}
+
+	sfd := serializedFeeDeltas{
+		Version: feeDeltasVersion,
+		Entries: make([]serializedFeeDelta, 0, len(mp.feeDeltas)),
+	}
+	for hash, delta := range mp.feeDeltas {
+		sfd.Entries = append(sfd.Entries, serializedFeeDelta{
+			TxID:  hash.String(),
+			Delta: delta,
+		})
+	}
+
+	return jsonfile.Write(path, &sfd)
+}
+
+// LoadFeeDeltas reads the fee deltas stored in the file configured by
+// FeeDeltasFile.  A missing file is not an error.  It must be called before
+// any transactions are added to the pool.
+//
+// This function is safe for concurrent access.
+func (mp *TxPool) LoadFeeDeltas() error {
+	path := mp.cfg.FeeDeltasFile
+	if path == "" {
+		return nil
+	}
+
+	r, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer r.Close()
+
+	var sfd serializedFeeDeltas
+	if err := json.NewDecoder(r).Decode(&sfd); err != nil {
+		return fmt.Errorf("unable to decode %s: %v", path, err)
+	}
+	if sfd.Version != feeDeltasVersion {
+		return fmt.Errorf("unknown fee deltas version %d in %s",
+			sfd.Version, path)
+	}
+
+	mp.mtx.Lock()
+	defer mp.mtx.Unlock()
+
+	for _, entry := range sfd.Entries {
+		hash, err := chainhash.NewHashFromStr(entry.TxID)
+		if err != nil {
+			log.Warnf("Skipping invalid fee delta entry: %v", err)
+			continue
+		}
+		if entry.Delta != 0 {
+			mp.feeDeltas[*hash] = entry.Delta
+		}
+	}
+
+	log.Infof("Loaded %d transaction fee deltas from '%s'",
+		len(mp.feeDeltas), path)
+	return nil
+}
+
+// setFeeDelta sets the fee delta of the transaction with the passed hash and
+// updates the transaction when it is in the pool.
+//
+// This function MUST be called with the mempool lock held (for writes).
+func (mp *TxPool) setFeeDelta(hash *chainhash.Hash, delta int64) {
+	if delta == 0 {
+		delete(mp.feeDeltas, *hash)
+	} else {
+		mp.feeDeltas[*hash] = delta
+	}
+
+	// The descriptors handed out by MiningDescs may still be in use, so
+	// replace the descriptor instead of modifying it.
+	if txD, exists := mp.pool[*hash]; exists {
+		updated := *txD
+		updated.FeeDelta = delta
+		mp.pool[*hash] = &updated
+	}
+}
+
+// PrioritiseTransaction adds the passed delta in satoshis to the fee delta of
+// the transaction with the passed hash.  The modified fee, which is the fee the
+// transaction pays adjusted by its fee delta, is used in place of the fee when
+// selecting transactions for new blocks and when deciding whether a
+// transaction replaces the ones it conflicts with.  The transaction does not
+// need to be in the pool yet.
+//
+// Fee deltas are kept until the transaction is included in a block and are
+// persisted to the file configured by FeeDeltasFile.
+//
+// This function is safe for concurrent access.
+func (mp *TxPool) PrioritiseTransaction(hash *chainhash.Hash, delta int64) error {
+	mp.mtx.Lock()
+	defer mp.mtx.Unlock()
+
+	delta += mp.feeDeltas[*hash]
+	mp.setFeeDelta(hash, delta)
+	atomic.StoreInt64(&mp.lastUpdated, time.Now().Unix())
+
+	log.Debugf("Prioritised transaction %v with a fee delta of %d",
+		hash, delta)
+	return mp.saveFeeDeltas()
+}
+
+// ClearFeeDelta removes the fee delta of the transaction with the passed hash.
+// It should be called once the transaction is included in a block.
+//
+// This function is safe for concurrent access.
+func (mp *TxPool) ClearFeeDelta(hash *chainhash.Hash) error {
+	mp.mtx.Lock()
+	defer mp.mtx.Unlock()
+
+	if _, ok := mp.feeDeltas[*hash]; !ok {
+		return nil
+	}
+	mp.setFeeDelta(hash, 0)
+	return mp.saveFeeDeltas()
+}
+
+// FeeDelta returns the fee delta in satoshis of the transaction with the passed
+// hash.
+//
+// This function is safe for concurrent access.
+func (mp *TxPool) FeeDelta(hash *chainhash.Hash) int64 {
+	mp.mtx.RLock()
+	delta := mp.feeDeltas[*hash]
+	mp.mtx.RUnlock()
+	return delta
+}
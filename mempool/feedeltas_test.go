@@ -0,0 +1,161 @@
+// Copyright (c) 2013-2016 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package mempool
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/btgsuite/btgd/chaincfg"
+	"github.com/btgsuite/btgd/wire"
+	btcutil "github.com/btgsuite/btgutil"
+)
+
+// TestPrioritiseTransaction ensures fee deltas adjust the fees transactions
+// are considered to pay, both for transactions which are already in the pool
+// and for those which are added later, and that they survive restarts.
+func TestPrioritiseTransaction(t *testing.T) {
+	t.Parallel()
+
+	harness, outputs, err := newPoolHarness(&chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatalf("unable to create test pool: %v", err)
+	}
+	ctx := &testContext{t, harness}
+	txPool := harness.txPool
+
+	dir, err := ioutil.TempDir("", "feedeltas")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	txPool.cfg.FeeDeltasFile = filepath.Join(dir, "feedeltas.json")
+
+	// Fee deltas accumulate and are reflected by the mempool entry and
+	// the descriptor used for mining.
+	tx := ctx.addSignedTx(outputs[:1], 1, 1000, true, false)
+	for i := 0; i < 2; i++ {
+		if err := txPool.PrioritiseTransaction(tx.Hash(), 500); err != nil {
+			t.Fatalf("PrioritiseTransaction: unexpected error: %v", err)
+		}
+	}
+	entry, err := txPool.MempoolEntry(tx.Hash())
+	if err != nil {
+		t.Fatalf("MempoolEntry: unexpected error: %v", err)
+	}
+	if entry.Fees.Base != 0.00001 || entry.Fees.Modified != 0.00002 {
+		t.Fatalf("unexpected fees: %+v", entry.Fees)
+	}
+	descs := txPool.MiningDescs()
+	if len(descs) != 1 || descs[0].Fee != 1000 || descs[0].FeeDelta != 1000 {
+		t.Fatalf("unexpected mining descriptors: %+v", descs)
+	}
+
+	// A replacement must pay more than the modified fee of the
+	// transaction it replaces.
+	replacement, err := harness.CreateSignedTx(outputs[:1], 1, 1500, false)
+	if err != nil {
+		t.Fatalf("unable to create signed tx: %v", err)
+	}
+	_, err = txPool.ProcessTransaction(replacement, false, false, 0)
+	if err == nil {
+		t.Fatal("ProcessTransaction: replacement paying less than the " +
+			"modified fee was accepted")
+	}
+
+	// The fee delta of a transaction which is not in the pool yet is
+	// applied once it is added.
+	child, err := harness.CreateSignedTx([]spendableOutput{
+		txOutToSpendableOut(tx, 0),
+	}, 1, 1000, false)
+	if err != nil {
+		t.Fatalf("unable to create signed tx: %v", err)
+	}
+	if err := txPool.PrioritiseTransaction(child.Hash(), -1000); err != nil {
+		t.Fatalf("PrioritiseTransaction: unexpected error: %v", err)
+	}
+	_, err = txPool.ProcessTransaction(child, false, false, 0)
+	if err != nil {
+		t.Fatalf("ProcessTransaction: unexpected error: %v", err)
+	}
+	entry, err = txPool.MempoolEntry(child.Hash())
+	if err != nil {
+		t.Fatalf("MempoolEntry: unexpected error: %v", err)
+	}
+	if entry.Fees.Modified != 0 || entry.AncestorFees != 2000 {
+		t.Fatalf("unexpected fees: %+v", entry)
+	}
+
+	// The fee deltas are loaded by a new pool.
+	restarted := New(&txPool.cfg)
+	if err := restarted.LoadFeeDeltas(); err != nil {
+		t.Fatalf("LoadFeeDeltas: unexpected error: %v", err)
+	}
+	if delta := restarted.FeeDelta(tx.Hash()); delta != 1000 {
+		t.Fatalf("got fee delta %d, want 1000", delta)
+	}
+	if delta := restarted.FeeDelta(child.Hash()); delta != -1000 {
+		t.Fatalf("got fee delta %d, want -1000", delta)
+	}
+
+	// Clearing a fee delta restores the fee of the transaction.
+	if err := txPool.ClearFeeDelta(tx.Hash()); err != nil {
+		t.Fatalf("ClearFeeDelta: unexpected error: %v", err)
+	}
+	desc, err := txPool.FetchTxDesc(tx.Hash())
+	if err != nil {
+		t.Fatalf("FetchTxDesc: unexpected error: %v", err)
+	}
+	if desc.FeeDelta != 0 || txPool.FeeDelta(tx.Hash()) != 0 {
+		t.Fatalf("fee delta was not cleared: %d", desc.FeeDelta)
+	}
+	if desc.modifiedFee() != int64(btcutil.Amount(1000)) {
+		t.Fatalf("got modified fee %d, want 1000", desc.modifiedFee())
+	}
+}
+
+// TestPrioritiseTransactionRelayFee ensures a positive fee delta allows a
+// transaction which does not pay the minimum relay fee into the pool.
+func TestPrioritiseTransactionRelayFee(t *testing.T) {
+	t.Parallel()
+
+	harness, outputs, err := newPoolHarness(&chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatalf("unable to create test pool: %v", err)
+	}
+	txPool := harness.txPool
+
+	// Don't allow any free transactions through the rate limiter.
+	txPool.cfg.Policy.FreeTxRelayLimit = 0
+
+	tx, err := harness.CreateSignedTx(outputs[:1], 1, 0, false)
+	if err != nil {
+		t.Fatalf("unable to create signed tx: %v", err)
+	}
+	_, err = txPool.ProcessTransaction(tx, false, true, 0)
+	if err == nil {
+		t.Fatal("ProcessTransaction: free transaction was accepted")
+	}
+	if code, _ := extractRejectCode(err); code != wire.RejectInsufficientFee {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Prioritising the transaction with a delta that covers the minimum
+	// relay fee gets it into the pool.
+	minFee := calcMinRequiredTxRelayFee(GetTxVirtualSize(tx),
+		txPool.cfg.Policy.MinRelayTxFee)
+	if err := txPool.PrioritiseTransaction(tx.Hash(), minFee); err != nil {
+		t.Fatalf("PrioritiseTransaction: unexpected error: %v", err)
+	}
+	_, err = txPool.ProcessTransaction(tx, false, true, 0)
+	if err != nil {
+		t.Fatalf("ProcessTransaction: unexpected error: %v", err)
+	}
+	if !txPool.HaveTransaction(tx.Hash()) {
+		t.Fatal("prioritised transaction is not in the pool")
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"container/list"
 	"fmt"
 	"math"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -103,6 +104,11 @@ type Config struct {
 	// FeeEstimatator provides a feeEstimator. If it is not nil, the mempool
 	// records all new transactions it observes into the feeEstimator.
 	FeeEstimator *FeeEstimator
+
+	// FeeDeltasFile is the path of the file the fee deltas transactions
+	// are prioritised with are persisted to.  An empty path keeps them in
+	// memory only.
+	FeeDeltasFile string
 }
 
 // Policy houses the policy (configuration parameters) which is used to
@@ -185,6 +191,11 @@ type TxPool struct {
 	pennyTotal    float64 // exponentially decaying total for penny spends.
 	lastPennyUnix int64   // unix time of last ``penny spend''
 
+	// feeDeltas houses the fee deltas set by PrioritiseTransaction keyed
+	// by transaction hash.  They are kept for transactions which are not
+	// in the pool as well.
+	feeDeltas map[chainhash.Hash]int64
+
 	// nextExpireScan is the time after which the orphan pool will be
 	// scanned in order to evict orphans.  This is NOT a hard deadline as
 	// the scan will only run when an orphan is added to the pool as opposed
@@ -543,6 +554,7 @@ func (mp *TxPool) addTransaction(utxoView *blockchain.UtxoViewpoint, tx *btcutil
 			Height:   height,
 			Fee:      fee,
 			FeePerKB: fee * 1000 / GetTxVirtualSize(tx),
+			FeeDelta: mp.feeDeltas[*tx.Hash()],
 		},
 		StartingPriority: mining.CalcPriority(tx.MsgTx(), utxoView, height),
 	}
@@ -825,6 +837,24 @@ func (mp *TxPool) FetchTransaction(txHash *chainhash.Hash) (*btcutil.Tx, error)
 	return nil, fmt.Errorf("transaction is not in the pool")
 }
 
+// FetchTxDesc returns the descriptor of the requested transaction from the
+// transaction pool.  This only fetches from the main transaction pool and does
+// not include orphans.  The descriptor is to be treated as read only.
+//
+// This function is safe for concurrent access.
+func (mp *TxPool) FetchTxDesc(txHash *chainhash.Hash) (*TxDesc, error) {
+	// Protect concurrent access.
+	mp.mtx.RLock()
+	txDesc, exists := mp.pool[*txHash]
+	mp.mtx.RUnlock()
+
+	if exists {
+		return txDesc, nil
+	}
+
+	return nil, fmt.Errorf("transaction is not in the pool")
+}
+
 // validateReplacement determines whether a transaction is deemed as a valid
 // replacement of all of its conflicts according to the RBF policy. If it is
 // valid, no error is returned. Otherwise, an error is returned indicating what
@@ -864,6 +894,10 @@ func (mp *TxPool) validateReplacement(tx *btcutil.Tx,
 	// than what they replaced as that would lower the fee rate of the next
 	// block. Requiring that the fee rate always be increased is also an
 	// easy-to-reason about way to prevent DoS attacks via replacements.
+	//
+	// The fees are adjusted by the fee deltas the transactions were
+	// prioritised with, consistent with how they are mined.
+	txFee += mp.feeDeltas[*tx.Hash()]
 	var (
 		txSize           = GetTxVirtualSize(tx)
 		txFeeRate        = txFee * 1000 / txSize
@@ -871,15 +905,15 @@ func (mp *TxPool) validateReplacement(tx *btcutil.Tx,
 		conflictsParents = make(map[chainhash.Hash]struct{})
 	)
 	for hash, conflict := range conflicts {
-		if txFeeRate <= mp.pool[hash].FeePerKB {
+		conflictFeeRate := mp.pool[hash].modifiedFeePerKB()
+		if txFeeRate <= conflictFeeRate {
 			str := fmt.Sprintf("replacement transaction %v has an "+
 				"insufficient fee rate: needs more than %v, "+
-				"has %v", tx.Hash(), mp.pool[hash].FeePerKB,
-				txFeeRate)
+				"has %v", tx.Hash(), conflictFeeRate, txFeeRate)
 			return nil, txRuleError(wire.RejectInsufficientFee, str)
 		}
 
-		conflictsFee += mp.pool[hash].Fee
+		conflictsFee += mp.pool[hash].modifiedFee()
 
 		// We'll track each conflict's parents to ensure the replacement
 		// isn't spending any new unconfirmed inputs.
@@ -919,12 +953,23 @@ func (mp *TxPool) validateReplacement(tx *btcutil.Tx,
 	return conflicts, nil
 }
 
-// maybeAcceptTransaction is the internal function which implements the public
-// MaybeAcceptTransaction.  See the comment for MaybeAcceptTransaction for
-// more details.
+// acceptResult houses the state needed to add a transaction which passed all
+// of the checks for acceptance into the memory pool.
+type acceptResult struct {
+	utxoView   *blockchain.UtxoViewpoint
+	bestHeight int32
+	fee        int64
+	conflicts  map[chainhash.Hash]*btcutil.Tx
+}
+
+// checkAcceptance performs all of the checks for accepting the passed
+// transaction into the memory pool without adding it.  When the transaction is
+// an orphan, the unknown referenced parents are returned instead.  The memory
+// pool is only modified by the rate limiter when rateLimit is set.
 //
-// This function MUST be called with the mempool lock held (for writes).
-func (mp *TxPool) maybeAcceptTransaction(tx *btcutil.Tx, isNew, rateLimit, rejectDupOrphans bool) ([]*chainhash.Hash, *TxDesc, error) {
+// This function MUST be called with the mempool lock held (for writes when
+// rateLimit is set, for reads otherwise).
+func (mp *TxPool) checkAcceptance(tx *btcutil.Tx, isNew, rateLimit, rejectDupOrphans bool) ([]*chainhash.Hash, *acceptResult, error) {
 	txHash := tx.Hash()
 
 	// If a transaction has iwtness data, and segwit isn't active yet, If
@@ -1139,12 +1184,16 @@ func (mp *TxPool) maybeAcceptTransaction(tx *btcutil.Tx, isNew, rateLimit, rejec
 	// which is more desirable.  Therefore, as long as the size of the
 	// transaction does not exceeed 1000 less than the reserved space for
 	// high-priority transactions, don't require a fee for it.
+	//
+	// The fee checks below use the fee adjusted by any fee delta the
+	// transaction was prioritised with.
+	modifiedFee := txFee + mp.feeDeltas[*txHash]
 	serializedSize := GetTxVirtualSize(tx)
 	minFee := calcMinRequiredTxRelayFee(serializedSize,
 		mp.cfg.Policy.MinRelayTxFee)
-	if serializedSize >= (DefaultBlockPrioritySize-1000) && txFee < minFee {
+	if serializedSize >= (DefaultBlockPrioritySize-1000) && modifiedFee < minFee {
 		str := fmt.Sprintf("transaction %v has %d fees which is under "+
-			"the required amount of %d", txHash, txFee,
+			"the required amount of %d", txHash, modifiedFee,
 			minFee)
 		return nil, nil, txRuleError(wire.RejectInsufficientFee, str)
 	}
@@ -1153,7 +1202,7 @@ func (mp *TxPool) maybeAcceptTransaction(tx *btcutil.Tx, isNew, rateLimit, rejec
 	// in the next block.  Transactions which are being added back to the
 	// memory pool from blocks that have been disconnected during a reorg
 	// are exempted.
-	if isNew && !mp.cfg.Policy.DisableRelayPriority && txFee < minFee {
+	if isNew && !mp.cfg.Policy.DisableRelayPriority && modifiedFee < minFee {
 		currentPriority := mining.CalcPriority(tx.MsgTx(), utxoView,
 			nextBlockHeight)
 		if currentPriority <= mining.MinHighPriority {
@@ -1166,7 +1215,7 @@ func (mp *TxPool) maybeAcceptTransaction(tx *btcutil.Tx, isNew, rateLimit, rejec
 
 	// Free-to-relay transactions are rate limited here to prevent
 	// penny-flooding with tiny transactions as a form of attack.
-	if rateLimit && txFee < minFee {
+	if rateLimit && modifiedFee < minFee {
 		nowUnix := time.Now().Unix()
 		// Decay passed data with an exponentially decaying ~10 minute
 		// window - matches bitcoind handling.
@@ -1210,21 +1259,43 @@ func (mp *TxPool) maybeAcceptTransaction(tx *btcutil.Tx, isNew, rateLimit, rejec
 		return nil, nil, err
 	}
 
+	return nil, &acceptResult{
+		utxoView:   utxoView,
+		bestHeight: bestHeight,
+		fee:        txFee,
+		conflicts:  conflicts,
+	}, nil
+}
+
+// maybeAcceptTransaction is the internal function which implements the public
+// MaybeAcceptTransaction.  See the comment for MaybeAcceptTransaction for
+// more details.
+//
+// This function MUST be called with the mempool lock held (for writes).
+func (mp *TxPool) maybeAcceptTransaction(tx *btcutil.Tx, isNew, rateLimit, rejectDupOrphans bool) ([]*chainhash.Hash, *TxDesc, error) {
+	missingParents, result, err := mp.checkAcceptance(tx, isNew,
+		rateLimit, rejectDupOrphans)
+	if err != nil || len(missingParents) > 0 {
+		return missingParents, nil, err
+	}
+
 	// Now that we've deemed the transaction as valid, we can add it to the
 	// mempool. If it ended up replacing any transactions, we'll remove them
 	// first.
-	for _, conflict := range conflicts {
+	txHash := tx.Hash()
+	for _, conflict := range result.conflicts {
 		log.Debugf("Replacing transaction %v (fee_rate=%v sat/kb) "+
 			"with %v (fee_rate=%v sat/kb)\n", conflict.Hash(),
-			mp.pool[*conflict.Hash()].FeePerKB, tx.Hash(),
-			txFee*1000/serializedSize)
+			mp.pool[*conflict.Hash()].FeePerKB, txHash,
+			result.fee*1000/GetTxVirtualSize(tx))
 
 		// The conflict set should already include the descendants for
 		// each one, so we don't need to remove the redeemers within
 		// this call as they'll be removed eventually.
 		mp.removeTransaction(conflict, false)
 	}
-	txD := mp.addTransaction(utxoView, tx, bestHeight, txFee)
+	txD := mp.addTransaction(result.utxoView, tx, result.bestHeight,
+		result.fee)
 
 	log.Debugf("Accepted transaction %v (pool size: %v)", txHash,
 		len(mp.pool))
@@ -1252,6 +1323,46 @@ func (mp *TxPool) MaybeAcceptTransaction(tx *btcutil.Tx, isNew, rateLimit bool)
 	return hashes, txD, err
 }
 
+// MempoolAcceptResult houses the result of checking whether a transaction
+// would be accepted into the memory pool.
+type MempoolAcceptResult struct {
+	// TxFee is the fee paid by the transaction in satoshis.
+	TxFee btcutil.Amount
+
+	// TxSize is the virtual size of the transaction.
+	TxSize int64
+
+	// MissingParents are the unknown parents of the transaction when it is
+	// an orphan.  The fee and size are not set in that case.
+	MissingParents []*chainhash.Hash
+}
+
+// CheckMempoolAcceptance performs all of the checks MaybeAcceptTransaction
+// performs for a new transaction without adding it to the memory pool, so the
+// memory pool is never modified.  A rule error is returned when the
+// transaction would be rejected.
+//
+// Since the transaction is not added, free transactions are not subject to the
+// rate limiter.
+//
+// This function is safe for concurrent access.
+func (mp *TxPool) CheckMempoolAcceptance(tx *btcutil.Tx) (*MempoolAcceptResult, error) {
+	mp.mtx.RLock()
+	missingParents, result, err := mp.checkAcceptance(tx, true, false, true)
+	mp.mtx.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	if len(missingParents) > 0 {
+		return &MempoolAcceptResult{MissingParents: missingParents}, nil
+	}
+
+	return &MempoolAcceptResult{
+		TxFee:  btcutil.Amount(result.fee),
+		TxSize: GetTxVirtualSize(tx),
+	}, nil
+}
+
 // processOrphans is the internal function which implements the public
 // ProcessOrphans.  See the comment for ProcessOrphans for more details.
 //
@@ -1511,6 +1622,7 @@ func (mp *TxPool) RawMempoolVerbose() map[string]*btcjson.GetRawMempoolVerboseRe
 			Vsize:            int32(GetTxVirtualSize(tx)),
 			Weight:           int32(blockchain.GetTransactionWeight(tx)),
 			Fee:              btcutil.Amount(desc.Fee).ToBTC(),
+			ModifiedFee:      btcutil.Amount(desc.modifiedFee()).ToBTC(),
 			Time:             desc.Added.Unix(),
 			Height:           int64(desc.Height),
 			StartingPriority: desc.StartingPriority,
@@ -1531,6 +1643,191 @@ func (mp *TxPool) RawMempoolVerbose() map[string]*btcjson.GetRawMempoolVerboseRe
 	return result
 }
 
+// sortedHashStrings returns the hashes of the passed transactions as sorted
+// strings.
+func sortedHashStrings(txns map[chainhash.Hash]*btcutil.Tx) []string {
+	hashStrings := make([]string, 0, len(txns))
+	for hash := range txns {
+		hashStrings = append(hashStrings, hash.String())
+	}
+	sort.Strings(hashStrings)
+	return hashStrings
+}
+
+// mempoolEntry returns the passed entry of the mempool as a fully populated
+// btcjson result.
+//
+// This function MUST be called with the mempool lock held (for reads).
+func (mp *TxPool) mempoolEntry(desc *TxDesc, bestHeight int32) *btcjson.GetMempoolEntryResult {
+	// Calculate the current priority based on the inputs to the
+	// transaction.  Use zero if one or more of the input transactions
+	// can't be found for some reason.
+	tx := desc.Tx
+	var currentPriority float64
+	utxos, err := mp.fetchInputUtxos(tx)
+	if err == nil {
+		currentPriority = mining.CalcPriority(tx.MsgTx(), utxos,
+			bestHeight+1)
+	}
+
+	// The ancestor and descendant statistics include the transaction
+	// itself.
+	vsize := GetTxVirtualSize(tx)
+	modifiedFee := desc.modifiedFee()
+	ancestorCount, ancestorSize, ancestorFees := int64(1), vsize,
+		modifiedFee
+	for hash, ancestor := range mp.txAncestors(tx, nil) {
+		ancestorCount++
+		ancestorSize += GetTxVirtualSize(ancestor)
+		ancestorFees += mp.pool[hash].modifiedFee()
+	}
+	descendantCount, descendantSize, descendantFees := int64(1), vsize,
+		modifiedFee
+	for hash, descendant := range mp.txDescendants(tx, nil) {
+		descendantCount++
+		descendantSize += GetTxVirtualSize(descendant)
+		descendantFees += mp.pool[hash].modifiedFee()
+	}
+
+	// Determine the transactions in the pool the transaction spends
+	// outputs of and those which spend its outputs.
+	parents := make(map[chainhash.Hash]*btcutil.Tx)
+	for _, txIn := range tx.MsgTx().TxIn {
+		if parent, ok := mp.pool[txIn.PreviousOutPoint.Hash]; ok {
+			parents[*parent.Tx.Hash()] = parent.Tx
+		}
+	}
+	children := make(map[chainhash.Hash]*btcutil.Tx)
+	prevOut := wire.OutPoint{Hash: *tx.Hash()}
+	for txOutIdx := range tx.MsgTx().TxOut {
+		prevOut.Index = uint32(txOutIdx)
+		if child, ok := mp.outpoints[prevOut]; ok {
+			children[*child.Hash()] = child
+		}
+	}
+
+	return &btcjson.GetMempoolEntryResult{
+		Size:             int32(tx.MsgTx().SerializeSize()),
+		Vsize:            int32(vsize),
+		Weight:           int32(blockchain.GetTransactionWeight(tx)),
+		Fee:              btcutil.Amount(desc.Fee).ToBTC(),
+		ModifiedFee:      btcutil.Amount(modifiedFee).ToBTC(),
+		Time:             desc.Added.Unix(),
+		Height:           int64(desc.Height),
+		StartingPriority: desc.StartingPriority,
+		CurrentPriority:  currentPriority,
+		DescendantCount:  descendantCount,
+		DescendantSize:   descendantSize,
+		DescendantFees:   float64(descendantFees),
+		AncestorCount:    ancestorCount,
+		AncestorSize:     ancestorSize,
+		AncestorFees:     float64(ancestorFees),
+		Fees: btcjson.MempoolFees{
+			Base:       btcutil.Amount(desc.Fee).ToBTC(),
+			Modified:   btcutil.Amount(modifiedFee).ToBTC(),
+			Ancestor:   btcutil.Amount(ancestorFees).ToBTC(),
+			Descendant: btcutil.Amount(descendantFees).ToBTC(),
+		},
+		Depends:           sortedHashStrings(parents),
+		SpentBy:           sortedHashStrings(children),
+		BIP125Replaceable: mp.signalsReplacement(tx, nil),
+	}
+}
+
+// MempoolEntry returns the entry of the transaction with the passed hash in
+// the mempool as a fully populated btcjson result.
+//
+// This function is safe for concurrent access.
+func (mp *TxPool) MempoolEntry(txHash *chainhash.Hash) (*btcjson.GetMempoolEntryResult, error) {
+	mp.mtx.RLock()
+	defer mp.mtx.RUnlock()
+
+	desc, exists := mp.pool[*txHash]
+	if !exists {
+		return nil, fmt.Errorf("transaction is not in the pool")
+	}
+	return mp.mempoolEntry(desc, mp.cfg.BestHeight()), nil
+}
+
+// mempoolEntries returns the entries of the passed transactions in the
+// mempool as fully populated btcjson results keyed by their hashes.
+//
+// This function MUST be called with the mempool lock held (for reads).
+func (mp *TxPool) mempoolEntries(txns map[chainhash.Hash]*btcutil.Tx) map[string]*btcjson.GetMempoolEntryResult {
+	bestHeight := mp.cfg.BestHeight()
+	entries := make(map[string]*btcjson.GetMempoolEntryResult, len(txns))
+	for hash := range txns {
+		entries[hash.String()] = mp.mempoolEntry(mp.pool[hash],
+			bestHeight)
+	}
+	return entries
+}
+
+// TxAncestors returns the sorted hashes of all unconfirmed ancestors of the
+// transaction with the passed hash in the mempool.  Given transactions A, B,
+// and C where C spends B and B spends A, A and B are considered ancestors of C.
+//
+// This function is safe for concurrent access.
+func (mp *TxPool) TxAncestors(txHash *chainhash.Hash) ([]string, error) {
+	mp.mtx.RLock()
+	defer mp.mtx.RUnlock()
+
+	desc, exists := mp.pool[*txHash]
+	if !exists {
+		return nil, fmt.Errorf("transaction is not in the pool")
+	}
+	return sortedHashStrings(mp.txAncestors(desc.Tx, nil)), nil
+}
+
+// TxAncestorsVerbose returns the entries of all unconfirmed ancestors of the
+// transaction with the passed hash in the mempool as fully populated btcjson
+// results keyed by their hashes.
+//
+// This function is safe for concurrent access.
+func (mp *TxPool) TxAncestorsVerbose(txHash *chainhash.Hash) (map[string]*btcjson.GetMempoolEntryResult, error) {
+	mp.mtx.RLock()
+	defer mp.mtx.RUnlock()
+
+	desc, exists := mp.pool[*txHash]
+	if !exists {
+		return nil, fmt.Errorf("transaction is not in the pool")
+	}
+	return mp.mempoolEntries(mp.txAncestors(desc.Tx, nil)), nil
+}
+
+// TxDescendants returns the sorted hashes of all unconfirmed descendants of
+// the transaction with the passed hash in the mempool.  Given transactions A,
+// B, and C where C spends B and B spends A, B and C are considered descendants
+// of A.
+//
+// This function is safe for concurrent access.
+func (mp *TxPool) TxDescendants(txHash *chainhash.Hash) ([]string, error) {
+	mp.mtx.RLock()
+	defer mp.mtx.RUnlock()
+
+	desc, exists := mp.pool[*txHash]
+	if !exists {
+		return nil, fmt.Errorf("transaction is not in the pool")
+	}
+	return sortedHashStrings(mp.txDescendants(desc.Tx, nil)), nil
+}
+
+// TxDescendantsVerbose returns the entries of all unconfirmed descendants of
+// the transaction with the passed hash in the mempool as fully populated
+// btcjson results keyed by their hashes.
+//
+// This function is safe for concurrent access.
+func (mp *TxPool) TxDescendantsVerbose(txHash *chainhash.Hash) (map[string]*btcjson.GetMempoolEntryResult, error) {
+	mp.mtx.RLock()
+	defer mp.mtx.RUnlock()
+
+	desc, exists := mp.pool[*txHash]
+	if !exists {
+		return nil, fmt.Errorf("transaction is not in the pool")
+	}
+	return mp.mempoolEntries(mp.txDescendants(desc.Tx, nil)), nil
+}
+
 // LastUpdated returns the last time a transaction was added to or removed from
 // the main pool.  It does not include the orphan pool.
 //
@@ -1549,5 +1846,6 @@ func New(cfg *Config) *TxPool {
 		orphansByPrev:  make(map[wire.OutPoint]map[chainhash.Hash]*btcutil.Tx),
 		nextExpireScan: time.Now().Add(orphanExpireScanInterval),
 		outpoints:      make(map[wire.OutPoint]*btcutil.Tx),
+		feeDeltas:      make(map[chainhash.Hash]int64),
 	}
 }
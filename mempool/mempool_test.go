@@ -7,6 +7,7 @@ package mempool
 import (
 	"encoding/hex"
 	"reflect"
+	"sort"
 	"strings"
 	"sync"
 	"testing"
@@ -14,6 +15,7 @@ import (
 
 	"github.com/btgsuite/btgd/blockchain"
 	"github.com/btgsuite/btgd/btcec"
+	"github.com/btgsuite/btgd/btcjson"
 	"github.com/btgsuite/btgd/chaincfg"
 	"github.com/btgsuite/btgd/chaincfg/chainhash"
 	"github.com/btgsuite/btgd/txscript"
@@ -1452,6 +1454,187 @@ func TestAncestorsDescendants(t *testing.T) {
 	}
 }
 
+// TestCheckMempoolAcceptance ensures transactions can be checked for
+// acceptance into the mempool without modifying it.
+func TestCheckMempoolAcceptance(t *testing.T) {
+	t.Parallel()
+
+	harness, outputs, err := newPoolHarness(&chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatalf("unable to create test pool: %v", err)
+	}
+	tc := &testContext{t, harness}
+	txPool := harness.txPool
+
+	// A valid transaction is reported along with its fee and size, but is
+	// not added to the pool.
+	tx, err := harness.CreateSignedTx(outputs[:1], 1, 1000, false)
+	if err != nil {
+		t.Fatalf("unable to create signed tx: %v", err)
+	}
+	result, err := txPool.CheckMempoolAcceptance(tx)
+	if err != nil {
+		t.Fatalf("CheckMempoolAcceptance: unexpected error: %v", err)
+	}
+	if result.TxFee != 1000 || result.TxSize != GetTxVirtualSize(tx) ||
+		len(result.MissingParents) != 0 {
+
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	testPoolMembership(tc, tx, false, false)
+
+	// An orphan reports its missing parents instead.
+	orphan, err := harness.CreateSignedTx([]spendableOutput{
+		txOutToSpendableOut(tx, 0),
+	}, 1, 1000, false)
+	if err != nil {
+		t.Fatalf("unable to create signed tx: %v", err)
+	}
+	result, err = txPool.CheckMempoolAcceptance(orphan)
+	if err != nil {
+		t.Fatalf("CheckMempoolAcceptance: unexpected error: %v", err)
+	}
+	if len(result.MissingParents) != 1 ||
+		*result.MissingParents[0] != *tx.Hash() {
+
+		t.Fatalf("unexpected missing parents: %v", result.MissingParents)
+	}
+	testPoolMembership(tc, orphan, false, false)
+
+	// Transactions which are already in the pool, or would double spend
+	// one without signaling replacement, are rejected.
+	_, err = txPool.ProcessTransaction(tx, false, false, 0)
+	if err != nil {
+		t.Fatalf("ProcessTransaction: unexpected error: %v", err)
+	}
+	doubleSpend, err := harness.CreateSignedTx(outputs[:1], 2, 2000, false)
+	if err != nil {
+		t.Fatalf("unable to create signed tx: %v", err)
+	}
+	for _, tx := range []*btcutil.Tx{tx, doubleSpend} {
+		_, err := txPool.CheckMempoolAcceptance(tx)
+		if _, ok := err.(RuleError); !ok {
+			t.Fatalf("CheckMempoolAcceptance: got %v, want rule "+
+				"error", err)
+		}
+	}
+	testPoolMembership(tc, doubleSpend, false, false)
+	if txPool.Count() != 1 {
+		t.Fatalf("got %d transactions in the pool, want 1",
+			txPool.Count())
+	}
+}
+
+// TestMempoolEntry ensures the entries of transactions in the mempool report
+// their ancestor and descendant statistics, the transactions they depend on
+// and are spent by and whether they signal replacement.
+func TestMempoolEntry(t *testing.T) {
+	t.Parallel()
+
+	harness, outputs, err := newPoolHarness(&chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatalf("unable to create test pool: %v", err)
+	}
+	ctx := &testContext{t, harness}
+	txPool := harness.txPool
+
+	// We'll be creating the following chain of unconfirmed transactions
+	// where B and C spend A and only C signals replacement.
+	//
+	//       B
+	//     /
+	//   A
+	//     \
+	//       C
+	a := ctx.addSignedTx(outputs[:1], 2, 1000, false, false)
+	b := ctx.addSignedTx([]spendableOutput{txOutToSpendableOut(a, 0)}, 1,
+		2000, false, false)
+	c := ctx.addSignedTx([]spendableOutput{txOutToSpendableOut(a, 1)}, 1,
+		3000, true, false)
+	sortedHashes := func(txns ...*btcutil.Tx) []string {
+		hashes := make([]string, 0, len(txns))
+		for _, tx := range txns {
+			hashes = append(hashes, tx.Hash().String())
+		}
+		sort.Strings(hashes)
+		return hashes
+	}
+
+	entryA, err := txPool.MempoolEntry(a.Hash())
+	if err != nil {
+		t.Fatalf("MempoolEntry: unexpected error: %v", err)
+	}
+	wantA := btcjson.MempoolFees{
+		Base:       0.00001,
+		Modified:   0.00001,
+		Ancestor:   0.00001,
+		Descendant: 0.00006,
+	}
+	if entryA.Fees != wantA {
+		t.Fatalf("got fees %+v, want %+v", entryA.Fees, wantA)
+	}
+	if entryA.AncestorCount != 1 || entryA.DescendantCount != 3 ||
+		entryA.DescendantFees != 6000 {
+
+		t.Fatalf("unexpected statistics: %+v", entryA)
+	}
+	if !reflect.DeepEqual(entryA.SpentBy, sortedHashes(b, c)) ||
+		len(entryA.Depends) != 0 || entryA.BIP125Replaceable {
+
+		t.Fatalf("unexpected entry: %+v", entryA)
+	}
+
+	entryB, err := txPool.MempoolEntry(b.Hash())
+	if err != nil {
+		t.Fatalf("MempoolEntry: unexpected error: %v", err)
+	}
+	wantSize := GetTxVirtualSize(a) + GetTxVirtualSize(b)
+	if entryB.AncestorCount != 2 || entryB.AncestorSize != wantSize ||
+		entryB.AncestorFees != 3000 || entryB.DescendantCount != 1 {
+
+		t.Fatalf("unexpected statistics: %+v", entryB)
+	}
+	if !reflect.DeepEqual(entryB.Depends, sortedHashes(a)) ||
+		len(entryB.SpentBy) != 0 || entryB.BIP125Replaceable {
+
+		t.Fatalf("unexpected entry: %+v", entryB)
+	}
+
+	entryC, err := txPool.MempoolEntry(c.Hash())
+	if err != nil {
+		t.Fatalf("MempoolEntry: unexpected error: %v", err)
+	}
+	if !entryC.BIP125Replaceable {
+		t.Fatal("transaction does not signal replacement")
+	}
+
+	ancestors, err := txPool.TxAncestors(c.Hash())
+	if err != nil {
+		t.Fatalf("TxAncestors: unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(ancestors, sortedHashes(a)) {
+		t.Fatalf("got ancestors %v, want %v", ancestors, sortedHashes(a))
+	}
+	descendants, err := txPool.TxDescendantsVerbose(a.Hash())
+	if err != nil {
+		t.Fatalf("TxDescendantsVerbose: unexpected error: %v", err)
+	}
+	if len(descendants) != 2 ||
+		!reflect.DeepEqual(descendants[c.Hash().String()], entryC) {
+
+		t.Fatalf("unexpected descendants: %v", descendants)
+	}
+
+	// Transactions which are not in the pool are reported as such.
+	unknown := chainhash.Hash{0x01}
+	if _, err := txPool.MempoolEntry(&unknown); err == nil {
+		t.Fatal("MempoolEntry: expected error for unknown transaction")
+	}
+	if _, err := txPool.TxDescendants(&unknown); err == nil {
+		t.Fatal("TxDescendants: expected error for unknown transaction")
+	}
+}
+
 // TestRBF tests the different cases required for a transaction to properly
 // replace its conflicts given that they all signal replacement.
 func TestRBF(t *testing.T) {
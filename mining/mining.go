@@ -51,6 +51,11 @@ type TxDesc struct {
 
 	// FeePerKB is the fee the transaction pays in Satoshi per 1000 bytes.
 	FeePerKB int64
+
+	// FeeDelta is the amount in Satoshi the fee of the transaction is
+	// adjusted by when it is prioritised for inclusion in new blocks.  The
+	// fee actually paid is not affected.
+	FeeDelta int64
 }
 
 // TxSource represents a source of transactions to consider for inclusion in
@@ -576,8 +581,17 @@ mempoolLoop:
 		prioItem.priority = CalcPriority(tx.MsgTx(), utxos,
 			nextBlockHeight)
 
-		// Calculate the fee in Satoshi/kB.
+		// Calculate the fee in Satoshi/kB.  Transactions which were
+		// prioritised with a fee delta are ordered by their modified
+		// fee, while the fee they actually pay is collected.
 		prioItem.feePerKB = txDesc.FeePerKB
+		if txDesc.FeeDelta != 0 {
+			vsize := (blockchain.GetTransactionWeight(tx) +
+				blockchain.WitnessScaleFactor - 1) /
+				blockchain.WitnessScaleFactor
+			prioItem.feePerKB = (txDesc.Fee + txDesc.FeeDelta) *
+				1000 / vsize
+		}
 		prioItem.fee = txDesc.Fee
 
 		// Add the transaction to the priority queue to mark it ready
@@ -0,0 +1,179 @@
+// Copyright (c) 2013-2017 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NAT is an interface representing a NAT traversal options for example UPNP or
+// NAT-PMP. It provides methods to query and manipulate this traversal to allow
+// access to services.
+type NAT interface {
+	// Name returns the name of the port mapping protocol.
+	Name() string
+
+	// Get the external address from outside the NAT.
+	GetExternalAddress() (addr net.IP, err error)
+
+	// Add a port mapping for protocol ("udp" or "tcp") from external port
+	// to internal port with description lasting for the passed lifetime.
+	// The mapping is verified to forward to the internal port and the
+	// external port and lifetime granted by the NAT are returned.
+	AddPortMapping(protocol string, externalPort, internalPort int,
+		description string, lifetime time.Duration) (*portMapping, error)
+
+	// Remove a previously added port mapping from external port to
+	// internal port.
+	DeletePortMapping(protocol string, externalPort, internalPort int) (err error)
+}
+
+// portMapping describes a port mapping granted by a NAT.
+type portMapping struct {
+	// externalPort is the port on the external address which is forwarded
+	// to the internal port.  It may differ from the requested port.
+	externalPort int
+
+	// lifetime is the duration the mapping is granted for.  The mapping
+	// has to be renewed before it expires.
+	lifetime time.Duration
+}
+
+// natpmpPort is the port NAT-PMP and PCP servers listen on at the gateway.
+const natpmpPort = 5351
+
+// discoverNAT searches the local network for a gateway which supports one of
+// the enabled port mapping protocols.  PCP is preferred over NAT-PMP, which is
+// preferred over UPnP.  It returns nil when no supported gateway is found.
+func discoverNAT(upnp, natpmp bool) NAT {
+	if natpmp {
+		gateway, err := defaultGateway()
+		if err != nil {
+			srvrLog.Warnf("Can't find the default gateway: %v", err)
+		} else {
+			gatewayAddr := net.JoinHostPort(gateway.String(),
+				strconv.Itoa(natpmpPort))
+			nat, err := discoverPCP(gatewayAddr)
+			if err == nil {
+				return nat
+			}
+			srvrLog.Debugf("Can't discover PCP: %v", err)
+
+			nat, err = discoverNATPMP(gatewayAddr)
+			if err == nil {
+				return nat
+			}
+			srvrLog.Warnf("Can't discover NAT-PMP or PCP: %v", err)
+		}
+	}
+
+	if upnp {
+		nat, err := Discover()
+		if err == nil {
+			return nat
+		}
+		srvrLog.Warnf("Can't discover upnp: %v", err)
+	}
+
+	// No NAT here is fine, just means no port mapping on the network.
+	return nil
+}
+
+// natListenPort returns the port to map on the NAT gateway, which is the port
+// of the first listener or the default port of the network when there are no
+// listeners.
+func natListenPort(listeners []net.Listener) int {
+	for _, listener := range listeners {
+		if addr, ok := listener.Addr().(*net.TCPAddr); ok {
+			return addr.Port
+		}
+	}
+	port, _ := strconv.Atoi(activeNetParams.DefaultPort)
+	return port
+}
+
+// defaultGateway returns the IPv4 address of the default gateway.  The routing
+// table is used where it is available and the first address of the network of
+// the outbound interface is assumed otherwise, which is what most home routers
+// use.
+func defaultGateway() (net.IP, error) {
+	if gateway, err := routeTableGateway("/proc/net/route"); err == nil {
+		return gateway, nil
+	}
+
+	// Find the address of the outbound interface by connecting a UDP
+	// socket, which does not send any packets.
+	conn, err := net.Dial("udp4", "8.8.8.8:53")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	local := conn.LocalAddr().(*net.UDPAddr).IP.To4()
+	if local == nil || !isPrivateIPv4(local) {
+		return nil, errors.New("no private IPv4 address")
+	}
+	return net.IPv4(local[0], local[1], local[2], 1), nil
+}
+
+// routeTableGateway returns the gateway of the default route from a routing
+// table in the format of /proc/net/route on Linux.
+func routeTableGateway(path string) (net.IP, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		gateway, err := hex.DecodeString(fields[2])
+		if err != nil || len(gateway) != 4 {
+			continue
+		}
+
+		// The addresses are in host byte order, which is little endian
+		// on all supported systems.
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip,
+			binary.LittleEndian.Uint32(gateway))
+		if ip.IsUnspecified() {
+			continue
+		}
+		return ip, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, errors.New("no default route")
+}
+
+// isPrivateIPv4 returns whether the passed IPv4 address is in one of the RFC
+// 1918 private networks.
+func isPrivateIPv4(ip net.IP) bool {
+	return ip[0] == 10 || (ip[0] == 172 && ip[1]&0xf0 == 16) ||
+		(ip[0] == 192 && ip[1] == 168)
+}
+
+// localIPFor returns the local address used to reach the passed host.
+func localIPFor(host string) (net.IP, error) {
+	conn, err := net.Dial("udp", net.JoinHostPort(host, "1"))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
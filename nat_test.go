@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// TestRouteTableGateway ensures the default gateway is read from a routing
+// table in the format of /proc/net/route.
+func TestRouteTableGateway(t *testing.T) {
+	tests := []struct {
+		table string
+		want  string
+	}{
+		{
+			table: "Iface\tDestination\tGateway \tFlags\n" +
+				"eth0\t0000A8C0\t00000000\t0001\n" +
+				"eth0\t00000000\t0101A8C0\t0003\n",
+			want: "192.168.1.1",
+		},
+		{
+			table: "Iface\tDestination\tGateway \tFlags\n" +
+				"eth0\t0000000A\t00000000\t0001\n",
+		},
+	}
+
+	for i, test := range tests {
+		f, err := ioutil.TempFile("", "route")
+		if err != nil {
+			t.Fatalf("TempFile: unexpected error: %v", err)
+		}
+		defer os.Remove(f.Name())
+		if _, err := f.WriteString(test.table); err != nil {
+			t.Fatalf("WriteString: unexpected error: %v", err)
+		}
+		f.Close()
+
+		gateway, err := routeTableGateway(f.Name())
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("#%d: expected error, got %v", i, gateway)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+			continue
+		}
+		if gateway.String() != test.want {
+			t.Errorf("#%d: got %v, want %s", i, gateway, test.want)
+		}
+	}
+}
@@ -0,0 +1,412 @@
+// Copyright (c) 2013-2017 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// natpmpInitialTimeout is the time to wait for the first response to
+	// a NAT-PMP or PCP request.  The time is doubled for every
+	// retransmission as recommended by RFC 6886 and RFC 6887.
+	natpmpInitialTimeout = 250 * time.Millisecond
+
+	// natpmpRetries is the number of times a NAT-PMP or PCP request is
+	// sent before giving up.
+	natpmpRetries = 4
+
+	// natpmpVersion and pcpVersion are the protocol versions of NAT-PMP
+	// and PCP.
+	natpmpVersion = 0
+	pcpVersion    = 2
+
+	// The following constants are the NAT-PMP opcodes.
+	natpmpOpExternalAddress = 0
+	natpmpOpMapUDP          = 1
+	natpmpOpMapTCP          = 2
+
+	// The following constants are the PCP opcodes.
+	pcpOpAnnounce = 0
+	pcpOpMap      = 1
+
+	// natpmpResponseBit is set in the opcode of NAT-PMP and PCP responses.
+	natpmpResponseBit = 0x80
+
+	// pcpResultUnsuppVersion is the result code of a PCP server which does
+	// not support the version of the request.  It is also used by NAT-PMP
+	// servers which receive a PCP request.
+	pcpResultUnsuppVersion = 1
+)
+
+// natpmpRequest sends the request to the gateway and returns the first
+// response from the gateway which is accepted by the passed function.  The
+// request is retransmitted with exponential backoff until a response is
+// received.
+func natpmpRequest(gatewayAddr string, req []byte,
+	accept func(resp []byte) bool) ([]byte, error) {
+
+	gateway, err := net.ResolveUDPAddr("udp", gatewayAddr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, gateway)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 1100)
+	timeout := natpmpInitialTimeout
+	for i := 0; i < natpmpRetries; i++ {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		deadline := time.Now().Add(timeout)
+		if err := conn.SetReadDeadline(deadline); err != nil {
+			return nil, err
+		}
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				break
+			}
+			if accept(buf[:n]) {
+				resp := make([]byte, n)
+				copy(resp, buf[:n])
+				return resp, nil
+			}
+		}
+		timeout *= 2
+	}
+	return nil, errors.New("no response from gateway")
+}
+
+// natpmpNAT implements the NAT interface using NAT-PMP as specified by RFC
+// 6886.
+type natpmpNAT struct {
+	gatewayAddr string
+}
+
+// discoverNATPMP returns a NAT for the gateway at the passed address when it
+// supports NAT-PMP.
+func discoverNATPMP(gatewayAddr string) (NAT, error) {
+	nat := &natpmpNAT{gatewayAddr: gatewayAddr}
+	if _, err := nat.GetExternalAddress(); err != nil {
+		return nil, err
+	}
+	return nat, nil
+}
+
+// Name returns the name of the port mapping protocol.
+//
+// This is part of the NAT interface implementation.
+func (n *natpmpNAT) Name() string {
+	return "NAT-PMP"
+}
+
+// request sends a NAT-PMP request with the passed opcode and returns the
+// response once the result code has been verified to indicate success.
+func (n *natpmpNAT) request(req []byte, respLen int) ([]byte, error) {
+	op := req[1]
+	resp, err := natpmpRequest(n.gatewayAddr, req, func(resp []byte) bool {
+		return len(resp) >= 4 && resp[0] == natpmpVersion &&
+			resp[1] == op|natpmpResponseBit
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result := binary.BigEndian.Uint16(resp[2:4]); result != 0 {
+		return nil, fmt.Errorf("NAT-PMP request failed with result "+
+			"code %d", result)
+	}
+	if len(resp) < respLen {
+		return nil, errors.New("short NAT-PMP response")
+	}
+	return resp, nil
+}
+
+// GetExternalAddress implements the NAT interface by requesting the external
+// address from the NAT-PMP gateway.
+func (n *natpmpNAT) GetExternalAddress() (net.IP, error) {
+	resp, err := n.request([]byte{natpmpVersion, natpmpOpExternalAddress}, 12)
+	if err != nil {
+		return nil, err
+	}
+	return net.IPv4(resp[8], resp[9], resp[10], resp[11]), nil
+}
+
+// natpmpMapOpcode returns the NAT-PMP opcode used to map ports of the passed
+// protocol.
+func natpmpMapOpcode(protocol string) (byte, error) {
+	switch protocol {
+	case "udp":
+		return natpmpOpMapUDP, nil
+	case "tcp":
+		return natpmpOpMapTCP, nil
+	}
+	return 0, fmt.Errorf("unsupported protocol %q", protocol)
+}
+
+// mapPort requests a mapping of the internal port with the passed lifetime and
+// returns the response after verifying it maps the internal port.
+func (n *natpmpNAT) mapPort(protocol string, externalPort, internalPort int,
+	lifetime time.Duration) (*portMapping, error) {
+
+	op, err := natpmpMapOpcode(protocol)
+	if err != nil {
+		return nil, err
+	}
+	req := make([]byte, 12)
+	req[0] = natpmpVersion
+	req[1] = op
+	binary.BigEndian.PutUint16(req[4:6], uint16(internalPort))
+	binary.BigEndian.PutUint16(req[6:8], uint16(externalPort))
+	binary.BigEndian.PutUint32(req[8:12], uint32(lifetime/time.Second))
+	resp, err := n.request(req, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	if port := int(binary.BigEndian.Uint16(resp[8:10])); port != internalPort {
+		return nil, fmt.Errorf("NAT-PMP mapped internal port %d instead "+
+			"of %d", port, internalPort)
+	}
+	return &portMapping{
+		externalPort: int(binary.BigEndian.Uint16(resp[10:12])),
+		lifetime: time.Duration(binary.BigEndian.Uint32(resp[12:16])) *
+			time.Second,
+	}, nil
+}
+
+// AddPortMapping implements the NAT interface by requesting a mapping from the
+// NAT-PMP gateway.  The gateway may assign a different external port and a
+// shorter lifetime than requested.
+func (n *natpmpNAT) AddPortMapping(protocol string, externalPort,
+	internalPort int, description string,
+	lifetime time.Duration) (*portMapping, error) {
+
+	mapping, err := n.mapPort(protocol, externalPort, internalPort, lifetime)
+	if err != nil {
+		return nil, err
+	}
+	if mapping.externalPort == 0 || mapping.lifetime == 0 {
+		return nil, errors.New("NAT-PMP gateway did not map the port")
+	}
+	return mapping, nil
+}
+
+// DeletePortMapping implements the NAT interface by requesting a mapping with
+// a lifetime of zero from the NAT-PMP gateway, which removes it.
+func (n *natpmpNAT) DeletePortMapping(protocol string, externalPort,
+	internalPort int) error {
+
+	_, err := n.mapPort(protocol, 0, internalPort, 0)
+	return err
+}
+
+// pcpNAT implements the NAT interface using PCP as specified by RFC 6887.
+type pcpNAT struct {
+	gatewayAddr string
+	clientIP    net.IP
+
+	// The following fields are protected by mtx.  nonces houses the
+	// nonce of each mapping so renewals and deletions refer to the same
+	// mapping and externalIP the external address assigned to the last
+	// mapping.
+	mtx        sync.Mutex
+	nonces     map[string][12]byte
+	externalIP net.IP
+}
+
+// discoverPCP returns a NAT for the gateway at the passed address when it
+// supports PCP.
+func discoverPCP(gatewayAddr string) (NAT, error) {
+	host, _, err := net.SplitHostPort(gatewayAddr)
+	if err != nil {
+		return nil, err
+	}
+	clientIP, err := localIPFor(host)
+	if err != nil {
+		return nil, err
+	}
+	nat := &pcpNAT{
+		gatewayAddr: gatewayAddr,
+		clientIP:    clientIP,
+		nonces:      make(map[string][12]byte),
+	}
+	if _, err := nat.request(pcpOpAnnounce, 0, nil); err != nil {
+		return nil, err
+	}
+	return nat, nil
+}
+
+// Name returns the name of the port mapping protocol.
+//
+// This is part of the NAT interface implementation.
+func (n *pcpNAT) Name() string {
+	return "PCP"
+}
+
+// request sends a PCP request with the passed opcode, lifetime and opcode
+// specific payload and returns the response once the result code has been
+// verified to indicate success.  The payload of MAP responses must start with
+// the nonce of the request.
+func (n *pcpNAT) request(op byte, lifetime time.Duration,
+	payload []byte) ([]byte, error) {
+
+	req := make([]byte, 24+len(payload))
+	req[0] = pcpVersion
+	req[1] = op
+	binary.BigEndian.PutUint32(req[4:8], uint32(lifetime/time.Second))
+	copy(req[8:24], n.clientIP.To16())
+	copy(req[24:], payload)
+
+	resp, err := natpmpRequest(n.gatewayAddr, req, func(resp []byte) bool {
+		// NAT-PMP gateways respond to PCP requests with their own
+		// version and an unsupported version result code.
+		if len(resp) >= 4 && resp[0] == natpmpVersion {
+			return true
+		}
+		if len(resp) < 24 || resp[0] != pcpVersion ||
+			resp[1] != op|natpmpResponseBit {
+			return false
+		}
+		return op != pcpOpMap ||
+			(len(resp) >= 36 && string(resp[24:36]) == string(payload[:12]))
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp[0] != pcpVersion {
+		return nil, errors.New("gateway does not support PCP")
+	}
+	if result := resp[3]; result != 0 {
+		return nil, fmt.Errorf("PCP request failed with result code %d",
+			result)
+	}
+	return resp, nil
+}
+
+// pcpProtocol returns the IANA protocol number of the passed protocol.
+func pcpProtocol(protocol string) (byte, error) {
+	switch protocol {
+	case "udp":
+		return 17, nil
+	case "tcp":
+		return 6, nil
+	}
+	return 0, fmt.Errorf("unsupported protocol %q", protocol)
+}
+
+// mapPort sends a MAP request for the internal port with the passed lifetime
+// and returns the response after verifying it maps the internal port.
+func (n *pcpNAT) mapPort(protocol string, externalPort, internalPort int,
+	lifetime time.Duration) (*portMapping, net.IP, error) {
+
+	proto, err := pcpProtocol(protocol)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Reuse the nonce of an existing mapping of the internal port so the
+	// gateway treats the request as a renewal or deletion of it.
+	key := fmt.Sprintf("%s:%d", protocol, internalPort)
+	n.mtx.Lock()
+	nonce, ok := n.nonces[key]
+	if !ok {
+		if _, err := rand.Read(nonce[:]); err != nil {
+			n.mtx.Unlock()
+			return nil, nil, err
+		}
+		n.nonces[key] = nonce
+	}
+	n.mtx.Unlock()
+
+	payload := make([]byte, 36)
+	copy(payload[0:12], nonce[:])
+	payload[12] = proto
+	binary.BigEndian.PutUint16(payload[16:18], uint16(internalPort))
+	binary.BigEndian.PutUint16(payload[18:20], uint16(externalPort))
+	copy(payload[20:36], net.IPv4zero.To16())
+	resp, err := n.request(pcpOpMap, lifetime, payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(resp) < 60 {
+		return nil, nil, errors.New("short PCP response")
+	}
+	if resp[36] != proto {
+		return nil, nil, errors.New("PCP mapped a different protocol")
+	}
+	if port := int(binary.BigEndian.Uint16(resp[40:42])); port != internalPort {
+		return nil, nil, fmt.Errorf("PCP mapped internal port %d "+
+			"instead of %d", port, internalPort)
+	}
+
+	mapping := &portMapping{
+		externalPort: int(binary.BigEndian.Uint16(resp[42:44])),
+		lifetime: time.Duration(binary.BigEndian.Uint32(resp[4:8])) *
+			time.Second,
+	}
+	externalIP := make(net.IP, net.IPv6len)
+	copy(externalIP, resp[44:60])
+	return mapping, externalIP, nil
+}
+
+// GetExternalAddress implements the NAT interface by returning the external
+// address the PCP gateway assigned to the last mapping.
+func (n *pcpNAT) GetExternalAddress() (net.IP, error) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	if n.externalIP == nil {
+		return nil, errors.New("no PCP mapping")
+	}
+	return n.externalIP, nil
+}
+
+// AddPortMapping implements the NAT interface by sending a MAP request to the
+// PCP gateway.  The gateway may assign a different external port and a shorter
+// lifetime than requested.
+func (n *pcpNAT) AddPortMapping(protocol string, externalPort,
+	internalPort int, description string,
+	lifetime time.Duration) (*portMapping, error) {
+
+	mapping, externalIP, err := n.mapPort(protocol, externalPort,
+		internalPort, lifetime)
+	if err != nil {
+		return nil, err
+	}
+	if mapping.externalPort == 0 || mapping.lifetime == 0 {
+		return nil, errors.New("PCP gateway did not map the port")
+	}
+
+	n.mtx.Lock()
+	n.externalIP = externalIP
+	n.mtx.Unlock()
+	return mapping, nil
+}
+
+// DeletePortMapping implements the NAT interface by sending a MAP request with
+// a lifetime of zero to the PCP gateway, which removes the mapping.
+func (n *pcpNAT) DeletePortMapping(protocol string, externalPort,
+	internalPort int) error {
+
+	_, _, err := n.mapPort(protocol, externalPort, internalPort, 0)
+	if err != nil {
+		return err
+	}
+
+	n.mtx.Lock()
+	delete(n.nonces, fmt.Sprintf("%s:%d", protocol, internalPort))
+	n.mtx.Unlock()
+	return nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeGateway is a UDP responder on the loopback interface which answers
+// NAT-PMP and PCP requests using the passed handler.  Requests for which the
+// handler returns nil are not answered.  The responder is stopped by closing
+// the returned connection.
+func fakeGateway(t *testing.T, handler func(req []byte) []byte) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: unexpected error: %v", err)
+	}
+	go func() {
+		buf := make([]byte, 1100)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if resp := handler(buf[:n]); resp != nil {
+				conn.WriteToUDP(resp, addr)
+			}
+		}
+	}()
+	return conn
+}
+
+// natpmpGateway returns a handler which implements a NAT-PMP gateway with the
+// passed external address.  Mappings are granted the passed external port and
+// lifetime, or the result code when it is not zero.  PCP requests are refused
+// with an unsupported version result.
+func natpmpGateway(externalIP net.IP, grantPort uint16, grantLifetime uint32,
+	result uint16) func(req []byte) []byte {
+
+	return func(req []byte) []byte {
+		if len(req) < 2 {
+			return nil
+		}
+		if req[0] != natpmpVersion {
+			return []byte{natpmpVersion, req[1] | natpmpResponseBit, 0,
+				pcpResultUnsuppVersion}
+		}
+		switch req[1] {
+		case natpmpOpExternalAddress:
+			resp := make([]byte, 12)
+			resp[1] = natpmpResponseBit
+			copy(resp[8:12], externalIP.To4())
+			return resp
+
+		case natpmpOpMapUDP, natpmpOpMapTCP:
+			resp := make([]byte, 16)
+			resp[1] = req[1] | natpmpResponseBit
+			binary.BigEndian.PutUint16(resp[2:4], result)
+			copy(resp[8:10], req[4:6])
+			lifetime := binary.BigEndian.Uint32(req[8:12])
+			if lifetime != 0 {
+				binary.BigEndian.PutUint16(resp[10:12], grantPort)
+				if lifetime > grantLifetime {
+					lifetime = grantLifetime
+				}
+			}
+			binary.BigEndian.PutUint32(resp[12:16], lifetime)
+			return resp
+		}
+		return nil
+	}
+}
+
+// pcpGateway returns a handler which implements a PCP gateway with the passed
+// external address.  Mappings are granted the passed external port and
+// lifetime, or the result code when it is not zero.
+func pcpGateway(externalIP net.IP, grantPort uint16, grantLifetime uint32,
+	result byte) func(req []byte) []byte {
+
+	return func(req []byte) []byte {
+		if len(req) < 24 || req[0] != pcpVersion {
+			return nil
+		}
+		resp := make([]byte, len(req))
+		copy(resp, req)
+		resp[1] = req[1] | natpmpResponseBit
+		resp[3] = result
+		if req[1] != pcpOpMap || len(req) < 60 {
+			return resp
+		}
+		lifetime := binary.BigEndian.Uint32(req[4:8])
+		if lifetime > grantLifetime {
+			lifetime = grantLifetime
+		}
+		binary.BigEndian.PutUint32(resp[4:8], lifetime)
+		binary.BigEndian.PutUint16(resp[42:44], grantPort)
+		copy(resp[44:60], externalIP.To16())
+		return resp
+	}
+}
+
+// TestNATPMP ensures port mappings and the external address are obtained from
+// a NAT-PMP gateway and that PCP discovery fails against it.
+func TestNATPMP(t *testing.T) {
+	externalIP := net.IPv4(203, 0, 113, 7)
+	gateway := fakeGateway(t, natpmpGateway(externalIP, 18338, 600, 0))
+	defer gateway.Close()
+	addr := gateway.LocalAddr().String()
+
+	if _, err := discoverPCP(addr); err == nil {
+		t.Fatal("discoverPCP: expected error from NAT-PMP gateway")
+	}
+	nat, err := discoverNATPMP(addr)
+	if err != nil {
+		t.Fatalf("discoverNATPMP: unexpected error: %v", err)
+	}
+	if nat.Name() != "NAT-PMP" {
+		t.Fatalf("Name: got %q, want %q", nat.Name(), "NAT-PMP")
+	}
+
+	ip, err := nat.GetExternalAddress()
+	if err != nil {
+		t.Fatalf("GetExternalAddress: unexpected error: %v", err)
+	}
+	if !ip.Equal(externalIP) {
+		t.Fatalf("GetExternalAddress: got %v, want %v", ip, externalIP)
+	}
+
+	// The gateway grants a different port and a shorter lifetime than
+	// requested.
+	mapping, err := nat.AddPortMapping("tcp", 8338, 8338, "test",
+		20*time.Minute)
+	if err != nil {
+		t.Fatalf("AddPortMapping: unexpected error: %v", err)
+	}
+	if mapping.externalPort != 18338 || mapping.lifetime != 10*time.Minute {
+		t.Fatalf("AddPortMapping: got port %d lifetime %v, want port "+
+			"18338 lifetime 10m0s", mapping.externalPort, mapping.lifetime)
+	}
+	if err := nat.DeletePortMapping("tcp", 18338, 8338); err != nil {
+		t.Fatalf("DeletePortMapping: unexpected error: %v", err)
+	}
+
+	// Failed mappings are reported.
+	failGateway := fakeGateway(t, natpmpGateway(externalIP, 0, 600, 3))
+	defer failGateway.Close()
+	addr = failGateway.LocalAddr().String()
+	nat, err = discoverNATPMP(addr)
+	if err != nil {
+		t.Fatalf("discoverNATPMP: unexpected error: %v", err)
+	}
+	if _, err := nat.AddPortMapping("tcp", 8338, 8338, "test",
+		20*time.Minute); err == nil {
+		t.Fatal("AddPortMapping: expected error for failed mapping")
+	}
+}
+
+// TestPCP ensures port mappings and the external address are obtained from a
+// PCP gateway.
+func TestPCP(t *testing.T) {
+	externalIP := net.IPv4(198, 51, 100, 23)
+	gateway := fakeGateway(t, pcpGateway(externalIP, 28338, 900, 0))
+	defer gateway.Close()
+	addr := gateway.LocalAddr().String()
+
+	nat, err := discoverPCP(addr)
+	if err != nil {
+		t.Fatalf("discoverPCP: unexpected error: %v", err)
+	}
+	if nat.Name() != "PCP" {
+		t.Fatalf("Name: got %q, want %q", nat.Name(), "PCP")
+	}
+
+	// The external address is only known once a port is mapped.
+	if _, err := nat.GetExternalAddress(); err == nil {
+		t.Fatal("GetExternalAddress: expected error before mapping")
+	}
+	mapping, err := nat.AddPortMapping("tcp", 8338, 8338, "test",
+		20*time.Minute)
+	if err != nil {
+		t.Fatalf("AddPortMapping: unexpected error: %v", err)
+	}
+	if mapping.externalPort != 28338 || mapping.lifetime != 15*time.Minute {
+		t.Fatalf("AddPortMapping: got port %d lifetime %v, want port "+
+			"28338 lifetime 15m0s", mapping.externalPort, mapping.lifetime)
+	}
+	ip, err := nat.GetExternalAddress()
+	if err != nil {
+		t.Fatalf("GetExternalAddress: unexpected error: %v", err)
+	}
+	if !ip.Equal(externalIP) {
+		t.Fatalf("GetExternalAddress: got %v, want %v", ip, externalIP)
+	}
+	if err := nat.DeletePortMapping("tcp", 28338, 8338); err != nil {
+		t.Fatalf("DeletePortMapping: unexpected error: %v", err)
+	}
+
+	// Failed mappings are reported.
+	failGateway := fakeGateway(t, pcpGateway(externalIP, 0, 900, 0))
+	defer failGateway.Close()
+	addr = failGateway.LocalAddr().String()
+	nat, err = discoverPCP(addr)
+	if err != nil {
+		t.Fatalf("discoverPCP: unexpected error: %v", err)
+	}
+	if _, err := nat.AddPortMapping("tcp", 8338, 8338, "test",
+		20*time.Minute); err == nil {
+		t.Fatal("AddPortMapping: expected error for failed mapping")
+	}
+}
+
+// TestNATPMPNoGateway ensures discovery fails when the gateway does not
+// respond.
+func TestNATPMPNoGateway(t *testing.T) {
+	gateway := fakeGateway(t, func(req []byte) []byte { return nil })
+	defer gateway.Close()
+	if _, err := discoverNATPMP(gateway.LocalAddr().String()); err == nil {
+		t.Fatal("discoverNATPMP: expected error without response")
+	}
+}
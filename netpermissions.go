@@ -0,0 +1,186 @@
+// Copyright (c) 2013-2017 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// netPermissions houses the permissions granted to peers which match a
+// whitelisted network or connect to a whitelisted bind address.
+type netPermissions uint32
+
+const (
+	// permNoBan prevents the peer from being banned, disconnected for
+	// misbehavior or evicted.  It implies permDownload.
+	permNoBan netPermissions = 1 << iota
+
+	// permRelay allows the peer to relay transactions even when the
+	// server only relays blocks.
+	permRelay
+
+	// permForceRelay relays the transactions of the peer even when they
+	// are already in the memory pool.  It implies permRelay.
+	permForceRelay
+
+	// permMempool allows the peer to request the contents of the memory
+	// pool even when bloom filtering is disabled.
+	permMempool
+
+	// permDownload allows the peer to download historical blocks once the
+	// upload target is reached.
+	permDownload
+
+	// permAddr allows the peer to request addresses more than once per
+	// connection.
+	permAddr
+)
+
+// defaultWhitelistPermissions are the permissions granted by a whitelist or
+// whitebind entry which does not list any.
+const defaultWhitelistPermissions = permNoBan | permRelay | permMempool |
+	permDownload
+
+// netPermissionNames maps the permission names used by the whitelist and
+// whitebind options to the permissions they grant.
+var netPermissionNames = []struct {
+	name string
+	perm netPermissions
+}{
+	{"noban", permNoBan | permDownload},
+	{"relay", permRelay},
+	{"forcerelay", permForceRelay | permRelay},
+	{"mempool", permMempool},
+	{"download", permDownload},
+	{"addr", permAddr},
+}
+
+// Has returns whether all of the passed permissions are granted.
+func (p netPermissions) Has(perm netPermissions) bool {
+	return p&perm == perm
+}
+
+// Strings returns the names of the granted permissions.
+func (p netPermissions) Strings() []string {
+	names := make([]string, 0, len(netPermissionNames))
+	for _, n := range netPermissionNames {
+		if p.Has(n.perm) {
+			names = append(names, n.name)
+		}
+	}
+	return names
+}
+
+// parseNetPermissions splits a whitelist or whitebind entry in the format
+// [<permission>[,<permission>...]@]<value> into the granted permissions and
+// the value.  Entries which do not list any permissions are granted the
+// default whitelist permissions.
+func parseNetPermissions(entry string) (netPermissions, string, error) {
+	at := strings.LastIndex(entry, "@")
+	if at == -1 {
+		return defaultWhitelistPermissions, entry, nil
+	}
+
+	var perms netPermissions
+	for _, name := range strings.Split(entry[:at], ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		var found bool
+		for _, n := range netPermissionNames {
+			if n.name == name {
+				perms |= n.perm
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, "", fmt.Errorf("unknown permission %q", name)
+		}
+	}
+	return perms, entry[at+1:], nil
+}
+
+// netWhitelist is a whitelisted network along with the permissions granted to
+// the peers it contains.
+type netWhitelist struct {
+	ipnet *net.IPNet
+	perms netPermissions
+}
+
+// parseWhitelist parses a whitelist entry in the format
+// [<permissions>@]<IP or network>.
+func parseWhitelist(entry string) (netWhitelist, error) {
+	perms, addr, err := parseNetPermissions(entry)
+	if err != nil {
+		return netWhitelist{}, err
+	}
+	_, ipnet, err := net.ParseCIDR(addr)
+	if err != nil {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return netWhitelist{}, fmt.Errorf("invalid IP or "+
+				"network %q", addr)
+		}
+		var bits int
+		if ip.To4() == nil {
+			// IPv6
+			bits = 128
+		} else {
+			bits = 32
+		}
+		ipnet = &net.IPNet{
+			IP:   ip,
+			Mask: net.CIDRMask(bits, bits),
+		}
+	}
+	return netWhitelist{ipnet: ipnet, perms: perms}, nil
+}
+
+// netWhitebind is a whitelisted bind address along with the permissions
+// granted to the peers which connect to it.
+type netWhitebind struct {
+	addr  string
+	ip    net.IP
+	port  string
+	perms netPermissions
+}
+
+// parseWhitebind parses a whitebind entry in the format
+// [<permissions>@]<host>:<port>.
+func parseWhitebind(entry string) (netWhitebind, error) {
+	perms, addr, err := parseNetPermissions(entry)
+	if err != nil {
+		return netWhitebind{}, err
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return netWhitebind{}, err
+	}
+	var ip net.IP
+	if host != "" {
+		ip = net.ParseIP(host)
+		if ip == nil {
+			return netWhitebind{}, fmt.Errorf("invalid IP %q", host)
+		}
+	}
+	return netWhitebind{addr: addr, ip: ip, port: port, perms: perms}, nil
+}
+
+// matches returns whether a connection accepted at the passed local address
+// was accepted by the listener of the bind address.
+func (wb *netWhitebind) matches(localAddr net.Addr) bool {
+	host, port, err := net.SplitHostPort(localAddr.String())
+	if err != nil || port != wb.port {
+		return false
+	}
+	if wb.ip == nil || wb.ip.IsUnspecified() {
+		return true
+	}
+	return wb.ip.Equal(net.ParseIP(host))
+}
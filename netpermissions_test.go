@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+// TestParseNetPermissions ensures whitelist and whitebind entries are split
+// into the granted permissions and the value.
+func TestParseNetPermissions(t *testing.T) {
+	tests := []struct {
+		entry string
+		perms netPermissions
+		value string
+		names []string
+		err   bool
+	}{
+		{
+			entry: "192.168.1.0/24",
+			perms: defaultWhitelistPermissions,
+			value: "192.168.1.0/24",
+			names: []string{"noban", "relay", "mempool", "download"},
+		},
+		{
+			entry: "relay,mempool@::1",
+			perms: permRelay | permMempool,
+			value: "::1",
+			names: []string{"relay", "mempool"},
+		},
+		{
+			entry: "forcerelay,addr@127.0.0.1:8338",
+			perms: permForceRelay | permRelay | permAddr,
+			value: "127.0.0.1:8338",
+			names: []string{"relay", "forcerelay", "addr"},
+		},
+		{
+			entry: "@10.0.0.1",
+			perms: 0,
+			value: "10.0.0.1",
+			names: []string{},
+		},
+		{
+			entry: "bloomfilter@10.0.0.1",
+			err:   true,
+		},
+	}
+
+	for _, test := range tests {
+		perms, value, err := parseNetPermissions(test.entry)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: expected error", test.entry)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.entry, err)
+			continue
+		}
+		if perms != test.perms || value != test.value {
+			t.Errorf("%q: got (%v, %q), want (%v, %q)", test.entry,
+				perms, value, test.perms, test.value)
+		}
+		if names := perms.Strings(); !reflect.DeepEqual(names, test.names) {
+			t.Errorf("%q: got names %v, want %v", test.entry, names,
+				test.names)
+		}
+	}
+}
+
+// TestWhitebindMatches ensures whitebind entries match the local addresses of
+// the connections accepted by their listener.
+func TestWhitebindMatches(t *testing.T) {
+	tests := []struct {
+		entry     string
+		localAddr string
+		want      bool
+	}{
+		{"127.0.0.1:8338", "127.0.0.1:8338", true},
+		{"127.0.0.1:8338", "127.0.0.2:8338", false},
+		{"127.0.0.1:8338", "127.0.0.1:8339", false},
+		{":8338", "10.0.0.1:8338", true},
+		{"0.0.0.0:8338", "10.0.0.1:8338", true},
+		{"[::1]:8338", "[::1]:8338", true},
+	}
+
+	for _, test := range tests {
+		wb, err := parseWhitebind(test.entry)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.entry, err)
+			continue
+		}
+		addr, err := net.ResolveTCPAddr("tcp", test.localAddr)
+		if err != nil {
+			t.Fatalf("ResolveTCPAddr: unexpected error: %v", err)
+		}
+		if got := wb.matches(addr); got != test.want {
+			t.Errorf("%q matches %s: got %v, want %v", test.entry,
+				test.localAddr, got, test.want)
+		}
+	}
+}
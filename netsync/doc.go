@@ -6,8 +6,9 @@
 Package netsync implements a concurrency safe block syncing protocol. The
 SyncManager communicates with connected peers to perform an initial block
 download, keep the chain and unconfirmed transaction pool in sync, and announce
-new blocks connected to the chain. Currently the sync manager selects a single
-sync peer that it downloads all blocks from until it is up to date with the
-longest chain the sync peer is aware of.
+new blocks connected to the chain. The sync manager selects a sync peer that it
+downloads and validates the header chain from without relying on checkpoints.
+The blocks of the best header chain are then downloaded in parallel from all
+suitable peers within a moving window and connected to the chain in order.
 */
 package netsync
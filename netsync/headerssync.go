@@ -0,0 +1,262 @@
+// Copyright (c) 2017 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package netsync
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/btgsuite/btgd/blockchain"
+	"github.com/btgsuite/btgd/chaincfg"
+	"github.com/btgsuite/btgd/chaincfg/chainhash"
+	"github.com/btgsuite/btgd/wire"
+)
+
+const (
+	// headerCommitmentPeriod is the number of headers between the headers
+	// a commitment is stored for while presyncing a header chain.
+	headerCommitmentPeriod = 600
+
+	// redownloadBufferSize is the number of redownloaded headers which are
+	// held back until the commitments of the headers which follow them
+	// were verified.  It covers enough commitments to make it infeasible
+	// for a peer to redownload a different header chain than the one it
+	// presynced without being detected.
+	redownloadBufferSize = 14000
+)
+
+// errLowWorkHeaderChain indicates that a peer ran out of headers before its
+// header chain had enough work to be stored.
+var errLowWorkHeaderChain = errors.New("header chain has too little work")
+
+// hasSufficientWork returns whether a chain of headers with the passed work
+// ending at the passed height is allowed to be stored.  Its work must reach the
+// passed threshold and it must include the passed checkpoint, if any.
+func hasSufficientWork(work *big.Int, height int32, threshold *big.Int,
+	checkpoint *chaincfg.Checkpoint) bool {
+
+	if checkpoint != nil && height < checkpoint.Height {
+		return false
+	}
+	return work.Cmp(threshold) >= 0
+}
+
+// headersPresync validates the headers of a chain which does not have enough
+// work to be stored without storing them, which protects against low-work
+// header spam.  The headers are downloaded twice.  While presyncing, only their
+// work is accumulated and a salted commitment to every headerCommitmentPeriod
+// header is kept.  Once the chain is found to have enough work, the headers
+// are redownloaded from the start and released to be stored as soon as enough
+// of the commitments which follow them were verified.
+type headersPresync struct {
+	powLimit       *big.Int
+	threshold      *big.Int
+	checkpoint     *chaincfg.Checkpoint
+	salt           [16]byte
+	commitOffset   int32
+	maxCommitments int
+
+	// The following fields track the presynced headers.
+	lastHash    chainhash.Hash
+	height      int32
+	work        *big.Int
+	commitments []bool
+
+	// The following fields track the redownloaded headers.  buffer houses
+	// the headers which are not released yet, and all remaining headers
+	// are released once the redownloaded headers have enough work.
+	redownloading    bool
+	startHash        chainhash.Hash
+	startHeight      int32
+	startWork        *big.Int
+	redownloadHash   chainhash.Hash
+	redownloadHeight int32
+	redownloadWork   *big.Int
+	buffer           []*wire.BlockHeader
+	releaseRemaining bool
+}
+
+// newHeadersPresync returns a presync of the header chain which builds on the
+// block or header with the passed hash, height, timestamp and total work.  The
+// presynced chain must reach the passed work threshold and include the passed
+// checkpoint, if any, before its headers are released.
+func newHeadersPresync(startHash *chainhash.Hash, startHeight int32,
+	startTime time.Time, startWork, threshold *big.Int,
+	checkpoint *chaincfg.Checkpoint, powLimit *big.Int) *headersPresync {
+
+	s := &headersPresync{
+		powLimit:    powLimit,
+		threshold:   threshold,
+		checkpoint:  checkpoint,
+		lastHash:    *startHash,
+		height:      startHeight,
+		work:        new(big.Int).Set(startWork),
+		startHash:   *startHash,
+		startHeight: startHeight,
+		startWork:   startWork,
+	}
+	var offset [4]byte
+	rand.Read(s.salt[:])
+	rand.Read(offset[:])
+	s.commitOffset = int32(binary.LittleEndian.Uint32(offset[:]) %
+		headerCommitmentPeriod)
+
+	// The median time rule allows at most six blocks per second, so bound
+	// the number of commitments by the maximum length of a chain with
+	// timestamps up to the maximum allowed time in the future.
+	maxSeconds := time.Now().Unix() - startTime.Unix() +
+		2*blockchain.MaxTimeOffsetSeconds
+	s.maxCommitments = int(6 * maxSeconds / headerCommitmentPeriod)
+	return s
+}
+
+// commitment returns the salted commitment to the header with the passed hash.
+func (s *headersPresync) commitment(hash *chainhash.Hash) bool {
+	h := sha256.New()
+	h.Write(s.salt[:])
+	h.Write(hash[:])
+	return h.Sum(nil)[0]&1 == 1
+}
+
+// checkHeader ensures the passed header builds on the header with the passed
+// hash and has a valid proof of work.
+func (s *headersPresync) checkHeader(header *wire.BlockHeader,
+	prevHash *chainhash.Hash) error {
+
+	if header.PrevBlock != *prevHash {
+		return fmt.Errorf("header %v does not connect to the previous "+
+			"header %v", header.BlockHash(), prevHash)
+	}
+	return blockchain.CheckHeaderProofOfWork(header, s.powLimit)
+}
+
+// presyncHeader accumulates the work of the passed presynced header and keeps
+// a commitment to it when it is due.
+func (s *headersPresync) presyncHeader(header *wire.BlockHeader) error {
+	if err := s.checkHeader(header, &s.lastHash); err != nil {
+		return err
+	}
+	s.lastHash = header.BlockHash()
+	s.height++
+	s.work.Add(s.work, blockchain.CalcWork(header.Bits))
+
+	if s.checkpoint != nil && s.height == s.checkpoint.Height &&
+		!s.lastHash.IsEqual(s.checkpoint.Hash) {
+
+		return fmt.Errorf("header %v at height %d does not match "+
+			"checkpoint %v", s.lastHash, s.height, s.checkpoint.Hash)
+	}
+	if s.height%headerCommitmentPeriod == s.commitOffset {
+		if len(s.commitments) >= s.maxCommitments {
+			return fmt.Errorf("header chain exceeds the maximum "+
+				"length of %d commitments", s.maxCommitments)
+		}
+		s.commitments = append(s.commitments, s.commitment(&s.lastHash))
+	}
+	return nil
+}
+
+// redownloadHeader verifies the passed redownloaded header against the
+// commitment kept while presyncing and buffers it.
+func (s *headersPresync) redownloadHeader(header *wire.BlockHeader) error {
+	if err := s.checkHeader(header, &s.redownloadHash); err != nil {
+		return err
+	}
+	s.redownloadHash = header.BlockHash()
+	s.redownloadHeight++
+	s.redownloadWork.Add(s.redownloadWork, blockchain.CalcWork(header.Bits))
+	if hasSufficientWork(s.redownloadWork, s.redownloadHeight, s.threshold,
+		s.checkpoint) {
+
+		s.releaseRemaining = true
+	}
+
+	if !s.releaseRemaining &&
+		s.redownloadHeight%headerCommitmentPeriod == s.commitOffset {
+
+		if len(s.commitments) == 0 {
+			return errors.New("redownloaded header chain is longer " +
+				"than the presynced one")
+		}
+		commitment := s.commitments[0]
+		s.commitments = s.commitments[1:]
+		if s.commitment(&s.redownloadHash) != commitment {
+			return errors.New("redownloaded header chain does not " +
+				"match the presynced one")
+		}
+	}
+	s.buffer = append(s.buffer, header)
+	return nil
+}
+
+// processHeaders presyncs or redownloads the passed headers, which were sent
+// in a full headers message when full is set.  It returns the redownloaded
+// headers which are ready to be stored.  An error is returned when the headers
+// are invalid, do not match the presynced ones, or the peer ran out of
+// headers before the chain had enough work.
+func (s *headersPresync) processHeaders(headers []*wire.BlockHeader,
+	full bool) ([]*wire.BlockHeader, error) {
+
+	if !s.redownloading {
+		for _, header := range headers {
+			if err := s.presyncHeader(header); err != nil {
+				return nil, err
+			}
+		}
+
+		// Redownload the headers from the start once the presynced
+		// chain has enough work.
+		if hasSufficientWork(s.work, s.height, s.threshold, s.checkpoint) {
+			s.redownloading = true
+			s.redownloadHash = s.startHash
+			s.redownloadHeight = s.startHeight
+			s.redownloadWork = new(big.Int).Set(s.startWork)
+			return nil, nil
+		}
+		if !full {
+			return nil, errLowWorkHeaderChain
+		}
+		return nil, nil
+	}
+
+	for _, header := range headers {
+		if err := s.redownloadHeader(header); err != nil {
+			return nil, err
+		}
+	}
+	if !s.releaseRemaining && !full {
+		return nil, errLowWorkHeaderChain
+	}
+
+	var n int
+	switch {
+	case s.releaseRemaining:
+		n = len(s.buffer)
+	case len(s.buffer) > redownloadBufferSize:
+		n = len(s.buffer) - redownloadBufferSize
+	}
+	ready := s.buffer[:n:n]
+	s.buffer = s.buffer[n:]
+	return ready, nil
+}
+
+// done returns whether all headers of the presynced chain were released.
+func (s *headersPresync) done() bool {
+	return s.releaseRemaining && len(s.buffer) == 0
+}
+
+// nextHash returns the hash of the header after which the next headers are
+// requested.
+func (s *headersPresync) nextHash() *chainhash.Hash {
+	if s.redownloading {
+		return &s.redownloadHash
+	}
+	return &s.lastHash
+}
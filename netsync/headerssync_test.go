@@ -0,0 +1,190 @@
+// Copyright (c) 2017 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package netsync
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/btgsuite/btgd/blockchain"
+	"github.com/btgsuite/btgd/chaincfg"
+	"github.com/btgsuite/btgd/chaincfg/chainhash"
+	"github.com/btgsuite/btgd/wire"
+	btcutil "github.com/btgsuite/btgutil"
+)
+
+// blockHeaders returns the headers of the passed blocks.
+func blockHeaders(blocks []*btcutil.Block) []*wire.BlockHeader {
+	headers := make([]*wire.BlockHeader, 0, len(blocks))
+	for _, block := range blocks {
+		headers = append(headers, &block.MsgBlock().Header)
+	}
+	return headers
+}
+
+// chainWork returns the total work of the chain of the passed number of
+// blocks at the proof of work limit of the passed network, including the
+// genesis block.
+func chainWork(params *chaincfg.Params, numBlocks int64) *big.Int {
+	work := blockchain.CalcWork(params.GenesisBlock.Header.Bits)
+	return work.Add(work, new(big.Int).Mul(big.NewInt(numBlocks),
+		blockchain.CalcWork(params.PowLimitBits)))
+}
+
+// newTestPresync returns a presync of the chain which builds on the genesis
+// block of the passed network and must have the work of the passed number of
+// blocks.
+func newTestPresync(params *chaincfg.Params, numBlocks int64,
+	checkpoint *chaincfg.Checkpoint) *headersPresync {
+
+	genesis := &params.GenesisBlock.Header
+	return newHeadersPresync(params.GenesisHash, 0, genesis.Timestamp,
+		chainWork(params, 0), chainWork(params, numBlocks), checkpoint,
+		params.PowLimit)
+}
+
+// TestHeadersPresync ensures the headers of a presynced chain are only
+// released once they were redownloaded and the chain has enough work.
+func TestHeadersPresync(t *testing.T) {
+	const numBlocks = 1500
+	const batchSize = 500
+	const sufficientBlocks = 1300
+
+	params := chaincfg.RegressionNetParams
+	blocks, err := generateBlocks(&params, numBlocks, nil)
+	if err != nil {
+		t.Fatalf("unable to generate blocks: %v", err)
+	}
+	headers := blockHeaders(blocks)
+	presync := newTestPresync(&params, sufficientBlocks, nil)
+
+	// None of the headers are released while presyncing.
+	for i := 0; i < numBlocks; i += batchSize {
+		full := i+batchSize < numBlocks
+		released, err := presync.processHeaders(headers[i:i+batchSize],
+			full)
+		if err != nil {
+			t.Fatalf("presync of headers %d: %v", i, err)
+		}
+		if len(released) != 0 {
+			t.Fatalf("presync of headers %d released %d headers",
+				i, len(released))
+		}
+	}
+	if !presync.nextHash().IsEqual(params.GenesisHash) {
+		t.Fatalf("got next hash %v after presync, want %v",
+			presync.nextHash(), params.GenesisHash)
+	}
+
+	// All headers are released once the redownloaded headers have enough
+	// work.
+	var released []*wire.BlockHeader
+	for i := 0; i < numBlocks; i += batchSize {
+		full := i+batchSize < numBlocks
+		ready, err := presync.processHeaders(headers[i:i+batchSize],
+			full)
+		if err != nil {
+			t.Fatalf("redownload of headers %d: %v", i, err)
+		}
+		if i+batchSize < sufficientBlocks && len(ready) != 0 {
+			t.Fatalf("redownload of headers %d released %d "+
+				"headers", i, len(ready))
+		}
+		released = append(released, ready...)
+	}
+	if !presync.done() {
+		t.Fatal("presync is not done after the redownload")
+	}
+	if len(released) != numBlocks {
+		t.Fatalf("got %d released headers, want %d", len(released),
+			numBlocks)
+	}
+	for i := range released {
+		if released[i] != headers[i] {
+			t.Fatalf("released header %d does not match", i)
+		}
+	}
+}
+
+// TestHeadersPresyncErrors ensures invalid, low-work and mismatching header
+// chains are detected while presyncing and redownloading them.
+func TestHeadersPresyncErrors(t *testing.T) {
+	const numBlocks = 1500
+	const sufficientBlocks = 1300
+
+	params := chaincfg.RegressionNetParams
+	blocks, err := generateBlocks(&params, numBlocks, nil)
+	if err != nil {
+		t.Fatalf("unable to generate blocks: %v", err)
+	}
+	headers := blockHeaders(blocks)
+	wrongCheckpoint := &chaincfg.Checkpoint{
+		Height: 10,
+		Hash:   &chainhash.Hash{},
+	}
+
+	tests := []struct {
+		name       string
+		checkpoint *chaincfg.Checkpoint
+		presync    []*wire.BlockHeader
+		redownload []*wire.BlockHeader
+		mismatch   bool
+		lowWork    bool
+	}{
+		{
+			name:    "disconnected header",
+			presync: append(headers[:10:10], headers[11:]...),
+		},
+		{
+			name:       "checkpoint mismatch",
+			checkpoint: wrongCheckpoint,
+			presync:    headers,
+		},
+		{
+			name:    "low-work presync",
+			presync: headers[:sufficientBlocks-1],
+			lowWork: true,
+		},
+		{
+			name:       "low-work redownload",
+			presync:    headers,
+			redownload: headers[:sufficientBlocks-1],
+			lowWork:    true,
+		},
+		{
+			name:       "commitment mismatch",
+			presync:    headers,
+			redownload: headers,
+			mismatch:   true,
+		},
+	}
+
+	for _, test := range tests {
+		presync := newTestPresync(&params, sufficientBlocks,
+			test.checkpoint)
+		_, err := presync.processHeaders(test.presync, false)
+		if test.redownload != nil {
+			if err != nil {
+				t.Errorf("%s: unexpected presync error: %v",
+					test.name, err)
+				continue
+			}
+
+			// Flip the first commitment, which the redownloaded
+			// chain cannot match then.
+			if test.mismatch {
+				presync.commitments[0] = !presync.commitments[0]
+			}
+			_, err = presync.processHeaders(test.redownload, false)
+		}
+		if err == nil {
+			t.Errorf("%s: header chain was not rejected", test.name)
+			continue
+		}
+		if test.lowWork != (err == errLowWorkHeaderChain) {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+	}
+}
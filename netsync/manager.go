@@ -8,6 +8,7 @@ import (
 	"container/list"
 	"math/rand"
 	"net"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -23,10 +24,37 @@ import (
 )
 
 const (
-	// minInFlightBlocks is the minimum number of blocks that should be
-	// in the request queue for headers-first mode before requesting
-	// more.
-	minInFlightBlocks = 10
+	// blockDownloadWindow is the maximum number of blocks past the next
+	// block to connect which are downloaded in headers-first mode.  Blocks
+	// are requested from all sync candidates in parallel, so the window
+	// bounds the number of blocks which have to be held in memory while
+	// waiting for an earlier block.
+	blockDownloadWindow = 256
+
+	// maxBlocksInFlightPerPeer is the maximum number of blocks which are
+	// requested from a single peer at once in headers-first mode.
+	maxBlocksInFlightPerPeer = 16
+
+	// blockStallTimeout is the time after which a peer that has not
+	// delivered the next block to connect is considered to stall the
+	// download window while later blocks are waiting.
+	blockStallTimeout = 15 * time.Second
+
+	// blockDownloadTimeout is the time after which any requested block
+	// that has not been delivered is considered stalled.
+	blockDownloadTimeout = 2 * time.Minute
+
+	// blockStallCheckInterval is the interval at which the in-flight
+	// block requests of headers-first mode are checked for stalls.
+	blockStallCheckInterval = 5 * time.Second
+
+	// throughputDecay is the weight given to the newest sample of the
+	// moving average of the block throughput of a peer.
+	throughputDecay = 0.2
+
+	// headerListBatchSize is the number of headers loaded from the chain
+	// at once when filling the list of headers whose blocks are fetched.
+	headerListBatchSize = 2 * blockDownloadWindow
 
 	// maxRejectedTxns is the maximum number of rejected transactions
 	// hashes to store in memory.
@@ -47,6 +75,20 @@ const (
 	// stallSampleInterval the interval at which we will check to see if our
 	// sync has stalled.
 	stallSampleInterval = 30 * time.Second
+
+	// staleTipCheckInterval is the interval at which we will check to see
+	// if our tip has gone stale.
+	staleTipCheckInterval = time.Minute
+
+	// staleTipMultiplier is the multiple of the target time per block
+	// after which the tip is considered potentially stale when it has not
+	// advanced.
+	staleTipMultiplier = 3
+
+	// maxHeaderForksPerPeer is the maximum number of headers messages a
+	// peer may send which fork from the best known header chain before it
+	// is disconnected.
+	maxHeaderForksPerPeer = 8
 )
 
 // zeroHash is the zero value hash (all zeros).  It is defined as a convenience.
@@ -131,13 +173,28 @@ type pauseMsg struct {
 	unpause <-chan struct{}
 }
 
-// headerNode is used as a node in a list of headers that are linked together
-// between checkpoints.
+// probeHeadersMsg is a message type to be sent across the message channel for
+// probing a peer for headers which build on the passed locator.
+type probeHeadersMsg struct {
+	peer    *peerpkg.Peer
+	locator blockchain.BlockLocator
+}
+
+// headerNode is used as a node in a list of headers whose blocks are fetched
+// in headers-first mode.
 type headerNode struct {
 	height int32
 	hash   *chainhash.Hash
 }
 
+// blockRequest describes a block requested by the download scheduler of
+// headers-first mode.
+type blockRequest struct {
+	node      *headerNode
+	peer      *peerpkg.Peer
+	requested time.Time
+}
+
 // peerSyncState stores additional information that the SyncManager tracks
 // about a peer.
 type peerSyncState struct {
@@ -145,6 +202,21 @@ type peerSyncState struct {
 	requestQueue    []*wire.InvVect
 	requestedTxns   map[chainhash.Hash]struct{}
 	requestedBlocks map[chainhash.Hash]struct{}
+
+	// blockThroughput is a moving average of the rate, in bytes per
+	// second, at which the peer delivered requested blocks.  It is used to
+	// rank the peers blocks are downloaded from.  lastBlockTime is the
+	// time the peer last delivered a requested block.
+	blockThroughput float64
+	lastBlockTime   time.Time
+
+	// headerForks is the number of headers messages the peer sent which
+	// fork from the best known header chain.
+	headerForks int
+
+	// headersProbe is whether the peer was probed for headers by
+	// ProbeHeaders and its reply has not been received yet.
+	headersProbe bool
 }
 
 // SyncManager is used to communicate block related messages with peers. The
@@ -153,6 +225,10 @@ type peerSyncState struct {
 // chain is in sync, the SyncManager handles incoming block and header
 // notifications and relays announcements of new blocks to peers.
 type SyncManager struct {
+	// The following variables must only be used atomically.
+	lastTipUpdate int64 // Unix nanoseconds of the last tip change.
+	tipStale      int32
+
 	peerNotifier   PeerNotifier
 	started        int32
 	shutdown       int32
@@ -172,11 +248,26 @@ type SyncManager struct {
 	peerStates       map[*peerpkg.Peer]*peerSyncState
 	lastProgressTime time.Time
 
-	// The following fields are used for headers-first mode.
+	// The following fields are used for headers-first mode.  The header
+	// chain is downloaded from the sync peer and validated first.  The
+	// blocks up to the best header, headerTarget, are then downloaded from
+	// all sync candidates in parallel.  headerList houses the headers of
+	// the next blocks to connect and is filled from the block index up to
+	// nextHeaderHeight as the download progresses.  Blocks up to
+	// fastAddHeight are verified by a checkpoint.  blockRequests houses
+	// the blocks which are in flight and queuedBlocks the blocks which
+	// arrived before the blocks they build on.  presync validates the
+	// headers of a chain with too little work to be stored before they
+	// are processed.
 	headersFirstMode bool
 	headerList       *list.List
-	startHeader      *list.Element
-	nextCheckpoint   *chaincfg.Checkpoint
+	fetchingBlocks   bool
+	headerTarget     *headerNode
+	nextHeaderHeight int32
+	fastAddHeight    int32
+	blockRequests    map[chainhash.Hash]*blockRequest
+	queuedBlocks     map[chainhash.Hash]*blockMsg
+	presync          *headersPresync
 
 	// An optional fee estimator.
 	feeEstimator *mempool.FeeEstimator
@@ -184,46 +275,30 @@ type SyncManager struct {
 
 // resetHeaderState sets the headers-first mode state to values appropriate for
 // syncing from a new peer.
-func (sm *SyncManager) resetHeaderState(newestHash *chainhash.Hash, newestHeight int32) {
+func (sm *SyncManager) resetHeaderState() {
 	sm.headersFirstMode = false
 	sm.headerList.Init()
-	sm.startHeader = nil
-
-	// When there is a next checkpoint, add an entry for the latest known
-	// block into the header pool.  This allows the next downloaded header
-	// to prove it links to the chain properly.
-	if sm.nextCheckpoint != nil {
-		node := headerNode{height: newestHeight, hash: newestHash}
-		sm.headerList.PushBack(&node)
-	}
+	sm.fetchingBlocks = false
+	sm.headerTarget = nil
+	sm.nextHeaderHeight = 0
+	sm.fastAddHeight = -1
+	sm.blockRequests = make(map[chainhash.Hash]*blockRequest)
+	sm.queuedBlocks = make(map[chainhash.Hash]*blockMsg)
+	sm.presync = nil
+	sm.chain.CancelPrevalidation()
 }
 
-// findNextHeaderCheckpoint returns the next checkpoint after the passed height.
-// It returns nil when there is not one either because the height is already
-// later than the final checkpoint or some other reason such as disabled
-// checkpoints.
-func (sm *SyncManager) findNextHeaderCheckpoint(height int32) *chaincfg.Checkpoint {
+// findLastHeaderCheckpoint returns the latest checkpoint at or before the
+// passed height.  It returns nil when there is not one either because the
+// height is before the first checkpoint or checkpoints are disabled.
+func (sm *SyncManager) findLastHeaderCheckpoint(height int32) *chaincfg.Checkpoint {
 	checkpoints := sm.chain.Checkpoints()
-	if len(checkpoints) == 0 {
-		return nil
-	}
-
-	// There is no next checkpoint if the height is already after the final
-	// checkpoint.
-	finalCheckpoint := &checkpoints[len(checkpoints)-1]
-	if height >= finalCheckpoint.Height {
-		return nil
-	}
-
-	// Find the next checkpoint.
-	nextCheckpoint := finalCheckpoint
-	for i := len(checkpoints) - 2; i >= 0; i-- {
-		if height >= checkpoints[i].Height {
-			break
+	for i := len(checkpoints) - 1; i >= 0; i-- {
+		if checkpoints[i].Height <= height {
+			return &checkpoints[i]
 		}
-		nextCheckpoint = &checkpoints[i]
 	}
-	return nextCheckpoint
+	return nil
 }
 
 // startSync will choose the best peer among the available candidate peers to
@@ -278,20 +353,27 @@ func (sm *SyncManager) startSync() {
 		}
 
 		// This peer has a height greater than our own, we'll consider
-		// it in the set of better peers from which we'll randomly
-		// select.
+		// it in the set of better peers from which we'll select.
 		higherPeers = append(higherPeers, peer)
 	}
 
-	// Pick randomly from the set of peers greater than our block height,
-	// falling back to a random peer of the same height if none are greater.
-	//
-	// TODO(conner): Use a better algorithm to ranking peers based on
-	// observed metrics and/or sync in parallel.
+	// Pick the peer with the greatest measured block throughput from the
+	// set of peers greater than our block height, or a random one when
+	// none have delivered blocks yet, falling back to a random peer of the
+	// same height if none are greater.  Blocks are downloaded from all
+	// sync candidates in headers-first mode, so the sync peer mostly
+	// serves headers and block announcements.
 	var bestPeer *peerpkg.Peer
 	switch {
 	case len(higherPeers) > 0:
 		bestPeer = higherPeers[rand.Intn(len(higherPeers))]
+		for _, peer := range higherPeers {
+			if sm.peerStates[peer].blockThroughput >
+				sm.peerStates[bestPeer].blockThroughput {
+
+				bestPeer = peer
+			}
+		}
 
 	case len(equalPeers) > 0:
 		bestPeer = equalPeers[rand.Intn(len(equalPeers))]
@@ -314,32 +396,27 @@ func (sm *SyncManager) startSync() {
 		log.Infof("Syncing to block height %d from peer %v",
 			bestPeer.LastBlock(), bestPeer.Addr())
 
-		// When the current height is less than a known checkpoint we
-		// can use block headers to learn about which blocks comprise
-		// the chain up to the checkpoint and perform less validation
-		// for them.  This is possible since each header contains the
-		// hash of the previous header and a merkle root.  Therefore if
-		// we validate all of the received headers link together
-		// properly and the checkpoint hashes match, we can be sure the
-		// hashes for the blocks in between are accurate.  Further, once
-		// the full blocks are downloaded, the merkle root is computed
-		// and compared against the value in the header which proves the
-		// full block hasn't been tampered with.
+		// Download the block headers first to learn about which blocks
+		// comprise the chain with the most work.  Each header is fully
+		// validated, including its proof of work and required
+		// difficulty, and added to the block index before any of the
+		// blocks are requested.  This prevents wasting bandwidth and
+		// disk space on blocks of chains which do not have the most
+		// work and allows downloading the blocks from many peers in
+		// parallel.  Once the full blocks are downloaded, the merkle
+		// root is computed and compared against the value in the header
+		// which proves the full block hasn't been tampered with.
 		//
-		// Once we have passed the final checkpoint, or checkpoints are
-		// disabled, use standard inv messages learn about the blocks
-		// and fully validate them.  Finally, regression test mode does
-		// not support the headers-first approach so do normal block
-		// downloads when in regression test mode.
-		if sm.nextCheckpoint != nil &&
-			best.Height < sm.nextCheckpoint.Height &&
-			sm.chainParams != &chaincfg.RegressionNetParams {
-
-			bestPeer.PushGetHeadersMsg(locator, sm.nextCheckpoint.Hash)
+		// Regression test mode does not support the headers-first
+		// approach so do normal block downloads when in regression test
+		// mode.
+		if sm.chainParams != &chaincfg.RegressionNetParams {
+			bestHeader, bestHeaderHeight := sm.chain.BestHeader()
+			locator := sm.chain.BlockLocatorFromHash(&bestHeader)
+			bestPeer.PushGetHeadersMsg(locator, &zeroHash)
 			sm.headersFirstMode = true
-			log.Infof("Downloading headers for blocks %d to "+
-				"%d from peer %s", best.Height+1,
-				sm.nextCheckpoint.Height, bestPeer.Addr())
+			log.Infof("Downloading headers for blocks after height "+
+				"%d from peer %s", bestHeaderHeight, bestPeer.Addr())
 		} else {
 			bestPeer.PushGetBlocksMsg(locator, &zeroHash)
 		}
@@ -410,9 +487,12 @@ func (sm *SyncManager) handleNewPeerMsg(peer *peerpkg.Peer) {
 		requestedBlocks: make(map[chainhash.Hash]struct{}),
 	}
 
-	// Start syncing by choosing the best candidate if needed.
+	// Start syncing by choosing the best candidate if needed.  When blocks
+	// are already being downloaded, the new peer takes part.
 	if isSyncCandidate && sm.syncPeer == nil {
 		sm.startSync()
+	} else if isSyncCandidate && sm.fetchingBlocks {
+		sm.fetchHeaderBlocks()
 	}
 }
 
@@ -480,17 +560,20 @@ func (sm *SyncManager) handleDonePeerMsg(peer *peerpkg.Peer) {
 		return
 	}
 
-	// Remove the peer from the list of candidate peers.
-	delete(sm.peerStates, peer)
-
 	log.Infof("Lost peer %s", peer)
 
 	sm.clearRequestedState(state)
 
+	// Remove the peer from the list of candidate peers.
+	delete(sm.peerStates, peer)
+
 	if peer == sm.syncPeer {
 		// Update the sync peer. The server has already disconnected the
 		// peer before signaling to the sync manager.
 		sm.updateSyncPeer(false)
+	} else if sm.fetchingBlocks {
+		// Reassign the blocks which were requested from the peer.
+		sm.fetchHeaderBlocks()
 	}
 }
 
@@ -510,6 +593,14 @@ func (sm *SyncManager) clearRequestedState(state *peerSyncState) {
 	// and request them now to speed things up a little.
 	for blockHash := range state.requestedBlocks {
 		delete(sm.requestedBlocks, blockHash)
+
+		// Blocks requested by the download scheduler are reassigned
+		// to other peers.
+		if req, ok := sm.blockRequests[blockHash]; ok &&
+			state == sm.peerStates[req.peer] {
+
+			delete(sm.blockRequests, blockHash)
+		}
 	}
 }
 
@@ -528,8 +619,7 @@ func (sm *SyncManager) updateSyncPeer(dcSyncPeer bool) {
 
 	// Reset any header state before we choose our next active sync peer.
 	if sm.headersFirstMode {
-		best := sm.chain.BestSnapshot()
-		sm.resetHeaderState(&best.Hash, best.Height)
+		sm.resetHeaderState()
 	}
 
 	sm.syncPeer = nil
@@ -650,36 +740,78 @@ func (sm *SyncManager) handleBlockMsg(bmsg *blockMsg) {
 		}
 	}
 
+	// Remove block from request maps. Either chain will know about it and
+	// so we shouldn't have any more instances of trying to fetch it, or we
+	// will fail the insert and thus we'll retry next time we get an inv.
+	delete(state.requestedBlocks, *blockHash)
+	delete(sm.requestedBlocks, *blockHash)
+
+	// Blocks requested by the download scheduler of headers-first mode may
+	// arrive in any order.  Queue the blocks which do not build on the
+	// block being waited for, so blocks are always connected in order.
+	if req, ok := sm.blockRequests[*blockHash]; ok && req.peer == peer {
+		delete(sm.blockRequests, *blockHash)
+		sm.updateBlockThroughput(state, req, bmsg.block)
+
+		firstNodeEl := sm.headerList.Front()
+		if firstNodeEl != nil &&
+			!blockHash.IsEqual(firstNodeEl.Value.(*headerNode).hash) {
+
+			sm.queuedBlocks[*blockHash] = bmsg
+
+			// Validate the block while the blocks it builds on
+			// are still being downloaded or connected.
+			flags := blockchain.BFNone
+			if req.node.height <= sm.fastAddHeight {
+				flags |= blockchain.BFFastAdd
+			}
+			sm.chain.PrevalidateBlock(bmsg.block, flags)
+
+			sm.fetchHeaderBlocks()
+			return
+		}
+	}
+
+	sm.processPeerBlock(bmsg)
+
+	// Connect the queued blocks which build on the block and request more
+	// blocks to keep the download window full.
+	if sm.fetchingBlocks {
+		sm.connectQueuedBlocks()
+		sm.fetchHeaderBlocks()
+	}
+}
+
+// processPeerBlock processes a block received from a peer after it has been
+// removed from the request maps.
+func (sm *SyncManager) processPeerBlock(bmsg *blockMsg) {
+	peer := bmsg.peer
+	blockHash := bmsg.block.Hash()
+
 	// When in headers-first mode, if the block matches the hash of the
-	// first header in the list of headers that are being fetched, it's
-	// eligible for less validation since the headers have already been
-	// verified to link together and are valid up to the next checkpoint.
-	// Also, remove the list entry for all blocks except the checkpoint
-	// since it is needed to verify the next round of headers links
-	// properly.
-	isCheckpointBlock := false
+	// first header in the list of headers that are being fetched, remove
+	// the list entry.  Blocks at or below the last checkpoint in the
+	// header chain are eligible for less validation since their headers
+	// have already been verified to link together up to the checkpoint.
+	var fetchedNode *headerNode
+	isTargetBlock := false
 	behaviorFlags := blockchain.BFNone
 	if sm.headersFirstMode {
 		firstNodeEl := sm.headerList.Front()
 		if firstNodeEl != nil {
 			firstNode := firstNodeEl.Value.(*headerNode)
 			if blockHash.IsEqual(firstNode.hash) {
-				behaviorFlags |= blockchain.BFFastAdd
-				if firstNode.hash.IsEqual(sm.nextCheckpoint.Hash) {
-					isCheckpointBlock = true
-				} else {
-					sm.headerList.Remove(firstNodeEl)
+				if firstNode.height <= sm.fastAddHeight {
+					behaviorFlags |= blockchain.BFFastAdd
 				}
+				isTargetBlock = sm.headerTarget != nil &&
+					firstNode.hash.IsEqual(sm.headerTarget.hash)
+				fetchedNode = firstNode
+				sm.headerList.Remove(firstNodeEl)
 			}
 		}
 	}
 
-	// Remove block from request maps. Either chain will know about it and
-	// so we shouldn't have any more instances of trying to fetch it, or we
-	// will fail the insert and thus we'll retry next time we get an inv.
-	delete(state.requestedBlocks, *blockHash)
-	delete(sm.requestedBlocks, *blockHash)
-
 	// Process the block to include validation, best chain selection, orphan
 	// handling, etc.
 	_, isOrphan, err := sm.chain.ProcessBlock(bmsg.block, behaviorFlags)
@@ -700,10 +832,18 @@ func (sm *SyncManager) handleBlockMsg(bmsg *blockMsg) {
 			panic(dbErr)
 		}
 
+		// The queued blocks which build on the rejected block can't be
+		// connected, so stop validating them ahead.
+		sm.chain.CancelPrevalidation()
+
 		// Convert the error into an appropriate reject message and
 		// send it.
 		code, reason := mempool.ErrToRejectErr(err)
 		peer.PushRejectMsg(wire.CmdBlock, code, reason, blockHash, false)
+
+		if fetchedNode != nil {
+			sm.handleRejectedHeaderBlock(peer, fetchedNode, err)
+		}
 		return
 	}
 
@@ -750,7 +890,7 @@ func (sm *SyncManager) handleBlockMsg(bmsg *blockMsg) {
 			peer.PushGetBlocksMsg(locator, orphanRoot)
 		}
 	} else {
-		if peer == sm.syncPeer {
+		if peer == sm.syncPeer || sm.headersFirstMode {
 			sm.lastProgressTime = time.Now()
 		}
 
@@ -780,78 +920,173 @@ func (sm *SyncManager) handleBlockMsg(bmsg *blockMsg) {
 		}
 	}
 
-	// Nothing more to do if we aren't in headers-first mode.
-	if !sm.headersFirstMode {
+	// Nothing more to do if we aren't in headers-first mode or the block
+	// is not the header target.  More blocks are requested by the caller.
+	if !sm.headersFirstMode || !isTargetBlock {
 		return
 	}
 
-	// This is headers-first mode, so if the block is not a checkpoint
-	// request more blocks using the header list when the request queue is
-	// getting short.
-	if !isCheckpointBlock {
-		if sm.startHeader != nil &&
-			len(state.requestedBlocks) < minInFlightBlocks {
-			sm.fetchHeaderBlocks()
-		}
+	// This is headers-first mode and all blocks up to the header target
+	// have been downloaded.  Ask the sync peer for any headers after the
+	// best known header.  Normal mode is entered once the sync peer has no
+	// more headers to offer.
+	sm.fetchingBlocks = false
+	sm.headerTarget = nil
+	bestHeader, _ := sm.chain.BestHeader()
+	locator := sm.chain.BlockLocatorFromHash(&bestHeader)
+	err = sm.syncPeer.PushGetHeadersMsg(locator, &zeroHash)
+	if err != nil {
+		log.Warnf("Failed to send getheaders message to peer %s: %v",
+			sm.syncPeer.Addr(), err)
+	}
+}
+
+// handleRejectedHeaderBlock handles the rejection of the passed block of the
+// header chain being downloaded in headers-first mode.  When the block was
+// found to be invalid, the header chain is no longer the best header chain,
+// so the download restarts with the blocks of the best remaining one.
+// Otherwise the peer sent a block which does not match its header, such as a
+// mutated block with the same hash, so the block is requested again from
+// another peer.  Either way, the peer which sent the block is disconnected.
+func (sm *SyncManager) handleRejectedHeaderBlock(peer *peerpkg.Peer,
+	node *headerNode, err error) {
+
+	// Blocks which are already known are skipped like any other block
+	// which is not received.
+	rerr, ok := err.(blockchain.RuleError)
+	if ok && rerr.ErrorCode == blockchain.ErrDuplicateBlock {
 		return
 	}
 
-	// This is headers-first mode and the block is a checkpoint.  When
-	// there is a next checkpoint, get the next round of headers by asking
-	// for headers starting from the block after this one up to the next
-	// checkpoint.
-	prevHeight := sm.nextCheckpoint.Height
-	prevHash := sm.nextCheckpoint.Hash
-	sm.nextCheckpoint = sm.findNextHeaderCheckpoint(prevHeight)
-	if sm.nextCheckpoint != nil {
-		locator := blockchain.BlockLocator([]*chainhash.Hash{prevHash})
-		err := peer.PushGetHeadersMsg(locator, sm.nextCheckpoint.Hash)
-		if err != nil {
-			log.Warnf("Failed to send getheaders message to "+
-				"peer %s: %v", peer.Addr(), err)
+	bestHeader, _ := sm.chain.BestHeader()
+	if sm.headerTarget != nil && bestHeader.IsEqual(sm.headerTarget.hash) {
+		sm.headerList.PushFront(node)
+	} else {
+		log.Infof("Block %v at height %d is invalid -- restarting the "+
+			"block download", node.hash, node.height)
+		sm.restartBlockDownload()
+	}
+
+	// Internal errors are not the fault of the peer.
+	if ok {
+		log.Warnf("Peer %s sent invalid block %v -- disconnecting",
+			peer.Addr(), node.hash)
+		peer.Disconnect()
+	}
+}
+
+// restartBlockDownload abandons the blocks of the current header target and
+// starts downloading the blocks of the best known header chain instead.  The
+// blocks which were received ahead are dropped since they may build on an
+// invalid block, while the blocks in flight are still accepted as usual.
+func (sm *SyncManager) restartBlockDownload() {
+	sm.fetchingBlocks = false
+	sm.headerTarget = nil
+	sm.queuedBlocks = make(map[chainhash.Hash]*blockMsg)
+	sm.chain.CancelPrevalidation()
+	sm.startBlockDownload()
+}
+
+// connectQueuedBlocks processes the queued blocks of headers-first mode in
+// order for as long as the block at the front of the header list has been
+// received.
+func (sm *SyncManager) connectQueuedBlocks() {
+	for sm.fetchingBlocks {
+		firstNodeEl := sm.headerList.Front()
+		if firstNodeEl == nil {
 			return
 		}
-		log.Infof("Downloading headers for blocks %d to %d from "+
-			"peer %s", prevHeight+1, sm.nextCheckpoint.Height,
-			sm.syncPeer.Addr())
-		return
+		firstNode := firstNodeEl.Value.(*headerNode)
+		bmsg, ok := sm.queuedBlocks[*firstNode.hash]
+		if !ok {
+			// A block which is already known is never received, so
+			// skip it to avoid waiting for it forever.  The
+			// header target block is always processed.
+			_, inFlight := sm.blockRequests[*firstNode.hash]
+			if inFlight || firstNode.hash.IsEqual(sm.headerTarget.hash) {
+				return
+			}
+			haveBlock, err := sm.chain.HaveBlock(firstNode.hash)
+			if err != nil || !haveBlock {
+				return
+			}
+			sm.headerList.Remove(firstNodeEl)
+			continue
+		}
+		delete(sm.queuedBlocks, *firstNode.hash)
+		sm.processPeerBlock(bmsg)
 	}
+}
 
-	// This is headers-first mode, the block is a checkpoint, and there are
-	// no more checkpoints, so switch to normal mode by requesting blocks
-	// from the block after this one up to the end of the chain (zero hash).
-	sm.headersFirstMode = false
-	sm.headerList.Init()
-	log.Infof("Reached the final checkpoint -- switching to normal mode")
-	locator := blockchain.BlockLocator([]*chainhash.Hash{blockHash})
-	err = peer.PushGetBlocksMsg(locator, &zeroHash)
-	if err != nil {
-		log.Warnf("Failed to send getblocks message to peer %s: %v",
-			peer.Addr(), err)
+// updateBlockThroughput updates the moving average of the block throughput of
+// a peer which delivered the passed requested block.
+func (sm *SyncManager) updateBlockThroughput(state *peerSyncState,
+	req *blockRequest, block *btcutil.Block) {
+
+	// The peer is downloading the block from the time it was requested or
+	// the peer delivered its previous block, whichever is later.
+	now := time.Now()
+	start := req.requested
+	if state.lastBlockTime.After(start) {
+		start = state.lastBlockTime
+	}
+	state.lastBlockTime = now
+	elapsed := now.Sub(start)
+	if elapsed < time.Millisecond {
+		elapsed = time.Millisecond
+	}
+
+	sample := float64(block.MsgBlock().SerializeSize()) / elapsed.Seconds()
+	if state.blockThroughput == 0 {
+		state.blockThroughput = sample
 		return
 	}
+	state.blockThroughput += throughputDecay * (sample - state.blockThroughput)
+}
+
+// downloadPeers returns the peers blocks are downloaded from in headers-first
+// mode ranked by their block throughput, fastest first.
+func (sm *SyncManager) downloadPeers() []*peerpkg.Peer {
+	peers := make([]*peerpkg.Peer, 0, len(sm.peerStates))
+	for peer, state := range sm.peerStates {
+		if state.syncCandidate && peer.Connected() {
+			peers = append(peers, peer)
+		}
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return sm.peerStates[peers[i]].blockThroughput >
+			sm.peerStates[peers[j]].blockThroughput
+	})
+	return peers
 }
 
-// fetchHeaderBlocks creates and sends a request to the syncPeer for the next
-// list of blocks to be downloaded based on the current list of headers.
+// fetchHeaderBlocks requests the blocks in the download window which are not
+// already in flight or received.  The window starts at the next block to
+// connect and the blocks are assigned to the fastest peers which have spare
+// capacity and are known to have the block, so the blocks needed soonest are
+// downloaded from the fastest peers.
 func (sm *SyncManager) fetchHeaderBlocks() {
-	// Nothing to do if there is no start header.
-	if sm.startHeader == nil {
-		log.Warnf("fetchHeaderBlocks called with no start header")
+	// Nothing to do until the headers are synced.
+	if !sm.fetchingBlocks {
 		return
 	}
+	sm.fillHeaderList()
 
-	// Build up a getdata request for the list of blocks the headers
-	// describe.  The size hint will be limited to wire.MaxInvPerMsg by
-	// the function, so no need to double check it here.
-	gdmsg := wire.NewMsgGetDataSizeHint(uint(sm.headerList.Len()))
-	numRequested := 0
-	for e := sm.startHeader; e != nil; e = e.Next() {
+	peers := sm.downloadPeers()
+	requests := make(map[*peerpkg.Peer]*wire.MsgGetData)
+	e := sm.headerList.Front()
+	for i := 0; e != nil && i < blockDownloadWindow; e, i = e.Next(), i+1 {
 		node, ok := e.Value.(*headerNode)
 		if !ok {
 			log.Warn("Header list node type is not a headerNode")
 			continue
 		}
+		if _, ok := sm.blockRequests[*node.hash]; ok {
+			continue
+		}
+		if _, ok := sm.queuedBlocks[*node.hash]; ok {
+			continue
+		}
 
 		iv := wire.NewInvVect(wire.InvTypeBlock, node.hash)
 		haveInv, err := sm.haveInventory(iv)
@@ -860,29 +1095,112 @@ func (sm *SyncManager) fetchHeaderBlocks() {
 				"existing inventory during header block "+
 				"fetch: %v", err)
 		}
-		if !haveInv {
-			syncPeerState := sm.peerStates[sm.syncPeer]
-
-			sm.requestedBlocks[*node.hash] = struct{}{}
-			syncPeerState.requestedBlocks[*node.hash] = struct{}{}
+		if haveInv {
+			continue
+		}
 
-			// If we're fetching from a witness enabled peer
-			// post-fork, then ensure that we receive all the
-			// witness data in the blocks.
-			if sm.syncPeer.IsWitnessEnabled() {
-				iv.Type = wire.InvTypeWitnessBlock
+		// Pick the fastest peer with spare capacity.  Blocks later in
+		// the window have greater heights, so there is nothing more to
+		// request when no peer is able to serve this one.
+		var peer *peerpkg.Peer
+		for _, p := range peers {
+			state := sm.peerStates[p]
+			if len(state.requestedBlocks) < maxBlocksInFlightPerPeer &&
+				p.LastBlock() >= node.height {
+
+				peer = p
+				break
 			}
-
-			gdmsg.AddInvVect(iv)
-			numRequested++
 		}
-		sm.startHeader = e.Next()
-		if numRequested >= wire.MaxInvPerMsg {
+		if peer == nil {
 			break
 		}
+
+		state := sm.peerStates[peer]
+		sm.requestedBlocks[*node.hash] = struct{}{}
+		state.requestedBlocks[*node.hash] = struct{}{}
+		sm.blockRequests[*node.hash] = &blockRequest{
+			node:      node,
+			peer:      peer,
+			requested: time.Now(),
+		}
+
+		// If we're fetching from a witness enabled peer post-fork, then
+		// ensure that we receive all the witness data in the blocks.
+		if peer.IsWitnessEnabled() {
+			iv.Type = wire.InvTypeWitnessBlock
+		}
+
+		gdmsg, ok := requests[peer]
+		if !ok {
+			gdmsg = wire.NewMsgGetData()
+			requests[peer] = gdmsg
+		}
+		gdmsg.AddInvVect(iv)
 	}
-	if len(gdmsg.InvList) > 0 {
-		sm.syncPeer.QueueMessage(gdmsg, nil)
+	for peer, gdmsg := range requests {
+		peer.QueueMessage(gdmsg, nil)
+	}
+}
+
+// handleBlockStallSample disconnects peers which stall the block download of
+// headers-first mode, which causes their requests to be reassigned to other
+// peers.  A peer stalls the download when it has not delivered the next block
+// to connect while later blocks are waiting, or when any of its requests time
+// out.  Peers are only disconnected when there are other peers to download
+// from, otherwise the stall detection of the sync peer takes over.
+func (sm *SyncManager) handleBlockStallSample() {
+	if atomic.LoadInt32(&sm.shutdown) != 0 || !sm.fetchingBlocks {
+		return
+	}
+	if len(sm.downloadPeers()) < 2 {
+		return
+	}
+
+	var nextHash *chainhash.Hash
+	if firstNodeEl := sm.headerList.Front(); firstNodeEl != nil {
+		nextHash = firstNodeEl.Value.(*headerNode).hash
+	}
+	now := time.Now()
+	for hash, req := range sm.blockRequests {
+		timeout := blockDownloadTimeout
+		if len(sm.queuedBlocks) > 0 && hash.IsEqual(nextHash) {
+			timeout = blockStallTimeout
+		}
+		if now.Sub(req.requested) < timeout || !req.peer.Connected() {
+			continue
+		}
+
+		log.Infof("Peer %s stalled the download of block %v at "+
+			"height %d -- disconnecting", req.peer.Addr(), hash,
+			req.node.height)
+		req.peer.Disconnect()
+	}
+}
+
+// handleStaleTipSample checks whether the tip has not advanced for longer than
+// expected while no blocks are being downloaded, which indicates that the
+// connected peers may not be relaying new blocks.  The result is exposed by
+// IsTipStale so the server is able to look for peers which do.
+func (sm *SyncManager) handleStaleTipSample() {
+	if atomic.LoadInt32(&sm.shutdown) != 0 {
+		return
+	}
+
+	lastTipUpdate := time.Unix(0, atomic.LoadInt64(&sm.lastTipUpdate))
+	sinceTipUpdate := time.Since(lastTipUpdate)
+	staleAfter := staleTipMultiplier * sm.chainParams.TargetTimePerBlock
+	stale := sinceTipUpdate > staleAfter && len(sm.requestedBlocks) == 0
+
+	wasStale := atomic.LoadInt32(&sm.tipStale) != 0
+	switch {
+	case stale && !wasStale:
+		atomic.StoreInt32(&sm.tipStale, 1)
+		log.Warnf("Potential stale tip detected, last tip update %v "+
+			"ago", sinceTipUpdate.Truncate(time.Second))
+	case !stale && wasStale:
+		atomic.StoreInt32(&sm.tipStale, 0)
+		log.Infof("Tip is no longer stale")
 	}
 }
 
@@ -890,15 +1208,24 @@ func (sm *SyncManager) fetchHeaderBlocks() {
 // requested when performing a headers-first sync.
 func (sm *SyncManager) handleHeadersMsg(hmsg *headersMsg) {
 	peer := hmsg.peer
-	_, exists := sm.peerStates[peer]
+	state, exists := sm.peerStates[peer]
 	if !exists {
 		log.Warnf("Received headers message from unknown peer %s", peer)
 		return
 	}
 
-	// The remote peer is misbehaving if we didn't request headers.
+	// The headers a probed peer replies with are processed regardless of
+	// the sync state, unless the peer is the sync peer in headers-first
+	// mode and the headers are processed as part of the sync anyway.
 	msg := hmsg.headers
 	numHeaders := len(msg.Headers)
+	if state.headersProbe && (!sm.headersFirstMode || peer != sm.syncPeer) {
+		state.headersProbe = false
+		sm.handleProbeHeaders(peer, msg.Headers)
+		return
+	}
+
+	// The remote peer is misbehaving if we didn't request headers.
 	if !sm.headersFirstMode {
 		log.Warnf("Got %d unrequested headers from %s -- "+
 			"disconnecting", numHeaders, peer.Addr())
@@ -906,92 +1233,307 @@ func (sm *SyncManager) handleHeadersMsg(hmsg *headersMsg) {
 		return
 	}
 
-	// Nothing to do for an empty headers message.
-	if numHeaders == 0 {
+	// Only the sync peer is asked for headers, so ignore the headers of
+	// any other peer, such as block announcements of peers which prefer
+	// headers.
+	if peer != sm.syncPeer {
+		log.Debugf("Ignoring %d headers from non-sync peer %s",
+			numHeaders, peer.Addr())
 		return
 	}
 
-	// Process all of the received headers ensuring each one connects to the
-	// previous and that checkpoints match.
-	receivedCheckpoint := false
-	var finalHash *chainhash.Hash
-	for _, blockHeader := range msg.Headers {
-		blockHash := blockHeader.BlockHash()
-		finalHash = &blockHash
-
-		// Ensure there is a previous header to compare against.
-		prevNodeEl := sm.headerList.Back()
-		if prevNodeEl == nil {
-			log.Warnf("Header list does not contain a previous" +
-				"element as expected -- disconnecting peer")
+	// Presync the headers while a chain with too little work to be stored
+	// is being presynced.  The presync releases the headers to process
+	// once the chain is found to have enough work.
+	headers := msg.Headers
+	full := numHeaders == wire.MaxBlockHeadersPerMsg
+	if sm.presync != nil {
+		sm.lastProgressTime = time.Now()
+		var err error
+		headers, err = sm.presync.processHeaders(headers, full)
+		if err != nil {
+			log.Warnf("Failed to presync headers from %s: %v -- "+
+				"disconnecting", peer.Addr(), err)
 			peer.Disconnect()
 			return
 		}
-
-		// Ensure the header properly connects to the previous one and
-		// add it to the list of headers.
-		node := headerNode{hash: &blockHash}
-		prevNode := prevNodeEl.Value.(*headerNode)
-		if prevNode.hash.IsEqual(&blockHeader.PrevBlock) {
-			node.height = prevNode.height + 1
-			e := sm.headerList.PushBack(&node)
-			if sm.startHeader == nil {
-				sm.startHeader = e
+		if !sm.presync.done() {
+			if !sm.processHeaders(peer, headers) {
+				return
 			}
-		} else {
-			log.Warnf("Received block header that does not "+
-				"properly connect to the chain from peer %s "+
-				"-- disconnecting", peer.Addr())
+			locator := blockchain.BlockLocator(
+				[]*chainhash.Hash{sm.presync.nextHash()})
+			err := peer.PushGetHeadersMsg(locator, &zeroHash)
+			if err != nil {
+				log.Warnf("Failed to send getheaders message "+
+					"to peer %s: %v", peer.Addr(), err)
+			}
+			return
+		}
+		sm.presync = nil
+	} else if numHeaders > 0 {
+		// Limit the number of side chains a peer can make us validate.
+		first := headers[0]
+		bestHeader, _ := sm.chain.BestHeader()
+		firstHash := first.BlockHash()
+		if have, _ := sm.chain.HaveBlock(&firstHash); !have &&
+			first.PrevBlock != bestHeader {
+
+			state.headerForks++
+			if state.headerForks > maxHeaderForksPerPeer {
+				log.Warnf("Peer %s sent headers of too many "+
+					"forks -- disconnecting", peer.Addr())
+				peer.Disconnect()
+				return
+			}
+		}
+
+		// Headers of a chain with too little work are not stored.
+		// The chain is presynced instead when the peer likely has more
+		// of its headers and ignored otherwise.
+		sufficient, err := sm.hasSufficientHeaderWork(headers)
+		if err != nil {
+			log.Warnf("Rejected block headers from %s: %v -- "+
+				"disconnecting", peer.Addr(), err)
 			peer.Disconnect()
 			return
 		}
+		if !sufficient {
+			sm.lastProgressTime = time.Now()
+			if full {
+				sm.startPresync(peer, headers)
+				return
+			}
+			log.Debugf("Ignoring %d headers of a low-work chain "+
+				"from %s", numHeaders, peer.Addr())
+			headers = nil
+		}
+	}
 
-		// Verify the header at the next checkpoint height matches.
-		if node.height == sm.nextCheckpoint.Height {
-			if node.hash.IsEqual(sm.nextCheckpoint.Hash) {
-				receivedCheckpoint = true
-				log.Infof("Verified downloaded block "+
-					"header against checkpoint at height "+
-					"%d/hash %s", node.height, node.hash)
-			} else {
-				log.Warnf("Block header at height %d/hash "+
-					"%s from peer %s does NOT match "+
-					"expected checkpoint hash of %s -- "+
-					"disconnecting", node.height,
-					node.hash, peer.Addr(),
-					sm.nextCheckpoint.Hash)
+	if !sm.processHeaders(peer, headers) {
+		return
+	}
+
+	// A full headers message means the peer likely has more headers, so
+	// request the next batch starting from the latest received header.
+	if full {
+		finalHash := msg.Headers[numHeaders-1].BlockHash()
+		locator := blockchain.BlockLocator([]*chainhash.Hash{&finalHash})
+		err := peer.PushGetHeadersMsg(locator, &zeroHash)
+		if err != nil {
+			log.Warnf("Failed to send getheaders message to "+
+				"peer %s: %v", peer.Addr(), err)
+		}
+		return
+	}
+
+	// The sync peer has no more headers, so download the blocks of the
+	// best known header chain.
+	if !sm.fetchingBlocks {
+		sm.startBlockDownload()
+	}
+}
+
+// handleProbeHeadersMsg sends a getheaders message with the passed locator to
+// the peer so the headers it replies with are processed even though it is not
+// the sync peer.  The sync peer in headers-first mode is not probed since it is
+// sent getheaders messages by the sync anyway.
+func (sm *SyncManager) handleProbeHeadersMsg(msg *probeHeadersMsg) {
+	state, exists := sm.peerStates[msg.peer]
+	if !exists || (sm.headersFirstMode && msg.peer == sm.syncPeer) {
+		return
+	}
+
+	if err := msg.peer.PushGetHeadersMsg(msg.locator, &zeroHash); err != nil {
+		log.Warnf("Failed to send getheaders message to peer %s: %v",
+			msg.peer.Addr(), err)
+		return
+	}
+	state.headersProbe = true
+}
+
+// handleProbeHeaders processes the headers a probed peer replied with.  The
+// headers of a chain with too little work are ignored since the peer is not
+// the sync peer, so its chain is not presynced.
+func (sm *SyncManager) handleProbeHeaders(peer *peerpkg.Peer, headers []*wire.BlockHeader) {
+	if len(headers) == 0 {
+		return
+	}
+	sufficient, err := sm.hasSufficientHeaderWork(headers)
+	if err != nil {
+		log.Warnf("Rejected block headers from %s: %v -- "+
+			"disconnecting", peer.Addr(), err)
+		peer.Disconnect()
+		return
+	}
+	if !sufficient {
+		log.Debugf("Ignoring %d headers of a low-work chain from %s",
+			len(headers), peer.Addr())
+		return
+	}
+	sm.processHeaders(peer, headers)
+}
+
+// processHeaders processes the passed headers received from the sync peer.
+// The chain ensures each header connects to a known header and is valid,
+// including the proof of work, difficulty, timestamp and checkpoint rules, so
+// headers can be synced from the sync peer without relying on checkpoints.  It
+// returns whether all headers were processed.
+func (sm *SyncManager) processHeaders(peer *peerpkg.Peer, headers []*wire.BlockHeader) bool {
+	for _, blockHeader := range headers {
+		err := sm.chain.ProcessBlockHeader(blockHeader, blockchain.BFNone)
+		if err != nil {
+			blockHash := blockHeader.BlockHash()
+			if _, ok := err.(blockchain.RuleError); ok {
+				log.Warnf("Rejected block header %v from %s: "+
+					"%v -- disconnecting", blockHash,
+					peer.Addr(), err)
 				peer.Disconnect()
-				return
+			} else {
+				log.Errorf("Failed to process block header "+
+					"%v: %v", blockHash, err)
 			}
-			break
+			return false
 		}
 	}
+	if len(headers) > 0 {
+		sm.lastProgressTime = time.Now()
+	}
+	return true
+}
 
-	// When this header is a checkpoint, switch to fetching the blocks for
-	// all of the headers since the last checkpoint.
-	if receivedCheckpoint {
-		// Since the first entry of the list is always the final block
-		// that is already in the database and is only used to ensure
-		// the next header links properly, it must be removed before
-		// fetching the blocks.
-		sm.headerList.Remove(sm.headerList.Front())
-		log.Infof("Received %v block headers: Fetching blocks",
-			sm.headerList.Len())
-		sm.progressLogger.SetLastLogTime(time.Now())
-		sm.fetchHeaderBlocks()
+// headerWorkCheckpoint returns the checkpoint a chain of headers which builds
+// on the passed height must include before its headers are stored.  It is the
+// latest checkpoint when it is after the passed height and nil otherwise.
+func (sm *SyncManager) headerWorkCheckpoint(height int32) *chaincfg.Checkpoint {
+	checkpoint := sm.chain.LatestCheckpoint()
+	if checkpoint == nil || checkpoint.Height <= height {
+		return nil
+	}
+	return checkpoint
+}
+
+// hasSufficientHeaderWork returns whether the chain which ends with the passed
+// headers has enough work for its headers to be stored.  Its work must reach
+// the header work threshold of the chain and it must include the latest
+// checkpoint.  The headers of chains which are already known are always
+// stored.
+func (sm *SyncManager) hasSufficientHeaderWork(headers []*wire.BlockHeader) (bool, error) {
+	finalHash := headers[len(headers)-1].BlockHash()
+	if have, err := sm.chain.HaveBlock(&finalHash); err != nil || have {
+		return true, err
+	}
+
+	// Leave headers which do not connect to a known header to be rejected
+	// by the chain.
+	height, work, err := sm.chain.HeaderChainWork(&headers[0].PrevBlock)
+	if err != nil {
+		return true, nil
+	}
+	for _, header := range headers {
+		work.Add(work, blockchain.CalcWork(header.Bits))
+	}
+	return hasSufficientWork(work, height+int32(len(headers)),
+		sm.chain.HeaderWorkThreshold(), sm.headerWorkCheckpoint(height)), nil
+}
+
+// startPresync starts presyncing the chain which continues with the passed
+// headers received from the sync peer and requests its next headers.
+func (sm *SyncManager) startPresync(peer *peerpkg.Peer, headers []*wire.BlockHeader) {
+	startHash := &headers[0].PrevBlock
+	startHeader, err := sm.chain.HeaderByHash(startHash)
+	if err != nil {
+		log.Errorf("Failed to load block header %v: %v", startHash, err)
+		return
+	}
+	startHeight, startWork, err := sm.chain.HeaderChainWork(startHash)
+	if err != nil {
+		log.Errorf("Failed to load block header %v: %v", startHash, err)
+		return
+	}
+	presync := newHeadersPresync(startHash, startHeight,
+		startHeader.Timestamp, startWork, sm.chain.HeaderWorkThreshold(),
+		sm.headerWorkCheckpoint(startHeight), sm.chainParams.PowLimit)
+	if _, err := presync.processHeaders(headers, true); err != nil {
+		log.Warnf("Failed to presync headers from %s: %v -- "+
+			"disconnecting", peer.Addr(), err)
+		peer.Disconnect()
+		return
+	}
+	sm.presync = presync
+	log.Infof("Presyncing headers of a low-work chain after height %d "+
+		"from peer %s", startHeight, peer.Addr())
+
+	locator := blockchain.BlockLocator([]*chainhash.Hash{presync.nextHash()})
+	if err := peer.PushGetHeadersMsg(locator, &zeroHash); err != nil {
+		log.Warnf("Failed to send getheaders message to peer %s: %v",
+			peer.Addr(), err)
+	}
+}
+
+// startBlockDownload starts downloading the blocks of the best known header
+// chain in headers-first mode.  When the blocks of the best known header chain
+// are already available, it switches to normal mode instead.
+func (sm *SyncManager) startBlockDownload() {
+	best := sm.chain.BestSnapshot()
+	bestHeader, bestHeaderHeight := sm.chain.BestHeader()
+	if bestHeader == best.Hash {
+		sm.resetHeaderState()
+		log.Infof("Synced headers to height %d -- switching to normal "+
+			"mode", bestHeaderHeight)
 		return
 	}
 
-	// This header is not a checkpoint, so request the next batch of
-	// headers starting from the latest known header and ending with the
-	// next checkpoint.
-	locator := blockchain.BlockLocator([]*chainhash.Hash{finalHash})
-	err := peer.PushGetHeadersMsg(locator, sm.nextCheckpoint.Hash)
+	forkHeight, err := sm.chain.FindForkHeight(&bestHeader)
 	if err != nil {
-		log.Warnf("Failed to send getheaders message to "+
-			"peer %s: %v", peer.Addr(), err)
+		log.Warnf("Unable to find the fork point of the best header "+
+			"%v: %v", bestHeader, err)
 		return
 	}
+
+	// Blocks up to the last checkpoint at or below the best header are
+	// eligible for less validation since the header chain is verified to
+	// contain the checkpoint.
+	sm.fastAddHeight = -1
+	if checkpoint := sm.findLastHeaderCheckpoint(bestHeaderHeight); checkpoint != nil {
+		sm.fastAddHeight = checkpoint.Height
+	}
+
+	sm.headerTarget = &headerNode{height: bestHeaderHeight, hash: &bestHeader}
+	sm.nextHeaderHeight = forkHeight + 1
+	sm.headerList.Init()
+	log.Infof("Fetching blocks %d to %d", sm.nextHeaderHeight,
+		bestHeaderHeight)
+	sm.progressLogger.SetLastLogTime(time.Now())
+	sm.fetchingBlocks = true
+	sm.fetchHeaderBlocks()
+}
+
+// fillHeaderList appends the headers of the chain leading to the header target
+// to the list of headers whose blocks are being fetched, so the list always
+// covers at least twice the download window.
+func (sm *SyncManager) fillHeaderList() {
+	for sm.headerList.Len() < 2*blockDownloadWindow &&
+		sm.nextHeaderHeight <= sm.headerTarget.height {
+
+		hashes, err := sm.chain.HeaderChainHashes(sm.headerTarget.hash,
+			sm.nextHeaderHeight, headerListBatchSize)
+		if err != nil {
+			log.Warnf("Unable to load headers from height %d: %v",
+				sm.nextHeaderHeight, err)
+			return
+		}
+		if len(hashes) == 0 {
+			return
+		}
+		for i := range hashes {
+			sm.headerList.PushBack(&headerNode{
+				height: sm.nextHeaderHeight,
+				hash:   &hashes[i],
+			})
+			sm.nextHeaderHeight++
+		}
+	}
 }
 
 // haveInventory returns whether or not the inventory represented by the passed
@@ -1272,6 +1814,10 @@ func (sm *SyncManager) limitMap(m map[chainhash.Hash]struct{}, limit int) {
 func (sm *SyncManager) blockHandler() {
 	stallTicker := time.NewTicker(stallSampleInterval)
 	defer stallTicker.Stop()
+	blockStallTicker := time.NewTicker(blockStallCheckInterval)
+	defer blockStallTicker.Stop()
+	staleTipTicker := time.NewTicker(staleTipCheckInterval)
+	defer staleTipTicker.Stop()
 
 out:
 	for {
@@ -1295,6 +1841,9 @@ out:
 			case *headersMsg:
 				sm.handleHeadersMsg(msg)
 
+			case *probeHeadersMsg:
+				sm.handleProbeHeadersMsg(msg)
+
 			case *donePeerMsg:
 				sm.handleDonePeerMsg(msg.peer)
 
@@ -1335,6 +1884,12 @@ out:
 		case <-stallTicker.C:
 			sm.handleStallSample()
 
+		case <-blockStallTicker.C:
+			sm.handleBlockStallSample()
+
+		case <-staleTipTicker.C:
+			sm.handleStaleTipSample()
+
 		case <-sm.quit:
 			break out
 		}
@@ -1375,6 +1930,7 @@ func (sm *SyncManager) handleBlockchainNotification(notification *blockchain.Not
 			log.Warnf("Chain connected notification is not a block.")
 			break
 		}
+		atomic.StoreInt64(&sm.lastTipUpdate, time.Now().UnixNano())
 
 		// Remove all of the transactions (except the coinbase) in the
 		// connected block from the transaction pool.  Secondly, remove any
@@ -1382,11 +1938,16 @@ func (sm *SyncManager) handleBlockchainNotification(notification *blockchain.Not
 		// new transactions.  Finally, remove any transaction that is
 		// no longer an orphan. Transactions which depend on a confirmed
 		// transaction are NOT removed recursively because they are still
-		// valid.
+		// valid.  The fee deltas of the confirmed transactions are no
+		// longer needed either.
 		for _, tx := range block.Transactions()[1:] {
 			sm.txMemPool.RemoveTransaction(tx, false)
 			sm.txMemPool.RemoveDoubleSpends(tx)
 			sm.txMemPool.RemoveOrphan(tx)
+			if err := sm.txMemPool.ClearFeeDelta(tx.Hash()); err != nil {
+				log.Errorf("Unable to clear fee delta of "+
+					"transaction %v: %v", tx.Hash(), err)
+			}
 			sm.peerNotifier.TransactionConfirmed(tx)
 			acceptedTxs := sm.txMemPool.ProcessOrphans(tx)
 			sm.peerNotifier.AnnounceNewTransactions(acceptedTxs)
@@ -1492,6 +2053,20 @@ func (sm *SyncManager) QueueHeaders(headers *wire.MsgHeaders, peer *peerpkg.Peer
 	sm.msgChan <- &headersMsg{headers: headers, peer: peer}
 }
 
+// ProbeHeaders sends a getheaders message with the passed locator to the peer
+// and processes the headers it replies with, even though the peer is not the
+// sync peer.  It is used to learn whether a peer which announced less work
+// than the tip has a better chain.
+func (sm *SyncManager) ProbeHeaders(peer *peerpkg.Peer, locator blockchain.BlockLocator) {
+	// No channel handling here because the caller does not need to block
+	// on the probe.
+	if atomic.LoadInt32(&sm.shutdown) != 0 {
+		return
+	}
+
+	sm.msgChan <- &probeHeadersMsg{peer: peer, locator: locator}
+}
+
 // DonePeer informs the blockmanager that a peer has disconnected.
 func (sm *SyncManager) DonePeer(peer *peerpkg.Peer) {
 	// Ignore if we are shutting down.
@@ -1553,6 +2128,14 @@ func (sm *SyncManager) IsCurrent() bool {
 	return <-reply
 }
 
+// IsTipStale returns whether or not the tip has not advanced for longer than
+// expected while no blocks are being downloaded.
+//
+// This function is safe for concurrent access.
+func (sm *SyncManager) IsTipStale() bool {
+	return atomic.LoadInt32(&sm.tipStale) != 0
+}
+
 // Pause pauses the sync manager until the returned channel is closed.
 //
 // Note that while paused, all peer and block processing is halted.  The
@@ -1578,18 +2161,15 @@ func New(config *Config) (*SyncManager, error) {
 		progressLogger:  newBlockProgressLogger("Processed", log),
 		msgChan:         make(chan interface{}, config.MaxPeers*3),
 		headerList:      list.New(),
+		blockRequests:   make(map[chainhash.Hash]*blockRequest),
+		queuedBlocks:    make(map[chainhash.Hash]*blockMsg),
 		quit:            make(chan struct{}),
 		feeEstimator:    config.FeeEstimator,
+		lastTipUpdate:   time.Now().UnixNano(),
 	}
 
-	best := sm.chain.BestSnapshot()
-	if !config.DisableCheckpoints {
-		// Initialize the next checkpoint based on the current height.
-		sm.nextCheckpoint = sm.findNextHeaderCheckpoint(best.Height)
-		if sm.nextCheckpoint != nil {
-			sm.resetHeaderState(&best.Hash, best.Height)
-		}
-	} else {
+	sm.resetHeaderState()
+	if config.DisableCheckpoints {
 		log.Info("Checkpoints are disabled")
 	}
 
@@ -0,0 +1,744 @@
+// Copyright (c) 2017 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package netsync
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/btgsuite/btgd/blockchain"
+	"github.com/btgsuite/btgd/chaincfg"
+	"github.com/btgsuite/btgd/chaincfg/chainhash"
+	"github.com/btgsuite/btgd/database"
+	_ "github.com/btgsuite/btgd/database/ffldb"
+	"github.com/btgsuite/btgd/mempool"
+	peerpkg "github.com/btgsuite/btgd/peer"
+	"github.com/btgsuite/btgd/txscript"
+	"github.com/btgsuite/btgd/wire"
+	btcutil "github.com/btgsuite/btgutil"
+)
+
+// mockPeerNotifier implements the PeerNotifier interface without notifying
+// any peers.
+type mockPeerNotifier struct{}
+
+func (mockPeerNotifier) AnnounceNewTransactions([]*mempool.TxDesc) {}
+
+func (mockPeerNotifier) UpdatePeerHeights(*chainhash.Hash, int32, *peerpkg.Peer) {}
+
+func (mockPeerNotifier) RelayInventory(*wire.InvVect, interface{}) {}
+
+func (mockPeerNotifier) TransactionConfirmed(*btcutil.Tx) {}
+
+// generateBlocks returns a chain of the passed number of blocks which build on
+// the genesis block of the passed network.  The optional munge function is
+// invoked with the height and each block before it is solved.
+func generateBlocks(params *chaincfg.Params, numBlocks int32,
+	munge func(int32, *wire.MsgBlock)) ([]*btcutil.Block, error) {
+
+	target := blockchain.CompactToBig(params.PowLimitBits)
+	prev := &params.GenesisBlock.Header
+	timestamp := time.Unix(time.Now().Unix(), 0)
+	blocks := make([]*btcutil.Block, 0, numBlocks)
+	for height := int32(1); height <= numBlocks; height++ {
+		coinbaseScript, err := txscript.NewScriptBuilder().
+			AddInt64(int64(height)).AddInt64(0).Script()
+		if err != nil {
+			return nil, err
+		}
+		coinbaseTx := wire.NewMsgTx(1)
+		coinbaseTx.AddTxIn(&wire.TxIn{
+			PreviousOutPoint: *wire.NewOutPoint(&chainhash.Hash{},
+				wire.MaxPrevOutIndex),
+			Sequence:        wire.MaxTxInSequenceNum,
+			SignatureScript: coinbaseScript,
+		})
+		coinbaseTx.AddTxOut(&wire.TxOut{
+			Value:    blockchain.CalcBlockSubsidy(height, params),
+			PkScript: []byte{txscript.OP_TRUE},
+		})
+
+		msgBlock := &wire.MsgBlock{
+			Header: wire.BlockHeader{
+				Version:   1,
+				PrevBlock: prev.BlockHash(),
+				Height:    uint32(height),
+				Timestamp: timestamp.Add(time.Duration(height) *
+					time.Second),
+				Bits: params.PowLimitBits,
+			},
+			Transactions: []*wire.MsgTx{coinbaseTx},
+		}
+		if munge != nil {
+			munge(height, msgBlock)
+		}
+		block := btcutil.NewBlock(msgBlock)
+		merkles := blockchain.BuildMerkleTreeStore(block.Transactions(),
+			false)
+		msgBlock.Header.MerkleRoot = *merkles[len(merkles)-1]
+
+		for nonce := uint32(0); ; nonce++ {
+			msgBlock.Header.Nonce = wire.Uint256FromUint32(nonce)
+			hash := msgBlock.Header.BlockHash()
+			if blockchain.HashToBig(&hash).Cmp(target) <= 0 {
+				break
+			}
+		}
+		block = btcutil.NewBlock(msgBlock)
+		block.SetHeight(height)
+		blocks = append(blocks, block)
+		prev = &msgBlock.Header
+	}
+	return blocks, nil
+}
+
+// serveMockPeer performs the version handshake with the peer at the other end
+// of the passed connection while advertising the passed height, and then
+// ignores all messages until the connection is closed.
+func serveMockPeer(conn net.Conn, params *chaincfg.Params, height int32) {
+	defer conn.Close()
+
+	pver := wire.ProtocolVersion
+	if _, _, err := wire.ReadMessage(conn, pver, params.Net); err != nil {
+		return
+	}
+	services := wire.SFNodeNetwork | wire.SFNodeWitness
+	me := wire.NewNetAddress(conn.LocalAddr().(*net.TCPAddr), services)
+	you := wire.NewNetAddress(conn.RemoteAddr().(*net.TCPAddr), 0)
+	msgVersion := wire.NewMsgVersion(me, you, uint64(height)+1, height)
+	msgVersion.Services = services
+	for _, msg := range []wire.Message{msgVersion, wire.NewMsgVerAck()} {
+		if err := wire.WriteMessage(conn, msg, pver, params.Net); err != nil {
+			return
+		}
+	}
+	for {
+		if _, _, err := wire.ReadMessage(conn, pver, params.Net); err != nil {
+			return
+		}
+	}
+}
+
+// newTestPeer returns a peer which is connected to a mock remote peer that
+// advertises the passed height.  The remote peer ignores all requests.
+func newTestPeer(params *chaincfg.Params, height int32) (*peerpkg.Peer, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	defer listener.Close()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		return nil, err
+	}
+	remoteConn, err := listener.Accept()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go serveMockPeer(remoteConn, params, height)
+
+	verAck := make(chan struct{}, 1)
+	p, err := peerpkg.NewOutboundPeer(&peerpkg.Config{
+		ChainParams: params,
+		Listeners: peerpkg.MessageListeners{
+			OnVerAck: func(*peerpkg.Peer, *wire.MsgVerAck) {
+				verAck <- struct{}{}
+			},
+		},
+		TrickleInterval: time.Second * 10,
+	}, listener.Addr().String())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	p.AssociateConnection(conn)
+
+	select {
+	case <-verAck:
+	case <-time.After(time.Second * 10):
+		p.Disconnect()
+		return nil, errors.New("timeout waiting for verack")
+	}
+	return p, nil
+}
+
+// syncHarness houses a sync manager which downloads the blocks of a header
+// chain in headers-first mode from mock peers.
+type syncHarness struct {
+	t        *testing.T
+	sm       *SyncManager
+	chain    *blockchain.BlockChain
+	blocks   []*btcutil.Block
+	peers    []*peerpkg.Peer
+	teardown func()
+}
+
+// newSyncHarness returns a sync harness which has processed the headers of
+// the generated blocks received from the sync peer and requested the blocks
+// from peers advertising the passed heights.  The optional munge function is
+// passed to generateBlocks.
+func newSyncHarness(t *testing.T, numBlocks int32, peerHeights []int32,
+	munge func(int32, *wire.MsgBlock)) *syncHarness {
+
+	// Copy the regression test parameters, which are easy to mine, since
+	// the sync manager does not use headers-first mode on the regression
+	// test network.
+	params := chaincfg.RegressionNetParams
+	params.Name = "headersfirsttest"
+	blocks, err := generateBlocks(&params, numBlocks, munge)
+	if err != nil {
+		t.Fatalf("unable to generate blocks: %v", err)
+	}
+
+	dbPath, err := ioutil.TempDir("", "netsynctest")
+	if err != nil {
+		t.Fatalf("unable to create test db path: %v", err)
+	}
+	db, err := database.Create("ffldb", dbPath, params.Net)
+	if err != nil {
+		os.RemoveAll(dbPath)
+		t.Fatalf("error creating db: %v", err)
+	}
+	h := &syncHarness{t: t, blocks: blocks}
+	h.teardown = func() {
+		for _, p := range h.peers {
+			p.Disconnect()
+			p.WaitForDisconnect()
+		}
+		db.Close()
+		os.RemoveAll(dbPath)
+	}
+
+	h.chain, err = blockchain.New(&blockchain.Config{
+		DB:          db,
+		ChainParams: &params,
+		TimeSource:  blockchain.NewMedianTime(),
+	})
+	if err != nil {
+		h.teardown()
+		t.Fatalf("failed to create chain instance: %v", err)
+	}
+	h.sm, err = New(&Config{
+		PeerNotifier: mockPeerNotifier{},
+		Chain:        h.chain,
+		ChainParams:  &params,
+		MaxPeers:     len(peerHeights),
+	})
+	if err != nil {
+		h.teardown()
+		t.Fatalf("failed to create sync manager: %v", err)
+	}
+
+	for _, height := range peerHeights {
+		p, err := newTestPeer(&params, height)
+		if err != nil {
+			h.teardown()
+			t.Fatalf("unable to connect peer: %v", err)
+		}
+		h.peers = append(h.peers, p)
+		h.sm.handleNewPeerMsg(p)
+	}
+	if h.sm.syncPeer == nil || !h.sm.headersFirstMode {
+		h.teardown()
+		t.Fatalf("sync manager did not start a headers-first sync")
+	}
+
+	headers := wire.NewMsgHeaders()
+	for _, block := range blocks {
+		headers.AddBlockHeader(&block.MsgBlock().Header)
+	}
+	h.sm.handleHeadersMsg(&headersMsg{headers: headers, peer: h.sm.syncPeer})
+	if !h.sm.fetchingBlocks {
+		h.teardown()
+		t.Fatalf("sync manager did not start the block download")
+	}
+	return h
+}
+
+// requestPeer returns the peer the block at the passed height was requested
+// from.
+func (h *syncHarness) requestPeer(height int32) *peerpkg.Peer {
+	h.t.Helper()
+	req, ok := h.sm.blockRequests[*h.blocks[height-1].Hash()]
+	if !ok {
+		h.t.Fatalf("block at height %d is not requested", height)
+	}
+	return req.peer
+}
+
+// deliver hands the passed block to the sync manager as if it was received
+// from the passed peer.
+func (h *syncHarness) deliver(block *btcutil.Block, peer *peerpkg.Peer) {
+	h.sm.handleBlockMsg(&blockMsg{block: block, peer: peer})
+}
+
+// assertTip ensures the tip of the main chain is at the passed height.
+func (h *syncHarness) assertTip(height int32) {
+	h.t.Helper()
+	if best := h.chain.BestSnapshot(); best.Height != height {
+		h.t.Fatalf("got tip height %d, want %d", best.Height, height)
+	}
+}
+
+// TestFetchHeaderBlocks ensures the blocks of the header chain are requested
+// from all peers which have them without exceeding the blocks in flight per
+// peer.
+func TestFetchHeaderBlocks(t *testing.T) {
+	const numBlocks = 24
+	const lowHeight = 5
+	h := newSyncHarness(t, numBlocks, []int32{numBlocks, numBlocks,
+		lowHeight}, nil)
+	defer h.teardown()
+
+	if len(h.sm.blockRequests) != numBlocks {
+		t.Fatalf("got %d requested blocks, want %d",
+			len(h.sm.blockRequests), numBlocks)
+	}
+	inFlight := make(map[*peerpkg.Peer]int)
+	for height := int32(1); height <= numBlocks; height++ {
+		peer := h.requestPeer(height)
+		inFlight[peer]++
+		if peer.LastBlock() < height {
+			t.Fatalf("block at height %d requested from peer at "+
+				"height %d", height, peer.LastBlock())
+		}
+		state := h.sm.peerStates[peer]
+		if _, ok := state.requestedBlocks[*h.blocks[height-1].Hash()]; !ok {
+			t.Fatalf("block at height %d is not tracked by its "+
+				"peer", height)
+		}
+	}
+	for peer, n := range inFlight {
+		if n > maxBlocksInFlightPerPeer {
+			t.Fatalf("peer %s has %d blocks in flight, want at "+
+				"most %d", peer, n, maxBlocksInFlightPerPeer)
+		}
+	}
+}
+
+// TestOutOfOrderHeaderBlocks ensures blocks received before the blocks they
+// build on are queued and connected in order once the missing block arrives.
+func TestOutOfOrderHeaderBlocks(t *testing.T) {
+	const numBlocks = 8
+	h := newSyncHarness(t, numBlocks, []int32{numBlocks, numBlocks}, nil)
+	defer h.teardown()
+
+	for height := int32(numBlocks); height > 1; height-- {
+		h.deliver(h.blocks[height-1], h.requestPeer(height))
+	}
+	if len(h.sm.queuedBlocks) != numBlocks-1 {
+		t.Fatalf("got %d queued blocks, want %d",
+			len(h.sm.queuedBlocks), numBlocks-1)
+	}
+	h.assertTip(0)
+
+	h.deliver(h.blocks[0], h.requestPeer(1))
+	h.assertTip(numBlocks)
+	if len(h.sm.queuedBlocks) != 0 || len(h.sm.blockRequests) != 0 {
+		t.Fatalf("got %d queued and %d requested blocks, want none",
+			len(h.sm.queuedBlocks), len(h.sm.blockRequests))
+	}
+
+	// All blocks up to the header target are downloaded, so the sync
+	// peer is asked for more headers.
+	if h.sm.fetchingBlocks || h.sm.headerTarget != nil {
+		t.Fatal("sync manager is still fetching blocks")
+	}
+}
+
+// TestMutatedHeaderBlock ensures a block which does not match its header is
+// requested again from another peer and the peer which sent it is
+// disconnected.
+func TestMutatedHeaderBlock(t *testing.T) {
+	const numBlocks = 8
+	h := newSyncHarness(t, numBlocks, []int32{numBlocks, numBlocks}, nil)
+	defer h.teardown()
+
+	// Queue a block which builds on the mutated block.
+	h.deliver(h.blocks[1], h.requestPeer(2))
+
+	// Mutate the coinbase of the first block, which keeps its hash while
+	// the merkle root no longer matches.
+	block := h.blocks[0]
+	var msgBlock wire.MsgBlock
+	msgBlock.Header = block.MsgBlock().Header
+	coinbaseTx := block.MsgBlock().Transactions[0].Copy()
+	coinbaseTx.TxIn[0].SignatureScript = append(
+		coinbaseTx.TxIn[0].SignatureScript, txscript.OP_TRUE)
+	msgBlock.AddTransaction(coinbaseTx)
+	mutated := btcutil.NewBlock(&msgBlock)
+	if !mutated.Hash().IsEqual(block.Hash()) {
+		t.Fatal("mutated block has a different hash")
+	}
+
+	sender := h.requestPeer(1)
+	h.deliver(mutated, sender)
+	if sender.Connected() {
+		t.Fatal("peer which sent the mutated block is still connected")
+	}
+	if peer := h.requestPeer(1); peer == sender || !peer.Connected() {
+		t.Fatalf("block is not requested again from another peer")
+	}
+	if bestHeader, _ := h.chain.BestHeader(); !bestHeader.IsEqual(
+		h.blocks[numBlocks-1].Hash()) {
+
+		t.Fatalf("got best header %v, want %v", bestHeader,
+			h.blocks[numBlocks-1].Hash())
+	}
+	h.assertTip(0)
+
+	// The valid block connects along with the queued block.
+	h.deliver(block, h.requestPeer(1))
+	h.assertTip(2)
+}
+
+// TestInvalidHeaderBlock ensures the block download restarts with the best
+// remaining header chain when a block of the header chain is invalid and the
+// peer which sent it is disconnected.
+func TestInvalidHeaderBlock(t *testing.T) {
+	const numBlocks = 8
+	const invalidHeight = 3
+
+	// The block at the invalid height has a second coinbase.
+	munge := func(height int32, msgBlock *wire.MsgBlock) {
+		if height == invalidHeight {
+			coinbaseTx := msgBlock.Transactions[0].Copy()
+			coinbaseTx.TxOut[0].Value = 0
+			msgBlock.AddTransaction(coinbaseTx)
+		}
+	}
+	h := newSyncHarness(t, numBlocks, []int32{numBlocks, numBlocks}, munge)
+	defer h.teardown()
+
+	for height := int32(1); height < invalidHeight; height++ {
+		h.deliver(h.blocks[height-1], h.requestPeer(height))
+	}
+	h.assertTip(invalidHeight - 1)
+
+	sender := h.requestPeer(invalidHeight)
+	h.deliver(h.blocks[invalidHeight-1], sender)
+	if sender.Connected() {
+		t.Fatal("peer which sent the invalid block is still connected")
+	}
+	h.assertTip(invalidHeight - 1)
+
+	// The header chain of the invalid block no longer is the best header
+	// chain, and the blocks of the remaining one are all connected.
+	bestHeader, _ := h.chain.BestHeader()
+	if want := h.blocks[invalidHeight-2].Hash(); !bestHeader.IsEqual(want) {
+		t.Fatalf("got best header %v, want %v", bestHeader, want)
+	}
+	if h.sm.headersFirstMode || h.sm.fetchingBlocks {
+		t.Fatal("sync manager is still in headers-first mode")
+	}
+}
+
+// TestHandleBlockStallSample ensures peers are disconnected when they stall
+// the next block to connect or any of their requests time out, unless there
+// is no other peer to download from.
+func TestHandleBlockStallSample(t *testing.T) {
+	const numBlocks = 8
+
+	// stall marks the request of the block at the passed height as sent
+	// the passed duration ago.
+	stall := func(h *syncHarness, height int32, d time.Duration) {
+		h.sm.blockRequests[*h.blocks[height-1].Hash()].requested =
+			time.Now().Add(-d)
+	}
+
+	// Peers are not disconnected when there is no other peer.
+	h := newSyncHarness(t, numBlocks, []int32{numBlocks}, nil)
+	stall(h, 1, blockDownloadTimeout+time.Second)
+	h.sm.handleBlockStallSample()
+	if !h.requestPeer(1).Connected() {
+		t.Fatal("the only peer was disconnected")
+	}
+	h.teardown()
+
+	h = newSyncHarness(t, numBlocks, []int32{numBlocks, numBlocks}, nil)
+	defer h.teardown()
+
+	// A late block is not stalling before its download times out unless
+	// it is the next block to connect and later blocks are waiting.
+	stall(h, 1, blockStallTimeout+time.Second)
+	stall(h, numBlocks, blockStallTimeout+time.Second)
+	h.sm.handleBlockStallSample()
+	for _, p := range h.peers {
+		if !p.Connected() {
+			t.Fatal("peer disconnected before stalling")
+		}
+	}
+
+	h.deliver(h.blocks[1], h.requestPeer(2))
+	h.sm.handleBlockStallSample()
+	if h.requestPeer(1).Connected() {
+		t.Fatal("peer stalling the next block is still connected")
+	}
+}
+
+// TestLowWorkHeaders ensures the headers of a chain with too little work are
+// only stored after the chain was presynced and redownloaded, and peers which
+// send mismatching headers or too many forks are disconnected.
+func TestLowWorkHeaders(t *testing.T) {
+	const numBlocks = 4
+	const maxHeaders = wire.MaxBlockHeadersPerMsg
+	const forkBlocks = 2*maxHeaders + 500
+	const sufficientBlocks = 2*maxHeaders + 100
+
+	// The fork has a different block version, so it does not share any
+	// blocks with the chain of the harness.
+	params := chaincfg.RegressionNetParams
+	fork, err := generateBlocks(&params, forkBlocks,
+		func(_ int32, msgBlock *wire.MsgBlock) {
+			msgBlock.Header.Version = 4
+		})
+	if err != nil {
+		t.Fatalf("unable to generate blocks: %v", err)
+	}
+	forkHeaders := blockHeaders(fork)
+
+	// setup returns a harness which requires header chains to have the
+	// work of the fork.
+	setup := func() *syncHarness {
+		h := newSyncHarness(t, numBlocks, []int32{numBlocks}, nil)
+		h.sm.chainParams.MinimumChainWork = chainWork(h.sm.chainParams,
+			sufficientBlocks)
+		return h
+	}
+
+	// send hands the passed headers to the sync manager as if they were
+	// received from the sync peer.
+	send := func(h *syncHarness, headers []*wire.BlockHeader) {
+		msg := wire.NewMsgHeaders()
+		for _, header := range headers {
+			msg.AddBlockHeader(header)
+		}
+		h.sm.handleHeadersMsg(&headersMsg{headers: msg, peer: h.sm.syncPeer})
+	}
+
+	// assertStored ensures the fork header at the passed height is stored
+	// or not as passed.
+	assertStored := func(h *syncHarness, height int32, want bool) {
+		t.Helper()
+		_, err := h.chain.HeaderByHash(fork[height-1].Hash())
+		if stored := err == nil; stored != want {
+			t.Fatalf("fork header at height %d stored: got %v, "+
+				"want %v", height, stored, want)
+		}
+	}
+
+	// The fork is presynced and redownloaded before it is stored.
+	h := setup()
+	peer := h.sm.syncPeer
+	for i := 0; i < forkBlocks; i += maxHeaders {
+		end := i + maxHeaders
+		if end > forkBlocks {
+			end = forkBlocks
+		}
+		send(h, forkHeaders[i:end])
+		if h.sm.presync == nil {
+			t.Fatalf("fork is not presynced after height %d", end)
+		}
+		assertStored(h, 1, false)
+	}
+	for i := 0; i < forkBlocks; i += maxHeaders {
+		end := i + maxHeaders
+		if end > forkBlocks {
+			end = forkBlocks
+		}
+		assertStored(h, 1, false)
+		send(h, forkHeaders[i:end])
+	}
+	if h.sm.presync != nil {
+		t.Fatal("presync is not done after the redownload")
+	}
+	assertStored(h, forkBlocks, true)
+	if bestHeader, _ := h.chain.BestHeader(); !bestHeader.IsEqual(
+		fork[forkBlocks-1].Hash()) {
+
+		t.Fatalf("got best header %v, want %v", bestHeader,
+			fork[forkBlocks-1].Hash())
+	}
+	if !peer.Connected() {
+		t.Fatal("peer which sent the fork was disconnected")
+	}
+	h.teardown()
+
+	// A peer which redownloads mismatching headers is disconnected.
+	h = setup()
+	peer = h.sm.syncPeer
+	for i := 0; i < forkBlocks; i += maxHeaders {
+		end := i + maxHeaders
+		if end > forkBlocks {
+			end = forkBlocks
+		}
+		send(h, forkHeaders[i:end])
+	}
+	h.sm.presync.commitments[0] = !h.sm.presync.commitments[0]
+	send(h, forkHeaders[:maxHeaders])
+	if peer.Connected() {
+		t.Fatal("peer which sent mismatching headers is still connected")
+	}
+	assertStored(h, 1, false)
+	h.teardown()
+
+	// The headers of a low-work chain which are not followed by more are
+	// ignored, unless the peer sends too many forks.
+	h = setup()
+	defer h.teardown()
+	peer = h.sm.syncPeer
+	for i := 0; i < maxHeaderForksPerPeer; i++ {
+		send(h, forkHeaders[:10])
+		if !peer.Connected() || h.sm.presync != nil {
+			t.Fatal("peer which sent a low-work chain was not ignored")
+		}
+		assertStored(h, 1, false)
+	}
+	send(h, forkHeaders[:10])
+	if peer.Connected() {
+		t.Fatal("peer which sent too many forks is still connected")
+	}
+}
+
+// TestHandleStaleTipSample ensures the tip is only considered stale when it
+// has not advanced for longer than expected while no blocks are being
+// downloaded, and is no longer stale once it advances.
+func TestHandleStaleTipSample(t *testing.T) {
+	const numBlocks = 4
+	h := newSyncHarness(t, numBlocks, []int32{numBlocks}, nil)
+	defer h.teardown()
+
+	staleAfter := staleTipMultiplier * h.sm.chainParams.TargetTimePerBlock
+	setLastTipUpdate := func(ago time.Duration) {
+		atomic.StoreInt64(&h.sm.lastTipUpdate,
+			time.Now().Add(-ago).UnixNano())
+	}
+
+	tests := []struct {
+		name            string
+		sinceTipUpdate  time.Duration
+		requestedBlocks bool
+		stale           bool
+	}{{
+		name:           "recent tip update",
+		sinceTipUpdate: staleAfter - time.Minute,
+	}, {
+		name:            "blocks being downloaded",
+		sinceTipUpdate:  staleAfter + time.Minute,
+		requestedBlocks: true,
+	}, {
+		name:           "old tip update",
+		sinceTipUpdate: staleAfter + time.Minute,
+		stale:          true,
+	}, {
+		name:           "still stale",
+		sinceTipUpdate: staleAfter + time.Hour,
+		stale:          true,
+	}, {
+		name:           "tip advanced",
+		sinceTipUpdate: 0,
+	}}
+	for _, test := range tests {
+		if test.requestedBlocks {
+			h.sm.requestedBlocks[*h.blocks[0].Hash()] = struct{}{}
+		} else {
+			h.sm.requestedBlocks = make(map[chainhash.Hash]struct{})
+		}
+		setLastTipUpdate(test.sinceTipUpdate)
+		h.sm.handleStaleTipSample()
+		if stale := h.sm.IsTipStale(); stale != test.stale {
+			t.Errorf("%s: got stale %v, want %v", test.name, stale,
+				test.stale)
+		}
+	}
+
+	// Nothing is sampled once the sync manager is shutting down.
+	setLastTipUpdate(staleAfter + time.Minute)
+	atomic.StoreInt32(&h.sm.shutdown, 1)
+	h.sm.handleStaleTipSample()
+	if h.sm.IsTipStale() {
+		t.Error("tip sampled during shutdown")
+	}
+}
+
+// TestProbeHeaders ensures the headers a probed peer replies with are
+// processed even though it is not the sync peer, while unrequested headers of
+// the peer are still ignored.
+func TestProbeHeaders(t *testing.T) {
+	const numBlocks = 4
+	h := newSyncHarness(t, numBlocks, []int32{numBlocks, numBlocks}, nil)
+	defer h.teardown()
+
+	// The fork has a different block version and more work than the chain
+	// of the harness.
+	fork, err := generateBlocks(h.sm.chainParams, numBlocks+2,
+		func(_ int32, msgBlock *wire.MsgBlock) {
+			msgBlock.Header.Version = 4
+		})
+	if err != nil {
+		t.Fatalf("unable to generate blocks: %v", err)
+	}
+	peer := h.peers[0]
+	if peer == h.sm.syncPeer {
+		peer = h.peers[1]
+	}
+
+	// send hands the headers of the fork up to the passed height to the
+	// sync manager as if they were received from the peer.
+	send := func(height int) {
+		msg := wire.NewMsgHeaders()
+		for _, header := range blockHeaders(fork[:height]) {
+			msg.AddBlockHeader(header)
+		}
+		h.sm.handleHeadersMsg(&headersMsg{headers: msg, peer: peer})
+	}
+
+	// assertStored ensures the fork header at the passed height is stored
+	// or not as passed.
+	assertStored := func(height int, want bool) {
+		t.Helper()
+		_, err := h.chain.HeaderByHash(fork[height-1].Hash())
+		if stored := err == nil; stored != want {
+			t.Fatalf("fork header at height %d stored: got %v, "+
+				"want %v", height, stored, want)
+		}
+	}
+
+	send(numBlocks)
+	assertStored(1, false)
+
+	genesis := h.sm.chainParams.GenesisHash
+	h.sm.handleProbeHeadersMsg(&probeHeadersMsg{
+		peer:    peer,
+		locator: blockchain.BlockLocator([]*chainhash.Hash{genesis}),
+	})
+	if !h.sm.peerStates[peer].headersProbe {
+		t.Fatal("peer was not probed")
+	}
+	send(numBlocks + 1)
+	assertStored(numBlocks+1, true)
+	if h.sm.peerStates[peer].headersProbe || !peer.Connected() {
+		t.Fatal("probe reply was not handled")
+	}
+
+	// Only a single reply is processed.
+	send(numBlocks + 2)
+	assertStored(numBlocks+2, false)
+
+	// The sync peer is not probed in headers-first mode.
+	h.sm.handleProbeHeadersMsg(&probeHeadersMsg{
+		peer:    h.sm.syncPeer,
+		locator: blockchain.BlockLocator([]*chainhash.Hash{genesis}),
+	})
+	if h.sm.peerStates[h.sm.syncPeer].headersProbe {
+		t.Fatal("sync peer was probed in headers-first mode")
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright (c) 2013-2017 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/btgsuite/btgd/addrmgr"
+	"github.com/btgsuite/btgd/connmgr"
+	"github.com/btgsuite/btgd/wire"
+)
+
+// onionKeyFilename is the name of the file in the data directory which stores
+// the private key of the onion service so the onion address stays the same
+// across restarts.
+const onionKeyFilename = "onion_v3_private_key"
+
+// initOnionListener binds the listener Tor forwards inbound onion service
+// connections to.  It uses a dedicated port on the loopback address so peers
+// which connect through the onion service can be told apart from other local
+// peers.
+func initOnionListener() (net.Listener, error) {
+	return net.Listen("tcp4", "127.0.0.1:0")
+}
+
+// isOnionServiceConn returns whether the passed inbound connection was accepted
+// by the onion service listener and was therefore forwarded by Tor.
+func (s *server) isOnionServiceConn(conn net.Conn) bool {
+	if s.onionListener == nil {
+		return false
+	}
+	return conn.LocalAddr().String() == s.onionListener.Addr().String()
+}
+
+// readOnionKey returns the onion service private key stored at the passed path
+// or an empty string when no key has been stored yet.
+func readOnionKey(path string) (string, error) {
+	key, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	return strings.TrimSpace(string(key)), nil
+}
+
+// setupOnionService connects to the Tor control port and creates an ephemeral
+// onion service which forwards to the onion service listener.  The onion address is
+// added to the local addresses advertised to peers.  The control connection
+// and the ID of the service are returned.
+func (s *server) setupOnionService() (*connmgr.TorControl, string, error) {
+	target := s.onionListener.Addr().String()
+	port, err := strconv.ParseUint(activeNetParams.DefaultPort, 10, 16)
+	if err != nil {
+		return nil, "", err
+	}
+	keyPath := filepath.Join(cfg.DataDir, onionKeyFilename)
+	key, err := readOnionKey(keyPath)
+	if err != nil {
+		return nil, "", err
+	}
+
+	ctrl, err := connmgr.DialTorControl(cfg.TorControl)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := ctrl.Authenticate(cfg.TorPassword); err != nil {
+		ctrl.Close()
+		return nil, "", err
+	}
+	serviceID, newKey, err := ctrl.AddOnion(key, uint16(port), target)
+	if err != nil {
+		ctrl.Close()
+		return nil, "", err
+	}
+	if newKey != key {
+		err := ioutil.WriteFile(keyPath, []byte(newKey+"\n"), 0600)
+		if err != nil {
+			srvrLog.Warnf("Unable to save onion service key to %s: %v",
+				keyPath, err)
+		}
+	}
+
+	na, err := wire.NewNetAddressV2Host(serviceID+".onion", uint16(port),
+		s.services, false)
+	if err != nil {
+		ctrl.DelOnion(serviceID)
+		ctrl.Close()
+		return nil, "", err
+	}
+	err = s.addrManager.AddLocalAddress(na, addrmgr.ManualPrio)
+	if err != nil {
+		srvrLog.Warnf("Unable to advertise onion service address: %v", err)
+	}
+	return ctrl, serviceID, nil
+}
+
+// onionServiceHandler creates an ephemeral onion service through the Tor
+// control port on startup and removes it again when the server shuts down.
+//
+// It MUST be run as a goroutine.
+func (s *server) onionServiceHandler() {
+	defer s.wg.Done()
+
+	ctrl, serviceID, err := s.setupOnionService()
+	if err != nil {
+		srvrLog.Warnf("Unable to create onion service via Tor control "+
+			"port %s: %v", cfg.TorControl, err)
+		return
+	}
+	srvrLog.Infof("Accepting inbound connections via onion service %s.onion",
+		serviceID)
+
+	<-s.quit
+
+	if err := ctrl.DelOnion(serviceID); err != nil {
+		srvrLog.Warnf("Unable to remove onion service: %v", err)
+	} else {
+		srvrLog.Debugf("Removed onion service %s.onion", serviceID)
+	}
+	ctrl.Close()
+}
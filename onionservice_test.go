@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btclog"
+	"github.com/btgsuite/btgd/peer"
+)
+
+// TestIsOnionServiceConn ensures only connections accepted by the onion
+// service listener are considered to be forwarded by Tor, even though other
+// local peers connect from the loopback address as well.
+func TestIsOnionServiceConn(t *testing.T) {
+	onionListener, err := initOnionListener()
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	defer onionListener.Close()
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	defer listener.Close()
+
+	// accept dials the passed listener from the loopback address and
+	// returns the accepted connection.
+	accept := func(l net.Listener) net.Conn {
+		client, err := net.Dial("tcp4", l.Addr().String())
+		if err != nil {
+			t.Fatalf("unable to dial %s: %v", l.Addr(), err)
+		}
+		defer client.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			t.Fatalf("unable to accept: %v", err)
+		}
+		return conn
+	}
+
+	onionConn := accept(onionListener)
+	defer onionConn.Close()
+	localConn := accept(listener)
+	defer localConn.Close()
+
+	// Without an onion service no connection is forwarded by Tor.
+	var s server
+	if s.isOnionServiceConn(onionConn) {
+		t.Fatal("connection considered onion service peer without an " +
+			"onion service")
+	}
+
+	s.onionListener = onionListener
+	if !s.isOnionServiceConn(onionConn) {
+		t.Fatal("connection to the onion service listener not " +
+			"considered onion service peer")
+	}
+	if s.isOnionServiceConn(localConn) {
+		t.Fatal("loopback connection to another listener considered " +
+			"onion service peer")
+	}
+}
+
+// TestOnionServicePeerBan ensures misbehaving peers which connected through the
+// onion service are disconnected without banning the loopback address they
+// share with every other onion service peer.
+func TestOnionServicePeerBan(t *testing.T) {
+	oldCfg, oldLog := cfg, peerLog
+	defer func() { cfg, peerLog = oldCfg, oldLog }()
+	cfg = &config{BanThreshold: defaultBanThreshold}
+	peerLog = btclog.Disabled
+
+	tests := []struct {
+		name         string
+		onionService bool
+		wantBan      bool
+	}{
+		{"regular peer", false, true},
+		{"onion service peer", true, false},
+	}
+	for _, test := range tests {
+		s := &server{banPeers: make(chan *serverPeer, 1)}
+		sp := newServerPeer(s, false)
+		sp.Peer = peer.NewInboundPeer(&peer.Config{})
+		sp.onionService = test.onionService
+
+		sp.addBanScore(cfg.BanThreshold+1, 0, "test")
+		disconnected := make(chan struct{})
+		go func() {
+			sp.WaitForDisconnect()
+			close(disconnected)
+		}()
+		select {
+		case <-disconnected:
+		case <-time.After(time.Second):
+			t.Errorf("%s: peer was not disconnected", test.name)
+		}
+		if banned := len(s.banPeers) == 1; banned != test.wantBan {
+			t.Errorf("%s: got banned %v, want %v", test.name,
+				banned, test.wantBan)
+		}
+	}
+}
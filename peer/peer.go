@@ -22,13 +22,14 @@ import (
 	"github.com/btgsuite/btgd/blockchain"
 	"github.com/btgsuite/btgd/chaincfg"
 	"github.com/btgsuite/btgd/chaincfg/chainhash"
+	"github.com/btgsuite/btgd/v2transport"
 	"github.com/btgsuite/btgd/wire"
 	"github.com/davecgh/go-spew/spew"
 )
 
 const (
 	// MaxProtocolVersion is the max protocol version the peer supports.
-	MaxProtocolVersion = wire.BTGHardForkVersion
+	MaxProtocolVersion = wire.AddrV2Version
 
 	// DefaultTrickleInterval is the min time between attempts to send an
 	// inv message to a peer.
@@ -106,6 +107,9 @@ type MessageListeners struct {
 	// OnAddr is invoked when a peer receives an addr bitcoin message.
 	OnAddr func(p *Peer, msg *wire.MsgAddr)
 
+	// OnAddrV2 is invoked when a peer receives an addrv2 bitcoin message.
+	OnAddrV2 func(p *Peer, msg *wire.MsgAddrV2)
+
 	// OnPing is invoked when a peer receives a ping bitcoin message.
 	OnPing func(p *Peer, msg *wire.MsgPing)
 
@@ -201,6 +205,10 @@ type MessageListeners struct {
 	// message.
 	OnSendHeaders func(p *Peer, msg *wire.MsgSendHeaders)
 
+	// OnSendAddrV2 is invoked when a peer receives a sendaddrv2 bitcoin
+	// message during the version negotiation.
+	OnSendAddrV2 func(p *Peer, msg *wire.MsgSendAddrV2)
+
 	// OnRead is invoked when a peer receives a bitcoin message.  It
 	// consists of the number of bytes read, the message, and whether or not
 	// an error in the read occurred.  Typically, callers will opt to use
@@ -275,6 +283,11 @@ type Config struct {
 	// TrickleInterval is the duration of the ticker which trickles down the
 	// inventory to a peer.
 	TrickleInterval time.Duration
+
+	// V2Transport specifies whether the BIP0324 v2 encrypted transport is
+	// used.  Outbound peers perform the v2 handshake while inbound peers
+	// accept connections using either the v1 or v2 transport.
+	V2Transport bool
 }
 
 // minUint32 is a helper function to return the minimum of two uint32s.
@@ -287,25 +300,26 @@ func minUint32(a, b uint32) uint32 {
 }
 
 // newNetAddress attempts to extract the IP address and port from the passed
-// net.Addr interface and create a bitcoin NetAddress structure using that
+// net.Addr interface and create a bitcoin NetAddressV2 structure using that
 // information.
-func newNetAddress(addr net.Addr, services wire.ServiceFlag) (*wire.NetAddress, error) {
+func newNetAddress(addr net.Addr, services wire.ServiceFlag) (*wire.NetAddressV2, error) {
 	// addr will be a net.TCPAddr when not using a proxy.
 	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
 		ip := tcpAddr.IP
 		port := uint16(tcpAddr.Port)
 		na := wire.NewNetAddressIPPort(ip, port, services)
-		return na, nil
+		return wire.NetAddressV2FromLegacy(na), nil
 	}
 
 	// addr will be a socks.ProxiedAddr when using a proxy.
 	if proxiedAddr, ok := addr.(*socks.ProxiedAddr); ok {
-		ip := net.ParseIP(proxiedAddr.Host)
-		if ip == nil {
-			ip = net.ParseIP("0.0.0.0")
-		}
 		port := uint16(proxiedAddr.Port)
-		na := wire.NewNetAddressIPPort(ip, port, services)
+		na, err := wire.NewNetAddressV2Host(proxiedAddr.Host, port,
+			services, false)
+		if err != nil {
+			na = wire.NetAddressV2FromLegacy(wire.NewNetAddressIPPort(
+				net.IPv4zero, port, services))
+		}
 		return na, nil
 	}
 
@@ -322,7 +336,7 @@ func newNetAddress(addr net.Addr, services wire.ServiceFlag) (*wire.NetAddress,
 		return nil, err
 	}
 	na := wire.NewNetAddressIPPort(ip, uint16(port), services)
-	return na, nil
+	return wire.NetAddressV2FromLegacy(na), nil
 }
 
 // outMsg is used to house a message to be sent along with a channel to signal
@@ -379,6 +393,7 @@ type StatsSnap struct {
 	LastPingNonce  uint64
 	LastPingTime   time.Time
 	LastPingMicros int64
+	MinPingMicros  int64
 }
 
 // HashFunc is a function which returns a block hash, height and error
@@ -386,12 +401,12 @@ type StatsSnap struct {
 type HashFunc func() (hash *chainhash.Hash, height int32, err error)
 
 // AddrFunc is a func which takes an address and returns a related address.
-type AddrFunc func(remoteAddr *wire.NetAddress) *wire.NetAddress
+type AddrFunc func(remoteAddr *wire.NetAddressV2) *wire.NetAddressV2
 
 // HostToNetAddrFunc is a func which takes a host, port, services and returns
 // the netaddress.
 type HostToNetAddrFunc func(host string, port uint16,
-	services wire.ServiceFlag) (*wire.NetAddress, error)
+	services wire.ServiceFlag) (*wire.NetAddressV2, error)
 
 // NOTE: The overall data flow of a peer is split into 3 goroutines.  Inbound
 // messages are read via the inHandler goroutine and generally dispatched to
@@ -430,6 +445,14 @@ type Peer struct {
 
 	conn net.Conn
 
+	// reader is the source of v1 messages, which is the connection unless
+	// bytes were already consumed while detecting the transport.
+	// v2Transport is set when the BIP0324 v2 transport is in use.  Both
+	// are set before the protocol negotiation and never modified
+	// afterwards.
+	reader      io.Reader
+	v2Transport *v2transport.Transport
+
 	// These fields are set at creation time and never modified, so they are
 	// safe to read from concurrently without a mutex.
 	addr    string
@@ -437,7 +460,7 @@ type Peer struct {
 	inbound bool
 
 	flagsMtx             sync.Mutex // protects the peer flags below
-	na                   *wire.NetAddress
+	na                   *wire.NetAddressV2
 	id                   int32
 	userAgent            string
 	services             wire.ServiceFlag
@@ -445,6 +468,8 @@ type Peer struct {
 	advertisedProtoVer   uint32 // protocol version advertised by remote
 	protocolVersion      uint32 // negotiated protocol version
 	sendHeadersPreferred bool   // peer sent a sendheaders message
+	wantsAddrV2          bool   // peer sent a sendaddrv2 message
+	v1Responder          bool   // peer hung up on the v2 handshake
 	verAckReceived       bool
 	witnessEnabled       bool
 
@@ -469,6 +494,7 @@ type Peer struct {
 	lastPingNonce      uint64    // Set to nonce if we have a pending ping.
 	lastPingTime       time.Time // Time we sent last ping.
 	lastPingMicros     int64     // Time for last ping to return.
+	minPingMicros      int64     // Fastest ping observed, 0 if none.
 
 	stallControl  chan stallControlMsg
 	outputQueue   chan outMsg
@@ -553,6 +579,7 @@ func (p *Peer) StatsSnapshot() *StatsSnap {
 		LastPingNonce:  p.lastPingNonce,
 		LastPingMicros: p.lastPingMicros,
 		LastPingTime:   p.lastPingTime,
+		MinPingMicros:  p.minPingMicros,
 	}
 
 	p.statsMtx.RUnlock()
@@ -573,7 +600,7 @@ func (p *Peer) ID() int32 {
 // NA returns the peer network address.
 //
 // This function is safe for concurrent access.
-func (p *Peer) NA() *wire.NetAddress {
+func (p *Peer) NA() *wire.NetAddressV2 {
 	p.flagsMtx.Lock()
 	na := p.na
 	p.flagsMtx.Unlock()
@@ -663,6 +690,18 @@ func (p *Peer) LastPingMicros() int64 {
 	return lastPingMicros
 }
 
+// MinPingMicros returns the fastest ping time observed for the remote peer in
+// microseconds or 0 when no ping has completed yet.
+//
+// This function is safe for concurrent access.
+func (p *Peer) MinPingMicros() int64 {
+	p.statsMtx.RLock()
+	minPingMicros := p.minPingMicros
+	p.statsMtx.RUnlock()
+
+	return minPingMicros
+}
+
 // VersionKnown returns the whether or not the version of a peer is known
 // locally.
 //
@@ -796,6 +835,44 @@ func (p *Peer) WantsHeaders() bool {
 	return sendHeadersPreferred
 }
 
+// WantsAddrV2 returns if the peer signaled support for addrv2 messages
+// (BIP0155) during the version negotiation.
+//
+// This function is safe for concurrent access.
+func (p *Peer) WantsAddrV2() bool {
+	p.flagsMtx.Lock()
+	wantsAddrV2 := p.wantsAddrV2
+	p.flagsMtx.Unlock()
+
+	return wantsAddrV2
+}
+
+// ShouldReconnectV1 returns whether the BIP0324 v2 handshake with the outbound
+// peer failed because the peer closed the connection without replying, which
+// indicates that it only supports the v1 transport.  Reconnecting to the peer
+// should use the v1 transport then.
+//
+// This function is safe for concurrent access.
+func (p *Peer) ShouldReconnectV1() bool {
+	p.flagsMtx.Lock()
+	v1Responder := p.v1Responder
+	p.flagsMtx.Unlock()
+
+	return v1Responder
+}
+
+// UsesV2Transport returns whether the connection to the peer uses the BIP0324
+// v2 encrypted transport.
+//
+// This function is safe for concurrent access.
+func (p *Peer) UsesV2Transport() bool {
+	p.flagsMtx.Lock()
+	usesV2 := p.v2Transport != nil
+	p.flagsMtx.Unlock()
+
+	return usesV2
+}
+
 // IsWitnessEnabled returns true if the peer has signalled that it supports
 // segregated witness.
 //
@@ -844,6 +921,39 @@ func (p *Peer) PushAddrMsg(addresses []*wire.NetAddress) ([]*wire.NetAddress, er
 	return msg.AddrList, nil
 }
 
+// PushAddrV2Msg sends an addrv2 message to the connected peer using the
+// provided addresses.  It behaves like PushAddrMsg and must only be used with
+// peers which signaled support for addrv2 messages as reported by WantsAddrV2.
+//
+// This function is safe for concurrent access.
+func (p *Peer) PushAddrV2Msg(addresses []*wire.NetAddressV2) ([]*wire.NetAddressV2, error) {
+	addressCount := len(addresses)
+
+	// Nothing to send.
+	if addressCount == 0 {
+		return nil, nil
+	}
+
+	msg := wire.NewMsgAddrV2()
+	msg.AddrList = make([]*wire.NetAddressV2, addressCount)
+	copy(msg.AddrList, addresses)
+
+	// Randomize the addresses sent if there are more than the maximum allowed.
+	if addressCount > wire.MaxAddrPerMsg {
+		// Shuffle the address list.
+		for i := 0; i < wire.MaxAddrPerMsg; i++ {
+			j := i + rand.Intn(addressCount-i)
+			msg.AddrList[i], msg.AddrList[j] = msg.AddrList[j], msg.AddrList[i]
+		}
+
+		// Truncate it to the maximum size.
+		msg.AddrList = msg.AddrList[:wire.MaxAddrPerMsg]
+	}
+
+	p.QueueMessage(msg, nil)
+	return msg.AddrList, nil
+}
+
 // PushGetBlocksMsg sends a getblocks message for the provided block locator
 // and stop hash.  It will ignore back-to-back duplicate requests.
 //
@@ -999,6 +1109,11 @@ func (p *Peer) handlePongMsg(msg *wire.MsgPong) {
 			p.lastPingMicros = time.Since(p.lastPingTime).Nanoseconds()
 			p.lastPingMicros /= 1000 // convert to usec.
 			p.lastPingNonce = 0
+			if p.minPingMicros == 0 ||
+				p.lastPingMicros < p.minPingMicros {
+
+				p.minPingMicros = p.lastPingMicros
+			}
 		}
 		p.statsMtx.Unlock()
 	}
@@ -1006,8 +1121,17 @@ func (p *Peer) handlePongMsg(msg *wire.MsgPong) {
 
 // readMessage reads the next bitcoin message from the peer with logging.
 func (p *Peer) readMessage(encoding wire.MessageEncoding) (wire.Message, []byte, error) {
-	n, msg, buf, err := wire.ReadMessageWithEncodingN(p.conn,
-		p.ProtocolVersion(), p.cfg.ChainParams.Net, encoding)
+	var n int
+	var msg wire.Message
+	var buf []byte
+	var err error
+	if p.v2Transport != nil {
+		n, msg, buf, err = p.v2Transport.ReadMessage(p.ProtocolVersion(),
+			encoding)
+	} else {
+		n, msg, buf, err = wire.ReadMessageWithEncodingN(p.reader,
+			p.ProtocolVersion(), p.cfg.ChainParams.Net, encoding)
+	}
 	atomic.AddUint64(&p.bytesReceived, uint64(n))
 	if p.cfg.Listeners.OnRead != nil {
 		p.cfg.Listeners.OnRead(p, n, msg, err)
@@ -1069,8 +1193,14 @@ func (p *Peer) writeMessage(msg wire.Message, enc wire.MessageEncoding) error {
 	}))
 
 	// Write the message to the peer.
-	n, err := wire.WriteMessageWithEncodingN(p.conn, msg,
-		p.ProtocolVersion(), p.cfg.ChainParams.Net, enc)
+	var n int
+	var err error
+	if p.v2Transport != nil {
+		n, err = p.v2Transport.WriteMessage(msg, p.ProtocolVersion(), enc)
+	} else {
+		n, err = wire.WriteMessageWithEncodingN(p.conn, msg,
+			p.ProtocolVersion(), p.cfg.ChainParams.Net, enc)
+	}
 	atomic.AddUint64(&p.bytesSent, uint64(n))
 	if p.cfg.Listeners.OnWrite != nil {
 		p.cfg.Listeners.OnWrite(p, n, msg, err)
@@ -1394,6 +1524,19 @@ out:
 				p.cfg.Listeners.OnAddr(p, msg)
 			}
 
+		case *wire.MsgAddrV2:
+			if p.cfg.Listeners.OnAddrV2 != nil {
+				p.cfg.Listeners.OnAddrV2(p, msg)
+			}
+
+		case *wire.MsgSendAddrV2:
+			// Support for addrv2 must be signaled before the verack
+			// message.
+			p.PushRejectMsg(msg.Command(), wire.RejectInvalid,
+				"sendaddrv2 message received after verack", nil,
+				true)
+			break out
+
 		case *wire.MsgPing:
 			p.handlePingMsg(msg)
 			if p.cfg.Listeners.OnPing != nil {
@@ -1968,36 +2111,66 @@ func (p *Peer) readRemoteVersionMsg() error {
 
 // readRemoteVerAckMsg waits for the next message to arrive from the remote
 // peer. If this message is not a verack message, then an error is returned.
-// This method is to be used as part of the version negotiation upon a new
-// connection.
+// A sendaddrv2 message is accepted before the verack message since that is
+// how peers signal support for addrv2 messages.  This method is to be used as
+// part of the version negotiation upon a new connection.
 func (p *Peer) readRemoteVerAckMsg() error {
-	// Read the next message from the wire.
-	remoteMsg, _, err := p.readMessage(wire.LatestEncoding)
-	if err != nil {
-		return err
-	}
+	for {
+		// Read the next message from the wire.
+		remoteMsg, _, err := p.readMessage(wire.LatestEncoding)
+		if err != nil {
+			return err
+		}
 
-	// It should be a verack message, otherwise send a reject message to the
-	// peer explaining why.
-	msg, ok := remoteMsg.(*wire.MsgVerAck)
-	if !ok {
-		reason := "a verack message must follow version"
-		rejectMsg := wire.NewMsgReject(
-			msg.Command(), wire.RejectMalformed, reason,
-		)
-		_ = p.writeMessage(rejectMsg, wire.LatestEncoding)
-		return errors.New(reason)
+		switch msg := remoteMsg.(type) {
+		case *wire.MsgVerAck:
+			p.flagsMtx.Lock()
+			p.verAckReceived = true
+			p.flagsMtx.Unlock()
+
+			if p.cfg.Listeners.OnVerAck != nil {
+				p.cfg.Listeners.OnVerAck(p, msg)
+			}
+			return nil
+
+		case *wire.MsgSendAddrV2:
+			p.flagsMtx.Lock()
+			p.wantsAddrV2 = true
+			p.flagsMtx.Unlock()
+
+			if p.cfg.Listeners.OnSendAddrV2 != nil {
+				p.cfg.Listeners.OnSendAddrV2(p, msg)
+			}
+
+		default:
+			// It should be a verack message, otherwise send a
+			// reject message to the peer explaining why.
+			reason := "a verack message must follow version"
+			rejectMsg := wire.NewMsgReject(
+				msg.Command(), wire.RejectMalformed, reason,
+			)
+			_ = p.writeMessage(rejectMsg, wire.LatestEncoding)
+			return errors.New(reason)
+		}
 	}
+}
 
+// writeSendAddrV2Msg signals support for addrv2 messages to the remote peer
+// when both our and the remote peer's advertised protocol versions support
+// them.  Older peers only accept a verack message at this point of the version
+// negotiation, so nothing is sent to them.  It must be called after the version
+// messages were exchanged and before our verack is sent.
+func (p *Peer) writeSendAddrV2Msg() error {
 	p.flagsMtx.Lock()
-	p.verAckReceived = true
+	remoteProtoVer := p.advertisedProtoVer
 	p.flagsMtx.Unlock()
 
-	if p.cfg.Listeners.OnVerAck != nil {
-		p.cfg.Listeners.OnVerAck(p, msg)
-	}
+	if remoteProtoVer < wire.AddrV2Version ||
+		p.cfg.ProtocolVersion < wire.AddrV2Version {
 
-	return nil
+		return nil
+	}
+	return p.writeMessage(wire.NewMsgSendAddrV2(), wire.LatestEncoding)
 }
 
 // localVersionMsg creates a version message that can be used to send to the
@@ -2012,7 +2185,14 @@ func (p *Peer) localVersionMsg() (*wire.MsgVersion, error) {
 		}
 	}
 
-	theirNA := p.na
+	// The version message is only able to carry legacy addresses, so an
+	// unroutable address is used as their address when theirs can not be
+	// represented that way.
+	theirNA := p.na.ToLegacy()
+	if theirNA == nil {
+		theirNA = wire.NewNetAddressIPPort(net.IP([]byte{0, 0, 0, 0}), 0,
+			p.na.Services)
+	}
 
 	// If we are behind a proxy and the connection comes from the proxy then
 	// we return an unroutable address as their address. This is to prevent
@@ -2020,7 +2200,7 @@ func (p *Peer) localVersionMsg() (*wire.MsgVersion, error) {
 	if p.cfg.Proxy != "" {
 		proxyaddress, _, err := net.SplitHostPort(p.cfg.Proxy)
 		// invalid proxy means poorly configured, be on the safe side.
-		if err != nil || p.na.IP.String() == proxyaddress {
+		if err != nil || p.na.Host() == proxyaddress {
 			theirNA = wire.NewNetAddressIPPort(net.IP([]byte{0, 0, 0, 0}), 0,
 				theirNA.Services)
 		}
@@ -2078,8 +2258,9 @@ func (p *Peer) writeLocalVersionMsg() error {
 //
 //   1. Remote peer sends their version.
 //   2. We send our version.
-//   3. We send our verack.
-//   4. Remote peer sends their verack.
+//   3. We send our sendaddrv2 if the negotiated protocol version supports it.
+//   4. We send our verack.
+//   5. Remote peer sends their verack, optionally preceded by sendaddrv2.
 func (p *Peer) negotiateInboundProtocol() error {
 	if err := p.readRemoteVersionMsg(); err != nil {
 		return err
@@ -2089,6 +2270,10 @@ func (p *Peer) negotiateInboundProtocol() error {
 		return err
 	}
 
+	if err := p.writeSendAddrV2Msg(); err != nil {
+		return err
+	}
+
 	err := p.writeMessage(wire.NewMsgVerAck(), wire.LatestEncoding)
 	if err != nil {
 		return err
@@ -2103,8 +2288,9 @@ func (p *Peer) negotiateInboundProtocol() error {
 //
 //   1. We send our version.
 //   2. Remote peer sends their version.
-//   3. Remote peer sends their verack.
-//   4. We send our verack.
+//   3. Remote peer sends their verack, optionally preceded by sendaddrv2.
+//   4. We send our sendaddrv2 if the negotiated protocol version supports it.
+//   5. We send our verack.
 func (p *Peer) negotiateOutboundProtocol() error {
 	if err := p.writeLocalVersionMsg(); err != nil {
 		return err
@@ -2118,15 +2304,54 @@ func (p *Peer) negotiateOutboundProtocol() error {
 		return err
 	}
 
+	if err := p.writeSendAddrV2Msg(); err != nil {
+		return err
+	}
+
 	return p.writeMessage(wire.NewMsgVerAck(), wire.LatestEncoding)
 }
 
+// negotiateTransport performs the BIP0324 v2 handshake when the v2 transport
+// is enabled.  Inbound peers which use the v1 transport continue to use it.
+func (p *Peer) negotiateTransport() error {
+	if !p.cfg.V2Transport {
+		return nil
+	}
+
+	t := v2transport.NewTransport(p.conn, p.cfg.ChainParams.Net, !p.inbound)
+	err := t.Handshake()
+	if err == v2transport.ErrV1Peer {
+		log.Debugf("Peer %s uses the v1 transport", p)
+		p.reader = t.V1Reader()
+		return nil
+	}
+	if err == v2transport.ErrV1Responder {
+		p.flagsMtx.Lock()
+		p.v1Responder = true
+		p.flagsMtx.Unlock()
+	}
+	if err != nil {
+		return err
+	}
+
+	p.flagsMtx.Lock()
+	p.v2Transport = t
+	p.flagsMtx.Unlock()
+	log.Debugf("Established v2 transport with %s (session id %x)", p,
+		t.SessionID())
+	return nil
+}
+
 // start begins processing input and output messages.
 func (p *Peer) start() error {
 	log.Tracef("Starting peer %s", p)
 
 	negotiateErr := make(chan error, 1)
 	go func() {
+		if err := p.negotiateTransport(); err != nil {
+			negotiateErr <- err
+			return
+		}
 		if p.inbound {
 			negotiateErr <- p.negotiateInboundProtocol()
 		} else {
@@ -2167,6 +2392,7 @@ func (p *Peer) AssociateConnection(conn net.Conn) {
 	}
 
 	p.conn = conn
+	p.reader = conn
 	p.timeConnected = time.Now()
 
 	if p.inbound {
@@ -2269,7 +2495,8 @@ func NewOutboundPeer(cfg *Config, addr string) (*Peer, error) {
 		}
 		p.na = na
 	} else {
-		p.na = wire.NewNetAddressIPPort(net.ParseIP(host), uint16(port), 0)
+		p.na = wire.NetAddressV2FromLegacy(wire.NewNetAddressIPPort(
+			net.ParseIP(host), uint16(port), 0))
 	}
 
 	return p, nil
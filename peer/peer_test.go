@@ -445,6 +445,9 @@ func TestPeerListeners(t *testing.T) {
 			OnSendHeaders: func(p *peer.Peer, msg *wire.MsgSendHeaders) {
 				ok <- msg
 			},
+			OnAddrV2: func(p *peer.Peer, msg *wire.MsgAddrV2) {
+				ok <- msg
+			},
 		},
 		UserAgentName:     "peer",
 		UserAgentVersion:  "1.0",
@@ -493,6 +496,10 @@ func TestPeerListeners(t *testing.T) {
 			"OnAddr",
 			wire.NewMsgAddr(),
 		},
+		{
+			"OnAddrV2",
+			wire.NewMsgAddrV2(),
+		},
 		{
 			"OnPing",
 			wire.NewMsgPing(42),
@@ -917,6 +924,262 @@ func TestDuplicateVersionMsg(t *testing.T) {
 	}
 }
 
+// TestAddrV2Negotiation ensures support for addrv2 messages is negotiated
+// during the version handshake depending on the protocol version and that a
+// sendaddrv2 message after the handshake disconnects the peer.
+func TestAddrV2Negotiation(t *testing.T) {
+	tests := []struct {
+		name        string
+		pver        uint32
+		wantsAddrV2 bool
+	}{
+		{"latest protocol version", 0, true},
+		{"before addrv2", wire.AddrV2Version - 1, false},
+	}
+	for _, test := range tests {
+		verack := make(chan struct{})
+		peerCfg := &peer.Config{
+			Listeners: peer.MessageListeners{
+				OnVerAck: func(p *peer.Peer, msg *wire.MsgVerAck) {
+					verack <- struct{}{}
+				},
+			},
+			UserAgentName:    "peer",
+			UserAgentVersion: "1.0",
+			ChainParams:      &chaincfg.MainNetParams,
+			ProtocolVersion:  test.pver,
+		}
+		inConn, outConn := pipe(
+			&conn{laddr: "10.0.0.1:9108", raddr: "10.0.0.2:9108"},
+			&conn{laddr: "10.0.0.2:9108", raddr: "10.0.0.1:9108"},
+		)
+		outPeer, err := peer.NewOutboundPeer(peerCfg, inConn.laddr)
+		if err != nil {
+			t.Fatalf("NewOutboundPeer: unexpected err: %v\n", err)
+		}
+		outPeer.AssociateConnection(outConn)
+		inPeer := peer.NewInboundPeer(peerCfg)
+		inPeer.AssociateConnection(inConn)
+		for i := 0; i < 2; i++ {
+			select {
+			case <-verack:
+			case <-time.After(time.Second):
+				t.Fatalf("%s: verack timeout", test.name)
+			}
+		}
+		if inPeer.WantsAddrV2() != test.wantsAddrV2 ||
+			outPeer.WantsAddrV2() != test.wantsAddrV2 {
+
+			t.Errorf("%s: unexpected WantsAddrV2 - got %v/%v, want %v",
+				test.name, inPeer.WantsAddrV2(),
+				outPeer.WantsAddrV2(), test.wantsAddrV2)
+		}
+		if !test.wantsAddrV2 {
+			inPeer.Disconnect()
+			outPeer.Disconnect()
+			continue
+		}
+
+		// Signaling support for addrv2 after the handshake is not
+		// allowed.
+		outPeer.QueueMessage(wire.NewMsgSendAddrV2(), nil)
+		disconnected := make(chan struct{}, 1)
+		go func() {
+			inPeer.WaitForDisconnect()
+			disconnected <- struct{}{}
+		}()
+		select {
+		case <-disconnected:
+		case <-time.After(time.Second):
+			t.Fatalf("%s: peer did not disconnect", test.name)
+		}
+		outPeer.Disconnect()
+	}
+}
+
+// TestAddrV2OldPeer ensures no sendaddrv2 message is sent to peers which
+// advertise a protocol version prior to addrv2 support and thus only accept a
+// verack message after the version message.
+func TestAddrV2OldPeer(t *testing.T) {
+	localNA := wire.NewNetAddressIPPort(net.ParseIP("10.0.0.1"),
+		uint16(8333), wire.SFNodeNetwork)
+	remoteNA := wire.NewNetAddressIPPort(net.ParseIP("10.0.0.2"),
+		uint16(8333), wire.SFNodeNetwork)
+
+	// Existing nodes advertise the protocol version of the hard fork.
+	oldPver := wire.BTGHardForkVersion
+
+	for _, inbound := range []bool{true, false} {
+		verack := make(chan struct{}, 1)
+		peerCfg := &peer.Config{
+			Listeners: peer.MessageListeners{
+				OnVerAck: func(p *peer.Peer, msg *wire.MsgVerAck) {
+					verack <- struct{}{}
+				},
+			},
+			UserAgentName:    "peer",
+			UserAgentVersion: "1.0",
+			ChainParams:      &chaincfg.MainNetParams,
+		}
+		localConn, remoteConn := pipe(
+			&conn{laddr: "10.0.0.1:8333", raddr: "10.0.0.2:8333"},
+			&conn{laddr: "10.0.0.2:8333", raddr: "10.0.0.1:8333"},
+		)
+		var p *peer.Peer
+		if inbound {
+			p = peer.NewInboundPeer(peerCfg)
+		} else {
+			var err error
+			p, err = peer.NewOutboundPeer(peerCfg, "10.0.0.2:8333")
+			if err != nil {
+				t.Fatalf("NewOutboundPeer: unexpected err - %v\n",
+					err)
+			}
+		}
+		p.AssociateConnection(localConn)
+
+		// Read the messages sent to the old remote peer into a channel.
+		outboundMessages := make(chan wire.Message, 10)
+		go func() {
+			for {
+				_, msg, _, err := wire.ReadMessageN(remoteConn,
+					oldPver, peerCfg.ChainParams.Net)
+				if err != nil {
+					close(outboundMessages)
+					return
+				}
+				outboundMessages <- msg
+			}
+		}()
+		writeMsg := func(msg wire.Message) {
+			_, err := wire.WriteMessageN(remoteConn.Writer, msg,
+				oldPver, peerCfg.ChainParams.Net)
+			if err != nil {
+				t.Fatalf("inbound %v: wire.WriteMessageN: "+
+					"unexpected err - %v", inbound, err)
+			}
+		}
+		readMsg := func(command string) {
+			select {
+			case msg, ok := <-outboundMessages:
+				if !ok {
+					t.Fatalf("inbound %v: peer disconnected "+
+						"before %s message", inbound, command)
+				}
+				if msg.Command() != command {
+					t.Fatalf("inbound %v: got %s message, want "+
+						"%s", inbound, msg.Command(), command)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("inbound %v: %s message timeout",
+					inbound, command)
+			}
+		}
+
+		// Perform the verack-only handshake of the old remote peer.
+		versionMsg := wire.NewMsgVersion(remoteNA, localNA, 0, 0)
+		versionMsg.ProtocolVersion = int32(oldPver)
+		if inbound {
+			writeMsg(versionMsg)
+			readMsg(wire.CmdVersion)
+			readMsg(wire.CmdVerAck)
+			writeMsg(wire.NewMsgVerAck())
+		} else {
+			readMsg(wire.CmdVersion)
+			writeMsg(versionMsg)
+			writeMsg(wire.NewMsgVerAck())
+			readMsg(wire.CmdVerAck)
+		}
+		select {
+		case <-verack:
+		case <-time.After(time.Second):
+			t.Fatalf("inbound %v: verack timeout", inbound)
+		}
+		if !p.Connected() || p.WantsAddrV2() {
+			t.Fatalf("inbound %v: got connected %v, wants addrv2 %v",
+				inbound, p.Connected(), p.WantsAddrV2())
+		}
+		p.Disconnect()
+		p.WaitForDisconnect()
+	}
+}
+
+// TestV2Transport ensures peers negotiate the BIP0324 v2 transport when both
+// sides enable it and inbound peers fall back to the v1 transport otherwise.
+func TestV2Transport(t *testing.T) {
+	tests := []struct {
+		name       string
+		inboundV2  bool
+		outboundV2 bool
+		wantV2     bool
+	}{
+		{"both v2", true, true, true},
+		{"v1 outbound", true, false, false},
+		{"both v1", false, false, false},
+	}
+	for _, test := range tests {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Listen: unexpected error: %v", err)
+		}
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			conn, _ := listener.Accept()
+			accepted <- conn
+		}()
+		outConn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial: unexpected error: %v", err)
+		}
+		inConn := <-accepted
+		listener.Close()
+		if inConn == nil {
+			t.Fatalf("%s: Accept failed", test.name)
+		}
+
+		verack := make(chan struct{}, 2)
+		peerCfg := func(v2 bool) *peer.Config {
+			return &peer.Config{
+				Listeners: peer.MessageListeners{
+					OnVerAck: func(p *peer.Peer, msg *wire.MsgVerAck) {
+						verack <- struct{}{}
+					},
+				},
+				UserAgentName:    "peer",
+				UserAgentVersion: "1.0",
+				ChainParams:      &chaincfg.MainNetParams,
+				V2Transport:      v2,
+			}
+		}
+		outPeer, err := peer.NewOutboundPeer(peerCfg(test.outboundV2),
+			inConn.LocalAddr().String())
+		if err != nil {
+			t.Fatalf("NewOutboundPeer: unexpected err: %v\n", err)
+		}
+		outPeer.AssociateConnection(outConn)
+		inPeer := peer.NewInboundPeer(peerCfg(test.inboundV2))
+		inPeer.AssociateConnection(inConn)
+		for i := 0; i < 2; i++ {
+			select {
+			case <-verack:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s: verack timeout", test.name)
+			}
+		}
+		if inPeer.UsesV2Transport() != test.wantV2 ||
+			outPeer.UsesV2Transport() != test.wantV2 {
+
+			t.Errorf("%s: unexpected UsesV2Transport - got %v/%v, "+
+				"want %v", test.name, inPeer.UsesV2Transport(),
+				outPeer.UsesV2Transport(), test.wantV2)
+		}
+		inPeer.Disconnect()
+		outPeer.Disconnect()
+		inPeer.WaitForDisconnect()
+		outPeer.WaitForDisconnect()
+	}
+}
+
 func init() {
 	// Allow self connection when running the tests.
 	peer.TstAllowSelfConns()
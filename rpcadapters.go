@@ -5,10 +5,15 @@
 package main
 
 import (
+	"net"
 	"sync/atomic"
+	"time"
 
+	"github.com/btgsuite/btgd/addrmgr"
 	"github.com/btgsuite/btgd/blockchain"
+	"github.com/btgsuite/btgd/btcjson"
 	"github.com/btgsuite/btgd/chaincfg/chainhash"
+	"github.com/btgsuite/btgd/connmgr"
 	"github.com/btgsuite/btgd/mempool"
 	"github.com/btgsuite/btgd/netsync"
 	"github.com/btgsuite/btgd/peer"
@@ -61,6 +66,29 @@ func (p *rpcPeer) FeeFilter() int64 {
 	return atomic.LoadInt64(&(*serverPeer)(p).feeFilter)
 }
 
+// MappedAS returns the autonomous system number of the peer according to the
+// asmap in use or zero when it is unknown.
+//
+// This function is safe for concurrent access and is part of the rpcserverPeer
+// interface implementation.
+func (p *rpcPeer) MappedAS() uint32 {
+	sp := (*serverPeer)(p)
+	na := sp.NA()
+	if na == nil {
+		return 0
+	}
+	return sp.server.addrManager.MappedAS(na)
+}
+
+// Permissions returns the names of the permissions granted to the peer by the
+// whitelist and whitebind options.
+//
+// This function is safe for concurrent access and is part of the rpcserverPeer
+// interface implementation.
+func (p *rpcPeer) Permissions() []string {
+	return (*serverPeer)(p).permissions.Strings()
+}
+
 // rpcConnManager provides a connection manager for use with the RPC server and
 // implements the rpcserverConnManager interface.
 type rpcConnManager struct {
@@ -164,6 +192,32 @@ func (cm *rpcConnManager) NetTotals() (uint64, uint64) {
 	return cm.server.NetTotals()
 }
 
+// InboundRejections returns the number of inbound peers that have been
+// rejected due to the per-IP and per-network group inbound limits,
+// respectively.
+//
+// This function is safe for concurrent access and is part of the
+// rpcserverConnManager interface implementation.
+func (cm *rpcConnManager) InboundRejections() (uint64, uint64) {
+	return cm.server.InboundRejections()
+}
+
+// UploadTarget returns the state of the upload target in the current cycle.
+//
+// This function is safe for concurrent access and is part of the
+// rpcserverConnManager interface implementation.
+func (cm *rpcConnManager) UploadTarget() *btcjson.UploadTarget {
+	bytesLeft, timeLeft := cm.server.UploadTargetLeft()
+	return &btcjson.UploadTarget{
+		TimeFrame:             int64(uploadTargetCycle / time.Second),
+		Target:                cm.server.maxUploadTarget,
+		TargetReached:         cm.server.uploadTargetReached(false),
+		ServeHistoricalBlocks: !cm.server.uploadTargetReached(true),
+		BytesLeftInCycle:      bytesLeft,
+		TimeLeftInCycle:       int64(timeLeft / time.Second),
+	}
+}
+
 // ConnectedPeers returns an array consisting of all connected peers.
 //
 // This function is safe for concurrent access and is part of the
@@ -223,6 +277,63 @@ func (cm *rpcConnManager) RelayTransactions(txns []*mempool.TxDesc) {
 	cm.server.relayTransactions(txns)
 }
 
+// BanSubnet bans the provided subnet until the given time and disconnects all
+// connected peers within it.
+//
+// This function is safe for concurrent access and is part of the
+// rpcserverConnManager interface implementation.
+func (cm *rpcConnManager) BanSubnet(subnet *net.IPNet, until time.Time, reason string) error {
+	if err := cm.server.banList.Ban(subnet, until, reason); err != nil {
+		return err
+	}
+
+	replyChan := make(chan int)
+	cm.server.query <- disconnectSubnetMsg{subnet: subnet, reply: replyChan}
+	<-replyChan
+	return nil
+}
+
+// UnbanSubnet removes the ban for the provided subnet.
+//
+// This function is safe for concurrent access and is part of the
+// rpcserverConnManager interface implementation.
+func (cm *rpcConnManager) UnbanSubnet(subnet *net.IPNet) error {
+	return cm.server.banList.Unban(subnet)
+}
+
+// BannedSubnets returns all currently banned addresses and subnets.
+//
+// This function is safe for concurrent access and is part of the
+// rpcserverConnManager interface implementation.
+func (cm *rpcConnManager) BannedSubnets() []connmgr.BanEntry {
+	return cm.server.banList.Entries()
+}
+
+// ClearBanned removes all bans.
+//
+// This function is safe for concurrent access and is part of the
+// rpcserverConnManager interface implementation.
+func (cm *rpcConnManager) ClearBanned() error {
+	return cm.server.banList.Clear()
+}
+
+// LocalServices returns the services the server advertises to its peers.
+//
+// This function is safe for concurrent access and is part of the
+// rpcserverConnManager interface implementation.
+func (cm *rpcConnManager) LocalServices() wire.ServiceFlag {
+	return cm.server.services
+}
+
+// LocalAddresses returns the local addresses the server knows about along with
+// the scores they are advertised with.
+//
+// This function is safe for concurrent access and is part of the
+// rpcserverConnManager interface implementation.
+func (cm *rpcConnManager) LocalAddresses() []addrmgr.LocalAddress {
+	return cm.server.addrManager.LocalAddresses()
+}
+
 // rpcSyncMgr provides a block manager for use with the RPC server and
 // implements the rpcserverSyncManager interface.
 type rpcSyncMgr struct {
@@ -277,3 +388,12 @@ func (b *rpcSyncMgr) SyncPeerID() int32 {
 func (b *rpcSyncMgr) LocateHeaders(locators []*chainhash.Hash, hashStop *chainhash.Hash) []wire.BlockHeader {
 	return b.server.chain.LocateHeaders(locators, hashStop)
 }
+
+// IsTipStale returns whether or not the tip has not advanced for longer than
+// expected.
+//
+// This function is safe for concurrent access and is part of the
+// rpcserverSyncManager interface implementation.
+func (b *rpcSyncMgr) IsTipStale() bool {
+	return b.syncMgr.IsTipStale()
+}
@@ -121,6 +121,17 @@ type NotificationHandlers struct {
 	// OnBlockDisconnected: it receives the block's height and header.
 	OnFilteredBlockDisconnected func(height int32, header *wire.BlockHeader)
 
+	// OnDeepReorg is invoked when a side chain with more work than the
+	// longest (best) chain was not activated because it forks from it
+	// deeper than the maximum reorganization depth of the server.  It will
+	// only be invoked if a preceding call to NotifyBlocks has been made to
+	// register for the notification and the function is non-nil.  It
+	// receives the hash and height of the latest block both chains have in
+	// common, the hash and height of the tip of the side chain and the
+	// number of blocks the reorganization would have disconnected.
+	OnDeepReorg func(forkHash *chainhash.Hash, forkHeight int32,
+		tipHash *chainhash.Hash, tipHeight int32, depth int32)
+
 	// OnRecvTx is invoked when a transaction that receives funds to a
 	// registered address is received into the memory pool and also
 	// connected to the longest (best) chain.  It will only be invoked if a
@@ -290,6 +301,25 @@ func (c *Client) handleNotification(ntfn *rawNotification) {
 		c.ntfnHandlers.OnFilteredBlockDisconnected(blockHeight,
 			blockHeader)
 
+	// OnDeepReorg
+	case btcjson.DeepReorgNtfnMethod:
+		// Ignore the notification if the client is not interested in
+		// it.
+		if c.ntfnHandlers.OnDeepReorg == nil {
+			return
+		}
+
+		forkHash, forkHeight, tipHash, tipHeight, depth, err :=
+			parseDeepReorgParams(ntfn.Params)
+		if err != nil {
+			log.Warnf("Received invalid deep reorg notification: %v",
+				err)
+			return
+		}
+
+		c.ntfnHandlers.OnDeepReorg(forkHash, forkHeight, tipHash,
+			tipHeight, depth)
+
 	// OnRecvTx
 	case btcjson.RecvTxNtfnMethod:
 		// Ignore the notification if the client is not interested in
@@ -615,6 +645,40 @@ func parseFilteredBlockDisconnectedParams(params []json.RawMessage) (int32,
 	return blockHeight, &blockHeader, nil
 }
 
+// parseDeepReorgParams parses out the fork hash and height, the side chain tip
+// hash and height and the depth from the parameters of a deepreorg
+// notification.
+func parseDeepReorgParams(params []json.RawMessage) (*chainhash.Hash, int32,
+	*chainhash.Hash, int32, int32, error) {
+
+	if len(params) != 5 {
+		return nil, 0, nil, 0, 0, wrongNumParams(len(params))
+	}
+
+	// Unmarshal the hashes as strings and the heights and depth as
+	// integers.
+	var forkHashStr, tipHashStr string
+	var forkHeight, tipHeight, depth int32
+	for i, v := range []interface{}{&forkHashStr, &forkHeight, &tipHashStr,
+		&tipHeight, &depth} {
+
+		if err := json.Unmarshal(params[i], v); err != nil {
+			return nil, 0, nil, 0, 0, err
+		}
+	}
+
+	forkHash, err := chainhash.NewHashFromStr(forkHashStr)
+	if err != nil {
+		return nil, 0, nil, 0, 0, err
+	}
+	tipHash, err := chainhash.NewHashFromStr(tipHashStr)
+	if err != nil {
+		return nil, 0, nil, 0, 0, err
+	}
+
+	return forkHash, forkHeight, tipHash, tipHeight, depth, nil
+}
+
 func parseHexParam(param json.RawMessage) ([]byte, error) {
 	var s string
 	err := json.Unmarshal(param, &s)
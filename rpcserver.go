@@ -28,12 +28,14 @@ import (
 	"time"
 
 	"github.com/btcsuite/websocket"
+	"github.com/btgsuite/btgd/addrmgr"
 	"github.com/btgsuite/btgd/blockchain"
 	"github.com/btgsuite/btgd/blockchain/indexers"
 	"github.com/btgsuite/btgd/btcec"
 	"github.com/btgsuite/btgd/btcjson"
 	"github.com/btgsuite/btgd/chaincfg"
 	"github.com/btgsuite/btgd/chaincfg/chainhash"
+	"github.com/btgsuite/btgd/connmgr"
 	"github.com/btgsuite/btgd/database"
 	"github.com/btgsuite/btgd/mempool"
 	"github.com/btgsuite/btgd/mining"
@@ -75,6 +77,10 @@ const (
 
 	// maxProtocolVersion is the max protocol version the server supports.
 	maxProtocolVersion = 70002
+
+	// maxTestMempoolAcceptTxns is the maximum number of transactions which
+	// can be checked by a single testmempoolaccept RPC.
+	maxTestMempoolAcceptTxns = 25
 )
 
 var (
@@ -128,6 +134,7 @@ type commandHandler func(*rpcServer, interface{}, <-chan struct{}) (interface{},
 var rpcHandlers map[string]commandHandler
 var rpcHandlersBeforeInit = map[string]commandHandler{
 	"addnode":               handleAddNode,
+	"clearbanned":           handleClearBanned,
 	"createrawtransaction":  handleCreateRawTransaction,
 	"debuglevel":            handleDebugLevel,
 	"decoderawtransaction":  handleDecodeRawTransaction,
@@ -145,6 +152,7 @@ var rpcHandlersBeforeInit = map[string]commandHandler{
 	"getblocktemplate":      handleGetBlockTemplate,
 	"getcfilter":            handleGetCFilter,
 	"getcfilterheader":      handleGetCFilterHeader,
+	"getchaintips":          handleGetChainTips,
 	"getconnectioncount":    handleGetConnectionCount,
 	"getcurrentnet":         handleGetCurrentNet,
 	"getdifficulty":         handleGetDifficulty,
@@ -152,22 +160,33 @@ var rpcHandlersBeforeInit = map[string]commandHandler{
 	"gethashespersec":       handleGetHashesPerSec,
 	"getheaders":            handleGetHeaders,
 	"getinfo":               handleGetInfo,
+	"getmempoolancestors":   handleGetMempoolAncestors,
+	"getmempooldescendants": handleGetMempoolDescendants,
+	"getmempoolentry":       handleGetMempoolEntry,
 	"getmempoolinfo":        handleGetMempoolInfo,
 	"getmininginfo":         handleGetMiningInfo,
 	"getnettotals":          handleGetNetTotals,
 	"getnetworkhashps":      handleGetNetworkHashPS,
+	"getnetworkinfo":        handleGetNetworkInfo,
 	"getpeerinfo":           handleGetPeerInfo,
 	"getrawmempool":         handleGetRawMempool,
 	"getrawtransaction":     handleGetRawTransaction,
 	"gettxout":              handleGetTxOut,
 	"help":                  handleHelp,
+	"invalidateblock":       handleInvalidateBlock,
+	"listbanned":            handleListBanned,
 	"node":                  handleNode,
 	"ping":                  handlePing,
+	"preciousblock":         handlePreciousBlock,
+	"prioritisetransaction": handlePrioritiseTransaction,
+	"reconsiderblock":       handleReconsiderBlock,
 	"searchrawtransactions": handleSearchRawTransactions,
 	"sendrawtransaction":    handleSendRawTransaction,
+	"setban":                handleSetBan,
 	"setgenerate":           handleSetGenerate,
 	"stop":                  handleStop,
 	"submitblock":           handleSubmitBlock,
+	"testmempoolaccept":     handleTestMempoolAccept,
 	"uptime":                handleUptime,
 	"validateaddress":       handleValidateAddress,
 	"verifychain":           handleVerifyChain,
@@ -226,13 +245,7 @@ var rpcAskWallet = map[string]struct{}{
 // Commands that are currently unimplemented, but should ultimately be.
 var rpcUnimplemented = map[string]struct{}{
 	"estimatepriority": {},
-	"getchaintips":     {},
-	"getmempoolentry":  {},
-	"getnetworkinfo":   {},
 	"getwork":          {},
-	"invalidateblock":  {},
-	"preciousblock":    {},
-	"reconsiderblock":  {},
 }
 
 // Commands that are available to a limited user
@@ -263,18 +276,24 @@ var rpcLimited = map[string]struct{}{
 	"getblockheader":        {},
 	"getcfilter":            {},
 	"getcfilterheader":      {},
+	"getchaintips":          {},
 	"getcurrentnet":         {},
 	"getdifficulty":         {},
 	"getheaders":            {},
 	"getinfo":               {},
+	"getmempoolancestors":   {},
+	"getmempooldescendants": {},
+	"getmempoolentry":       {},
 	"getnettotals":          {},
 	"getnetworkhashps":      {},
+	"getnetworkinfo":        {},
 	"getrawmempool":         {},
 	"getrawtransaction":     {},
 	"gettxout":              {},
 	"searchrawtransactions": {},
 	"sendrawtransaction":    {},
 	"submitblock":           {},
+	"testmempoolaccept":     {},
 	"uptime":                {},
 	"validateaddress":       {},
 	"verifymessage":         {},
@@ -508,6 +527,17 @@ func messageToHex(msg wire.Message) (string, error) {
 	return hex.EncodeToString(buf.Bytes()), nil
 }
 
+// handleClearBanned implements the clearbanned command.
+func handleClearBanned(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
+	if err := s.cfg.ConnMgr.ClearBanned(); err != nil {
+		context := "Failed to clear ban list"
+		return nil, internalRPCError(err.Error(), context)
+	}
+
+	// no data returned unless an error.
+	return nil, nil
+}
+
 // handleCreateRawTransaction handles createrawtransaction commands.
 func handleCreateRawTransaction(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
 	c := cmd.(*btcjson.CreateRawTransactionCmd)
@@ -1198,6 +1228,7 @@ func handleGetBlockChainInfo(s *rpcServer, cmd interface{}, closeChan <-chan str
 		Difficulty:    getDifficultyRatio(chainSnapshot.Bits, params),
 		MedianTime:    chainSnapshot.MedianTime.Unix(),
 		Pruned:        false,
+		StaleTip:      s.cfg.SyncMgr.IsTipStale(),
 		Bip9SoftForks: make(map[string]*btcjson.Bip9SoftForkDescription),
 	}
 
@@ -2234,6 +2265,21 @@ func handleGetCFilterHeader(s *rpcServer, cmd interface{}, closeChan <-chan stru
 	return hash.String(), nil
 }
 
+// handleGetChainTips implements the getchaintips command.
+func handleGetChainTips(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
+	tips := s.cfg.Chain.ChainTips()
+	results := make([]btcjson.GetChainTipsResult, 0, len(tips))
+	for _, tip := range tips {
+		results = append(results, btcjson.GetChainTipsResult{
+			Height:    tip.Height,
+			Hash:      tip.Hash.String(),
+			BranchLen: tip.BranchLen,
+			Status:    tip.Status.String(),
+		})
+	}
+	return results, nil
+}
+
 // handleGetConnectionCount implements the getconnectioncount command.
 func handleGetConnectionCount(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
 	return s.cfg.ConnMgr.ConnectedCount(), nil
@@ -2320,6 +2366,69 @@ func handleGetInfo(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (in
 	return ret, nil
 }
 
+// handleGetMempoolAncestors implements the getmempoolancestors command.
+func handleGetMempoolAncestors(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
+	c := cmd.(*btcjson.GetMempoolAncestorsCmd)
+	txHash, err := chainhash.NewHashFromStr(c.TxID)
+	if err != nil {
+		return nil, rpcDecodeHexError(c.TxID)
+	}
+
+	mp := s.cfg.TxMemPool
+	if c.Verbose != nil && *c.Verbose {
+		entries, err := mp.TxAncestorsVerbose(txHash)
+		if err != nil {
+			return nil, rpcNoTxInfoError(txHash)
+		}
+		return entries, nil
+	}
+
+	hashStrings, err := mp.TxAncestors(txHash)
+	if err != nil {
+		return nil, rpcNoTxInfoError(txHash)
+	}
+	return hashStrings, nil
+}
+
+// handleGetMempoolDescendants implements the getmempooldescendants command.
+func handleGetMempoolDescendants(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
+	c := cmd.(*btcjson.GetMempoolDescendantsCmd)
+	txHash, err := chainhash.NewHashFromStr(c.TxID)
+	if err != nil {
+		return nil, rpcDecodeHexError(c.TxID)
+	}
+
+	mp := s.cfg.TxMemPool
+	if c.Verbose != nil && *c.Verbose {
+		entries, err := mp.TxDescendantsVerbose(txHash)
+		if err != nil {
+			return nil, rpcNoTxInfoError(txHash)
+		}
+		return entries, nil
+	}
+
+	hashStrings, err := mp.TxDescendants(txHash)
+	if err != nil {
+		return nil, rpcNoTxInfoError(txHash)
+	}
+	return hashStrings, nil
+}
+
+// handleGetMempoolEntry implements the getmempoolentry command.
+func handleGetMempoolEntry(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
+	c := cmd.(*btcjson.GetMempoolEntryCmd)
+	txHash, err := chainhash.NewHashFromStr(c.TxID)
+	if err != nil {
+		return nil, rpcDecodeHexError(c.TxID)
+	}
+
+	entry, err := s.cfg.TxMemPool.MempoolEntry(txHash)
+	if err != nil {
+		return nil, rpcNoTxInfoError(txHash)
+	}
+	return entry, nil
+}
+
 // handleGetMempoolInfo implements the getmempoolinfo command.
 func handleGetMempoolInfo(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
 	mempoolTxns := s.cfg.TxMemPool.TxDescs()
@@ -2376,10 +2485,14 @@ func handleGetMiningInfo(s *rpcServer, cmd interface{}, closeChan <-chan struct{
 // handleGetNetTotals implements the getnettotals command.
 func handleGetNetTotals(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
 	totalBytesRecv, totalBytesSent := s.cfg.ConnMgr.NetTotals()
+	ipRejected, groupRejected := s.cfg.ConnMgr.InboundRejections()
 	reply := &btcjson.GetNetTotalsResult{
-		TotalBytesRecv: totalBytesRecv,
-		TotalBytesSent: totalBytesSent,
-		TimeMillis:     time.Now().UTC().UnixNano() / int64(time.Millisecond),
+		TotalBytesRecv:       totalBytesRecv,
+		TotalBytesSent:       totalBytesSent,
+		TimeMillis:           time.Now().UTC().UnixNano() / int64(time.Millisecond),
+		InboundIPRejected:    ipRejected,
+		InboundGroupRejected: groupRejected,
+		UploadTarget:         *s.cfg.ConnMgr.UploadTarget(),
 	}
 	return reply, nil
 }
@@ -2478,6 +2591,68 @@ func handleGetNetworkHashPS(s *rpcServer, cmd interface{}, closeChan <-chan stru
 	return hashesPerSec.Int64(), nil
 }
 
+// handleGetNetworkInfo implements the getnetworkinfo command.
+func handleGetNetworkInfo(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
+	// Build the user agent the same way it is advertised to peers.
+	versionMsg := wire.MsgVersion{UserAgent: wire.DefaultUserAgent}
+	err := versionMsg.AddUserAgent(userAgentName, userAgentVersion,
+		cfg.UserAgentComments...)
+	if err != nil {
+		return nil, internalRPCError(err.Error(),
+			"Failed to build the user agent")
+	}
+
+	var connectionsIn, connectionsOut int32
+	for _, p := range s.cfg.ConnMgr.ConnectedPeers() {
+		if p.ToPeer().Inbound() {
+			connectionsIn++
+		} else {
+			connectionsOut++
+		}
+	}
+
+	networks := make([]btcjson.NetworksResult, 0, len(supportedNetworks))
+	for _, name := range supportedNetworks {
+		proxy, randomizeCredentials := networkProxy(name)
+		networks = append(networks, btcjson.NetworksResult{
+			Name:                      name,
+			Limited:                   isNetworkLimited(name),
+			Reachable:                 isNetworkReachable(name),
+			Proxy:                     proxy,
+			ProxyRandomizeCredentials: randomizeCredentials,
+		})
+	}
+
+	localAddrs := s.cfg.ConnMgr.LocalAddresses()
+	localAddresses := make([]btcjson.LocalAddressesResult, 0, len(localAddrs))
+	for _, la := range localAddrs {
+		localAddresses = append(localAddresses, btcjson.LocalAddressesResult{
+			Address: la.NetAddress.Host(),
+			Port:    la.NetAddress.Port,
+			Score:   int32(la.Score),
+		})
+	}
+
+	relayFee := cfg.minRelayTxFee.ToBTC()
+	return &btcjson.GetNetworkInfoResult{
+		Version:         int32(1000000*appMajor + 10000*appMinor + 100*appPatch),
+		SubVersion:      versionMsg.UserAgent,
+		ProtocolVersion: int32(peer.MaxProtocolVersion),
+		LocalServices:   fmt.Sprintf("%016x", uint64(s.cfg.ConnMgr.LocalServices())),
+		LocalRelay:      !cfg.BlocksOnly,
+		TimeOffset:      int64(s.cfg.TimeSource.Offset().Seconds()),
+		Connections:     connectionsIn + connectionsOut,
+		ConnectionsIn:   connectionsIn,
+		ConnectionsOut:  connectionsOut,
+		NetworkActive:   true,
+		Networks:        networks,
+		RelayFee:        relayFee,
+		IncrementalFee:  relayFee,
+		LocalAddresses:  localAddresses,
+		Warnings:        s.cfg.Chain.Warnings(),
+	}, nil
+}
+
 // handleGetPeerInfo implements the getpeerinfo command.
 func handleGetPeerInfo(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
 	peers := s.cfg.ConnMgr.ConnectedPeers()
@@ -2506,6 +2681,8 @@ func handleGetPeerInfo(s *rpcServer, cmd interface{}, closeChan <-chan struct{})
 			BanScore:       int32(p.BanScore()),
 			FeeFilter:      p.FeeFilter(),
 			SyncNode:       statsSnap.ID == syncPeerID,
+			MappedAS:       p.MappedAS(),
+			Permissions:    p.Permissions(),
 		}
 		if p.ToPeer().LastPingNonce() != 0 {
 			wait := float64(time.Since(statsSnap.LastPingTime).Nanoseconds())
@@ -2801,6 +2978,53 @@ func handleHelp(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (inter
 	return help, nil
 }
 
+// blockStatusCommand runs the passed chain function which changes the
+// validation status of the block with the passed hash.  It returns a block not
+// found error when the block is not known.
+func blockStatusCommand(s *rpcServer, blockHash string,
+	fn func(*chainhash.Hash) error, context string) (interface{}, error) {
+
+	hash, err := chainhash.NewHashFromStr(blockHash)
+	if err != nil {
+		return nil, rpcDecodeHexError(blockHash)
+	}
+	if _, err := s.cfg.Chain.HeaderByHash(hash); err != nil {
+		return nil, &btcjson.RPCError{
+			Code:    btcjson.ErrRPCBlockNotFound,
+			Message: "Block not found",
+		}
+	}
+	if err := fn(hash); err != nil {
+		return nil, internalRPCError(err.Error(), context)
+	}
+	return nil, nil
+}
+
+// handleInvalidateBlock implements the invalidateblock command.
+func handleInvalidateBlock(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
+	c := cmd.(*btcjson.InvalidateBlockCmd)
+	return blockStatusCommand(s, c.BlockHash, s.cfg.Chain.InvalidateBlock,
+		"Failed to invalidate block")
+}
+
+// handleListBanned implements the listbanned command.
+func handleListBanned(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
+	now := time.Now()
+	entries := s.cfg.ConnMgr.BannedSubnets()
+	banned := make([]btcjson.ListBannedResult, 0, len(entries))
+	for _, entry := range entries {
+		banned = append(banned, btcjson.ListBannedResult{
+			Address:       entry.Subnet.String(),
+			BanCreated:    entry.Created.Unix(),
+			BannedUntil:   entry.Until.Unix(),
+			BanDuration:   int64(entry.Until.Sub(entry.Created).Seconds()),
+			TimeRemaining: int64(entry.Until.Sub(now).Seconds()),
+			BanReason:     entry.Reason,
+		})
+	}
+	return banned, nil
+}
+
 // handlePing implements the ping command.
 func handlePing(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
 	// Ask server to ping \o_
@@ -2814,6 +3038,46 @@ func handlePing(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (inter
 	return nil, nil
 }
 
+// handlePreciousBlock implements the preciousblock command.
+func handlePreciousBlock(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
+	c := cmd.(*btcjson.PreciousBlockCmd)
+	return blockStatusCommand(s, c.BlockHash, s.cfg.Chain.PreciousBlock,
+		"Failed to make block precious")
+}
+
+// handlePrioritiseTransaction implements the prioritisetransaction command.
+func handlePrioritiseTransaction(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
+	c := cmd.(*btcjson.PrioritiseTransactionCmd)
+	txHash, err := chainhash.NewHashFromStr(c.TxID)
+	if err != nil {
+		return nil, rpcDecodeHexError(c.TxID)
+	}
+
+	// Priority deltas are no longer supported, but the parameter is kept
+	// for compatibility.
+	if c.PriorityDelta != 0 {
+		return nil, &btcjson.RPCError{
+			Code: btcjson.ErrRPCInvalidParameter,
+			Message: "Priority is no longer supported, dummy argument " +
+				"to prioritisetransaction must be 0",
+		}
+	}
+
+	err = s.cfg.TxMemPool.PrioritiseTransaction(txHash, c.FeeDelta)
+	if err != nil {
+		context := "Failed to save fee delta"
+		return nil, internalRPCError(err.Error(), context)
+	}
+	return true, nil
+}
+
+// handleReconsiderBlock implements the reconsiderblock command.
+func handleReconsiderBlock(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
+	c := cmd.(*btcjson.ReconsiderBlockCmd)
+	return blockStatusCommand(s, c.BlockHash, s.cfg.Chain.ReconsiderBlock,
+		"Failed to reconsider block")
+}
+
 // retrievedTx represents a transaction that was either loaded from the
 // transaction memory pool or from the database.  When a transaction is loaded
 // from the database, it is loaded with the raw serialized bytes while the
@@ -3401,6 +3665,69 @@ func handleSendRawTransaction(s *rpcServer, cmd interface{}, closeChan <-chan st
 	return tx.Hash().String(), nil
 }
 
+// handleSetBan implements the setban command.
+func handleSetBan(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
+	c := cmd.(*btcjson.SetBanCmd)
+
+	subnet, err := connmgr.ParseSubnet(c.Subnet)
+	if err != nil {
+		return nil, &btcjson.RPCError{
+			Code:    btcjson.ErrRPCInvalidParameter,
+			Message: err.Error(),
+		}
+	}
+
+	switch c.SubCmd {
+	case btcjson.SBAdd:
+		// Use the configured ban duration when no ban time is given,
+		// otherwise interpret it as either a relative number of seconds
+		// or an absolute unix timestamp.
+		until := time.Now().Add(cfg.BanDuration)
+		if c.BanTime != nil && *c.BanTime > 0 {
+			if c.Absolute != nil && *c.Absolute {
+				until = time.Unix(*c.BanTime, 0)
+			} else {
+				until = time.Now().Add(time.Duration(*c.BanTime) *
+					time.Second)
+			}
+		}
+		if !until.After(time.Now()) {
+			return nil, &btcjson.RPCError{
+				Code:    btcjson.ErrRPCInvalidParameter,
+				Message: "ban time must be in the future",
+			}
+		}
+
+		err = s.cfg.ConnMgr.BanSubnet(subnet, until, "manually added")
+		if err != nil {
+			context := "Failed to ban subnet"
+			return nil, internalRPCError(err.Error(), context)
+		}
+
+	case btcjson.SBRemove:
+		err = s.cfg.ConnMgr.UnbanSubnet(subnet)
+		if err == connmgr.ErrNotBanned {
+			return nil, &btcjson.RPCError{
+				Code:    btcjson.ErrRPCMisc,
+				Message: "Unban failed: " + err.Error(),
+			}
+		}
+		if err != nil {
+			context := "Failed to unban subnet"
+			return nil, internalRPCError(err.Error(), context)
+		}
+
+	default:
+		return nil, &btcjson.RPCError{
+			Code:    btcjson.ErrRPCInvalidParameter,
+			Message: "invalid subcommand for setban",
+		}
+	}
+
+	// no data returned unless an error.
+	return nil, nil
+}
+
 // handleSetGenerate implements the setgenerate command.
 func handleSetGenerate(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
 	c := cmd.(*btcjson.SetGenerateCmd)
@@ -3479,6 +3806,150 @@ func handleSubmitBlock(s *rpcServer, cmd interface{}, closeChan <-chan struct{})
 	return nil, nil
 }
 
+// mempoolRejectReason converts a rule error returned from the memory pool to
+// a short token describing why the transaction was rejected, such as
+// "insufficient fee" or "txn-already-in-mempool".  Errors which originate in
+// the chain rules use the same tokens as block proposals.
+func mempoolRejectReason(err error) string {
+	if ruleErr, ok := err.(mempool.RuleError); ok {
+		err = ruleErr.Err
+	}
+
+	switch err := err.(type) {
+	case blockchain.RuleError:
+		return chainErrToGBTErrString(err)
+
+	case mempool.TxRuleError:
+		switch err.RejectCode {
+		case wire.RejectMalformed:
+			return "malformed"
+		case wire.RejectInvalid:
+			if strings.Contains(err.Description, "individual coinbase") {
+				return "coinbase"
+			}
+			return "invalid"
+		case wire.RejectObsolete:
+			return "obsolete"
+		case wire.RejectDuplicate:
+			switch {
+			case strings.Contains(err.Description, "already spent by"):
+				return "txn-mempool-conflict"
+			case strings.Contains(err.Description, "already have"):
+				return "txn-already-in-mempool"
+			case strings.Contains(err.Description, "unknown or fully-spent"):
+				return "missing-inputs"
+			}
+			return "txn-already-known"
+		case wire.RejectNonstandard:
+			switch {
+			case strings.Contains(err.Description, "sequence locks"):
+				return "non-BIP68-final"
+			case strings.Contains(err.Description, "sigop cost"):
+				return "bad-txns-too-many-sigops"
+			case strings.Contains(err.Description, "evicts more"):
+				return "too many potential replacements"
+			}
+			return "non-standard"
+		case wire.RejectDust:
+			return "dust"
+		case wire.RejectInsufficientFee:
+			return "insufficient fee"
+		case wire.RejectCheckpoint:
+			return "checkpoint"
+		}
+	}
+
+	return "rejected"
+}
+
+// handleTestMempoolAccept implements the testmempoolaccept command.
+func handleTestMempoolAccept(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
+	c := cmd.(*btcjson.TestMempoolAcceptCmd)
+	if len(c.RawTxns) == 0 || len(c.RawTxns) > maxTestMempoolAcceptTxns {
+		return nil, &btcjson.RPCError{
+			Code: btcjson.ErrRPCInvalidParameter,
+			Message: fmt.Sprintf("Array must contain between 1 and "+
+				"%d transactions", maxTestMempoolAcceptTxns),
+		}
+	}
+
+	// The maximum fee rate is specified in BTC/kvB.  A rate of zero
+	// disables the check.
+	var maxFeeRate btcutil.Amount
+	if c.MaxFeeRate != nil {
+		var err error
+		maxFeeRate, err = btcutil.NewAmount(*c.MaxFeeRate)
+		if err != nil || maxFeeRate < 0 {
+			return nil, &btcjson.RPCError{
+				Code:    btcjson.ErrRPCInvalidParameter,
+				Message: "Invalid maximum fee rate",
+			}
+		}
+	}
+
+	// Deserialize all of the transactions before checking any of them.
+	txns := make([]*btcutil.Tx, 0, len(c.RawTxns))
+	for _, hexStr := range c.RawTxns {
+		if len(hexStr)%2 != 0 {
+			hexStr = "0" + hexStr
+		}
+		serializedTx, err := hex.DecodeString(hexStr)
+		if err != nil {
+			return nil, rpcDecodeHexError(hexStr)
+		}
+		var msgTx wire.MsgTx
+		err = msgTx.Deserialize(bytes.NewReader(serializedTx))
+		if err != nil {
+			return nil, &btcjson.RPCError{
+				Code:    btcjson.ErrRPCDeserialization,
+				Message: "TX decode failed: " + err.Error(),
+			}
+		}
+		txns = append(txns, btcutil.NewTx(&msgTx))
+	}
+
+	// Each transaction is checked against the current state of the memory
+	// pool on its own, so transactions spending outputs created by other
+	// transactions in the same request are reported as missing inputs.
+	results := make([]*btcjson.TestMempoolAcceptResult, 0, len(txns))
+	for _, tx := range txns {
+		result := &btcjson.TestMempoolAcceptResult{
+			Txid:  tx.Hash().String(),
+			Wtxid: tx.WitnessHash().String(),
+		}
+		results = append(results, result)
+
+		accept, err := s.cfg.TxMemPool.CheckMempoolAcceptance(tx)
+		if err != nil {
+			if _, ok := err.(mempool.RuleError); !ok {
+				context := "Failed to check transaction " +
+					tx.Hash().String()
+				return nil, internalRPCError(err.Error(), context)
+			}
+			result.RejectReason = mempoolRejectReason(err)
+			result.RejectDetails = err.Error()
+			continue
+		}
+		if len(accept.MissingParents) > 0 {
+			result.RejectReason = "missing-inputs"
+			continue
+		}
+		feeRate := accept.TxFee * 1000 / btcutil.Amount(accept.TxSize)
+		if maxFeeRate != 0 && feeRate > maxFeeRate {
+			result.RejectReason = "max-fee-exceeded"
+			continue
+		}
+
+		result.Allowed = true
+		result.Vsize = int32(accept.TxSize)
+		result.Fees = &btcjson.TestMempoolAcceptFees{
+			Base: accept.TxFee.ToBTC(),
+		}
+	}
+
+	return results, nil
+}
+
 // handleUptime implements the uptime command.
 func handleUptime(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
 	return time.Now().Unix() - s.cfg.StartupTime, nil
@@ -4161,6 +4632,14 @@ type rpcserverPeer interface {
 	// FeeFilter returns the requested current minimum fee rate for which
 	// transactions should be announced.
 	FeeFilter() int64
+
+	// MappedAS returns the autonomous system number of the peer according
+	// to the asmap in use or zero when it is unknown.
+	MappedAS() uint32
+
+	// Permissions returns the names of the permissions granted to the
+	// peer by the whitelist and whitebind options.
+	Permissions() []string
 }
 
 // rpcserverConnManager represents a connection manager for use with the RPC
@@ -4203,6 +4682,15 @@ type rpcserverConnManager interface {
 	// network for all peers.
 	NetTotals() (uint64, uint64)
 
+	// InboundRejections returns the number of inbound peers that have been
+	// rejected due to the per-IP and per-network group inbound limits,
+	// respectively.
+	InboundRejections() (uint64, uint64)
+
+	// UploadTarget returns the state of the upload target in the current
+	// cycle.
+	UploadTarget() *btcjson.UploadTarget
+
 	// ConnectedPeers returns an array consisting of all connected peers.
 	ConnectedPeers() []rpcserverPeer
 
@@ -4222,6 +4710,28 @@ type rpcserverConnManager interface {
 	// RelayTransactions generates and relays inventory vectors for all of
 	// the passed transactions to all connected peers.
 	RelayTransactions(txns []*mempool.TxDesc)
+
+	// BanSubnet bans the provided subnet until the given time and
+	// disconnects all connected peers within it.
+	BanSubnet(subnet *net.IPNet, until time.Time, reason string) error
+
+	// UnbanSubnet removes the ban for the provided subnet.  It returns
+	// connmgr.ErrNotBanned when the subnet is not banned.
+	UnbanSubnet(subnet *net.IPNet) error
+
+	// BannedSubnets returns all currently banned addresses and subnets.
+	BannedSubnets() []connmgr.BanEntry
+
+	// ClearBanned removes all bans.
+	ClearBanned() error
+
+	// LocalServices returns the services the server advertises to its
+	// peers.
+	LocalServices() wire.ServiceFlag
+
+	// LocalAddresses returns the local addresses the server knows about
+	// along with the scores they are advertised with.
+	LocalAddresses() []addrmgr.LocalAddress
 }
 
 // rpcserverSyncManager represents a sync manager for use with the RPC server.
@@ -4249,6 +4759,10 @@ type rpcserverSyncManager interface {
 	// current tip is reached, up to a max of wire.MaxBlockHeadersPerMsg
 	// hashes.
 	LocateHeaders(locators []*chainhash.Hash, hashStop *chainhash.Hash) []wire.BlockHeader
+
+	// IsTipStale returns whether or not the tip has not advanced for
+	// longer than expected.
+	IsTipStale() bool
 }
 
 // rpcserverConfig is a descriptor containing the RPC server configuration.
@@ -4362,6 +4876,17 @@ func (s *rpcServer) handleBlockchainNotification(notification *blockchain.Notifi
 
 		// Notify registered websocket clients.
 		s.ntfnMgr.NotifyBlockDisconnected(block)
+
+	case blockchain.NTDeepReorg:
+		reorg, ok := notification.Data.(*blockchain.DeepReorg)
+		if !ok {
+			rpcsLog.Warnf("Chain deep reorg notification is not a " +
+				"deep reorg.")
+			break
+		}
+
+		// Notify registered websocket clients.
+		s.ntfnMgr.NotifyDeepReorg(reorg)
 	}
 }
 
@@ -0,0 +1,108 @@
+// Copyright (c) 2013-2016 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/btgsuite/btgd/blockchain"
+	"github.com/btgsuite/btgd/mempool"
+	"github.com/btgsuite/btgd/wire"
+)
+
+// TestMempoolRejectReason ensures rule errors returned by the memory pool are
+// converted to the expected reject reason tokens.
+func TestMempoolRejectReason(t *testing.T) {
+	txRuleError := func(code wire.RejectCode, desc string) error {
+		return mempool.RuleError{
+			Err: mempool.TxRuleError{RejectCode: code, Description: desc},
+		}
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{
+			name: "already in mempool",
+			err: txRuleError(wire.RejectDuplicate, "already have "+
+				"transaction abcd"),
+			want: "txn-already-in-mempool",
+		},
+		{
+			name: "mempool conflict",
+			err: txRuleError(wire.RejectDuplicate, "output abcd:0 "+
+				"already spent by transaction ef01 in the memory "+
+				"pool"),
+			want: "txn-mempool-conflict",
+		},
+		{
+			name: "already known",
+			err: txRuleError(wire.RejectDuplicate, "transaction "+
+				"already exists"),
+			want: "txn-already-known",
+		},
+		{
+			name: "min relay fee not met",
+			err: txRuleError(wire.RejectInsufficientFee, "transaction "+
+				"abcd has 0 fees which is under the required "+
+				"amount of 1000"),
+			want: "insufficient fee",
+		},
+		{
+			name: "replacement fee rate",
+			err: txRuleError(wire.RejectInsufficientFee, "replacement "+
+				"transaction abcd has an insufficient fee rate"),
+			want: "insufficient fee",
+		},
+		{
+			name: "dust",
+			err: txRuleError(wire.RejectDust, "transaction abcd is "+
+				"not standard: transaction output 0: payment of "+
+				"1 is dust"),
+			want: "dust",
+		},
+		{
+			name: "sequence locks",
+			err: txRuleError(wire.RejectNonstandard, "transaction's "+
+				"sequence locks on inputs not met"),
+			want: "non-BIP68-final",
+		},
+		{
+			name: "non-standard",
+			err: txRuleError(wire.RejectNonstandard, "transaction abcd "+
+				"is not standard: version 3 is not in the valid "+
+				"range of 1-2"),
+			want: "non-standard",
+		},
+		{
+			name: "individual coinbase",
+			err: txRuleError(wire.RejectInvalid, "transaction abcd is "+
+				"an individual coinbase"),
+			want: "coinbase",
+		},
+		{
+			name: "chain rule",
+			err: mempool.RuleError{Err: blockchain.RuleError{
+				ErrorCode:   blockchain.ErrImmatureSpend,
+				Description: "tried to spend coinbase abcd",
+			}},
+			want: "bad-txns-maturity",
+		},
+		{
+			name: "unknown error",
+			err:  mempool.RuleError{Err: errors.New("abcd")},
+			want: "rejected",
+		},
+	}
+
+	for _, test := range tests {
+		if got := mempoolRejectReason(test.err); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
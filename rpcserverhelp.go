@@ -40,6 +40,27 @@ var helpDescsEnUS = map[string]string{
 	"node-target":        "Either the IP address and port of the peer to operate on, or a valid peer ID.",
 	"node-connectsubcmd": "'perm' to make the connected peer a permanent one, 'temp' to try a single connect to a peer",
 
+	// SetBanCmd help.
+	"setban--synopsis": "Attempts to add or remove an IP address or subnet from the ban list.",
+	"setban-subnet":    "The IP address or subnet (e.g. 192.168.0.0/24) to operate on",
+	"setban-subcmd":    "'add' to ban the address or subnet and disconnect matching peers, or 'remove' to lift its ban",
+	"setban-bantime":   "The number of seconds the ban lasts or, when absolute is true, the time the ban expires in seconds since 1 Jan 1970 GMT (0 uses the configured ban duration)",
+	"setban-absolute":  "Whether or not bantime is an absolute timestamp",
+
+	// ListBannedCmd help.
+	"listbanned--synopsis": "Returns all banned IP addresses and subnets.",
+
+	// ListBannedResult help.
+	"listbannedresult-address":        "The banned IP address or subnet",
+	"listbannedresult-ban_created":    "Time the ban was created in seconds since 1 Jan 1970 GMT",
+	"listbannedresult-banned_until":   "Time the ban expires in seconds since 1 Jan 1970 GMT",
+	"listbannedresult-ban_duration":   "Total length of the ban in seconds",
+	"listbannedresult-time_remaining": "Number of seconds until the ban expires",
+	"listbannedresult-ban_reason":     "The reason the address or subnet was banned",
+
+	// ClearBannedCmd help.
+	"clearbanned--synopsis": "Removes all IP addresses and subnets from the ban list.",
+
 	// TransactionInput help.
 	"transactioninput-txid": "The hash of the input transaction",
 	"transactioninput-vout": "The specific output of the input transaction to redeem",
@@ -182,6 +203,7 @@ var helpDescsEnUS = map[string]string{
 	"getblockchaininforesult-pruned":                "A bool that indicates if the node is pruned or not",
 	"getblockchaininforesult-pruneheight":           "The lowest block retained in the current pruned chain",
 	"getblockchaininforesult-chainwork":             "The total cumulative work in the best chain",
+	"getblockchaininforesult-staletip":              "Whether the tip has not advanced for longer than expected, in which case extra outbound peers are tried",
 	"getblockchaininforesult-softforks":             "The status of the super-majority soft-forks",
 	"getblockchaininforesult-bip9_softforks":        "JSON object describing active BIP0009 deployments",
 	"getblockchaininforesult-bip9_softforks--key":   "bip9_softforks",
@@ -348,6 +370,15 @@ var helpDescsEnUS = map[string]string{
 	"getcfilterheader-hash":       "The hash of the block",
 	"getcfilterheader--result0":   "The block's gcs filter header",
 
+	// GetChainTipsCmd help.
+	"getchaintips--synopsis": "Returns information about all known tips in the block tree, including the main chain, side chains and chains of headers whose blocks have not been downloaded.",
+
+	// GetChainTipsResult help.
+	"getchaintipsresult-height":    "The height of the chain tip",
+	"getchaintipsresult-hash":      "The hash of the chain tip",
+	"getchaintipsresult-branchlen": "The length of the branch connecting the tip to the main chain, which is zero for the main chain",
+	"getchaintipsresult-status":    "The status of the chain (active, valid-fork, valid-headers, headers-only, invalid)",
+
 	// GetConnectionCountCmd help.
 	"getconnectioncount--synopsis": "Returns the number of active connections to other peers.",
 	"getconnectioncount--result0":  "The number of connections",
@@ -407,6 +438,53 @@ var helpDescsEnUS = map[string]string{
 	// GetInfoCmd help.
 	"getinfo--synopsis": "Returns a JSON object containing various state info.",
 
+	// GetMempoolAncestorsCmd help.
+	"getmempoolancestors--synopsis":   "Returns all in-mempool ancestors of a transaction in the memory pool.",
+	"getmempoolancestors-txid":        "The hash of the transaction",
+	"getmempoolancestors-verbose":     "Returns JSON object when true or an array of transaction hashes when false",
+	"getmempoolancestors--condition0": "verbose=false",
+	"getmempoolancestors--condition1": "verbose=true",
+	"getmempoolancestors--result0":    "Array of transaction hashes of the in-mempool ancestors",
+
+	// GetMempoolDescendantsCmd help.
+	"getmempooldescendants--synopsis":   "Returns all in-mempool descendants of a transaction in the memory pool.",
+	"getmempooldescendants-txid":        "The hash of the transaction",
+	"getmempooldescendants-verbose":     "Returns JSON object when true or an array of transaction hashes when false",
+	"getmempooldescendants--condition0": "verbose=false",
+	"getmempooldescendants--condition1": "verbose=true",
+	"getmempooldescendants--result0":    "Array of transaction hashes of the in-mempool descendants",
+
+	// GetMempoolEntryCmd help.
+	"getmempoolentry--synopsis": "Returns mempool data for a transaction in the memory pool.",
+	"getmempoolentry-txid":      "The hash of the transaction",
+
+	// GetMempoolEntryResult help.
+	"getmempoolentryresult-size":               "Transaction size in bytes",
+	"getmempoolentryresult-vsize":              "The virtual size of the transaction",
+	"getmempoolentryresult-weight":             "The transaction's weight (between vsize*4-3 and vsize*4)",
+	"getmempoolentryresult-fee":                "Transaction fee in bitcoins (deprecated, use fees.base)",
+	"getmempoolentryresult-modifiedfee":        "Transaction fee with fee deltas used for mining priority in bitcoins (deprecated, use fees.modified)",
+	"getmempoolentryresult-time":               "Local time transaction entered pool in seconds since 1 Jan 1970 GMT",
+	"getmempoolentryresult-height":             "Block height when transaction entered the pool",
+	"getmempoolentryresult-startingpriority":   "Priority when transaction entered the pool",
+	"getmempoolentryresult-currentpriority":    "Current priority",
+	"getmempoolentryresult-descendantcount":    "Number of in-mempool descendant transactions (including this one)",
+	"getmempoolentryresult-descendantsize":     "Virtual size of in-mempool descendants (including this one)",
+	"getmempoolentryresult-descendantfees":     "Modified fees of in-mempool descendants (including this one) in satoshis",
+	"getmempoolentryresult-ancestorcount":      "Number of in-mempool ancestor transactions (including this one)",
+	"getmempoolentryresult-ancestorsize":       "Virtual size of in-mempool ancestors (including this one)",
+	"getmempoolentryresult-ancestorfees":       "Modified fees of in-mempool ancestors (including this one) in satoshis",
+	"getmempoolentryresult-fees":               "The fees of the transaction in bitcoins",
+	"getmempoolentryresult-depends":            "Unconfirmed transactions used as inputs for this transaction",
+	"getmempoolentryresult-spentby":            "Unconfirmed transactions spending outputs from this transaction",
+	"getmempoolentryresult-bip125-replaceable": "Whether this transaction signals BIP0125 replaceability",
+
+	// MempoolFees help.
+	"mempoolfees-base":       "Transaction fee in bitcoins",
+	"mempoolfees-modified":   "Transaction fee with fee deltas used for mining priority in bitcoins",
+	"mempoolfees-ancestor":   "Modified fees of in-mempool ancestors (including this one) in bitcoins",
+	"mempoolfees-descendant": "Modified fees of in-mempool descendants (including this one) in bitcoins",
+
 	// GetMempoolInfoCmd help.
 	"getmempoolinfo--synopsis": "Returns memory pool information",
 
@@ -437,13 +515,56 @@ var helpDescsEnUS = map[string]string{
 	"getnetworkhashps-height":    "Perform estimate ending with this height or -1 for current best chain block height",
 	"getnetworkhashps--result0":  "Estimated hashes per second",
 
+	// GetNetworkInfoCmd help.
+	"getnetworkinfo--synopsis": "Returns a JSON object containing network-related information.",
+
+	// GetNetworkInfoResult help.
+	"getnetworkinforesult-version":         "The version of the server",
+	"getnetworkinforesult-subversion":      "The user agent the server advertises to its peers",
+	"getnetworkinforesult-protocolversion": "The latest supported protocol version",
+	"getnetworkinforesult-localservices":   "The services the server advertises to its peers, as a hex string",
+	"getnetworkinforesult-localrelay":      "Whether or not the server relays transactions",
+	"getnetworkinforesult-timeoffset":      "The time offset",
+	"getnetworkinforesult-connections":     "The number of connected peers",
+	"getnetworkinforesult-connections_in":  "The number of inbound peers",
+	"getnetworkinforesult-connections_out": "The number of outbound peers",
+	"getnetworkinforesult-networkactive":   "Whether or not networking is enabled",
+	"getnetworkinforesult-networks":        "Information about each network",
+	"getnetworkinforesult-relayfee":        "The minimum relay fee for non-free transactions in BTC/KB",
+	"getnetworkinforesult-incrementalfee":  "The minimum fee rate increase for transaction replacement in BTC/KB",
+	"getnetworkinforesult-localaddresses":  "The local addresses the server knows about",
+	"getnetworkinforesult-warnings":        "Any current network and blockchain warnings",
+
+	// NetworksResult help.
+	"networksresult-name":                        "The network name (ipv4, ipv6, onion, i2p or cjdns)",
+	"networksresult-limited":                     "Whether or not automatic outbound connections to the network are disabled by --onlynet",
+	"networksresult-reachable":                   "Whether or not the network is reachable",
+	"networksresult-proxy":                       "The proxy used for the network, if any",
+	"networksresult-proxy_randomize_credentials": "Whether or not random proxy credentials are used for each connection",
+
+	// LocalAddressesResult help.
+	"localaddressesresult-address": "The local address",
+	"localaddressesresult-port":    "The local port",
+	"localaddressesresult-score":   "The priority the address is advertised with",
+
 	// GetNetTotalsCmd help.
 	"getnettotals--synopsis": "Returns a JSON object containing network traffic statistics.",
 
 	// GetNetTotalsResult help.
-	"getnettotalsresult-totalbytesrecv": "Total bytes received",
-	"getnettotalsresult-totalbytessent": "Total bytes sent",
-	"getnettotalsresult-timemillis":     "Number of milliseconds since 1 Jan 1970 GMT",
+	"getnettotalsresult-totalbytesrecv":       "Total bytes received",
+	"getnettotalsresult-totalbytessent":       "Total bytes sent",
+	"getnettotalsresult-timemillis":           "Number of milliseconds since 1 Jan 1970 GMT",
+	"getnettotalsresult-inboundiprejected":    "Number of inbound peers rejected by the per-IP inbound limit",
+	"getnettotalsresult-inboundgrouprejected": "Number of inbound peers rejected by the per-network group inbound limit",
+	"getnettotalsresult-uploadtarget":         "The state of the upload target",
+
+	// UploadTarget help.
+	"uploadtarget-timeframe":               "Length of the measuring timeframe in seconds",
+	"uploadtarget-target":                  "Target in bytes, 0 when the upload target is disabled",
+	"uploadtarget-target_reached":          "Whether the target has been reached",
+	"uploadtarget-serve_historical_blocks": "Whether historical blocks are still served",
+	"uploadtarget-bytes_left_in_cycle":     "Bytes left in the current cycle",
+	"uploadtarget-time_left_in_cycle":      "Seconds left in the current cycle",
 
 	// GetPeerInfoResult help.
 	"getpeerinforesult-id":             "A unique node ID",
@@ -467,6 +588,8 @@ var helpDescsEnUS = map[string]string{
 	"getpeerinforesult-banscore":       "The ban score",
 	"getpeerinforesult-feefilter":      "The requested minimum fee a transaction must have to be announced to the peer",
 	"getpeerinforesult-syncnode":       "Whether or not the peer is the sync peer",
+	"getpeerinforesult-mapped_as":      "The autonomous system number of the peer according to the asmap in use (omitted when unknown)",
+	"getpeerinforesult-permissions":    "The permissions granted to the peer by the whitelist and whitebind options",
 
 	// GetPeerInfoCmd help.
 	"getpeerinfo--synopsis": "Returns data about each connected network peer as an array of json objects.",
@@ -474,6 +597,7 @@ var helpDescsEnUS = map[string]string{
 	// GetRawMempoolVerboseResult help.
 	"getrawmempoolverboseresult-size":             "Transaction size in bytes",
 	"getrawmempoolverboseresult-fee":              "Transaction fee in bitcoins",
+	"getrawmempoolverboseresult-modifiedfee":      "Transaction fee with the fee delta set by prioritisetransaction in bitcoins",
 	"getrawmempoolverboseresult-time":             "Local time transaction entered pool in seconds since 1 Jan 1970 GMT",
 	"getrawmempoolverboseresult-height":           "Block height when transaction entered the pool",
 	"getrawmempoolverboseresult-startingpriority": "Priority when transaction entered the pool",
@@ -519,10 +643,33 @@ var helpDescsEnUS = map[string]string{
 	"help--result0":    "List of commands",
 	"help--result1":    "Help for specified command",
 
+	// InvalidateBlockCmd help.
+	"invalidateblock--synopsis": "Permanently marks a block as invalid, as if it violated a consensus rule.\n" +
+		"The block and its descendants are disconnected when they are part of the main chain and the chain is reorganized to the best valid chain.",
+	"invalidateblock-blockhash": "The hash of the block to mark as invalid",
+
 	// PingCmd help.
 	"ping--synopsis": "Queues a ping to be sent to each connected peer.\n" +
 		"Ping times are provided by getpeerinfo via the pingtime and pingwait fields.",
 
+	// PreciousBlockCmd help.
+	"preciousblock--synopsis": "Treats a block as if it were received before others with the same work.\n" +
+		"The chain is reorganized to the block when it has as much work as the current tip.",
+	"preciousblock-blockhash": "The hash of the block to mark as precious",
+
+	// PrioritiseTransactionCmd help.
+	"prioritisetransaction--synopsis": "Adjusts the fee a transaction is considered to pay when selecting transactions for new blocks and deciding on replacements.\n" +
+		"The fee delta is kept until the transaction is included in a block and survives restarts.",
+	"prioritisetransaction-txid":          "The hash of the transaction, which does not need to be in the memory pool",
+	"prioritisetransaction-prioritydelta": "Unused, must be 0",
+	"prioritisetransaction-feedelta":      "The fee in satoshis to add to (or subtract from, if negative) the fee of the transaction",
+	"prioritisetransaction--result0":      "Always true",
+
+	// ReconsiderBlockCmd help.
+	"reconsiderblock--synopsis": "Removes invalidity status of a block, its ancestors and its descendants, reconsidering them for activation.\n" +
+		"This can be used to undo the effects of invalidateblock.",
+	"reconsiderblock-blockhash": "The hash of the block to reconsider",
+
 	// SearchRawTransactionsCmd help.
 	"searchrawtransactions--synopsis": "Returns raw data for transactions involving the passed address.\n" +
 		"Returned transactions are pulled from both the database, and transactions currently in the mempool.\n" +
@@ -566,6 +713,23 @@ var helpDescsEnUS = map[string]string{
 	"submitblock--condition1": "Block rejected",
 	"submitblock--result1":    "The reason the block was rejected",
 
+	// TestMempoolAcceptCmd help.
+	"testmempoolaccept--synopsis":  "Returns whether serialized, hex-encoded transactions would be accepted into the memory pool without adding or relaying them.",
+	"testmempoolaccept-rawtxns":    "Serialized, hex-encoded transactions, which are checked independently of each other",
+	"testmempoolaccept-maxfeerate": "Reject transactions with a fee rate higher than this value in BTC/kvB (0 to disable)",
+
+	// TestMempoolAcceptResult help.
+	"testmempoolacceptresult-txid":           "The hash of the transaction",
+	"testmempoolacceptresult-wtxid":          "The witness hash of the transaction",
+	"testmempoolacceptresult-allowed":        "Whether the transaction would be accepted into the memory pool",
+	"testmempoolacceptresult-vsize":          "The virtual size of the transaction (only when allowed is true)",
+	"testmempoolacceptresult-fees":           "The fees of the transaction (only when allowed is true)",
+	"testmempoolacceptresult-reject-reason":  "A short token for the reason the transaction would be rejected (only when allowed is false)",
+	"testmempoolacceptresult-reject-details": "A detailed description of why the transaction would be rejected (only when available)",
+
+	// TestMempoolAcceptFees help.
+	"testmempoolacceptfees-base": "Transaction fee in bitcoins",
+
 	// ValidateAddressResult help.
 	"validateaddresschainresult-isvalid": "Whether or not the address is valid",
 	"validateaddresschainresult-address": "The bitcoin address (only when isvalid is true)",
@@ -680,6 +844,7 @@ var helpDescsEnUS = map[string]string{
 // pointer to the type (or nil to indicate no return value).
 var rpcResultTypes = map[string][]interface{}{
 	"addnode":               nil,
+	"clearbanned":           nil,
 	"createrawtransaction":  {(*string)(nil)},
 	"debuglevel":            {(*string)(nil), (*string)(nil)},
 	"decoderawtransaction":  {(*btcjson.TxRawDecodeResult)(nil)},
@@ -697,6 +862,7 @@ var rpcResultTypes = map[string][]interface{}{
 	"getblockchaininfo":     {(*btcjson.GetBlockChainInfoResult)(nil)},
 	"getcfilter":            {(*string)(nil)},
 	"getcfilterheader":      {(*string)(nil)},
+	"getchaintips":          {(*[]btcjson.GetChainTipsResult)(nil)},
 	"getconnectioncount":    {(*int32)(nil)},
 	"getcurrentnet":         {(*uint32)(nil)},
 	"getdifficulty":         {(*float64)(nil)},
@@ -704,22 +870,33 @@ var rpcResultTypes = map[string][]interface{}{
 	"gethashespersec":       {(*float64)(nil)},
 	"getheaders":            {(*[]string)(nil)},
 	"getinfo":               {(*btcjson.InfoChainResult)(nil)},
+	"getmempoolancestors":   {(*[]string)(nil), (*btcjson.GetMempoolEntryResult)(nil)},
+	"getmempooldescendants": {(*[]string)(nil), (*btcjson.GetMempoolEntryResult)(nil)},
+	"getmempoolentry":       {(*btcjson.GetMempoolEntryResult)(nil)},
 	"getmempoolinfo":        {(*btcjson.GetMempoolInfoResult)(nil)},
 	"getmininginfo":         {(*btcjson.GetMiningInfoResult)(nil)},
 	"getnettotals":          {(*btcjson.GetNetTotalsResult)(nil)},
 	"getnetworkhashps":      {(*int64)(nil)},
+	"getnetworkinfo":        {(*btcjson.GetNetworkInfoResult)(nil)},
 	"getpeerinfo":           {(*[]btcjson.GetPeerInfoResult)(nil)},
 	"getrawmempool":         {(*[]string)(nil), (*btcjson.GetRawMempoolVerboseResult)(nil)},
 	"getrawtransaction":     {(*string)(nil), (*btcjson.TxRawResult)(nil)},
 	"gettxout":              {(*btcjson.GetTxOutResult)(nil)},
 	"node":                  nil,
 	"help":                  {(*string)(nil), (*string)(nil)},
+	"invalidateblock":       nil,
+	"listbanned":            {(*[]btcjson.ListBannedResult)(nil)},
 	"ping":                  nil,
+	"preciousblock":         nil,
+	"prioritisetransaction": {(*bool)(nil)},
+	"reconsiderblock":       nil,
 	"searchrawtransactions": {(*string)(nil), (*[]btcjson.SearchRawTransactionsResult)(nil)},
 	"sendrawtransaction":    {(*string)(nil)},
+	"setban":                nil,
 	"setgenerate":           nil,
 	"stop":                  {(*string)(nil)},
 	"submitblock":           {nil, (*string)(nil)},
+	"testmempoolaccept":     {(*[]btcjson.TestMempoolAcceptResult)(nil)},
 	"uptime":                {(*int64)(nil)},
 	"validateaddress":       {(*btcjson.ValidateAddressChainResult)(nil)},
 	"verifychain":           {(*bool)(nil)},
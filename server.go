@@ -13,7 +13,9 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"math/big"
 	"net"
+	"path/filepath"
 	"runtime"
 	"sort"
 	"strconv"
@@ -57,6 +59,72 @@ const (
 	// retries when connecting to persistent peers.  It is adjusted by the
 	// number of retries such that there is a retry backoff.
 	connectionRetryInterval = time.Second * 5
+
+	// banListFilename is the name of the file in the data directory used
+	// to persist banned addresses and subnets.
+	banListFilename = "banlist.json"
+
+	// anchorsFilename is the name of the file in the data directory used
+	// to persist the block-relay-only peers across restarts.
+	anchorsFilename = "anchors.json"
+
+	// feeDeltasFilename is the name of the file in the data directory used
+	// to persist the fee deltas set with the prioritisetransaction RPC.
+	feeDeltasFilename = "feedeltas.json"
+
+	// extraPeerCheckInterval is the interval at which outbound peers are
+	// checked for eviction and an extra outbound peer is tried when the
+	// tip is stale.
+	extraPeerCheckInterval = 45 * time.Second
+
+	// chainSyncTimeout is the time after which an outbound peer whose best
+	// known chain has less work than our tip is probed for headers.
+	chainSyncTimeout = 20 * time.Minute
+
+	// headersResponseTime is the time an outbound peer which was probed for
+	// headers has to reply with a chain which has as much work as our tip
+	// before it is evicted.
+	headersResponseTime = 2 * time.Minute
+
+	// maxProtectedOutbound is the maximum number of outbound peers which
+	// are protected from eviction because their best known chain had as
+	// much work as our tip.
+	maxProtectedOutbound = 4
+
+	// extraPeerRequestTimeout is the time after which a request for an
+	// extra outbound peer which did not lead to a new outbound peer is no
+	// longer considered pending.
+	extraPeerRequestTimeout = 5 * time.Minute
+
+	// minOutboundConnectTime is the minimum time an extra outbound peer
+	// is connected before it is considered for eviction.
+	minOutboundConnectTime = 30 * time.Second
+
+	// uploadTargetCycle is the duration of the cycle the upload target
+	// applies to.
+	uploadTargetCycle = 24 * time.Hour
+
+	// historicalBlockAge is the age relative to the tip after which blocks
+	// are considered historical and are no longer served once the upload
+	// target is reached.
+	historicalBlockAge = 7 * 24 * time.Hour
+
+	// portMappingLifetime is the lifetime requested for the mapping of the
+	// listening port on the NAT gateway.  The mapping is renewed at half of
+	// its lifetime.
+	portMappingLifetime = 20 * time.Minute
+
+	// portMappingRetryInterval is the time to wait before retrying a port
+	// mapping which failed.
+	portMappingRetryInterval = 5 * time.Minute
+
+	// v1FallbackExpiry is the time after which the v2 transport is tried
+	// again for an address which fell back to the v1 transport.
+	v1FallbackExpiry = 24 * time.Hour
+
+	// maxV1Fallbacks is the maximum number of addresses which are
+	// remembered to fall back to the v1 transport.
+	maxV1Fallbacks = 1000
 )
 
 var (
@@ -151,13 +219,19 @@ type updatePeerHeightsMsg struct {
 }
 
 // peerState maintains state of inbound, persistent, outbound peers as well
-// as banned peers and outbound groups.
+// as outbound groups and the IP addresses and groups of inbound peers.
 type peerState struct {
 	inboundPeers    map[int32]*serverPeer
 	outboundPeers   map[int32]*serverPeer
 	persistentPeers map[int32]*serverPeer
-	banned          map[string]time.Time
 	outboundGroups  map[string]int
+	inboundIPs      map[string]int
+	inboundGroups   map[string]int
+
+	// extraPeerRequested is the time an extra outbound peer was last
+	// requested because the tip is stale.  It is reset once the extra peer
+	// connected or the tip is no longer stale.
+	extraPeerRequested time.Time
 }
 
 // Count returns the count of all known peers.
@@ -166,6 +240,51 @@ func (ps *peerState) Count() int {
 		len(ps.persistentPeers)
 }
 
+// fullRelayOutboundCount returns the number of outbound peers which were
+// connected automatically and relay both blocks and transactions.
+func (ps *peerState) fullRelayOutboundCount() int {
+	var n int
+	for _, sp := range ps.outboundPeers {
+		if !sp.blockRelayOnly {
+			n++
+		}
+	}
+	return n
+}
+
+// inboundLimitKeys returns the IP address and network group keys which are
+// used to limit the number of inbound connections from the passed peer.
+func inboundLimitKeys(sp *serverPeer) (string, string) {
+	host, _, err := net.SplitHostPort(sp.Addr())
+	if err != nil {
+		host = sp.Addr()
+	}
+	var group string
+	if na := sp.NA(); na != nil {
+		group = sp.server.addrManager.GroupKey(na)
+	}
+	return host, group
+}
+
+// updateInboundCounts adjusts the number of inbound peers tracked for the IP
+// address and network group of the passed peer by delta.  Peers with the noban
+// permission and peers which connected through the onion service are exempt
+// from the inbound limits and are therefore not tracked.
+func (ps *peerState) updateInboundCounts(sp *serverPeer, delta int) {
+	if sp.hasPermission(permNoBan) || sp.onionService {
+		return
+	}
+	ip, group := inboundLimitKeys(sp)
+	ps.inboundIPs[ip] += delta
+	if ps.inboundIPs[ip] <= 0 {
+		delete(ps.inboundIPs, ip)
+	}
+	ps.inboundGroups[group] += delta
+	if ps.inboundGroups[group] <= 0 {
+		delete(ps.inboundGroups, group)
+	}
+}
+
 // forAllOutboundPeers is a helper function that runs closure on all outbound
 // peers known to peerState.
 func (ps *peerState) forAllOutboundPeers(closure func(sp *serverPeer)) {
@@ -198,16 +317,20 @@ type cfHeaderKV struct {
 type server struct {
 	// The following variables must only be used atomically.
 	// Putting the uint64s first makes them 64-bit aligned for 32-bit systems.
-	bytesReceived uint64 // Total bytes received from all peers since start.
-	bytesSent     uint64 // Total bytes sent by all peers since start.
-	started       int32
-	shutdown      int32
-	shutdownSched int32
-	startupTime   int64
+	bytesReceived       uint64 // Total bytes received from all peers since start.
+	bytesSent           uint64 // Total bytes sent by all peers since start.
+	inboundIPRejects    uint64 // Inbound peers rejected by the per-IP limit.
+	inboundGroupRejects uint64 // Inbound peers rejected by the per-group limit.
+	started             int32
+	shutdown            int32
+	shutdownSched       int32
+	startupTime         int64
 
 	chainParams          *chaincfg.Params
 	addrManager          *addrmgr.AddrManager
 	connManager          *connmgr.ConnManager
+	blockRelayConnMgr    *connmgr.ConnManager
+	banList              *connmgr.BanList
 	sigCache             *txscript.SigCache
 	hashCache            *txscript.HashCache
 	rpcServer            *rpcServer
@@ -215,6 +338,7 @@ type server struct {
 	chain                *blockchain.BlockChain
 	txMemPool            *mempool.TxPool
 	cpuMiner             *cpuminer.CPUMiner
+	dnsSeeder            *dnsSeeder
 	modifyRebroadcastInv chan interface{}
 	newPeers             chan *serverPeer
 	donePeers            chan *serverPeer
@@ -226,9 +350,19 @@ type server struct {
 	wg                   sync.WaitGroup
 	quit                 chan struct{}
 	nat                  NAT
+	natPort              int
+	onionListener        net.Listener
 	db                   database.DB
 	timeSource           blockchain.MedianTimeSource
 	services             wire.ServiceFlag
+	targetOutbound       int
+	maxUploadTarget      uint64
+
+	// The following fields track the bytes sent to peers in the current
+	// cycle of the upload target.  They are protected by uploadMtx.
+	uploadMtx        sync.Mutex
+	uploadCycleStart time.Time
+	uploadCycleBytes uint64
 
 	// The following fields are used for optional indexes.  They will be nil
 	// if the associated index is not enabled.  These fields are set during
@@ -254,13 +388,101 @@ type server struct {
 	// agentWhitelist is a list of whitelisted user agent substrings, no
 	// whitelisting will be applied if the list is empty or nil.
 	agentWhitelist []string
+
+	// netGroupKey is a random secret used to derive the keyed network
+	// groups of inbound peers when selecting a peer to evict.
+	netGroupKey [32]byte
+
+	// anchors houses the addresses of the block-relay-only peers that were
+	// connected when the server was last shut down.  They are tried before
+	// any other addresses for block-relay-only connections.
+	anchorsMtx sync.Mutex
+	anchors    []string
+
+	// v1Fallback houses the addresses of outbound peers which closed the
+	// connection in response to the BIP0324 v2 handshake along with the
+	// time the fallback expires.  Later connections to them use the v1
+	// transport until then.
+	v1FallbackMtx sync.Mutex
+	v1Fallback    map[string]time.Time
+}
+
+// chainSyncAction describes the action to take for an outbound peer whose best
+// known chain is checked against our tip.
+type chainSyncAction int
+
+const (
+	// chainSyncNone indicates that nothing needs to be done.
+	chainSyncNone chainSyncAction = iota
+
+	// chainSyncProbe indicates that the peer is to be probed for headers
+	// which build on the parent of the work header.
+	chainSyncProbe
+
+	// chainSyncEvict indicates that the peer is to be evicted.
+	chainSyncEvict
+)
+
+// chainSyncState houses the state used to evict outbound peers whose best
+// known chain has less work than our tip for too long.
+type chainSyncState struct {
+	// timeout is the time by which the best known chain of the peer must
+	// have as much work as the work header.
+	timeout time.Time
+
+	// workHeader is our tip when the timeout was set and work is its
+	// chain work.
+	workHeader chainhash.Hash
+	work       *big.Int
+
+	// sentGetHeaders is whether the peer was probed for headers after the
+	// timeout passed.
+	sentGetHeaders bool
+
+	// protect is whether the peer is protected from eviction because its
+	// best known chain had as much work as our tip.
+	protect bool
+}
+
+// update checks the passed chain work of the best block the peer is known to
+// have, which is nil when it is unknown, against our tip with the passed hash
+// and chain work and returns the action to take.  Peers are given
+// chainSyncTimeout to catch up with our tip, and then headersResponseTime to
+// reply to a probe for headers before they are evicted.  Peers which caught up
+// with the tip of a previous check are given another chainSyncTimeout.
+func (cs *chainSyncState) update(peerWork *big.Int, tip *chainhash.Hash,
+	tipWork *big.Int, now time.Time) chainSyncAction {
+
+	switch {
+	case peerWork != nil && peerWork.Cmp(tipWork) >= 0:
+		*cs = chainSyncState{protect: cs.protect}
+
+	case cs.timeout.IsZero() || (peerWork != nil && cs.work != nil &&
+		peerWork.Cmp(cs.work) >= 0):
+
+		cs.timeout = now.Add(chainSyncTimeout)
+		cs.workHeader = *tip
+		cs.work = tipWork
+		cs.sentGetHeaders = false
+
+	case now.After(cs.timeout):
+		if cs.sentGetHeaders {
+			return chainSyncEvict
+		}
+		cs.sentGetHeaders = true
+		cs.timeout = now.Add(headersResponseTime)
+		return chainSyncProbe
+	}
+	return chainSyncNone
 }
 
 // serverPeer extends the peer to maintain state shared by the server and
 // the blockmanager.
 type serverPeer struct {
 	// The following variables must only be used atomically
-	feeFilter int64
+	feeFilter     int64
+	lastTxTime    int64 // Unix nanoseconds of the last novel tx relayed.
+	lastBlockTime int64 // Unix nanoseconds of the last novel block relayed.
 
 	*peer.Peer
 
@@ -271,11 +493,23 @@ type serverPeer struct {
 	relayMtx       sync.Mutex
 	disableRelayTx bool
 	sentAddrs      bool
-	isWhitelisted  bool
+	permissions    netPermissions
+	onionService   bool
+	blockRelayOnly bool
+	v2Transport    bool
+	chainSync      chainSyncState
 	filter         *bloom.Filter
 	knownAddresses map[string]struct{}
 	banScore       connmgr.DynamicBanScore
 	quit           chan struct{}
+
+	// bestKnownWork is the chain work of the best block the peer is known
+	// to have and lastUnknownBlock is the latest block it announced whose
+	// header is not known yet.
+	bestKnownMtx     sync.Mutex
+	bestKnownWork    *big.Int
+	lastUnknownBlock *chainhash.Hash
+
 	// The following chans are used to sync blockmanager and server.
 	txProcessed    chan struct{}
 	blockProcessed chan struct{}
@@ -295,6 +529,38 @@ func newServerPeer(s *server, isPersistent bool) *serverPeer {
 	}
 }
 
+// hasPermission returns whether the peer has been granted all of the passed
+// permissions.
+func (sp *serverPeer) hasPermission(perm netPermissions) bool {
+	return sp.permissions.Has(perm)
+}
+
+// updateBlockAvailability records that the peer has the block with the passed
+// hash.  The chain work of the block is looked up once its header is known.
+func (sp *serverPeer) updateBlockAvailability(hash *chainhash.Hash) {
+	sp.bestKnownMtx.Lock()
+	sp.lastUnknownBlock = hash
+	sp.bestKnownMtx.Unlock()
+}
+
+// peerBestKnownWork returns the chain work of the best block the peer is known
+// to have, or nil when none of the blocks it announced are known.
+func (sp *serverPeer) peerBestKnownWork() *big.Int {
+	sp.bestKnownMtx.Lock()
+	defer sp.bestKnownMtx.Unlock()
+
+	if sp.lastUnknownBlock != nil {
+		_, work, err := sp.server.chain.HeaderChainWork(sp.lastUnknownBlock)
+		if err == nil {
+			if sp.bestKnownWork == nil || work.Cmp(sp.bestKnownWork) > 0 {
+				sp.bestKnownWork = work
+			}
+			sp.lastUnknownBlock = nil
+		}
+	}
+	return sp.bestKnownWork
+}
+
 // newestBlock returns the current best block hash and height using the format
 // required by the configuration for the peer package.
 func (sp *serverPeer) newestBlock() (*chainhash.Hash, int32, error) {
@@ -304,14 +570,14 @@ func (sp *serverPeer) newestBlock() (*chainhash.Hash, int32, error) {
 
 // addKnownAddresses adds the given addresses to the set of known addresses to
 // the peer to prevent sending duplicate addresses.
-func (sp *serverPeer) addKnownAddresses(addresses []*wire.NetAddress) {
+func (sp *serverPeer) addKnownAddresses(addresses []*wire.NetAddressV2) {
 	for _, na := range addresses {
 		sp.knownAddresses[addrmgr.NetAddressKey(na)] = struct{}{}
 	}
 }
 
 // addressKnown true if the given address is already known to the peer.
-func (sp *serverPeer) addressKnown(na *wire.NetAddress) bool {
+func (sp *serverPeer) addressKnown(na *wire.NetAddressV2) bool {
 	_, exists := sp.knownAddresses[addrmgr.NetAddressKey(na)]
 	return exists
 }
@@ -325,33 +591,57 @@ func (sp *serverPeer) setDisableRelayTx(disable bool) {
 }
 
 // relayTxDisabled returns whether or not relaying of transactions for the given
-// peer is disabled.
+// peer is disabled.  Transactions are never relayed to block-relay-only peers.
 // It is safe for concurrent access.
 func (sp *serverPeer) relayTxDisabled() bool {
 	sp.relayMtx.Lock()
-	isDisabled := sp.disableRelayTx
+	isDisabled := sp.disableRelayTx || sp.blockRelayOnly
 	sp.relayMtx.Unlock()
 
 	return isDisabled
 }
 
-// pushAddrMsg sends an addr message to the connected peer using the provided
-// addresses.
-func (sp *serverPeer) pushAddrMsg(addresses []*wire.NetAddress) {
+// pushAddrMsg sends an addrv2 message to the connected peer using the provided
+// addresses when the peer signaled support for them, or an addr message with
+// the addresses which can be represented as legacy addresses otherwise.
+func (sp *serverPeer) pushAddrMsg(addresses []*wire.NetAddressV2) {
 	// Filter addresses already known to the peer.
-	addrs := make([]*wire.NetAddress, 0, len(addresses))
+	addrs := make([]*wire.NetAddressV2, 0, len(addresses))
 	for _, addr := range addresses {
 		if !sp.addressKnown(addr) {
 			addrs = append(addrs, addr)
 		}
 	}
-	known, err := sp.PushAddrMsg(addrs)
+
+	if sp.WantsAddrV2() {
+		known, err := sp.PushAddrV2Msg(addrs)
+		if err != nil {
+			peerLog.Errorf("Can't push address message to %s: %v",
+				sp.Peer, err)
+			sp.Disconnect()
+			return
+		}
+		sp.addKnownAddresses(known)
+		return
+	}
+
+	legacyAddrs := make([]*wire.NetAddress, 0, len(addrs))
+	for _, addr := range addrs {
+		if legacy := addr.ToLegacy(); legacy != nil {
+			legacyAddrs = append(legacyAddrs, legacy)
+		}
+	}
+	known, err := sp.PushAddrMsg(legacyAddrs)
 	if err != nil {
 		peerLog.Errorf("Can't push address message to %s: %v", sp.Peer, err)
 		sp.Disconnect()
 		return
 	}
-	sp.addKnownAddresses(known)
+	for _, na := range known {
+		sp.addKnownAddresses([]*wire.NetAddressV2{
+			wire.NetAddressV2FromLegacy(na),
+		})
+	}
 }
 
 // addBanScore increases the persistent and decaying ban score fields by the
@@ -364,8 +654,8 @@ func (sp *serverPeer) addBanScore(persistent, transient uint32, reason string) {
 	if cfg.DisableBanning {
 		return
 	}
-	if sp.isWhitelisted {
-		peerLog.Debugf("Misbehaving whitelisted peer %s: %s", sp, reason)
+	if sp.hasPermission(permNoBan) {
+		peerLog.Debugf("Misbehaving noban peer %s: %s", sp, reason)
 		return
 	}
 
@@ -385,6 +675,16 @@ func (sp *serverPeer) addBanScore(persistent, transient uint32, reason string) {
 		peerLog.Warnf("Misbehaving peer %s: %s -- ban score increased to %d",
 			sp, reason, score)
 		if score > cfg.BanThreshold {
+			// Peers which connected through the onion service all
+			// share the loopback address of the Tor daemon, so
+			// banning it would lock out every onion service peer.
+			// They are only disconnected instead.
+			if sp.onionService {
+				peerLog.Warnf("Misbehaving onion service peer %s "+
+					"-- disconnecting", sp)
+				sp.Disconnect()
+				return
+			}
 			peerLog.Warnf("Misbehaving peer %s -- banning and disconnecting",
 				sp)
 			sp.server.BanPeer(sp)
@@ -481,8 +781,10 @@ func (sp *serverPeer) OnVerAck(_ *peer.Peer, _ *wire.MsgVerAck) {
 // bloom filter loaded, the contents are filtered accordingly.
 func (sp *serverPeer) OnMemPool(_ *peer.Peer, msg *wire.MsgMemPool) {
 	// Only allow mempool requests if the server has bloom filtering
-	// enabled.
-	if sp.server.services&wire.SFNodeBloom != wire.SFNodeBloom {
+	// enabled or the peer has the mempool permission.
+	if sp.server.services&wire.SFNodeBloom != wire.SFNodeBloom &&
+		!sp.hasPermission(permMempool) {
+
 		peerLog.Debugf("peer %v sent mempool request with bloom "+
 			"filtering disabled -- disconnecting", sp)
 		sp.Disconnect()
@@ -528,12 +830,21 @@ func (sp *serverPeer) OnMemPool(_ *peer.Peer, msg *wire.MsgMemPool) {
 // handler this does not serialize all transactions through a single thread
 // transactions don't rely on the previous one in a linear fashion like blocks.
 func (sp *serverPeer) OnTx(_ *peer.Peer, msg *wire.MsgTx) {
-	if cfg.BlocksOnly {
+	if cfg.BlocksOnly && !sp.hasPermission(permRelay) {
 		peerLog.Tracef("Ignoring tx %v from %v - blocksonly enabled",
 			msg.TxHash(), sp)
 		return
 	}
 
+	// Block-relay-only peers were asked not to relay transactions, so
+	// sending one is a protocol violation.
+	if sp.blockRelayOnly {
+		peerLog.Debugf("Block-relay-only peer %v sent tx %v -- "+
+			"disconnecting", sp, msg.TxHash())
+		sp.Disconnect()
+		return
+	}
+
 	// Add the transaction to the known inventory for the peer.
 	// Convert the raw MsgTx to a btcutil.Tx which provides some convenience
 	// methods and things such as hash caching.
@@ -546,8 +857,25 @@ func (sp *serverPeer) OnTx(_ *peer.Peer, msg *wire.MsgTx) {
 	// processed and known good or bad.  This helps prevent a malicious peer
 	// from queuing up a bunch of bad transactions before disconnecting (or
 	// being disconnected) and wasting memory.
+	//
+	// Transactions which were not previously known and end up in the
+	// mempool are considered novel and help protect the peer from being
+	// evicted.
+	novel := !sp.server.txMemPool.HaveTransaction(tx.Hash())
 	sp.server.syncManager.QueueTx(tx, sp.Peer, sp.txProcessed)
 	<-sp.txProcessed
+	if novel && sp.server.txMemPool.HaveTransaction(tx.Hash()) {
+		atomic.StoreInt64(&sp.lastTxTime, time.Now().UnixNano())
+	}
+
+	// Transactions from peers with the forcerelay permission are relayed
+	// even when they were already in the memory pool.
+	if !novel && sp.hasPermission(permForceRelay) {
+		txD, err := sp.server.txMemPool.FetchTxDesc(tx.Hash())
+		if err == nil {
+			sp.server.relayTransactions([]*mempool.TxDesc{txD})
+		}
+	}
 }
 
 // OnBlock is invoked when a peer receives a block bitcoin message.  It
@@ -560,6 +888,7 @@ func (sp *serverPeer) OnBlock(_ *peer.Peer, msg *wire.MsgBlock, buf []byte) {
 	// Add the block to the known inventory for the peer.
 	iv := wire.NewInvVect(wire.InvTypeBlock, block.Hash())
 	sp.AddKnownInventory(iv)
+	sp.updateBlockAvailability(block.Hash())
 
 	// Queue the block up to be handled by the block
 	// manager and intentionally block further receives
@@ -572,8 +901,17 @@ func (sp *serverPeer) OnBlock(_ *peer.Peer, msg *wire.MsgBlock, buf []byte) {
 	// reference implementation processes blocks in the same
 	// thread and therefore blocks further messages until
 	// the bitcoin block has been fully processed.
+	//
+	// Blocks which were not previously known and are accepted are
+	// considered novel and help protect the peer from being evicted.
+	haveBefore, _ := sp.server.chain.HaveBlock(block.Hash())
 	sp.server.syncManager.QueueBlock(block, sp.Peer, sp.blockProcessed)
 	<-sp.blockProcessed
+	if !haveBefore {
+		if haveAfter, _ := sp.server.chain.HaveBlock(block.Hash()); haveAfter {
+			atomic.StoreInt64(&sp.lastBlockTime, time.Now().UnixNano())
+		}
+	}
 }
 
 // OnInv is invoked when a peer receives an inv bitcoin message and is
@@ -581,7 +919,16 @@ func (sp *serverPeer) OnBlock(_ *peer.Peer, msg *wire.MsgBlock, buf []byte) {
 // accordingly.  We pass the message down to blockmanager which will call
 // QueueMessage with any appropriate responses.
 func (sp *serverPeer) OnInv(_ *peer.Peer, msg *wire.MsgInv) {
-	if !cfg.BlocksOnly {
+	// Blocks are announced in the order they build on each other, so the
+	// last one announced is the best block the peer has.
+	for i := len(msg.InvList) - 1; i >= 0; i-- {
+		if msg.InvList[i].Type == wire.InvTypeBlock {
+			sp.updateBlockAvailability(&msg.InvList[i].Hash)
+			break
+		}
+	}
+
+	if !cfg.BlocksOnly && !sp.blockRelayOnly {
 		if len(msg.InvList) > 0 {
 			sp.server.syncManager.QueueInv(msg, sp.Peer)
 		}
@@ -616,6 +963,10 @@ func (sp *serverPeer) OnInv(_ *peer.Peer, msg *wire.MsgInv) {
 // OnHeaders is invoked when a peer receives a headers bitcoin
 // message.  The message is passed down to the sync manager.
 func (sp *serverPeer) OnHeaders(_ *peer.Peer, msg *wire.MsgHeaders) {
+	if len(msg.Headers) > 0 {
+		hash := msg.Headers[len(msg.Headers)-1].BlockHash()
+		sp.updateBlockAvailability(&hash)
+	}
 	sp.server.syncManager.QueueHeaders(msg, sp.Peer)
 }
 
@@ -643,6 +994,16 @@ func (sp *serverPeer) OnGetData(_ *peer.Peer, msg *wire.MsgGetData) {
 	doneChan := make(chan struct{}, 1)
 
 	for i, iv := range msg.InvList {
+		// Peers are disconnected when they request historical blocks
+		// which are refused, so they look for the blocks elsewhere.
+		if sp.refuseHistoricalBlock(iv) {
+			peerLog.Infof("Upload target reached, refusing to serve "+
+				"historical block %v to peer %s -- disconnecting",
+				iv.Hash, sp)
+			sp.Disconnect()
+			return
+		}
+
 		var c chan struct{}
 		// If this will be the last message we send.
 		if i == length-1 && len(notFound.InvList) == 0 {
@@ -1222,8 +1583,9 @@ func (sp *serverPeer) OnGetAddr(_ *peer.Peer, msg *wire.MsgGetAddr) {
 	}
 
 	// Only allow one getaddr request per connection to discourage
-	// address stamping of inv announcements.
-	if sp.sentAddrs {
+	// address stamping of inv announcements.  Peers with the addr
+	// permission are exempt.
+	if sp.sentAddrs && !sp.hasPermission(permAddr) {
 		peerLog.Debugf("Ignoring repeated getaddr request from peer ",
 			"%v", sp)
 		return
@@ -1240,6 +1602,27 @@ func (sp *serverPeer) OnGetAddr(_ *peer.Peer, msg *wire.MsgGetAddr) {
 // OnAddr is invoked when a peer receives an addr bitcoin message and is
 // used to notify the server about advertised addresses.
 func (sp *serverPeer) OnAddr(_ *peer.Peer, msg *wire.MsgAddr) {
+	// Ignore old style addresses which don't include a timestamp.
+	if sp.ProtocolVersion() < wire.NetAddressTimeVersion {
+		return
+	}
+
+	addrs := make([]*wire.NetAddressV2, 0, len(msg.AddrList))
+	for _, na := range msg.AddrList {
+		addrs = append(addrs, wire.NetAddressV2FromLegacy(na))
+	}
+	sp.handleAddrs(msg, addrs)
+}
+
+// OnAddrV2 is invoked when a peer receives an addrv2 bitcoin message and is
+// used to notify the server about advertised addresses.
+func (sp *serverPeer) OnAddrV2(_ *peer.Peer, msg *wire.MsgAddrV2) {
+	sp.handleAddrs(msg, msg.AddrList)
+}
+
+// handleAddrs adds the passed addresses advertised by the peer in the passed
+// addr or addrv2 message to the address manager.
+func (sp *serverPeer) handleAddrs(msg wire.Message, addrList []*wire.NetAddressV2) {
 	// Ignore addresses when running on the simulation test network.  This
 	// helps prevent the network from becoming another public test network
 	// since it will not be able to learn about other peers that have not
@@ -1248,20 +1631,29 @@ func (sp *serverPeer) OnAddr(_ *peer.Peer, msg *wire.MsgAddr) {
 		return
 	}
 
-	// Ignore old style addresses which don't include a timestamp.
-	if sp.ProtocolVersion() < wire.NetAddressTimeVersion {
+	// Addresses are not relayed with block-relay-only peers.
+	if sp.blockRelayOnly {
 		return
 	}
 
 	// A message that has no addresses is invalid.
-	if len(msg.AddrList) == 0 {
+	if len(addrList) == 0 {
 		peerLog.Errorf("Command [%s] from %s does not contain any addresses",
 			msg.Command(), sp.Peer)
 		sp.Disconnect()
 		return
 	}
 
-	for _, na := range msg.AddrList {
+	// Addresses on networks which are not known can't be validated, so
+	// they are neither stored nor relayed as recommended by BIP0155.
+	addrs := make([]*wire.NetAddressV2, 0, len(addrList))
+	for _, na := range addrList {
+		if na.NetworkID.IsKnown() {
+			addrs = append(addrs, na)
+		}
+	}
+
+	for _, na := range addrs {
 		// Don't add more address if we're disconnecting.
 		if !sp.Connected() {
 			return
@@ -1276,7 +1668,7 @@ func (sp *serverPeer) OnAddr(_ *peer.Peer, msg *wire.MsgAddr) {
 		}
 
 		// Add address to known addresses for this peer.
-		sp.addKnownAddresses([]*wire.NetAddress{na})
+		sp.addKnownAddresses([]*wire.NetAddressV2{na})
 	}
 
 	// Add addresses to server address manager.  The address manager handles
@@ -1284,7 +1676,7 @@ func (sp *serverPeer) OnAddr(_ *peer.Peer, msg *wire.MsgAddr) {
 	// addresses, and last seen updates.
 	// XXX bitcoind gives a 2 hour time penalty here, do we want to do the
 	// same?
-	sp.server.addrManager.AddAddresses(msg.AddrList, sp.NA())
+	sp.server.addrManager.AddAddresses(addrs, sp.NA())
 }
 
 // OnRead is invoked when a peer receives a message and it is used to update
@@ -1560,6 +1952,67 @@ func (s *server) handleUpdatePeerHeights(state *peerState, umsg updatePeerHeight
 	})
 }
 
+// keyedNetGroup returns the network group of the passed address keyed by the
+// secret network group key of the server so that remote peers are unable to
+// predict the ordering of the groups.
+func (s *server) keyedNetGroup(na *wire.NetAddressV2) uint64 {
+	var buf bytes.Buffer
+	buf.Write(s.netGroupKey[:])
+	buf.WriteString(s.addrManager.GroupKey(na))
+	hash := chainhash.HashB(buf.Bytes())
+	return binary.LittleEndian.Uint64(hash)
+}
+
+// evictInboundPeer selects an inbound peer to make room for a new inbound
+// connection using the same criteria as Bitcoin Core and disconnects it.  It
+// returns false when every inbound peer is protected from eviction.  It is
+// invoked from the peerHandler goroutine.
+func (s *server) evictInboundPeer(state *peerState) bool {
+	candidates := make([]connmgr.EvictionCandidate, 0,
+		len(state.inboundPeers))
+	for _, sp := range state.inboundPeers {
+		// Peers with the noban permission are never evicted.
+		if sp.hasPermission(permNoBan) || sp.NA() == nil {
+			continue
+		}
+
+		var lastTxTime, lastBlockTime time.Time
+		if t := atomic.LoadInt64(&sp.lastTxTime); t != 0 {
+			lastTxTime = time.Unix(0, t)
+		}
+		if t := atomic.LoadInt64(&sp.lastBlockTime); t != 0 {
+			lastBlockTime = time.Unix(0, t)
+		}
+		minPing := time.Duration(sp.MinPingMicros()) * time.Microsecond
+		relevant := hasServices(sp.Services(), wire.SFNodeNetwork)
+
+		candidates = append(candidates, connmgr.EvictionCandidate{
+			ID:               sp.ID(),
+			ConnTime:         sp.StatsSnapshot().ConnTime,
+			MinPingTime:      minPing,
+			LastBlockTime:    lastBlockTime,
+			LastTxTime:       lastTxTime,
+			RelevantServices: relevant,
+			RelayTxes:        !sp.relayTxDisabled(),
+			BloomFilter:      sp.filter.IsLoaded(),
+			KeyedNetGroup:    s.keyedNetGroup(sp.NA()),
+		})
+	}
+
+	id, ok := connmgr.SelectPeerToEvict(candidates)
+	if !ok {
+		return false
+	}
+
+	sp := state.inboundPeers[id]
+	srvrLog.Infof("Max peers reached [%d] - evicting inbound peer %s",
+		cfg.MaxPeers, sp)
+	state.updateInboundCounts(sp, -1)
+	delete(state.inboundPeers, id)
+	sp.Disconnect()
+	return true
+}
+
 // handleAddPeerMsg deals with adding new peers.  It is invoked from the
 // peerHandler goroutine.
 func (s *server) handleAddPeerMsg(state *peerState, sp *serverPeer) bool {
@@ -1587,22 +2040,48 @@ func (s *server) handleAddPeerMsg(state *peerState, sp *serverPeer) bool {
 		sp.Disconnect()
 		return false
 	}
-	if banEnd, ok := state.banned[host]; ok {
-		if time.Now().Before(banEnd) {
+	if ip := net.ParseIP(host); ip != nil {
+		if banned, banEnd := s.banList.IsBanned(ip); banned {
 			srvrLog.Debugf("Peer %s is banned for another %v - disconnecting",
 				host, time.Until(banEnd))
 			sp.Disconnect()
 			return false
 		}
+	}
+
+	// Limit the number of inbound peers from a single IP address and
+	// network group so a single host is unable to occupy many of the
+	// inbound slots.  Peers with the noban permission are exempt, as are
+	// peers which connected through the onion service since Tor forwards
+	// all of them from the loopback address.
+	if sp.Inbound() && !sp.hasPermission(permNoBan) && !sp.onionService {
+		ip, group := inboundLimitKeys(sp)
+		if cfg.MaxInboundPerIP > 0 &&
+			state.inboundIPs[ip] >= cfg.MaxInboundPerIP {
+
+			srvrLog.Infof("Max inbound peers from %s reached [%d] - "+
+				"disconnecting peer %s", ip, cfg.MaxInboundPerIP, sp)
+			atomic.AddUint64(&s.inboundIPRejects, 1)
+			sp.Disconnect()
+			return false
+		}
+		if cfg.MaxInboundPerGroup > 0 &&
+			state.inboundGroups[group] >= cfg.MaxInboundPerGroup {
 
-		srvrLog.Infof("Peer %s is no longer banned", host)
-		delete(state.banned, host)
+			srvrLog.Infof("Max inbound peers from group %s reached "+
+				"[%d] - disconnecting peer %s", group,
+				cfg.MaxInboundPerGroup, sp)
+			atomic.AddUint64(&s.inboundGroupRejects, 1)
+			sp.Disconnect()
+			return false
+		}
 	}
 
-	// TODO: Check for max peers from a single IP.
+	// Limit max number of total peers.  New inbound peers may take the
+	// place of an existing inbound peer which is selected for eviction.
+	if state.Count() >= cfg.MaxPeers &&
+		(!sp.Inbound() || !s.evictInboundPeer(state)) {
 
-	// Limit max number of total peers.
-	if state.Count() >= cfg.MaxPeers {
 		srvrLog.Infof("Max peers reached [%d] - disconnecting peer %s",
 			cfg.MaxPeers, sp)
 		sp.Disconnect()
@@ -1615,8 +2094,9 @@ func (s *server) handleAddPeerMsg(state *peerState, sp *serverPeer) bool {
 	srvrLog.Debugf("New peer %s", sp)
 	if sp.Inbound() {
 		state.inboundPeers[sp.ID()] = sp
+		state.updateInboundCounts(sp, 1)
 	} else {
-		state.outboundGroups[addrmgr.GroupKey(sp.NA())]++
+		state.outboundGroups[s.addrManager.GroupKey(sp.NA())]++
 		if sp.persistent {
 			state.persistentPeers[sp.ID()] = sp
 		} else {
@@ -1637,17 +2117,20 @@ func (s *server) handleAddPeerMsg(state *peerState, sp *serverPeer) bool {
 	// remote peer for outbound connections. This is skipped when running on
 	// the simulation test network since it is only intended to connect to
 	// specified peers and actively avoids advertising and connecting to
-	// discovered peers.
+	// discovered peers.  Addresses are never exchanged with
+	// block-relay-only peers.
 	if !cfg.SimNet && !sp.Inbound() {
 		// Advertise the local address when the server accepts incoming
 		// connections and it believes itself to be close to the best
 		// known tip.
-		if !cfg.DisableListen && s.syncManager.IsCurrent() {
+		if !cfg.DisableListen && !sp.blockRelayOnly &&
+			s.syncManager.IsCurrent() {
+
 			// Get address that best matches.
 			lna := s.addrManager.GetBestLocalAddress(sp.NA())
 			if addrmgr.IsRoutable(lna) {
 				// Filter addresses the peer already knows about.
-				addresses := []*wire.NetAddress{lna}
+				addresses := []*wire.NetAddressV2{lna}
 				sp.pushAddrMsg(addresses)
 			}
 		}
@@ -1656,7 +2139,9 @@ func (s *server) handleAddPeerMsg(state *peerState, sp *serverPeer) bool {
 		// more and the peer has a protocol version new enough to
 		// include a timestamp with addresses.
 		hasTimestamp := sp.ProtocolVersion() >= wire.NetAddressTimeVersion
-		if s.addrManager.NeedMoreAddresses() && hasTimestamp {
+		if s.addrManager.NeedMoreAddresses() && hasTimestamp &&
+			!sp.blockRelayOnly {
+
 			sp.QueueMessage(wire.NewMsgGetAddr(), nil)
 		}
 
@@ -1683,17 +2168,30 @@ func (s *server) handleDonePeerMsg(state *peerState, sp *serverPeer) {
 	// our connection manager about the disconnection. This can happen if we
 	// process a peer's `done` message before its `add`.
 	if !sp.Inbound() {
+		cmgr := s.connManager
+		if sp.blockRelayOnly {
+			cmgr = s.blockRelayConnMgr
+		}
 		if sp.persistent {
-			s.connManager.Disconnect(sp.connReq.ID())
+			cmgr.Disconnect(sp.connReq.ID())
 		} else {
-			s.connManager.Remove(sp.connReq.ID())
-			go s.connManager.NewConnReq()
+			// Extra outbound peers which are evicted are not
+			// replaced.
+			cmgr.Remove(sp.connReq.ID())
+			if sp.blockRelayOnly ||
+				state.fullRelayOutboundCount() <= s.targetOutbound {
+
+				go cmgr.NewConnReq()
+			}
 		}
 	}
 
 	if _, ok := list[sp.ID()]; ok {
 		if !sp.Inbound() && sp.VersionKnown() {
-			state.outboundGroups[addrmgr.GroupKey(sp.NA())]--
+			state.outboundGroups[s.addrManager.GroupKey(sp.NA())]--
+		}
+		if sp.Inbound() {
+			state.updateInboundCounts(sp, -1)
 		}
 		delete(list, sp.ID())
 		srvrLog.Debugf("Removed peer %s", sp)
@@ -1704,15 +2202,28 @@ func (s *server) handleDonePeerMsg(state *peerState, sp *serverPeer) {
 // handleBanPeerMsg deals with banning peers.  It is invoked from the
 // peerHandler goroutine.
 func (s *server) handleBanPeerMsg(state *peerState, sp *serverPeer) {
+	if sp.onionService {
+		srvrLog.Debugf("can't ban onion service peer %s", sp)
+		return
+	}
 	host, _, err := net.SplitHostPort(sp.Addr())
 	if err != nil {
 		srvrLog.Debugf("can't split ban peer %s %v", sp.Addr(), err)
 		return
 	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		srvrLog.Debugf("can't ban non-IP peer address %s", sp.Addr())
+		return
+	}
 	direction := directionString(sp.Inbound())
 	srvrLog.Infof("Banned peer %s (%s) for %v", host, direction,
 		cfg.BanDuration)
-	state.banned[host] = time.Now().Add(cfg.BanDuration)
+	err = s.banList.BanIP(ip, time.Now().Add(cfg.BanDuration),
+		"node misbehaving")
+	if err != nil {
+		srvrLog.Errorf("Unable to save ban list: %v", err)
+	}
 }
 
 // handleRelayInvMsg deals with relaying inventory to peers that are not already
@@ -1832,6 +2343,11 @@ type removeNodeMsg struct {
 	reply chan error
 }
 
+type disconnectSubnetMsg struct {
+	subnet *net.IPNet
+	reply  chan int
+}
+
 // handleQuery is the central handler for all queries and commands from other
 // goroutines related to peer state.
 func (s *server) handleQuery(state *peerState, querymsg interface{}) {
@@ -1889,7 +2405,7 @@ func (s *server) handleQuery(state *peerState, querymsg interface{}) {
 		found := disconnectPeer(state.persistentPeers, msg.cmp, func(sp *serverPeer) {
 			// Keep group counts ok since we remove from
 			// the list now.
-			state.outboundGroups[addrmgr.GroupKey(sp.NA())]--
+			state.outboundGroups[s.addrManager.GroupKey(sp.NA())]--
 		})
 
 		if found {
@@ -1913,9 +2429,12 @@ func (s *server) handleQuery(state *peerState, querymsg interface{}) {
 		}
 		msg.reply <- peers
 	case disconnectNodeMsg:
-		// Check inbound peers. We pass a nil callback since we don't
-		// require any additional actions on disconnect for inbound peers.
-		found := disconnectPeer(state.inboundPeers, msg.cmp, nil)
+		// Check inbound peers.
+		found := disconnectPeer(state.inboundPeers, msg.cmp, func(sp *serverPeer) {
+			// Keep the inbound limit counts ok since we remove
+			// from the list now.
+			state.updateInboundCounts(sp, -1)
+		})
 		if found {
 			msg.reply <- nil
 			return
@@ -1925,7 +2444,7 @@ func (s *server) handleQuery(state *peerState, querymsg interface{}) {
 		found = disconnectPeer(state.outboundPeers, msg.cmp, func(sp *serverPeer) {
 			// Keep group counts ok since we remove from
 			// the list now.
-			state.outboundGroups[addrmgr.GroupKey(sp.NA())]--
+			state.outboundGroups[s.addrManager.GroupKey(sp.NA())]--
 		})
 		if found {
 			// If there are multiple outbound connections to the same
@@ -1933,7 +2452,7 @@ func (s *server) handleQuery(state *peerState, querymsg interface{}) {
 			// peers are found.
 			for found {
 				found = disconnectPeer(state.outboundPeers, msg.cmp, func(sp *serverPeer) {
-					state.outboundGroups[addrmgr.GroupKey(sp.NA())]--
+					state.outboundGroups[s.addrManager.GroupKey(sp.NA())]--
 				})
 			}
 			msg.reply <- nil
@@ -1941,6 +2460,26 @@ func (s *server) handleQuery(state *peerState, querymsg interface{}) {
 		}
 
 		msg.reply <- errors.New("peer not found")
+
+	case disconnectSubnetMsg:
+		// Disconnect every peer within the subnet.  The peers are
+		// removed from the peer state once their done messages are
+		// processed.
+		var count int
+		state.forAllPeers(func(sp *serverPeer) {
+			host, _, err := net.SplitHostPort(sp.Addr())
+			if err != nil {
+				return
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || !msg.subnet.Contains(ip) {
+				return
+			}
+			srvrLog.Infof("Disconnecting banned peer %s", sp)
+			sp.Disconnect()
+			count++
+		})
+		msg.reply <- count
 	}
 }
 
@@ -1991,6 +2530,7 @@ func newPeerConfig(sp *serverPeer) *peer.Config {
 			OnFilterLoad:   sp.OnFilterLoad,
 			OnGetAddr:      sp.OnGetAddr,
 			OnAddr:         sp.OnAddr,
+			OnAddrV2:       sp.OnAddrV2,
 			OnRead:         sp.OnRead,
 			OnWrite:        sp.OnWrite,
 
@@ -2008,9 +2548,10 @@ func newPeerConfig(sp *serverPeer) *peer.Config {
 		UserAgentComments: cfg.UserAgentComments,
 		ChainParams:       sp.server.chainParams,
 		Services:          sp.server.services,
-		DisableRelayTx:    cfg.BlocksOnly,
+		DisableRelayTx:    cfg.BlocksOnly || sp.blockRelayOnly,
 		ProtocolVersion:   peer.MaxProtocolVersion,
 		TrickleInterval:   cfg.TrickleInterval,
+		V2Transport:       sp.v2Transport,
 	}
 }
 
@@ -2019,8 +2560,19 @@ func newPeerConfig(sp *serverPeer) *peer.Config {
 // instance, associates it with the connection, and starts a goroutine to wait
 // for disconnection.
 func (s *server) inboundPeerConnected(conn net.Conn) {
+	// Reject connections from banned addresses before doing any work on
+	// their behalf.
+	if s.banList.IsBannedAddr(conn.RemoteAddr()) {
+		srvrLog.Debugf("Rejecting inbound connection from banned address %s",
+			conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+
 	sp := newServerPeer(s, false)
-	sp.isWhitelisted = isWhitelisted(conn.RemoteAddr())
+	sp.permissions = peerPermissions(conn, true)
+	sp.onionService = s.isOnionServiceConn(conn)
+	sp.v2Transport = cfg.V2Transport
 	sp.Peer = peer.NewInboundPeer(newPeerConfig(sp))
 	sp.AssociateConnection(conn)
 	go s.peerDoneHandler(sp)
@@ -2032,29 +2584,120 @@ func (s *server) inboundPeerConnected(conn net.Conn) {
 // request instance and the connection itself, and finally notifies the address
 // manager of the attempt.
 func (s *server) outboundPeerConnected(c *connmgr.ConnReq, conn net.Conn) {
+	s.newOutboundPeer(s.connManager, c, conn, false)
+}
+
+// blockRelayPeerConnected is invoked by the block-relay-only connection
+// manager when a new outbound connection is established.  It initializes a
+// new outbound server peer which only relays blocks.
+func (s *server) blockRelayPeerConnected(c *connmgr.ConnReq, conn net.Conn) {
+	s.newOutboundPeer(s.blockRelayConnMgr, c, conn, true)
+}
+
+// newOutboundPeer initializes a new outbound server peer instance for the
+// connection request made by the passed connection manager and associates it
+// with the connection.
+func (s *server) newOutboundPeer(cmgr *connmgr.ConnManager,
+	c *connmgr.ConnReq, conn net.Conn, blockRelayOnly bool) {
+
 	sp := newServerPeer(s, c.Permanent)
+	sp.blockRelayOnly = blockRelayOnly
+	sp.v2Transport = s.useV2Transport(c)
 	p, err := peer.NewOutboundPeer(newPeerConfig(sp), c.Addr.String())
 	if err != nil {
 		srvrLog.Debugf("Cannot create outbound peer %s: %v", c.Addr, err)
 		if c.Permanent {
-			s.connManager.Disconnect(c.ID())
+			cmgr.Disconnect(c.ID())
 		} else {
-			s.connManager.Remove(c.ID())
-			go s.connManager.NewConnReq()
+			cmgr.Remove(c.ID())
+			go cmgr.NewConnReq()
 		}
 		return
 	}
 	sp.Peer = p
 	sp.connReq = c
-	sp.isWhitelisted = isWhitelisted(conn.RemoteAddr())
+	sp.permissions = peerPermissions(conn, false)
 	sp.AssociateConnection(conn)
 	go s.peerDoneHandler(sp)
 }
 
+// useV2Transport returns whether the BIP0324 v2 transport is attempted for the
+// passed outbound connection request.  It is used for persistent peers and
+// peers which advertise support unless a previous attempt failed.
+func (s *server) useV2Transport(c *connmgr.ConnReq) bool {
+	if !cfg.V2Transport {
+		return false
+	}
+
+	addr := c.Addr.String()
+	s.v1FallbackMtx.Lock()
+	expiry, fallback := s.v1Fallback[addr]
+	if fallback && !time.Now().Before(expiry) {
+		delete(s.v1Fallback, addr)
+		fallback = false
+	}
+	s.v1FallbackMtx.Unlock()
+	if fallback {
+		return false
+	}
+	if c.Permanent {
+		return true
+	}
+
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return false
+	}
+	na, err := s.addrManager.HostToNetAddress(host, uint16(port), 0)
+	if err != nil {
+		return false
+	}
+	return s.addrManager.Services(na)&wire.SFNodeP2PV2 != 0
+}
+
+// addV1Fallback records that connections to the passed address use the v1
+// transport until v1FallbackExpiry after the passed time.  Expired entries are
+// removed first and the entry which expires soonest is evicted when the
+// maximum number of entries is reached.
+func (s *server) addV1Fallback(addr string, now time.Time) {
+	s.v1FallbackMtx.Lock()
+	defer s.v1FallbackMtx.Unlock()
+
+	if _, ok := s.v1Fallback[addr]; !ok && len(s.v1Fallback) >= maxV1Fallbacks {
+		var oldest string
+		var oldestExpiry time.Time
+		for a, expiry := range s.v1Fallback {
+			if !now.Before(expiry) {
+				delete(s.v1Fallback, a)
+				continue
+			}
+			if oldest == "" || expiry.Before(oldestExpiry) {
+				oldest, oldestExpiry = a, expiry
+			}
+		}
+		if len(s.v1Fallback) >= maxV1Fallbacks {
+			delete(s.v1Fallback, oldest)
+		}
+	}
+	s.v1Fallback[addr] = now.Add(v1FallbackExpiry)
+}
+
 // peerDoneHandler handles peer disconnects by notifiying the server that it's
 // done along with other performing other desirable cleanup.
 func (s *server) peerDoneHandler(sp *serverPeer) {
 	sp.WaitForDisconnect()
+
+	// Outbound peers which closed the connection in response to the v2
+	// handshake are reconnected with the v1 transport for a while.  Other
+	// failures such as timeouts say nothing about the supported transport.
+	if !sp.Inbound() && sp.ShouldReconnectV1() {
+		srvrLog.Debugf("Falling back to the v1 transport for %s", sp)
+		s.addV1Fallback(sp.Addr(), time.Now())
+	}
 	s.donePeers <- sp
 
 	// Only tell sync manager we are gone if we ever told it we existed.
@@ -2090,23 +2733,36 @@ func (s *server) peerHandler() {
 		inboundPeers:    make(map[int32]*serverPeer),
 		persistentPeers: make(map[int32]*serverPeer),
 		outboundPeers:   make(map[int32]*serverPeer),
-		banned:          make(map[string]time.Time),
 		outboundGroups:  make(map[string]int),
+		inboundIPs:      make(map[string]int),
+		inboundGroups:   make(map[string]int),
 	}
 
 	if !cfg.DisableDNSSeed {
 		// Add peers discovered through DNS to the address manager.
 		connmgr.SeedFromDNS(activeNetParams.Params, defaultRequiredServices,
 			btcdLookup, func(addrs []*wire.NetAddress) {
+				addrsV2 := make([]*wire.NetAddressV2, 0, len(addrs))
+				for _, na := range addrs {
+					addrsV2 = append(addrsV2,
+						wire.NetAddressV2FromLegacy(na))
+				}
+
 				// Bitcoind uses a lookup of the dns seeder here. This
 				// is rather strange since the values looked up by the
 				// DNS seed lookups will vary quite a lot.
 				// to replicate this behaviour we put all addresses as
 				// having come from the first one.
-				s.addrManager.AddAddresses(addrs, addrs[0])
+				s.addrManager.AddAddresses(addrsV2, addrsV2[0])
 			})
 	}
 	go s.connManager.Start()
+	if s.blockRelayConnMgr != nil {
+		go s.blockRelayConnMgr.Start()
+	}
+
+	extraPeerTicker := time.NewTicker(extraPeerCheckInterval)
+	defer extraPeerTicker.Stop()
 
 out:
 	for {
@@ -2139,7 +2795,16 @@ out:
 		case qmsg := <-s.query:
 			s.handleQuery(state, qmsg)
 
+		// Evict lagging outbound peers and rotate the extra outbound
+		// peer while the tip is stale.
+		case <-extraPeerTicker.C:
+			s.handleExtraPeerCheck(state)
+
 		case <-s.quit:
+			// Save the block-relay-only peers so they are reconnected
+			// first on the next start.
+			s.saveAnchors(state)
+
 			// Disconnect all peers on server shutdown.
 			state.forAllPeers(func(sp *serverPeer) {
 				srvrLog.Tracef("Shutdown peer %s", sp)
@@ -2150,7 +2815,13 @@ out:
 	}
 
 	s.connManager.Stop()
+	if s.blockRelayConnMgr != nil {
+		s.blockRelayConnMgr.Stop()
+	}
 	s.syncManager.Stop()
+	if err := s.chain.FlushUtxoCache(); err != nil {
+		srvrLog.Errorf("Unable to flush the utxo cache: %v", err)
+	}
 	s.addrManager.Stop()
 
 	// Drain channels before exiting so nothing is left waiting around
@@ -2172,6 +2843,160 @@ cleanup:
 	srvrLog.Tracef("Peer handler done")
 }
 
+// handleExtraPeerCheck evicts outbound peers whose best known chain has had
+// less work than our tip for too long and, while the tip is stale, keeps an
+// extra outbound peer connected to find peers which relay new blocks.  Peers
+// are probed for headers before they are evicted, and up to
+// maxProtectedOutbound peers whose best known chain had as much work as our tip
+// are protected from eviction, so slow announcements do not evict every
+// outbound peer.  When there are more outbound peers than targeted, the peer
+// which relayed a novel block the longest time ago is evicted, so the extra
+// peer is rotated until a peer which relays blocks is found.  It is invoked
+// from the peerHandler goroutine.
+func (s *server) handleExtraPeerCheck(state *peerState) {
+	now := time.Now()
+	best := s.chain.BestSnapshot()
+	_, tipWork, err := s.chain.HeaderChainWork(&best.Hash)
+	if err != nil {
+		srvrLog.Errorf("Unable to look up the work of the tip: %v", err)
+		return
+	}
+
+	var numProtected int
+	for _, sp := range state.outboundPeers {
+		if sp.chainSync.protect {
+			numProtected++
+		}
+	}
+	for _, sp := range state.outboundPeers {
+		if !sp.VersionKnown() {
+			continue
+		}
+		peerWork := sp.peerBestKnownWork()
+		if !sp.chainSync.protect && !sp.blockRelayOnly &&
+			numProtected < maxProtectedOutbound && peerWork != nil &&
+			peerWork.Cmp(tipWork) >= 0 {
+
+			sp.chainSync.protect = true
+			numProtected++
+		}
+		if sp.chainSync.protect || sp.hasPermission(permNoBan) {
+			continue
+		}
+
+		switch sp.chainSync.update(peerWork, &best.Hash, tipWork, now) {
+		case chainSyncProbe:
+			header, err := s.chain.HeaderByHash(&sp.chainSync.workHeader)
+			if err != nil {
+				srvrLog.Errorf("Unable to look up block header "+
+					"%v: %v", sp.chainSync.workHeader, err)
+				continue
+			}
+			srvrLog.Debugf("Outbound peer %s is behind our tip -- "+
+				"probing for headers", sp)
+			locator := s.chain.BlockLocatorFromHash(&header.PrevBlock)
+			go s.syncManager.ProbeHeaders(sp.Peer, locator)
+
+		case chainSyncEvict:
+			srvrLog.Infof("Outbound peer %s has not caught up with "+
+				"block %v -- disconnecting", sp,
+				sp.chainSync.workHeader)
+			sp.Disconnect()
+		}
+	}
+
+	// Evict the extra outbound peer which relayed a novel block the
+	// longest time ago, preferring the most recently connected one, unless
+	// it is protected.
+	if state.fullRelayOutboundCount() > s.targetOutbound {
+		var evict *serverPeer
+		var evictBlockTime int64
+		for _, sp := range state.outboundPeers {
+			if sp.blockRelayOnly || !sp.Connected() {
+				continue
+			}
+			blockTime := atomic.LoadInt64(&sp.lastBlockTime)
+			if evict == nil || blockTime < evictBlockTime ||
+				(blockTime == evictBlockTime &&
+					sp.TimeConnected().After(evict.TimeConnected())) {
+
+				evict = sp
+				evictBlockTime = blockTime
+			}
+		}
+		if evict != nil && !evict.chainSync.protect &&
+			now.Sub(evict.TimeConnected()) >= minOutboundConnectTime {
+
+			srvrLog.Infof("Evicting extra outbound peer %s", evict)
+			evict.Disconnect()
+		}
+	}
+
+	// Try an extra outbound peer while the tip is stale unless one was
+	// requested recently and has not connected yet.
+	if !s.syncManager.IsTipStale() ||
+		state.fullRelayOutboundCount() > s.targetOutbound {
+
+		state.extraPeerRequested = time.Time{}
+		return
+	}
+	if !state.extraPeerRequested.IsZero() &&
+		now.Sub(state.extraPeerRequested) < extraPeerRequestTimeout {
+
+		return
+	}
+	srvrLog.Infof("Tip is stale -- trying an extra outbound peer")
+	state.extraPeerRequested = now
+	go s.connManager.NewConnReq()
+}
+
+// saveAnchors writes the addresses of the currently connected block-relay-only
+// peers to the anchors file.  It is invoked from the peerHandler goroutine.
+func (s *server) saveAnchors(state *peerState) {
+	if s.blockRelayConnMgr == nil {
+		return
+	}
+
+	var anchors []string
+	for _, sp := range state.outboundPeers {
+		if sp.blockRelayOnly {
+			anchors = append(anchors, sp.Addr())
+		}
+	}
+	if len(anchors) == 0 {
+		return
+	}
+
+	path := filepath.Join(cfg.DataDir, anchorsFilename)
+	if err := writeAnchors(path, anchors); err != nil {
+		srvrLog.Errorf("Unable to save anchors to %s: %v", path, err)
+		return
+	}
+	srvrLog.Infof("Saved %d block-relay-only %s to %s", len(anchors),
+		pickNoun(uint64(len(anchors)), "anchor", "anchors"), path)
+}
+
+// nextAnchor removes and returns the next anchor address which should be
+// connected to, or nil when there are none left.  It is safe for concurrent
+// access.
+func (s *server) nextAnchor() net.Addr {
+	s.anchorsMtx.Lock()
+	defer s.anchorsMtx.Unlock()
+
+	for len(s.anchors) > 0 {
+		addrString := s.anchors[0]
+		s.anchors = s.anchors[1:]
+		addr, err := addrStringToNetAddr(addrString)
+		if err != nil {
+			srvrLog.Debugf("Skipping invalid anchor %s: %v", addrString,
+				err)
+			continue
+		}
+		return addr
+	}
+	return nil
+}
+
 // AddPeer adds a new peer that has already been connected to the server.
 func (s *server) AddPeer(sp *serverPeer) {
 	s.newPeers <- sp
@@ -2218,6 +3043,90 @@ func (s *server) OutboundGroupCount(key string) int {
 // for the server.  It is safe for concurrent access.
 func (s *server) AddBytesSent(bytesSent uint64) {
 	atomic.AddUint64(&s.bytesSent, bytesSent)
+
+	s.uploadMtx.Lock()
+	now := time.Now()
+	if now.Sub(s.uploadCycleStart) > uploadTargetCycle {
+		s.uploadCycleStart = now
+		s.uploadCycleBytes = 0
+	}
+	s.uploadCycleBytes += bytesSent
+	s.uploadMtx.Unlock()
+}
+
+// UploadTargetLeft returns the number of bytes which may still be sent to
+// peers in the current cycle of the upload target and the time left in the
+// cycle.  The number of bytes is zero when the upload target is disabled.
+//
+// This function is safe for concurrent access.
+func (s *server) UploadTargetLeft() (uint64, time.Duration) {
+	s.uploadMtx.Lock()
+	defer s.uploadMtx.Unlock()
+
+	// A new cycle starts with the next bytes sent once the current one
+	// has ended.
+	cycleEnd := s.uploadCycleStart.Add(uploadTargetCycle)
+	timeLeft := time.Until(cycleEnd)
+	if s.uploadCycleStart.IsZero() || timeLeft < 0 {
+		return s.maxUploadTarget, uploadTargetCycle
+	}
+	if s.uploadCycleBytes >= s.maxUploadTarget {
+		return 0, timeLeft
+	}
+	return s.maxUploadTarget - s.uploadCycleBytes, timeLeft
+}
+
+// uploadTargetReached returns whether the upload target has been reached in
+// the current cycle.  When historicalBlocks is true, enough bytes to serve a
+// maximum sized block for every block interval left in the cycle are reserved,
+// so recent blocks are still served once historical blocks are refused.
+//
+// This function is safe for concurrent access.
+func (s *server) uploadTargetReached(historicalBlocks bool) bool {
+	if s.maxUploadTarget == 0 {
+		return false
+	}
+
+	bytesLeft, timeLeft := s.UploadTargetLeft()
+	if historicalBlocks {
+		blocksLeft := uint64(timeLeft / s.chainParams.TargetTimePerBlock)
+		return bytesLeft <= blocksLeft*wire.MaxBlockPayload
+	}
+	return bytesLeft == 0
+}
+
+// refuseHistoricalBlock returns whether the block requested by the passed
+// inventory vector is refused to the peer because the upload target is reached
+// and the block is historical.  Peers with the download permission are always
+// served.
+func (sp *serverPeer) refuseHistoricalBlock(iv *wire.InvVect) bool {
+	return !sp.hasPermission(permDownload) &&
+		sp.server.uploadTargetReached(true) &&
+		sp.server.isHistoricalBlock(iv)
+}
+
+// isHistoricalBlock returns whether the passed inventory vector requests a
+// filtered block or a block which is older than historicalBlockAge relative to
+// the tip.
+func (s *server) isHistoricalBlock(iv *wire.InvVect) bool {
+	switch iv.Type {
+	case wire.InvTypeFilteredBlock, wire.InvTypeFilteredWitnessBlock:
+		return true
+	case wire.InvTypeBlock, wire.InvTypeWitnessBlock:
+	default:
+		return false
+	}
+
+	header, err := s.chain.HeaderByHash(&iv.Hash)
+	if err != nil {
+		return false
+	}
+	best := s.chain.BestSnapshot()
+	tipHeader, err := s.chain.HeaderByHash(&best.Hash)
+	if err != nil {
+		return false
+	}
+	return tipHeader.Timestamp.Sub(header.Timestamp) > historicalBlockAge
 }
 
 // AddBytesReceived adds the passed number of bytes to the total bytes received
@@ -2233,6 +3142,14 @@ func (s *server) NetTotals() (uint64, uint64) {
 		atomic.LoadUint64(&s.bytesSent)
 }
 
+// InboundRejections returns the number of inbound peers that have been
+// rejected due to the per-IP and per-network group inbound limits,
+// respectively.  It is safe for concurrent access.
+func (s *server) InboundRejections() (uint64, uint64) {
+	return atomic.LoadUint64(&s.inboundIPRejects),
+		atomic.LoadUint64(&s.inboundGroupRejects)
+}
+
 // UpdatePeerHeights updates the heights of all peers who have have announced
 // the latest connected main chain block, or a recognized orphan. These height
 // updates allow us to dynamically refresh peer heights, ensuring sync peer
@@ -2322,7 +3239,18 @@ func (s *server) Start() {
 
 	if s.nat != nil {
 		s.wg.Add(1)
-		go s.upnpUpdateThread()
+		go s.portMappingThread()
+	}
+
+	if cfg.TorControl != "" {
+		s.wg.Add(1)
+		go s.onionServiceHandler()
+	}
+
+	if s.dnsSeeder != nil {
+		s.dnsSeeder.Start()
+		srvrLog.Infof("Answering DNS seed queries for %s on %s",
+			cfg.DNSSeederHost, strings.Join(cfg.DNSSeederListeners, ", "))
 	}
 
 	if !cfg.DisableRPC {
@@ -2355,6 +3283,11 @@ func (s *server) Stop() error {
 	// Stop the CPU miner if needed
 	s.cpuMiner.Stop()
 
+	// Stop answering DNS seed queries if needed.
+	if s.dnsSeeder != nil {
+		s.dnsSeeder.Stop()
+	}
+
 	// Shutdown the RPC server if it's not disabled.
 	if !cfg.DisableRPC {
 		s.rpcServer.Stop()
@@ -2462,44 +3395,62 @@ func parseListeners(addrs []string) ([]net.Addr, error) {
 	return netAddrs, nil
 }
 
-func (s *server) upnpUpdateThread() {
-	// Go off immediately to prevent code duplication, thereafter we renew
-	// lease every 15 minutes.
-	timer := time.NewTimer(0 * time.Second)
-	lport, _ := strconv.ParseInt(activeNetParams.DefaultPort, 10, 16)
-	first := true
+// portMappingThread maps the listening port of the server on the NAT gateway
+// and advertises the external address to peers.  The mapping is renewed at
+// half of its lifetime, at which time the external address is refreshed in case
+// it changed.  The mapping is removed when the server shuts down.
+//
+// It must be run as a goroutine.
+func (s *server) portMappingThread() {
+	name := s.nat.Name()
+	timer := time.NewTimer(0)
+	var mapping *portMapping
+	var externalIP net.IP
 out:
 	for {
 		select {
 		case <-timer.C:
-			// TODO: pick external port  more cleverly
-			// TODO: know which ports we are listening to on an external net.
-			// TODO: if specific listen port doesn't work then ask for wildcard
-			// listen port?
-			// XXX this assumes timeout is in seconds.
-			listenPort, err := s.nat.AddPortMapping("tcp", int(lport), int(lport),
-				"btgd listen port", 20*60)
+			// Retry soon when the mapping fails.
+			timer.Reset(portMappingRetryInterval)
+
+			externalPort := s.natPort
+			if mapping != nil {
+				externalPort = mapping.externalPort
+			}
+			m, err := s.nat.AddPortMapping("tcp", externalPort,
+				s.natPort, "btgd listen port", portMappingLifetime)
 			if err != nil {
-				srvrLog.Warnf("can't add UPnP port mapping: %v", err)
+				srvrLog.Warnf("Can't add %s port mapping: %v", name, err)
+				continue
 			}
-			if first && err == nil {
-				// TODO: look this up periodically to see if upnp domain changed
-				// and so did ip.
-				externalip, err := s.nat.GetExternalAddress()
-				if err != nil {
-					srvrLog.Warnf("UPnP can't get external address: %v", err)
-					continue out
-				}
-				na := wire.NewNetAddressIPPort(externalip, uint16(listenPort),
-					s.services)
-				err = s.addrManager.AddLocalAddress(na, addrmgr.UpnpPrio)
-				if err != nil {
-					// XXX DeletePortMapping?
-				}
-				srvrLog.Warnf("Successfully bound via UPnP to %s", addrmgr.NetAddressKey(na))
-				first = false
+			mapping = m
+			renew := mapping.lifetime / 2
+			if renew > portMappingLifetime/2 {
+				renew = portMappingLifetime / 2
+			}
+			timer.Reset(renew)
+
+			ip, err := s.nat.GetExternalAddress()
+			if err != nil {
+				srvrLog.Warnf("%s can't get external address: %v", name,
+					err)
+				continue
 			}
-			timer.Reset(time.Minute * 15)
+			if ip.Equal(externalIP) {
+				continue
+			}
+			na := wire.NetAddressV2FromLegacy(wire.NewNetAddressIPPort(
+				ip, uint16(mapping.externalPort), s.services))
+			err = s.addrManager.AddLocalAddress(na, addrmgr.UpnpPrio)
+			if err != nil {
+				srvrLog.Warnf("Can't advertise %s external address "+
+					"%s: %v", name, addrmgr.NetAddressKey(na), err)
+				continue
+			}
+			externalIP = ip
+			srvrLog.Infof("Successfully bound via %s to %s", name,
+				addrmgr.NetAddressKey(na))
+
 		case <-s.quit:
 			break out
 		}
@@ -2507,10 +3458,15 @@ out:
 
 	timer.Stop()
 
-	if err := s.nat.DeletePortMapping("tcp", int(lport), int(lport)); err != nil {
-		srvrLog.Warnf("unable to remove UPnP port mapping: %v", err)
-	} else {
-		srvrLog.Debugf("successfully disestablished UPnP port mapping")
+	if mapping != nil {
+		err := s.nat.DeletePortMapping("tcp", mapping.externalPort, s.natPort)
+		if err != nil {
+			srvrLog.Warnf("Unable to remove %s port mapping: %v", name,
+				err)
+		} else {
+			srvrLog.Debugf("Successfully disestablished %s port mapping",
+				name)
+		}
 	}
 
 	s.wg.Done()
@@ -2579,8 +3535,27 @@ func newServer(listenAddrs, agentBlacklist, agentWhitelist []string,
 	if cfg.NoCFilters {
 		services &^= wire.SFNodeCF
 	}
+	if cfg.V2Transport {
+		services |= wire.SFNodeP2PV2
+	}
 
 	amgr := addrmgr.New(cfg.DataDir, btcdLookup)
+	if cfg.ASMap != "" {
+		asmap, err := addrmgr.LoadASMap(cfg.ASMap)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load asmap: %v", err)
+		}
+		srvrLog.Infof("Using asmap %s (checksum %s) to group peers by "+
+			"autonomous system", cfg.ASMap, asmap.Checksum())
+		amgr.SetASMap(asmap)
+	}
+
+	// Load the persisted bans.  A corrupt ban list is not fatal since it
+	// only results in previously banned peers being allowed to reconnect.
+	banList := connmgr.NewBanList(filepath.Join(cfg.DataDir, banListFilename))
+	if err := banList.Load(); err != nil {
+		srvrLog.Warnf("Unable to load ban list: %v", err)
+	}
 
 	var listeners []net.Listener
 	var nat NAT
@@ -2595,6 +3570,18 @@ func newServer(listenAddrs, agentBlacklist, agentWhitelist []string,
 		}
 	}
 
+	// The onion service forwards to a dedicated listener so peers which
+	// connect through it can be identified.
+	var onionListener net.Listener
+	if cfg.TorControl != "" {
+		var err error
+		onionListener, err = initOnionListener()
+		if err != nil {
+			return nil, fmt.Errorf("unable to listen for onion "+
+				"service connections: %v", err)
+		}
+	}
+
 	if len(agentBlacklist) > 0 {
 		srvrLog.Infof("User-agent blacklist %s", agentBlacklist)
 	}
@@ -2605,6 +3592,7 @@ func newServer(listenAddrs, agentBlacklist, agentWhitelist []string,
 	s := server{
 		chainParams:          chainParams,
 		addrManager:          amgr,
+		banList:              banList,
 		newPeers:             make(chan *serverPeer, cfg.MaxPeers),
 		donePeers:            make(chan *serverPeer, cfg.MaxPeers),
 		banPeers:             make(chan *serverPeer, cfg.MaxPeers),
@@ -2615,15 +3603,21 @@ func newServer(listenAddrs, agentBlacklist, agentWhitelist []string,
 		modifyRebroadcastInv: make(chan interface{}),
 		peerHeightsUpdate:    make(chan updatePeerHeightsMsg),
 		nat:                  nat,
+		natPort:              natListenPort(listeners),
+		onionListener:        onionListener,
 		db:                   db,
 		timeSource:           blockchain.NewMedianTime(),
 		services:             services,
 		sigCache:             txscript.NewSigCache(cfg.SigCacheMaxSize),
 		hashCache:            txscript.NewHashCache(cfg.SigCacheMaxSize),
 		cfCheckptCaches:      make(map[wire.FilterType][]cfHeaderKV),
+		v1Fallback:           make(map[string]time.Time),
 		agentBlacklist:       agentBlacklist,
 		agentWhitelist:       agentWhitelist,
 	}
+	if _, err := rand.Read(s.netGroupKey[:]); err != nil {
+		return nil, err
+	}
 
 	// Create the transaction and address indexes if needed.
 	//
@@ -2672,14 +3666,17 @@ func newServer(listenAddrs, agentBlacklist, agentWhitelist []string,
 	// Create a new block chain instance with the appropriate configuration.
 	var err error
 	s.chain, err = blockchain.New(&blockchain.Config{
-		DB:           s.db,
-		Interrupt:    interrupt,
-		ChainParams:  s.chainParams,
-		Checkpoints:  checkpoints,
-		TimeSource:   s.timeSource,
-		SigCache:     s.sigCache,
-		IndexManager: indexManager,
-		HashCache:    s.hashCache,
+		DB:               s.db,
+		Interrupt:        interrupt,
+		ChainParams:      s.chainParams,
+		Checkpoints:      checkpoints,
+		TimeSource:       s.timeSource,
+		SigCache:         s.sigCache,
+		IndexManager:     indexManager,
+		HashCache:        s.hashCache,
+		MaxReorgDepth:    cfg.MaxReorgDepth,
+		AssumeValid:      cfg.assumeValid,
+		UtxoCacheMaxSize: uint64(cfg.UtxoCacheMaxSizeMiB) * 1024 * 1024,
 	})
 	if err != nil {
 		return nil, err
@@ -2739,9 +3736,16 @@ func newServer(listenAddrs, agentBlacklist, agentWhitelist []string,
 		HashCache:          s.hashCache,
 		AddrIndex:          s.addrIndex,
 		FeeEstimator:       s.feeEstimator,
+		FeeDeltasFile:      filepath.Join(cfg.DataDir, feeDeltasFilename),
 	}
 	s.txMemPool = mempool.New(&txC)
 
+	// Load the persisted fee deltas.  A corrupt file is not fatal since it
+	// only results in transactions losing their prioritisation.
+	if err := s.txMemPool.LoadFeeDeltas(); err != nil {
+		srvrLog.Warnf("Unable to load fee deltas: %v", err)
+	}
+
 	s.syncManager, err = netsync.New(&netsync.Config{
 		PeerNotifier:       &s,
 		Chain:              s.chain,
@@ -2780,6 +3784,20 @@ func newServer(listenAddrs, agentBlacklist, agentWhitelist []string,
 		IsCurrent:              s.syncManager.IsCurrent,
 	})
 
+	// Answer DNS seed queries with the good addresses of the address
+	// manager when acting as a DNS seed.
+	if cfg.DNSSeederHost != "" {
+		port, err := strconv.ParseUint(chainParams.DefaultPort, 10, 16)
+		if err != nil {
+			return nil, err
+		}
+		s.dnsSeeder, err = newDNSSeeder(cfg.DNSSeederHost, cfg.DNSSeederNS,
+			cfg.DNSSeederListeners, uint16(port), amgr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// Only setup a function to return new addresses to connect to when
 	// not running in connect-only mode.  The simulation network is always
 	// in connect-only mode since it is only intended to connect to
@@ -2801,11 +3819,17 @@ func newServer(listenAddrs, agentBlacklist, agentWhitelist []string,
 				// in the same group so that we are not connecting
 				// to the same network segment at the expense of
 				// others.
-				key := addrmgr.GroupKey(addr.NetAddress())
+				key := s.addrManager.GroupKey(addr.NetAddress())
 				if s.OutboundGroupCount(key) != 0 {
 					continue
 				}
 
+				// Skip addresses on networks which can't be reached
+				// with the current configuration.
+				if !isReachable(addr.NetAddress()) {
+					continue
+				}
+
 				// only allow recent nodes (10mins) after we failed 30
 				// times
 				if tries < 30 && time.Since(addr.LastAttempt()) < 10*time.Minute {
@@ -2834,6 +3858,15 @@ func newServer(listenAddrs, agentBlacklist, agentWhitelist []string,
 	if cfg.MaxPeers < targetOutbound {
 		targetOutbound = cfg.MaxPeers
 	}
+	blockRelayPeers := cfg.BlockRelayPeers
+	if cfg.MaxPeers-targetOutbound < blockRelayPeers {
+		blockRelayPeers = cfg.MaxPeers - targetOutbound
+	}
+	s.targetOutbound = targetOutbound
+	s.maxUploadTarget = cfg.MaxUploadTarget * 1024 * 1024
+	if onionListener != nil {
+		listeners = append(listeners, onionListener)
+	}
 	cmgr, err := connmgr.New(&connmgr.Config{
 		Listeners:      listeners,
 		OnAccept:       s.inboundPeerConnected,
@@ -2842,12 +3875,48 @@ func newServer(listenAddrs, agentBlacklist, agentWhitelist []string,
 		Dial:           btcdDial,
 		OnConnection:   s.outboundPeerConnected,
 		GetNewAddress:  newAddressFunc,
+		BanList:        s.banList,
 	})
 	if err != nil {
 		return nil, err
 	}
 	s.connManager = cmgr
 
+	// Create a separate connection manager for the block-relay-only
+	// outbound peers.  They are only used when addresses are discovered
+	// automatically and the anchors saved at the last shutdown are
+	// connected to before any other addresses.
+	if newAddressFunc != nil && blockRelayPeers > 0 {
+		path := filepath.Join(cfg.DataDir, anchorsFilename)
+		anchors, err := readAnchors(path)
+		if err != nil {
+			srvrLog.Warnf("Unable to load anchors: %v", err)
+		} else if len(anchors) > 0 {
+			srvrLog.Infof("Loaded %d block-relay-only %s from %s",
+				len(anchors), pickNoun(uint64(len(anchors)),
+					"anchor", "anchors"), path)
+		}
+		s.anchors = anchors
+
+		blockRelayCmgr, err := connmgr.New(&connmgr.Config{
+			RetryDuration:  connectionRetryInterval,
+			TargetOutbound: uint32(blockRelayPeers),
+			Dial:           btcdDial,
+			OnConnection:   s.blockRelayPeerConnected,
+			GetNewAddress: func() (net.Addr, error) {
+				if addr := s.nextAnchor(); addr != nil {
+					return addr, nil
+				}
+				return newAddressFunc()
+			},
+			BanList: s.banList,
+		})
+		if err != nil {
+			return nil, err
+		}
+		s.blockRelayConnMgr = blockRelayCmgr
+	}
+
 	// Start up persistent peers.
 	permanentPeers := cfg.ConnectPeers
 	if len(permanentPeers) == 0 {
@@ -2963,14 +4032,7 @@ func initListeners(amgr *addrmgr.AddrManager, listenAddrs []string, services wir
 			}
 		}
 	} else {
-		if cfg.Upnp {
-			var err error
-			nat, err = Discover()
-			if err != nil {
-				srvrLog.Warnf("Can't discover upnp: %v", err)
-			}
-			// nil nat here is fine, just means no upnp on network.
-		}
+		nat = discoverNAT(cfg.Upnp, cfg.NATPMP)
 
 		// Add bound addresses to address manager to be advertised to peers.
 		for _, listener := range listeners {
@@ -3033,6 +4095,94 @@ func addrStringToNetAddr(addr string) (net.Addr, error) {
 	}, nil
 }
 
+// supportedNetworks houses the names of the networks used by the --onlynet
+// option in the order they are reported by the getnetworkinfo RPC.
+var supportedNetworks = []string{"ipv4", "ipv6", "onion", "i2p", "cjdns"}
+
+// isSupportedNetwork returns whether the passed name is one of the supported
+// networks.
+func isSupportedNetwork(name string) bool {
+	for _, n := range supportedNetworks {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// addrNetwork returns the name of the network of the passed address.
+func addrNetwork(na *wire.NetAddressV2) string {
+	switch {
+	case addrmgr.IsOnionCatTor(na) || addrmgr.IsTorV3(na):
+		return "onion"
+	case addrmgr.IsI2P(na):
+		return "i2p"
+	case addrmgr.IsCJDNS(na):
+		return "cjdns"
+	case addrmgr.IsIPv4(na):
+		return "ipv4"
+	}
+	return "ipv6"
+}
+
+// isNetworkLimited returns whether automatic outbound connections to the named
+// network are disabled by the --onlynet option.
+func isNetworkLimited(name string) bool {
+	if len(cfg.onlyNets) == 0 {
+		return false
+	}
+	_, ok := cfg.onlyNets[name]
+	return !ok
+}
+
+// networkProxy returns the SOCKS proxy connections to the named network are
+// made through, if any, and whether random proxy credentials are used for each
+// connection.  Onion addresses use the onion specific proxy when one is
+// configured, while I2P and CJDNS addresses are never dialed through a proxy.
+func networkProxy(name string) (string, bool) {
+	switch name {
+	case "ipv4", "ipv6":
+		return cfg.Proxy, cfg.proxyIsolation
+	case "onion":
+		switch {
+		case cfg.NoOnion:
+			return "", false
+		case cfg.OnionProxy != "":
+			return cfg.OnionProxy, cfg.TorIsolation
+		}
+		return cfg.Proxy, cfg.proxyIsolation
+	}
+	return "", false
+}
+
+// isNetworkReachable returns whether or not outbound connections can be made to
+// the named network with the current configuration.  Tor addresses are dialed
+// through the configured SOCKS proxy, so they are only reachable when one is
+// configured.  CJDNS addresses are dialed directly, so they are not reachable
+// when all connections go through a proxy, and I2P addresses are not
+// supported.
+func isNetworkReachable(name string) bool {
+	if isNetworkLimited(name) {
+		return false
+	}
+	switch name {
+	case "onion":
+		proxy, _ := networkProxy(name)
+		return proxy != ""
+	case "i2p":
+		return false
+	case "cjdns":
+		return cfg.Proxy == ""
+	}
+	return true
+}
+
+// isReachable returns whether or not outbound connections can be made to the
+// passed address with the current configuration.
+func isReachable(na *wire.NetAddressV2) bool {
+	return isNetworkReachable(addrNetwork(na))
+}
+
 // addLocalAddress adds an address that this node is listening on to the
 // address manager so that it may be relayed to peers.
 func addLocalAddress(addrMgr *addrmgr.AddrManager, addr string, services wire.ServiceFlag) error {
@@ -3064,7 +4214,8 @@ func addLocalAddress(addrMgr *addrmgr.AddrManager, addr string, services wire.Se
 				continue
 			}
 
-			netAddr := wire.NewNetAddressIPPort(ifaceIP, uint16(port), services)
+			netAddr := wire.NetAddressV2FromLegacy(
+				wire.NewNetAddressIPPort(ifaceIP, uint16(port), services))
 			addrMgr.AddLocalAddress(netAddr, addrmgr.BoundPrio)
 		}
 	} else {
@@ -3101,30 +4252,40 @@ func dynamicTickDuration(remaining time.Duration) time.Duration {
 	return time.Hour
 }
 
-// isWhitelisted returns whether the IP address is included in the whitelisted
-// networks and IPs.
-func isWhitelisted(addr net.Addr) bool {
+// peerPermissions returns the permissions granted to the peer of the passed
+// connection by the whitelisted networks which contain its address and, for
+// inbound connections, the whitelisted bind addresses it connected to.
+func peerPermissions(conn net.Conn, inbound bool) netPermissions {
+	var perms netPermissions
+	if inbound {
+		for i := range cfg.whitebinds {
+			if cfg.whitebinds[i].matches(conn.LocalAddr()) {
+				perms |= cfg.whitebinds[i].perms
+			}
+		}
+	}
 	if len(cfg.whitelists) == 0 {
-		return false
+		return perms
 	}
 
+	addr := conn.RemoteAddr()
 	host, _, err := net.SplitHostPort(addr.String())
 	if err != nil {
 		srvrLog.Warnf("Unable to SplitHostPort on '%s': %v", addr, err)
-		return false
+		return perms
 	}
 	ip := net.ParseIP(host)
 	if ip == nil {
 		srvrLog.Warnf("Unable to parse IP '%s'", addr)
-		return false
+		return perms
 	}
 
-	for _, ipnet := range cfg.whitelists {
-		if ipnet.Contains(ip) {
-			return true
+	for _, wl := range cfg.whitelists {
+		if wl.ipnet.Contains(ip) {
+			perms |= wl.perms
 		}
 	}
-	return false
+	return perms
 }
 
 // checkpointSorter implements sort.Interface to allow a slice of checkpoints to
@@ -0,0 +1,619 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btclog"
+	"github.com/btgsuite/btgd/blockchain"
+	"github.com/btgsuite/btgd/chaincfg"
+	"github.com/btgsuite/btgd/chaincfg/chainhash"
+	"github.com/btgsuite/btgd/connmgr"
+	"github.com/btgsuite/btgd/database"
+	"github.com/btgsuite/btgd/txscript"
+	"github.com/btgsuite/btgd/wire"
+	btcutil "github.com/btgsuite/btgutil"
+)
+
+// TestV1Fallback ensures addresses which fell back to the v1 transport use it
+// until the fallback expires and the number of fallbacks is bounded.
+func TestV1Fallback(t *testing.T) {
+	defer func(c *config) { cfg = c }(cfg)
+	cfg = &config{V2Transport: true}
+
+	s := &server{v1Fallback: make(map[string]time.Time)}
+	addr := &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 8338}
+	c := &connmgr.ConnReq{Addr: addr, Permanent: true}
+	if !s.useV2Transport(c) {
+		t.Fatal("useV2Transport: v2 not used without fallback")
+	}
+
+	now := time.Now()
+	s.addV1Fallback(addr.String(), now)
+	if s.useV2Transport(c) {
+		t.Fatal("useV2Transport: v2 used after fallback")
+	}
+
+	// The v2 transport is tried again once the fallback expired.
+	s.v1Fallback[addr.String()] = now.Add(-time.Second)
+	if !s.useV2Transport(c) {
+		t.Fatal("useV2Transport: v2 not used after fallback expired")
+	}
+	if _, ok := s.v1Fallback[addr.String()]; ok {
+		t.Fatal("useV2Transport: expired fallback not removed")
+	}
+
+	// Expired fallbacks are removed before the fallback which expires
+	// soonest is evicted.
+	for i := 0; i < maxV1Fallbacks; i++ {
+		a := fmt.Sprintf("10.0.%d.%d:8338", i/256, i%256)
+		s.addV1Fallback(a, now.Add(time.Duration(i)*time.Second))
+	}
+	expired := "10.0.0.5:8338"
+	s.v1Fallback[expired] = now
+	s.addV1Fallback(addr.String(), now.Add(time.Hour))
+	if len(s.v1Fallback) != maxV1Fallbacks {
+		t.Fatalf("addV1Fallback: got %d fallbacks, want %d",
+			len(s.v1Fallback), maxV1Fallbacks)
+	}
+	if _, ok := s.v1Fallback[expired]; ok {
+		t.Fatal("addV1Fallback: expired fallback not removed")
+	}
+	if _, ok := s.v1Fallback["10.0.0.0:8338"]; !ok {
+		t.Fatal("addV1Fallback: fallback evicted despite expired one")
+	}
+
+	s.addV1Fallback("5.6.7.8:8338", now)
+	if len(s.v1Fallback) != maxV1Fallbacks {
+		t.Fatalf("addV1Fallback: got %d fallbacks, want %d",
+			len(s.v1Fallback), maxV1Fallbacks)
+	}
+	if _, ok := s.v1Fallback["10.0.0.0:8338"]; ok {
+		t.Fatal("addV1Fallback: soonest expiring fallback not evicted")
+	}
+}
+
+// TestChainSyncState ensures outbound peers whose best known chain has less
+// work than our tip are given time to catch up, are probed for headers and are
+// only evicted when they do not reply with enough work.
+func TestChainSyncState(t *testing.T) {
+	tip := chainhash.Hash{1}
+	newTip := chainhash.Hash{2}
+	now := time.Now()
+
+	type step struct {
+		peerWork int64 // negative for unknown
+		tip      *chainhash.Hash
+		tipWork  int64
+		after    time.Duration
+		want     chainSyncAction
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{{
+		name: "caught up",
+		steps: []step{
+			{peerWork: 10, tip: &tip, tipWork: 10},
+			{peerWork: 10, tip: &tip, tipWork: 10,
+				after: chainSyncTimeout + time.Minute},
+		},
+	}, {
+		name: "behind until evicted",
+		steps: []step{
+			{peerWork: 9, tip: &tip, tipWork: 10},
+			{peerWork: 9, tip: &tip, tipWork: 10,
+				after: chainSyncTimeout},
+			{peerWork: 9, tip: &tip, tipWork: 10,
+				after: chainSyncTimeout + time.Second,
+				want:  chainSyncProbe},
+			{peerWork: 9, tip: &tip, tipWork: 10,
+				after: chainSyncTimeout + headersResponseTime},
+			{peerWork: 9, tip: &tip, tipWork: 10,
+				after: chainSyncTimeout + headersResponseTime +
+					2*time.Second,
+				want: chainSyncEvict},
+		},
+	}, {
+		name: "unknown best block",
+		steps: []step{
+			{peerWork: -1, tip: &tip, tipWork: 10},
+			{peerWork: -1, tip: &tip, tipWork: 10,
+				after: chainSyncTimeout + time.Second,
+				want:  chainSyncProbe},
+		},
+	}, {
+		name: "probe reply catches up",
+		steps: []step{
+			{peerWork: 9, tip: &tip, tipWork: 10},
+			{peerWork: 9, tip: &tip, tipWork: 10,
+				after: chainSyncTimeout + time.Second,
+				want:  chainSyncProbe},
+			{peerWork: 10, tip: &tip, tipWork: 10,
+				after: chainSyncTimeout + time.Minute},
+			{peerWork: 10, tip: &tip, tipWork: 10,
+				after: chainSyncTimeout + headersResponseTime +
+					time.Minute},
+		},
+	}, {
+		name: "caught up with the previous tip",
+		steps: []step{
+			{peerWork: 9, tip: &tip, tipWork: 10},
+			{peerWork: 10, tip: &newTip, tipWork: 11,
+				after: chainSyncTimeout - time.Minute},
+			{peerWork: 10, tip: &newTip, tipWork: 11,
+				after: chainSyncTimeout + time.Minute},
+			{peerWork: 10, tip: &newTip, tipWork: 11,
+				after: 2*chainSyncTimeout - time.Minute +
+					time.Second,
+				want: chainSyncProbe},
+		},
+	}}
+	for _, test := range tests {
+		var cs chainSyncState
+		for i, step := range test.steps {
+			var peerWork *big.Int
+			if step.peerWork >= 0 {
+				peerWork = big.NewInt(step.peerWork)
+			}
+			got := cs.update(peerWork, step.tip,
+				big.NewInt(step.tipWork), now.Add(step.after))
+			if got != step.want {
+				t.Fatalf("%s: step %d: got action %d, want %d",
+					test.name, i, got, step.want)
+			}
+		}
+	}
+}
+
+// newUploadTestChain returns a chain on the regression test network with a
+// block one second after the genesis block which is followed by a block
+// historicalBlockAge later, so the genesis block is historical and the first
+// block is exactly at the cutoff.
+func newUploadTestChain(t *testing.T) (*blockchain.BlockChain, []*btcutil.Block, func()) {
+	blockchain.UseLogger(btclog.Disabled)
+
+	params := chaincfg.RegressionNetParams
+	params.Name = "uploadtargettest"
+	genesisTime := params.GenesisBlock.Header.Timestamp
+	timestamps := []time.Time{
+		genesisTime.Add(time.Second),
+		genesisTime.Add(time.Second + historicalBlockAge),
+	}
+
+	dbPath, err := ioutil.TempDir("", "uploadtarget")
+	if err != nil {
+		t.Fatalf("unable to create test db path: %v", err)
+	}
+	db, err := database.Create("ffldb", dbPath, params.Net)
+	if err != nil {
+		os.RemoveAll(dbPath)
+		blockchain.UseLogger(chanLog)
+		t.Fatalf("error creating db: %v", err)
+	}
+	teardown := func() {
+		db.Close()
+		os.RemoveAll(dbPath)
+		blockchain.UseLogger(chanLog)
+	}
+	chain, err := blockchain.New(&blockchain.Config{
+		DB:          db,
+		ChainParams: &params,
+		TimeSource:  blockchain.NewMedianTime(),
+	})
+	if err != nil {
+		teardown()
+		t.Fatalf("failed to create chain instance: %v", err)
+	}
+
+	target := blockchain.CompactToBig(params.PowLimitBits)
+	prev := &params.GenesisBlock.Header
+	var blocks []*btcutil.Block
+	for i, timestamp := range timestamps {
+		height := int32(i + 1)
+		coinbaseScript, err := txscript.NewScriptBuilder().
+			AddInt64(int64(height)).AddInt64(0).Script()
+		if err != nil {
+			teardown()
+			t.Fatalf("unable to build coinbase script: %v", err)
+		}
+		coinbaseTx := wire.NewMsgTx(1)
+		coinbaseTx.AddTxIn(&wire.TxIn{
+			PreviousOutPoint: *wire.NewOutPoint(&chainhash.Hash{},
+				wire.MaxPrevOutIndex),
+			Sequence:        wire.MaxTxInSequenceNum,
+			SignatureScript: coinbaseScript,
+		})
+		coinbaseTx.AddTxOut(&wire.TxOut{
+			Value:    blockchain.CalcBlockSubsidy(height, &params),
+			PkScript: []byte{txscript.OP_TRUE},
+		})
+		msgBlock := &wire.MsgBlock{
+			Header: wire.BlockHeader{
+				Version:   1,
+				PrevBlock: prev.BlockHash(),
+				Height:    uint32(height),
+				Timestamp: timestamp,
+				Bits:      params.PowLimitBits,
+			},
+			Transactions: []*wire.MsgTx{coinbaseTx},
+		}
+		merkles := blockchain.BuildMerkleTreeStore(
+			btcutil.NewBlock(msgBlock).Transactions(), false)
+		msgBlock.Header.MerkleRoot = *merkles[len(merkles)-1]
+		for nonce := uint32(0); ; nonce++ {
+			msgBlock.Header.Nonce = wire.Uint256FromUint32(nonce)
+			hash := msgBlock.Header.BlockHash()
+			if blockchain.HashToBig(&hash).Cmp(target) <= 0 {
+				break
+			}
+		}
+
+		block := btcutil.NewBlock(msgBlock)
+		if _, _, err := chain.ProcessBlock(block, blockchain.BFNone); err != nil {
+			teardown()
+			t.Fatalf("unable to process block %d: %v", height, err)
+		}
+		blocks = append(blocks, block)
+		prev = &msgBlock.Header
+	}
+	return chain, blocks, teardown
+}
+
+// TestAddBytesSent ensures the bytes sent are added to the current cycle of
+// the upload target and a new cycle starts once the current one has ended.
+func TestAddBytesSent(t *testing.T) {
+	tests := []struct {
+		name       string
+		cycleStart time.Duration // ago, zero for not started
+		cycleBytes uint64
+		sent       uint64
+		wantBytes  uint64
+		wantReset  bool
+	}{{
+		name:      "first bytes",
+		sent:      100,
+		wantBytes: 100,
+		wantReset: true,
+	}, {
+		name:       "current cycle",
+		cycleStart: time.Hour,
+		cycleBytes: 1000,
+		sent:       100,
+		wantBytes:  1100,
+	}, {
+		name:       "cycle about to end",
+		cycleStart: uploadTargetCycle - time.Minute,
+		cycleBytes: 1000,
+		sent:       100,
+		wantBytes:  1100,
+	}, {
+		name:       "cycle ended",
+		cycleStart: uploadTargetCycle + time.Minute,
+		cycleBytes: 1000,
+		sent:       100,
+		wantBytes:  100,
+		wantReset:  true,
+	}}
+	for _, test := range tests {
+		s := &server{bytesSent: 5, uploadCycleBytes: test.cycleBytes}
+		if test.cycleStart != 0 {
+			s.uploadCycleStart = time.Now().Add(-test.cycleStart)
+		}
+		cycleStart := s.uploadCycleStart
+
+		s.AddBytesSent(test.sent)
+		if s.bytesSent != 5+test.sent {
+			t.Errorf("%s: got %d total bytes sent, want %d",
+				test.name, s.bytesSent, 5+test.sent)
+		}
+		if s.uploadCycleBytes != test.wantBytes {
+			t.Errorf("%s: got %d bytes in cycle, want %d",
+				test.name, s.uploadCycleBytes, test.wantBytes)
+		}
+		if reset := !s.uploadCycleStart.Equal(cycleStart); reset != test.wantReset {
+			t.Errorf("%s: got cycle reset %v, want %v", test.name,
+				reset, test.wantReset)
+		}
+	}
+}
+
+// TestUploadTargetReached ensures the upload target is reached once the bytes
+// of the current cycle are used up and, for historical blocks, once only the
+// reserve for the recent blocks of the rest of the cycle is left.
+func TestUploadTargetReached(t *testing.T) {
+	params := &chaincfg.MainNetParams
+	blockTime := params.TargetTimePerBlock
+
+	// The target exceeds the reserve of a full cycle, and the cycle is
+	// started such that half a block interval is left after the last
+	// reserved block.
+	const blocksLeft = 6
+	reserve := uint64(blocksLeft * wire.MaxBlockPayload)
+	cycleBlocks := uint64(uploadTargetCycle / blockTime)
+	maxTarget := (cycleBlocks + 1) * wire.MaxBlockPayload
+	cycleStart := uploadTargetCycle - blocksLeft*blockTime - blockTime/2
+
+	tests := []struct {
+		name           string
+		maxTarget      uint64
+		cycleStart     time.Duration // ago, zero for not started
+		cycleBytes     uint64
+		wantReached    bool
+		wantHistorical bool
+	}{{
+		name:       "disabled",
+		cycleStart: cycleStart,
+		cycleBytes: maxTarget,
+	}, {
+		name:      "cycle not started",
+		maxTarget: maxTarget,
+	}, {
+		name:           "target below reserve of full cycle",
+		maxTarget:      cycleBlocks * wire.MaxBlockPayload,
+		wantHistorical: true,
+	}, {
+		name:       "nothing sent",
+		maxTarget:  maxTarget,
+		cycleStart: cycleStart,
+	}, {
+		name:       "reserve not reached",
+		maxTarget:  maxTarget,
+		cycleStart: cycleStart,
+		cycleBytes: maxTarget - reserve - 1,
+	}, {
+		name:           "reserve reached",
+		maxTarget:      maxTarget,
+		cycleStart:     cycleStart,
+		cycleBytes:     maxTarget - reserve,
+		wantHistorical: true,
+	}, {
+		name:           "one byte left",
+		maxTarget:      maxTarget,
+		cycleStart:     cycleStart,
+		cycleBytes:     maxTarget - 1,
+		wantHistorical: true,
+	}, {
+		name:           "target reached",
+		maxTarget:      maxTarget,
+		cycleStart:     cycleStart,
+		cycleBytes:     maxTarget,
+		wantReached:    true,
+		wantHistorical: true,
+	}, {
+		name:           "target exceeded",
+		maxTarget:      maxTarget,
+		cycleStart:     cycleStart,
+		cycleBytes:     maxTarget + 1,
+		wantReached:    true,
+		wantHistorical: true,
+	}, {
+		name:       "cycle ended",
+		maxTarget:  maxTarget,
+		cycleStart: uploadTargetCycle + time.Minute,
+		cycleBytes: maxTarget,
+	}}
+	for _, test := range tests {
+		s := &server{
+			chainParams:      params,
+			maxUploadTarget:  test.maxTarget,
+			uploadCycleBytes: test.cycleBytes,
+		}
+		if test.cycleStart != 0 {
+			s.uploadCycleStart = time.Now().Add(-test.cycleStart)
+		}
+		if got := s.uploadTargetReached(false); got != test.wantReached {
+			t.Errorf("%s: got reached %v, want %v", test.name, got,
+				test.wantReached)
+		}
+		if got := s.uploadTargetReached(true); got != test.wantHistorical {
+			t.Errorf("%s: got reached for historical blocks %v, "+
+				"want %v", test.name, got, test.wantHistorical)
+		}
+	}
+}
+
+// TestRefuseHistoricalBlock ensures only historical and filtered blocks are
+// refused once the upload target is reached, and never to peers with the
+// download permission.
+func TestRefuseHistoricalBlock(t *testing.T) {
+	chain, blocks, teardown := newUploadTestChain(t)
+	defer teardown()
+	genesis := chaincfg.RegressionNetParams.GenesisHash
+
+	block := func(hash *chainhash.Hash) *wire.InvVect {
+		return wire.NewInvVect(wire.InvTypeBlock, hash)
+	}
+	tests := []struct {
+		name       string
+		iv         *wire.InvVect
+		historical bool
+	}{
+		{"historical block", block(genesis), true},
+		{"historical witness block", wire.NewInvVect(
+			wire.InvTypeWitnessBlock, genesis), true},
+		{"block at cutoff", block(blocks[0].Hash()), false},
+		{"tip", block(blocks[1].Hash()), false},
+		{"filtered block", wire.NewInvVect(wire.InvTypeFilteredBlock,
+			blocks[1].Hash()), true},
+		{"filtered witness block", wire.NewInvVect(
+			wire.InvTypeFilteredWitnessBlock, blocks[1].Hash()), true},
+		{"unknown block", block(&chainhash.Hash{1}), false},
+		{"transaction", wire.NewInvVect(wire.InvTypeTx, genesis), false},
+	}
+	perms := []struct {
+		name   string
+		perms  netPermissions
+		exempt bool
+	}{
+		{"no permissions", 0, false},
+		{"relay", permRelay | permMempool, false},
+		{"download", permDownload, true},
+		{"noban", netPermissionNames[0].perm, true},
+		{"whitelist", defaultWhitelistPermissions, true},
+	}
+
+	// The target exceeds the reserve of a full cycle, so it is only
+	// reached once the bytes are sent.
+	params := chaincfg.RegressionNetParams
+	maxTarget := uint64(uploadTargetCycle/params.TargetTimePerBlock+1) *
+		wire.MaxBlockPayload
+	for _, reached := range []bool{false, true} {
+		s := &server{
+			chain:            chain,
+			chainParams:      &params,
+			maxUploadTarget:  maxTarget,
+			uploadCycleStart: time.Now(),
+		}
+		if reached {
+			s.uploadCycleBytes = maxTarget
+		}
+		for _, test := range tests {
+			if got := s.isHistoricalBlock(test.iv); got != test.historical {
+				t.Errorf("%s: got historical %v, want %v",
+					test.name, got, test.historical)
+			}
+			for _, p := range perms {
+				sp := &serverPeer{server: s, permissions: p.perms}
+				want := reached && test.historical && !p.exempt
+				if got := sp.refuseHistoricalBlock(test.iv); got != want {
+					t.Errorf("%s, %s, target reached %v: got "+
+						"refused %v, want %v", test.name,
+						p.name, reached, got, want)
+				}
+			}
+		}
+	}
+}
+
+// TestNetworkReachability ensures the limited and reachable networks and their
+// proxies are derived from the configuration.
+func TestNetworkReachability(t *testing.T) {
+	defer func(c *config) { cfg = c }(cfg)
+
+	type network struct {
+		limited   bool
+		reachable bool
+		proxy     string
+		randomize bool
+	}
+	direct := network{reachable: true}
+	unreachable := network{}
+	tests := []struct {
+		name     string
+		cfg      config
+		networks map[string]network
+	}{{
+		name: "default",
+		cfg:  config{},
+		networks: map[string]network{
+			"ipv4":  direct,
+			"ipv6":  direct,
+			"onion": unreachable,
+			"i2p":   unreachable,
+			"cjdns": direct,
+		},
+	}, {
+		name: "proxy",
+		cfg:  config{Proxy: "127.0.0.1:9050", TorIsolation: true},
+		networks: map[string]network{
+			"ipv4":  {reachable: true, proxy: "127.0.0.1:9050"},
+			"ipv6":  {reachable: true, proxy: "127.0.0.1:9050"},
+			"onion": {reachable: true, proxy: "127.0.0.1:9050"},
+			"i2p":   unreachable,
+			"cjdns": unreachable,
+		},
+	}, {
+		name: "proxy with isolated credentials",
+		cfg: config{Proxy: "127.0.0.1:9050", TorIsolation: true,
+			proxyIsolation: true},
+		networks: map[string]network{
+			"ipv4": {reachable: true, proxy: "127.0.0.1:9050",
+				randomize: true},
+			"ipv6": {reachable: true, proxy: "127.0.0.1:9050",
+				randomize: true},
+			"onion": {reachable: true, proxy: "127.0.0.1:9050",
+				randomize: true},
+			"i2p":   unreachable,
+			"cjdns": unreachable,
+		},
+	}, {
+		name: "onion proxy",
+		cfg:  config{OnionProxy: "127.0.0.1:9051", TorIsolation: true},
+		networks: map[string]network{
+			"ipv4": direct,
+			"ipv6": direct,
+			"onion": {reachable: true, proxy: "127.0.0.1:9051",
+				randomize: true},
+			"i2p":   unreachable,
+			"cjdns": direct,
+		},
+	}, {
+		name: "proxy without onion",
+		cfg:  config{Proxy: "127.0.0.1:1080", NoOnion: true},
+		networks: map[string]network{
+			"ipv4":  {reachable: true, proxy: "127.0.0.1:1080"},
+			"ipv6":  {reachable: true, proxy: "127.0.0.1:1080"},
+			"onion": unreachable,
+			"i2p":   unreachable,
+			"cjdns": unreachable,
+		},
+	}, {
+		name: "only onion and cjdns",
+		cfg: config{OnionProxy: "127.0.0.1:9051", onlyNets: map[string]struct{}{
+			"onion": {}, "cjdns": {},
+		}},
+		networks: map[string]network{
+			"ipv4":  {limited: true},
+			"ipv6":  {limited: true},
+			"onion": {reachable: true, proxy: "127.0.0.1:9051"},
+			"i2p":   {limited: true},
+			"cjdns": direct,
+		},
+	}}
+	for _, test := range tests {
+		cfg = &test.cfg
+		for _, name := range supportedNetworks {
+			want := test.networks[name]
+			proxy, randomize := networkProxy(name)
+			got := network{
+				limited:   isNetworkLimited(name),
+				reachable: isNetworkReachable(name),
+				proxy:     proxy,
+				randomize: randomize,
+			}
+			if got != want {
+				t.Errorf("%s: %s: got %+v, want %+v", test.name,
+					name, got, want)
+			}
+		}
+	}
+
+	// Addresses are reachable when their network is.
+	cfg = &config{onlyNets: map[string]struct{}{"ipv6": {}}}
+	addrs := []struct {
+		host      string
+		cjdns     bool
+		reachable bool
+	}{
+		{"1.2.3.4", false, false},
+		{"2001:db8::1", false, true},
+		{"fc00::1", true, false},
+	}
+	for _, addr := range addrs {
+		na, err := wire.NewNetAddressV2Host(addr.host, 8338, 0, addr.cjdns)
+		if err != nil {
+			t.Fatalf("NewNetAddressV2Host(%s): unexpected error: %v",
+				addr.host, err)
+		}
+		if got := isReachable(na); got != addr.reachable {
+			t.Errorf("isReachable(%s): got %v, want %v", addr.host,
+				got, addr.reachable)
+		}
+	}
+}
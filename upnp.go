@@ -36,28 +36,16 @@ import (
 	"bytes"
 	"encoding/xml"
 	"errors"
+	"fmt"
+	"math/rand"
 	"net"
 	"net/http"
-	"os"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
 )
 
-// NAT is an interface representing a NAT traversal options for example UPNP or
-// NAT-PMP. It provides methods to query and manipulate this traversal to allow
-// access to services.
-type NAT interface {
-	// Get the external address from outside the NAT.
-	GetExternalAddress() (addr net.IP, err error)
-	// Add a port mapping for protocol ("udp" or "tcp") from external port to
-	// internal port with description lasting for timeout.
-	AddPortMapping(protocol string, externalPort, internalPort int, description string, timeout int) (mappedExternalPort int, err error)
-	// Remove a previously added port mapping from external port to
-	// internal port.
-	DeletePortMapping(protocol string, externalPort, internalPort int) (err error)
-}
-
 type upnpNAT struct {
 	serviceURL string
 	ourIP      string
@@ -126,7 +114,7 @@ func Discover() (nat NAT, err error) {
 			return
 		}
 		var ourIP string
-		ourIP, err = getOurIP()
+		ourIP, err = getOurIP(serviceURL)
 		if err != nil {
 			return
 		}
@@ -211,13 +199,18 @@ func getChildService(d *device, serviceType string) *service {
 	return nil
 }
 
-// getOurIP returns a best guess at what the local IP is.
-func getOurIP() (ip string, err error) {
-	hostname, err := os.Hostname()
+// getOurIP returns the local IP used to reach the router at the given service
+// url, which is the internal client port mappings have to forward to.
+func getOurIP(serviceURL string) (ip string, err error) {
+	u, err := url.Parse(serviceURL)
+	if err != nil {
+		return
+	}
+	addr, err := localIPFor(u.Hostname())
 	if err != nil {
 		return
 	}
-	return net.LookupCNAME(hostname)
+	return addr.String(), nil
 }
 
 // getServiceURL parses the xml description at the given root url to find the
@@ -229,7 +222,8 @@ func getServiceURL(rootURL string) (url string, err error) {
 	}
 	defer r.Body.Close()
 	if r.StatusCode >= 400 {
-		err = errors.New(string(r.StatusCode))
+		err = errors.New("Error " + strconv.Itoa(r.StatusCode) +
+			" for " + rootURL)
 		return
 	}
 	var root root
@@ -353,9 +347,53 @@ func (n *upnpNAT) GetExternalAddress() (addr net.IP, err error) {
 	return addr, nil
 }
 
+// upnpMappingAttempts is the number of external ports tried when adding a
+// port mapping.  Routers refuse mappings of external ports which are already
+// forwarded to another client, so random high ports are tried after the
+// requested one.
+const upnpMappingAttempts = 4
+
+// Name returns the name of the port mapping protocol.
+//
+// This is part of the NAT interface implementation.
+func (n *upnpNAT) Name() string {
+	return "UPnP"
+}
+
 // AddPortMapping implements the NAT interface by setting up a port forwarding
 // from the UPnP router to the local machine with the given ports and protocol.
-func (n *upnpNAT) AddPortMapping(protocol string, externalPort, internalPort int, description string, timeout int) (mappedExternalPort int, err error) {
+// The mapping is read back from the router to verify it forwards to us, and
+// random external ports are tried when the requested one can't be mapped.
+func (n *upnpNAT) AddPortMapping(protocol string, externalPort,
+	internalPort int, description string,
+	lifetime time.Duration) (*portMapping, error) {
+
+	var err error
+	for i := 0; i < upnpMappingAttempts; i++ {
+		if i > 0 {
+			externalPort = 1024 + rand.Intn(65535-1024)
+		}
+		err = n.addPortMapping(protocol, externalPort, internalPort,
+			description, lifetime)
+		if err != nil {
+			continue
+		}
+		err = n.verifyPortMapping(protocol, externalPort, internalPort)
+		if err != nil {
+			continue
+		}
+		return &portMapping{
+			externalPort: externalPort,
+			lifetime:     lifetime,
+		}, nil
+	}
+	return nil, err
+}
+
+// addPortMapping sends an AddPortMapping request to the UPnP router.
+func (n *upnpNAT) addPortMapping(protocol string, externalPort,
+	internalPort int, description string, lifetime time.Duration) error {
+
 	// A single concatenation would break ARM compilation.
 	message := "<u:AddPortMapping xmlns:u=\"urn:schemas-upnp-org:service:WANIPConnection:1\">\r\n" +
 		"<NewRemoteHost></NewRemoteHost><NewExternalPort>" + strconv.Itoa(externalPort)
@@ -364,21 +402,55 @@ func (n *upnpNAT) AddPortMapping(protocol string, externalPort, internalPort int
 		"<NewInternalClient>" + n.ourIP + "</NewInternalClient>" +
 		"<NewEnabled>1</NewEnabled><NewPortMappingDescription>"
 	message += description +
-		"</NewPortMappingDescription><NewLeaseDuration>" + strconv.Itoa(timeout) +
+		"</NewPortMappingDescription><NewLeaseDuration>" +
+		strconv.Itoa(int(lifetime/time.Second)) +
 		"</NewLeaseDuration></u:AddPortMapping>"
 
-	response, err := soapRequest(n.serviceURL, "AddPortMapping", message)
+	_, err := soapRequest(n.serviceURL, "AddPortMapping", message)
+	return err
+}
+
+// getSpecificPortMappingEntryResponse represents the XML response to a
+// GetSpecificPortMappingEntry SOAP request.
+type getSpecificPortMappingEntryResponse struct {
+	XMLName        xml.Name `xml:"GetSpecificPortMappingEntryResponse"`
+	InternalPort   int      `xml:"NewInternalPort"`
+	InternalClient string   `xml:"NewInternalClient"`
+	Enabled        string   `xml:"NewEnabled"`
+}
+
+// verifyPortMapping fetches the mapping of the external port from the UPnP
+// router and verifies it forwards to the internal port of the local machine.
+// Routers reply to AddPortMapping requests without the mapping, so this is
+// the only way to know the port was forwarded.
+func (n *upnpNAT) verifyPortMapping(protocol string, externalPort,
+	internalPort int) error {
+
+	message := "<u:GetSpecificPortMappingEntry xmlns:u=\"urn:schemas-upnp-org:service:WANIPConnection:1\">\r\n" +
+		"<NewRemoteHost></NewRemoteHost><NewExternalPort>" + strconv.Itoa(externalPort) +
+		"</NewExternalPort><NewProtocol>" + strings.ToUpper(protocol) + "</NewProtocol>" +
+		"</u:GetSpecificPortMappingEntry>"
+
+	response, err := soapRequest(n.serviceURL, "GetSpecificPortMappingEntry",
+		message)
 	if err != nil {
-		return
+		return err
 	}
 
-	// TODO: check response to see if the port was forwarded
-	// If the port was not wildcard we don't get an reply with the port in
-	// it. Not sure about wildcard yet. miniupnpc just checks for error
-	// codes here.
-	mappedExternalPort = externalPort
-	_ = response
-	return
+	var reply getSpecificPortMappingEntryResponse
+	err = xml.Unmarshal(response, &reply)
+	if err != nil {
+		return err
+	}
+	if reply.InternalPort != internalPort || reply.InternalClient != n.ourIP {
+		return fmt.Errorf("external port %d is forwarded to %s:%d",
+			externalPort, reply.InternalClient, reply.InternalPort)
+	}
+	if reply.Enabled == "0" {
+		return fmt.Errorf("mapping of external port %d is disabled",
+			externalPort)
+	}
+	return nil
 }
 
 // DeletePortMapping implements the NAT interface by removing up a port forwarding
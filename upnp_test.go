@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// upnpDescription is the device description served by the fake UPnP gateway.
+const upnpDescription = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+<specVersion><major>1</major><minor>0</minor></specVersion>
+<device>
+<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+<deviceList><device>
+<deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+<deviceList><device>
+<deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+<serviceList><service>
+<serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+<controlURL>/ctl/IPConn</controlURL>
+</service></serviceList>
+</device></deviceList>
+</device></deviceList>
+</device>
+</root>`
+
+// fakeUPnPGateway is an UPnP internet gateway device which maps ports to the
+// internal client that requests them unless the external port is taken.
+type fakeUPnPGateway struct {
+	mtx      sync.Mutex
+	taken    map[string]bool
+	mappings map[string]string
+}
+
+// soapArg returns the value of the passed argument of a SOAP request.
+func soapArg(body, name string) string {
+	re := regexp.MustCompile("<" + name + ">([^<]*)</" + name + ">")
+	m := re.FindStringSubmatch(body)
+	if m == nil {
+		return ""
+	}
+	return m[1]
+}
+
+// writeSOAP writes a SOAP reply with the passed body.
+func writeSOAP(w http.ResponseWriter, body string) {
+	fmt.Fprintf(w, `<?xml version="1.0"?><s:Envelope `+
+		`xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>%s`+
+		`</s:Body></s:Envelope>`, body)
+}
+
+func (g *fakeUPnPGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/rootDesc.xml" {
+		fmt.Fprint(w, upnpDescription)
+		return
+	}
+	if r.URL.Path != "/ctl/IPConn" {
+		http.NotFound(w, r)
+		return
+	}
+
+	b, _ := ioutil.ReadAll(r.Body)
+	body := string(b)
+	key := soapArg(body, "NewProtocol") + ":" + soapArg(body, "NewExternalPort")
+
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	action := r.Header.Get("SOAPAction")
+	switch {
+	case strings.Contains(action, "#GetExternalIPAddress"):
+		writeSOAP(w, `<u:GetExternalIPAddressResponse `+
+			`xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1">`+
+			`<NewExternalIPAddress>203.0.113.9</NewExternalIPAddress>`+
+			`</u:GetExternalIPAddressResponse>`)
+
+	case strings.Contains(action, "#AddPortMapping"):
+		if g.taken[key] {
+			http.Error(w, "ConflictInMappingEntry", 500)
+			return
+		}
+		g.mappings[key] = soapArg(body, "NewInternalClient") + " " +
+			soapArg(body, "NewInternalPort")
+		writeSOAP(w, `<u:AddPortMappingResponse `+
+			`xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1"/>`)
+
+	case strings.Contains(action, "#GetSpecificPortMappingEntry"):
+		mapping, ok := g.mappings[key]
+		if !ok {
+			http.Error(w, "NoSuchEntryInArray", 500)
+			return
+		}
+		fields := strings.Fields(mapping)
+		writeSOAP(w, `<u:GetSpecificPortMappingEntryResponse `+
+			`xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1">`+
+			`<NewInternalPort>`+fields[1]+`</NewInternalPort>`+
+			`<NewInternalClient>`+fields[0]+`</NewInternalClient>`+
+			`<NewEnabled>1</NewEnabled>`+
+			`</u:GetSpecificPortMappingEntryResponse>`)
+
+	case strings.Contains(action, "#DeletePortMapping"):
+		delete(g.mappings, key)
+		writeSOAP(w, `<u:DeletePortMappingResponse `+
+			`xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1"/>`)
+
+	default:
+		http.Error(w, "Invalid Action", 401)
+	}
+}
+
+// TestUPnP ensures port mappings and the external address are obtained from
+// an UPnP gateway, that mappings are verified and that another external port
+// is tried when the requested one is taken.
+func TestUPnP(t *testing.T) {
+	gateway := &fakeUPnPGateway{
+		taken:    map[string]bool{"TCP:8338": true},
+		mappings: make(map[string]string),
+	}
+	server := httptest.NewServer(gateway)
+	defer server.Close()
+
+	serviceURL, err := getServiceURL(server.URL + "/rootDesc.xml")
+	if err != nil {
+		t.Fatalf("getServiceURL: unexpected error: %v", err)
+	}
+	if want := server.URL + "/ctl/IPConn"; serviceURL != want {
+		t.Fatalf("getServiceURL: got %q, want %q", serviceURL, want)
+	}
+	ourIP, err := getOurIP(serviceURL)
+	if err != nil {
+		t.Fatalf("getOurIP: unexpected error: %v", err)
+	}
+	if ourIP != "127.0.0.1" {
+		t.Fatalf("getOurIP: got %q, want %q", ourIP, "127.0.0.1")
+	}
+	nat := &upnpNAT{serviceURL: serviceURL, ourIP: ourIP}
+
+	ip, err := nat.GetExternalAddress()
+	if err != nil {
+		t.Fatalf("GetExternalAddress: unexpected error: %v", err)
+	}
+	if ip.String() != "203.0.113.9" {
+		t.Fatalf("GetExternalAddress: got %v, want 203.0.113.9", ip)
+	}
+
+	// The requested external port is taken, so a random one is mapped.
+	mapping, err := nat.AddPortMapping("tcp", 8338, 8338, "test",
+		20*time.Minute)
+	if err != nil {
+		t.Fatalf("AddPortMapping: unexpected error: %v", err)
+	}
+	if mapping.externalPort == 8338 || mapping.lifetime != 20*time.Minute {
+		t.Fatalf("AddPortMapping: got port %d lifetime %v",
+			mapping.externalPort, mapping.lifetime)
+	}
+	key := "TCP:" + strconv.Itoa(mapping.externalPort)
+	if got := gateway.mappings[key]; got != "127.0.0.1 8338" {
+		t.Fatalf("AddPortMapping: gateway maps %s to %q", key, got)
+	}
+
+	if err := nat.DeletePortMapping("tcp", mapping.externalPort,
+		8338); err != nil {
+		t.Fatalf("DeletePortMapping: unexpected error: %v", err)
+	}
+	if _, ok := gateway.mappings[key]; ok {
+		t.Fatal("DeletePortMapping: mapping was not removed")
+	}
+
+	// Mappings which forward to another client are rejected.
+	nat.ourIP = "10.0.0.2"
+	gateway.mappings["TCP:18333"] = "10.0.0.3 8338"
+	if err := nat.verifyPortMapping("tcp", 18333, 8338); err == nil {
+		t.Fatal("verifyPortMapping: expected error for another client")
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright (c) 2013-2016 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package v2transport
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	// rekeyInterval is the number of messages encrypted with a key before
+	// the ciphers switch to a new key.
+	rekeyInterval = 224
+
+	// keyLen is the length of the cipher keys.
+	keyLen = 32
+)
+
+// rekeyNonce returns the 96-bit nonce made up of a 32-bit and a 64-bit little
+// endian counter which is used by the forward secure ciphers.
+func rekeyNonce(counter uint32, rekeyCounter uint64) [12]byte {
+	var nonce [12]byte
+	binary.LittleEndian.PutUint32(nonce[:4], counter)
+	binary.LittleEndian.PutUint64(nonce[4:], rekeyCounter)
+	return nonce
+}
+
+// fsChaCha20 is the forward secure ChaCha20 stream cipher used to encrypt the
+// packet lengths.  The keystream continues across chunks and the key is
+// replaced with keystream output after every rekeyInterval chunks.
+type fsChaCha20 struct {
+	stream       *chacha20.Cipher
+	chunkCounter uint32
+	rekeyCounter uint64
+}
+
+// newFSChaCha20 returns a forward secure ChaCha20 cipher with the passed
+// initial key.
+func newFSChaCha20(key []byte) *fsChaCha20 {
+	c := &fsChaCha20{}
+	c.setKey(key)
+	return c
+}
+
+// setKey switches the keystream to the passed key and the nonce of the current
+// rekey counter.
+func (c *fsChaCha20) setKey(key []byte) {
+	nonce := rekeyNonce(0, c.rekeyCounter)
+
+	// NewUnauthenticatedCipher only fails for keys and nonces of the
+	// wrong length.
+	c.stream, _ = chacha20.NewUnauthenticatedCipher(key, nonce[:])
+}
+
+// crypt encrypts or decrypts the passed chunk in place.
+func (c *fsChaCha20) crypt(chunk []byte) {
+	c.stream.XORKeyStream(chunk, chunk)
+
+	c.chunkCounter++
+	if c.chunkCounter == rekeyInterval {
+		var key [keyLen]byte
+		c.stream.XORKeyStream(key[:], key[:])
+		c.chunkCounter = 0
+		c.rekeyCounter++
+		c.setKey(key[:])
+	}
+}
+
+// fsChaCha20Poly1305 is the forward secure ChaCha20-Poly1305 AEAD used to
+// encrypt the packet contents.  The nonce is derived from the packet and
+// rekey counters and the key is replaced after every rekeyInterval packets.
+type fsChaCha20Poly1305 struct {
+	key           [keyLen]byte
+	aead          cipher.AEAD
+	packetCounter uint32
+	rekeyCounter  uint64
+}
+
+// newFSChaCha20Poly1305 returns a forward secure ChaCha20-Poly1305 AEAD with
+// the passed initial key.
+func newFSChaCha20Poly1305(key []byte) *fsChaCha20Poly1305 {
+	c := &fsChaCha20Poly1305{}
+	c.setKey(key)
+	return c
+}
+
+// setKey switches the AEAD to the passed key.
+func (c *fsChaCha20Poly1305) setKey(key []byte) {
+	copy(c.key[:], key)
+
+	// New only fails for keys of the wrong length.
+	c.aead, _ = chacha20poly1305.New(c.key[:])
+}
+
+// nextPacket advances the packet counter and switches to a new key once
+// rekeyInterval packets have been processed.  The new key is the encryption of
+// 32 zero bytes with the nonce with a packet counter of 0xffffffff, which is
+// never used to encrypt a packet.  Like the packet contents, it is encrypted
+// with the keystream starting at block 1 since block 0 is used for the
+// Poly1305 key.
+func (c *fsChaCha20Poly1305) nextPacket() {
+	c.packetCounter++
+	if c.packetCounter == rekeyInterval {
+		nonce := rekeyNonce(0xffffffff, c.rekeyCounter)
+		stream, _ := chacha20.NewUnauthenticatedCipher(c.key[:],
+			nonce[:])
+		stream.SetCounter(1)
+		var key [keyLen]byte
+		stream.XORKeyStream(key[:], key[:])
+		c.setKey(key[:])
+		c.packetCounter = 0
+		c.rekeyCounter++
+	}
+}
+
+// encrypt appends the encryption of the passed plaintext authenticated along
+// with the additional data to dst.
+func (c *fsChaCha20Poly1305) encrypt(dst, plaintext, aad []byte) []byte {
+	nonce := rekeyNonce(c.packetCounter, c.rekeyCounter)
+	dst = c.aead.Seal(dst, nonce[:], plaintext, aad)
+	c.nextPacket()
+	return dst
+}
+
+// decrypt appends the decryption of the passed ciphertext to dst after
+// verifying it along with the additional data.
+func (c *fsChaCha20Poly1305) decrypt(dst, ciphertext, aad []byte) ([]byte, error) {
+	nonce := rekeyNonce(c.packetCounter, c.rekeyCounter)
+	dst, err := c.aead.Open(dst, nonce[:], ciphertext, aad)
+	if err != nil {
+		return nil, err
+	}
+	c.nextPacket()
+	return dst, nil
+}
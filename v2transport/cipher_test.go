@@ -0,0 +1,118 @@
+// Copyright (c) 2013-2016 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package v2transport
+
+import (
+	"bytes"
+	"testing"
+
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// TestFSChaCha20 ensures the length cipher continues the keystream across
+// chunks and rekeys with the keystream which follows after rekeyInterval
+// chunks.
+func TestFSChaCha20(t *testing.T) {
+	var key [keyLen]byte
+	for i := range key {
+		key[i] = byte(i)
+	}
+	enc := newFSChaCha20(key[:])
+	dec := newFSChaCha20(key[:])
+
+	// keystream returns the passed number of keystream bytes for the passed
+	// key and rekey counter.
+	keystream := func(key []byte, rekeyCounter uint64, n int) []byte {
+		nonce := rekeyNonce(0, rekeyCounter)
+		c, err := chacha20.NewUnauthenticatedCipher(key, nonce[:])
+		if err != nil {
+			t.Fatalf("NewUnauthenticatedCipher: unexpected error: %v",
+				err)
+		}
+		stream := make([]byte, n)
+		c.XORKeyStream(stream, stream)
+		return stream
+	}
+
+	stream := keystream(key[:], 0, rekeyInterval*3+keyLen)
+	for i := 0; i < rekeyInterval; i++ {
+		chunk := []byte{byte(i), 0, 0}
+		enc.crypt(chunk)
+		want := []byte{byte(i) ^ stream[i*3], stream[i*3+1], stream[i*3+2]}
+		if !bytes.Equal(chunk, want) {
+			t.Fatalf("chunk %d: got %x, want %x", i, chunk, want)
+		}
+		dec.crypt(chunk)
+		if chunk[0] != byte(i) {
+			t.Fatalf("chunk %d: decrypted to %x", i, chunk)
+		}
+	}
+	if enc.rekeyCounter != 1 || enc.chunkCounter != 0 {
+		t.Fatalf("rekey: got counters %d/%d", enc.rekeyCounter,
+			enc.chunkCounter)
+	}
+
+	// The new key is the keystream which follows the last chunk.
+	newKey := stream[rekeyInterval*3:]
+	chunk := make([]byte, 3)
+	enc.crypt(chunk)
+	if want := keystream(newKey, 1, 3); !bytes.Equal(chunk, want) {
+		t.Fatalf("rekey: got %x, want %x", chunk, want)
+	}
+}
+
+// TestFSChaCha20Poly1305 ensures the packet cipher round trips across rekeys,
+// uses the expected nonces and keys and rejects tampered packets.
+func TestFSChaCha20Poly1305(t *testing.T) {
+	var key [keyLen]byte
+	key[0] = 1
+	enc := newFSChaCha20Poly1305(key[:])
+	dec := newFSChaCha20Poly1305(key[:])
+
+	aead, _ := chacha20poly1305.New(key[:])
+	for i := 0; i < 2*rekeyInterval+1; i++ {
+		// The key is replaced with the encryption of 32 zero bytes
+		// with the nonce of packet 0xffffffff after every rekey
+		// interval.
+		rekeyCounter := uint64(i / rekeyInterval)
+		if i > 0 && i%rekeyInterval == 0 {
+			nonce := rekeyNonce(0xffffffff, rekeyCounter-1)
+			zeros := make([]byte, keyLen)
+			newKey := aead.Seal(nil, nonce[:], zeros, nil)
+			aead, _ = chacha20poly1305.New(newKey[:keyLen])
+		}
+
+		plaintext := []byte{byte(i), byte(i >> 8)}
+		aad := []byte{byte(i)}
+		ciphertext := enc.encrypt(nil, plaintext, aad)
+
+		// Packets are encrypted with the packet and rekey counters as
+		// the nonce.
+		nonce := rekeyNonce(uint32(i%rekeyInterval), rekeyCounter)
+		want := aead.Seal(nil, nonce[:], plaintext, aad)
+		if !bytes.Equal(ciphertext, want) {
+			t.Fatalf("packet %d: got %x, want %x", i, ciphertext,
+				want)
+		}
+
+		got, err := dec.decrypt(nil, ciphertext, aad)
+		if err != nil {
+			t.Fatalf("packet %d: unexpected error: %v", i, err)
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Fatalf("packet %d: got %x, want %x", i, got, plaintext)
+		}
+	}
+	if enc.rekeyCounter != 2 || enc.key == key {
+		t.Fatalf("rekey: got rekey counter %d", enc.rekeyCounter)
+	}
+
+	ciphertext := enc.encrypt(nil, []byte{1}, nil)
+	ciphertext[0] ^= 1
+	if _, err := dec.decrypt(nil, ciphertext, nil); err == nil {
+		t.Fatal("decrypt: expected error for tampered packet")
+	}
+}
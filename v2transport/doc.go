@@ -0,0 +1,21 @@
+// Copyright (c) 2013-2016 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+/*
+Package v2transport implements the BIP0324 version 2 encrypted peer-to-peer
+transport protocol.
+
+The v2 transport replaces the plaintext message header framing of the original
+protocol with authenticated encryption.  Both parties exchange ElligatorSwift
+encoded public keys, which are indistinguishable from random bytes, followed
+by a random amount of garbage.  The ECDH shared secret is used to derive the
+keys of ChaCha20-Poly1305 ciphers for each direction which are rekeyed
+periodically to provide forward secrecy.  Messages are sent as packets with an
+encrypted length and frequently used message types are encoded with a single
+byte.
+
+A responder detects initiators which use the original protocol, allowing nodes
+to accept both kinds of connections on the same port.
+*/
+package v2transport
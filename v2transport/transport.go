@@ -0,0 +1,558 @@
+// Copyright (c) 2013-2016 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package v2transport
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/btgsuite/btgd/btcec"
+	"github.com/btgsuite/btgd/wire"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// GarbageTerminatorLen is the length of the garbage terminators which
+	// end the garbage sent after the public keys.
+	GarbageTerminatorLen = 16
+
+	// MaxGarbageLen is the maximum amount of garbage which may be sent
+	// after a public key.
+	MaxGarbageLen = 4095
+
+	// SessionIDLen is the length of the session ID which identifies an
+	// encrypted session.
+	SessionIDLen = 32
+
+	// lengthFieldLen is the length of the encrypted length field which
+	// precedes each packet.
+	lengthFieldLen = 3
+
+	// headerLen is the length of the encrypted packet header.
+	headerLen = 1
+
+	// tagLen is the length of the authentication tag of each packet.
+	tagLen = 16
+
+	// ignoreBit is the header bit which marks decoy packets that must be
+	// ignored by the receiver.
+	ignoreBit = 0x80
+
+	// maxContentsLen is the maximum length of the contents of a packet.  It
+	// allows for the largest message payload along with the long form
+	// message type.
+	maxContentsLen = 1 + wire.CommandSize + wire.MaxMessagePayload
+
+	// v1PrefixLen is the length of the start of a v1 version message which
+	// is used to detect v1 peers.
+	v1PrefixLen = 16
+
+	// sharedSecretSalt is the prefix of the salt used to derive the session
+	// keys.  The network magic is appended to it.
+	sharedSecretSalt = "bitcoin_v2_shared_secret"
+)
+
+var (
+	// ErrV1Peer is returned by the handshake of a responding transport when
+	// the initiator uses the v1 transport.  The bytes of the connection
+	// read during the attempt are available from V1Reader.
+	ErrV1Peer = errors.New("peer uses the v1 transport protocol")
+
+	// ErrV1Responder is returned by the handshake of an initiating
+	// transport when the responder closes the connection without sending
+	// anything, which is how responders that only support the v1
+	// transport react to the public key.
+	ErrV1Responder = errors.New("peer closed the connection without " +
+		"replying, it likely only supports the v1 transport protocol")
+
+	// ErrGarbageTerminator is returned when the garbage terminator is not
+	// received within the maximum amount of garbage.
+	ErrGarbageTerminator = errors.New("garbage terminator not received")
+
+	// ErrPacketTooLarge is returned when the length of a received packet
+	// exceeds the maximum.
+	ErrPacketTooLarge = errors.New("packet too large")
+
+	// ErrDecrypt is returned when a received packet fails authentication.
+	ErrDecrypt = errors.New("packet authentication failed")
+
+	// ErrHandshake is returned when messages are sent or received before
+	// the handshake has completed.
+	ErrHandshake = errors.New("v2 handshake not complete")
+)
+
+// shortMsgIDs maps the one byte message type IDs to the commands they
+// represent.  ID zero indicates the command follows in its 12-byte form.
+var shortMsgIDs = [...]string{
+	1:  wire.CmdAddr,
+	2:  wire.CmdBlock,
+	3:  "blocktxn",
+	4:  "cmpctblock",
+	5:  wire.CmdFeeFilter,
+	6:  wire.CmdFilterAdd,
+	7:  wire.CmdFilterClear,
+	8:  wire.CmdFilterLoad,
+	9:  wire.CmdGetBlocks,
+	10: "getblocktxn",
+	11: wire.CmdGetData,
+	12: wire.CmdGetHeaders,
+	13: wire.CmdHeaders,
+	14: wire.CmdInv,
+	15: wire.CmdMemPool,
+	16: wire.CmdMerkleBlock,
+	17: wire.CmdNotFound,
+	18: wire.CmdPing,
+	19: wire.CmdPong,
+	20: "sendcmpct",
+	21: wire.CmdTx,
+	22: wire.CmdGetCFilters,
+	23: wire.CmdCFilter,
+	24: wire.CmdGetCFHeaders,
+	25: wire.CmdCFHeaders,
+	26: wire.CmdGetCFCheckpt,
+	27: wire.CmdCFCheckpt,
+	28: wire.CmdAddrV2,
+}
+
+// shortMsgIDsByCmd maps commands to their one byte message type IDs.
+var shortMsgIDsByCmd = func() map[string]byte {
+	m := make(map[string]byte, len(shortMsgIDs))
+	for id, cmd := range shortMsgIDs {
+		if cmd != "" {
+			m[cmd] = byte(id)
+		}
+	}
+	return m
+}()
+
+// Transport implements the BIP0324 v2 encrypted transport protocol over a
+// connection.  After the handshake completes, ReadMessage and WriteMessage
+// may be called concurrently with each other, however neither may be called
+// concurrently with itself.
+type Transport struct {
+	r          *bufio.Reader
+	w          io.Writer
+	btcnet     wire.BitcoinNet
+	initiating bool
+
+	// v1Prefix holds the bytes read by a responder which detected a v1
+	// initiator.
+	v1Prefix []byte
+
+	sendL *fsChaCha20
+	sendP *fsChaCha20Poly1305
+	recvL *fsChaCha20
+	recvP *fsChaCha20Poly1305
+
+	sendGarbageTerminator [GarbageTerminatorLen]byte
+	recvGarbageTerminator [GarbageTerminatorLen]byte
+	sessionID             [SessionIDLen]byte
+
+	// recvAAD is the garbage received from the other party which is
+	// authenticated along with the first received packet.
+	recvAAD []byte
+
+	complete bool
+}
+
+// NewTransport returns a v2 transport over the passed connection for the
+// passed bitcoin network.  Initiating specifies whether we opened the
+// connection.  Handshake must be called before messages are exchanged.
+func NewTransport(rw io.ReadWriter, btcnet wire.BitcoinNet, initiating bool) *Transport {
+	return &Transport{
+		r:          bufio.NewReader(rw),
+		w:          rw,
+		btcnet:     btcnet,
+		initiating: initiating,
+	}
+}
+
+// v1Prefix returns the start of a v1 version message on the passed network.
+func v1Prefix(btcnet wire.BitcoinNet) []byte {
+	prefix := make([]byte, v1PrefixLen)
+	binary.LittleEndian.PutUint32(prefix, uint32(btcnet))
+	copy(prefix[4:], wire.CmdVersion)
+	return prefix
+}
+
+// randomGarbage returns a random amount of random garbage.
+func randomGarbage() ([]byte, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(MaxGarbageLen+1))
+	if err != nil {
+		return nil, err
+	}
+	garbage := make([]byte, n.Int64())
+	if _, err := rand.Read(garbage); err != nil {
+		return nil, err
+	}
+	return garbage, nil
+}
+
+// Handshake performs the v2 handshake with a random key and random garbage.
+// A responding transport returns ErrV1Peer when the initiator uses the v1
+// transport, in which case the connection should continue with the v1
+// protocol reading from V1Reader.
+func (t *Transport) Handshake() error {
+	var priv *btcec.PrivateKey
+	var ourPubKey [btcec.EllSwiftPubKeyLen]byte
+	for {
+		var err error
+		priv, ourPubKey, err = btcec.NewEllSwiftPrivateKey()
+		if err != nil {
+			return err
+		}
+
+		// Initiators must not send a public key which the responder
+		// would mistake for the start of a v1 version message.
+		prefix := v1Prefix(t.btcnet)
+		if !t.initiating || !bytes.Equal(ourPubKey[:v1PrefixLen], prefix) {
+			break
+		}
+	}
+	garbage, err := randomGarbage()
+	if err != nil {
+		return err
+	}
+	return t.handshake(priv, &ourPubKey, garbage)
+}
+
+// isDisconnect returns whether the passed read error indicates that the remote
+// peer closed or reset the connection, as opposed to a timeout or the local
+// end closing it.
+func isDisconnect(err error) bool {
+	if err == io.EOF {
+		return true
+	}
+	opErr, ok := err.(*net.OpError)
+	if !ok {
+		return false
+	}
+	sysErr, ok := opErr.Err.(*os.SyscallError)
+	return ok && sysErr.Err == syscall.ECONNRESET
+}
+
+// handshake performs the v2 handshake using the passed private key, its
+// ElligatorSwift encoded public key and garbage.
+func (t *Transport) handshake(priv *btcec.PrivateKey,
+	ourPubKey *[btcec.EllSwiftPubKeyLen]byte, garbage []byte) error {
+
+	var theirPubKey [btcec.EllSwiftPubKeyLen]byte
+	if t.initiating {
+		if err := t.write(ourPubKey[:], garbage); err != nil {
+			return err
+		}
+		n, err := io.ReadFull(t.r, theirPubKey[:])
+		if err != nil {
+			if n == 0 && isDisconnect(err) {
+				return ErrV1Responder
+			}
+			return err
+		}
+	} else {
+		// Detect initiators using the v1 protocol by the start of their
+		// version message.  Initiators using the v2 protocol never send
+		// a public key starting with the same bytes.
+		if _, err := io.ReadFull(t.r, theirPubKey[:v1PrefixLen]); err != nil {
+			return err
+		}
+		if bytes.Equal(theirPubKey[:v1PrefixLen], v1Prefix(t.btcnet)) {
+			t.v1Prefix = append([]byte(nil), theirPubKey[:v1PrefixLen]...)
+			return ErrV1Peer
+		}
+		if _, err := io.ReadFull(t.r, theirPubKey[v1PrefixLen:]); err != nil {
+			return err
+		}
+		if err := t.write(ourPubKey[:], garbage); err != nil {
+			return err
+		}
+	}
+
+	secret, err := btcec.V2ECDH(priv, &theirPubKey, ourPubKey, t.initiating)
+	if err != nil {
+		return err
+	}
+	t.initCiphers(secret[:])
+
+	// Send the garbage terminator followed by the version packet, which
+	// authenticates the garbage that was sent.  The version packet has no
+	// contents since no transport extensions are defined.
+	packet := t.encryptPacket(nil, garbage, false)
+	if err := t.write(t.sendGarbageTerminator[:], packet); err != nil {
+		return err
+	}
+
+	// Skip the garbage of the other party and read packets until the
+	// version packet is received.  The garbage is authenticated with the
+	// first packet, which may be a decoy.
+	if err := t.readGarbage(); err != nil {
+		return err
+	}
+	for {
+		_, ignore, err := t.readPacket()
+		if err != nil {
+			return err
+		}
+		if !ignore {
+			break
+		}
+	}
+	t.complete = true
+	return nil
+}
+
+// initCiphers derives the session keys, garbage terminators and session ID
+// from the ECDH shared secret.
+func (t *Transport) initCiphers(secret []byte) {
+	salt := []byte(sharedSecretSalt)
+	var magic [4]byte
+	binary.LittleEndian.PutUint32(magic[:], uint32(t.btcnet))
+	salt = append(salt, magic[:]...)
+	prk := hkdf.Extract(sha256.New, secret, salt)
+	expand := func(info string, n int) []byte {
+		out := make([]byte, n)
+		// Expanding fewer than 255 hash lengths never fails.
+		io.ReadFull(hkdf.Expand(sha256.New, prk, []byte(info)), out)
+		return out
+	}
+
+	initiatorL := expand("initiator_L", keyLen)
+	initiatorP := expand("initiator_P", keyLen)
+	responderL := expand("responder_L", keyLen)
+	responderP := expand("responder_P", keyLen)
+	terminators := expand("garbage_terminators", 2*GarbageTerminatorLen)
+	copy(t.sessionID[:], expand("session_id", SessionIDLen))
+
+	if t.initiating {
+		t.sendL = newFSChaCha20(initiatorL)
+		t.sendP = newFSChaCha20Poly1305(initiatorP)
+		t.recvL = newFSChaCha20(responderL)
+		t.recvP = newFSChaCha20Poly1305(responderP)
+		copy(t.sendGarbageTerminator[:], terminators[:GarbageTerminatorLen])
+		copy(t.recvGarbageTerminator[:], terminators[GarbageTerminatorLen:])
+	} else {
+		t.sendL = newFSChaCha20(responderL)
+		t.sendP = newFSChaCha20Poly1305(responderP)
+		t.recvL = newFSChaCha20(initiatorL)
+		t.recvP = newFSChaCha20Poly1305(initiatorP)
+		copy(t.sendGarbageTerminator[:], terminators[GarbageTerminatorLen:])
+		copy(t.recvGarbageTerminator[:], terminators[:GarbageTerminatorLen])
+	}
+}
+
+// write writes the concatenation of the passed byte slices with a single
+// write to the connection.
+func (t *Transport) write(parts ...[]byte) error {
+	var buf []byte
+	for _, part := range parts {
+		buf = append(buf, part...)
+	}
+	_, err := t.w.Write(buf)
+	return err
+}
+
+// readGarbage reads the garbage of the other party up to and including the
+// garbage terminator.
+func (t *Transport) readGarbage() error {
+	buf := make([]byte, GarbageTerminatorLen, GarbageTerminatorLen+MaxGarbageLen)
+	if _, err := io.ReadFull(t.r, buf); err != nil {
+		return err
+	}
+	for !bytes.HasSuffix(buf, t.recvGarbageTerminator[:]) {
+		if len(buf) == cap(buf) {
+			return ErrGarbageTerminator
+		}
+		b, err := t.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		buf = append(buf, b)
+	}
+	t.recvAAD = buf[:len(buf)-GarbageTerminatorLen]
+	return nil
+}
+
+// encryptPacket returns the encrypted packet for the passed contents.  The
+// additional data is authenticated along with the packet.  Ignore marks the
+// packet as a decoy.
+func (t *Transport) encryptPacket(contents, aad []byte, ignore bool) []byte {
+	packet := make([]byte, lengthFieldLen, lengthFieldLen+headerLen+
+		len(contents)+tagLen)
+	packet[0] = byte(len(contents))
+	packet[1] = byte(len(contents) >> 8)
+	packet[2] = byte(len(contents) >> 16)
+	t.sendL.crypt(packet)
+
+	plaintext := make([]byte, headerLen, headerLen+len(contents))
+	if ignore {
+		plaintext[0] = ignoreBit
+	}
+	plaintext = append(plaintext, contents...)
+	return t.sendP.encrypt(packet, plaintext, aad)
+}
+
+// readPacket reads and decrypts the next packet and returns its contents and
+// whether it is a decoy packet.
+func (t *Transport) readPacket() ([]byte, bool, error) {
+	var length [lengthFieldLen]byte
+	if _, err := io.ReadFull(t.r, length[:]); err != nil {
+		return nil, false, err
+	}
+	t.recvL.crypt(length[:])
+	contentsLen := int(length[0]) | int(length[1])<<8 | int(length[2])<<16
+	if contentsLen > maxContentsLen {
+		return nil, false, ErrPacketTooLarge
+	}
+
+	ciphertext := make([]byte, headerLen+contentsLen+tagLen)
+	if _, err := io.ReadFull(t.r, ciphertext); err != nil {
+		return nil, false, err
+	}
+	plaintext, err := t.recvP.decrypt(ciphertext[:0], ciphertext, t.recvAAD)
+	if err != nil {
+		return nil, false, ErrDecrypt
+	}
+	t.recvAAD = nil
+	return plaintext[headerLen:], plaintext[0]&ignoreBit != 0, nil
+}
+
+// V1Reader returns a reader which reads the connection of a responding
+// transport from the start after the handshake returned ErrV1Peer.
+func (t *Transport) V1Reader() io.Reader {
+	return io.MultiReader(bytes.NewReader(t.v1Prefix), t.r)
+}
+
+// SessionID returns the ID of the encrypted session.  Both parties derive the
+// same session ID, which may be compared out of band to detect a man in the
+// middle.
+func (t *Transport) SessionID() [SessionIDLen]byte {
+	return t.sessionID
+}
+
+// WriteDecoy sends a decoy packet with the passed contents which the other
+// party ignores.  It may be used to obscure traffic patterns.
+func (t *Transport) WriteDecoy(contents []byte) (int, error) {
+	if !t.complete {
+		return 0, ErrHandshake
+	}
+	packet := t.encryptPacket(contents, nil, true)
+	return t.w.Write(packet)
+}
+
+// WriteMessage encrypts and sends the passed message.  It returns the number
+// of bytes written.
+func (t *Transport) WriteMessage(msg wire.Message, pver uint32,
+	enc wire.MessageEncoding) (int, error) {
+
+	if !t.complete {
+		return 0, ErrHandshake
+	}
+
+	cmd := msg.Command()
+	var contents bytes.Buffer
+	if id, ok := shortMsgIDsByCmd[cmd]; ok {
+		contents.WriteByte(id)
+	} else {
+		if len(cmd) > wire.CommandSize {
+			return 0, fmt.Errorf("command [%s] is too long [max %v]",
+				cmd, wire.CommandSize)
+		}
+		var command [wire.CommandSize]byte
+		copy(command[:], cmd)
+		contents.WriteByte(0)
+		contents.Write(command[:])
+	}
+	header := contents.Len()
+	if err := msg.BtcEncode(&contents, pver, enc); err != nil {
+		return 0, err
+	}
+
+	// Enforce the same payload limits as the v1 transport.
+	payloadLen := contents.Len() - header
+	if payloadLen > wire.MaxMessagePayload {
+		return 0, fmt.Errorf("message payload is too large - encoded %d "+
+			"bytes, but maximum message payload is %d bytes",
+			payloadLen, wire.MaxMessagePayload)
+	}
+	if mpl := msg.MaxPayloadLength(pver); uint32(payloadLen) > mpl {
+		return 0, fmt.Errorf("message payload is too large - encoded %d "+
+			"bytes, but maximum message payload size for messages of "+
+			"type [%s] is %d", payloadLen, cmd, mpl)
+	}
+
+	packet := t.encryptPacket(contents.Bytes(), nil, false)
+	return t.w.Write(packet)
+}
+
+// ReadMessage reads, decrypts and parses the next message.  Decoy packets are
+// skipped.  The number of bytes read, the message and its raw payload are
+// returned.  Unknown message types result in a *wire.MessageError, which does
+// not indicate a problem with the transport.
+func (t *Transport) ReadMessage(pver uint32,
+	enc wire.MessageEncoding) (int, wire.Message, []byte, error) {
+
+	if !t.complete {
+		return 0, nil, nil, ErrHandshake
+	}
+
+	var totalBytes int
+	for {
+		contents, ignore, err := t.readPacket()
+		if contents != nil {
+			totalBytes += lengthFieldLen + headerLen + len(contents) +
+				tagLen
+		}
+		if err != nil {
+			return totalBytes, nil, nil, err
+		}
+		if ignore {
+			continue
+		}
+
+		if len(contents) == 0 {
+			return totalBytes, nil, nil, messageError("ReadMessage",
+				"empty packet contents")
+		}
+		var cmd string
+		payload := contents[1:]
+		if id := contents[0]; id != 0 {
+			if int(id) >= len(shortMsgIDs) || shortMsgIDs[id] == "" {
+				str := fmt.Sprintf("unknown message type ID %d", id)
+				return totalBytes, nil, nil, messageError(
+					"ReadMessage", str)
+			}
+			cmd = shortMsgIDs[id]
+		} else {
+			if len(payload) < wire.CommandSize {
+				return totalBytes, nil, nil, messageError(
+					"ReadMessage", "truncated message type")
+			}
+			cmd = string(bytes.TrimRight(payload[:wire.CommandSize],
+				"\x00"))
+			payload = payload[wire.CommandSize:]
+		}
+
+		msg, err := wire.ReadMessagePayload(cmd, payload, pver, enc)
+		if err != nil {
+			return totalBytes, nil, nil, err
+		}
+		return totalBytes, msg, payload, nil
+	}
+}
+
+// messageError creates a wire.MessageError for the passed function and
+// description.
+func messageError(f string, desc string) *wire.MessageError {
+	return &wire.MessageError{Func: "v2transport." + f, Description: desc}
+}
@@ -0,0 +1,415 @@
+// Copyright (c) 2013-2016 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package v2transport
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/btgsuite/btgd/btcec"
+	"github.com/btgsuite/btgd/wire"
+)
+
+const testPver = wire.ProtocolVersion
+
+// bip324TestNet is the network magic the BIP0324 test vectors are derived
+// with, which is the magic of the Bitcoin main network.
+const bip324TestNet wire.BitcoinNet = 0xd9b4bef9
+
+// connPair returns both ends of a loopback TCP connection.  Unlike in-memory
+// pipes, writes are buffered so both parties may send at the same time.
+func connPair(t *testing.T) (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: unexpected error: %v", err)
+	}
+	defer listener.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		accepted <- conn
+	}()
+	outbound, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: unexpected error: %v", err)
+	}
+	inbound := <-accepted
+	if inbound == nil {
+		t.Fatal("Accept failed")
+	}
+	return outbound, inbound
+}
+
+// testVersionMsg returns a version message which round trips through the wire
+// encoding.  The addresses of version messages are encoded without timestamps.
+func testVersionMsg() *wire.MsgVersion {
+	me := &wire.NetAddress{IP: net.ParseIP("1.2.3.4"), Port: 8338}
+	you := &wire.NetAddress{IP: net.ParseIP("5.6.7.8"), Port: 8338}
+	return wire.NewMsgVersion(me, you, 123, 0)
+}
+
+// handshakePair performs the handshake between an initiating and responding
+// transport and returns both transports.
+func handshakePair(t *testing.T) (*Transport, *Transport) {
+	outbound, inbound := connPair(t)
+	initiator := NewTransport(outbound, wire.MainNet, true)
+	responder := NewTransport(inbound, wire.MainNet, false)
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- responder.Handshake()
+	}()
+	if err := initiator.Handshake(); err != nil {
+		t.Fatalf("initiator handshake: unexpected error: %v", err)
+	}
+	if err := <-errChan; err != nil {
+		t.Fatalf("responder handshake: unexpected error: %v", err)
+	}
+	return initiator, responder
+}
+
+// TestTransport ensures messages are exchanged between both parties of a v2
+// connection, including across rekeys and with decoy packets.
+func TestTransport(t *testing.T) {
+	initiator, responder := handshakePair(t)
+	defer initiator.w.(net.Conn).Close()
+	defer responder.w.(net.Conn).Close()
+
+	if initiator.SessionID() != responder.SessionID() {
+		t.Fatal("session IDs differ")
+	}
+
+	// Messages with short IDs, messages with long IDs and decoys.
+	msgs := []wire.Message{
+		wire.NewMsgPing(1),
+		testVersionMsg(),
+		wire.NewMsgVerAck(),
+		wire.NewMsgSendAddrV2(),
+		wire.NewMsgPong(2),
+	}
+	for i := 0; i < 2*rekeyInterval; i++ {
+		msgs = append(msgs, wire.NewMsgPing(uint64(i)))
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		for i, msg := range msgs {
+			if i%3 == 0 {
+				if _, err := initiator.WriteDecoy([]byte{1, 2}); err != nil {
+					done <- err
+					return
+				}
+			}
+			_, err := initiator.WriteMessage(msg, testPver,
+				wire.BaseEncoding)
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	for i, want := range msgs {
+		_, got, _, err := responder.ReadMessage(testPver, wire.BaseEncoding)
+		if err != nil {
+			t.Fatalf("ReadMessage #%d: unexpected error: %v", i, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("ReadMessage #%d: got %v, want %v", i, got, want)
+		}
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("WriteMessage: unexpected error: %v", err)
+	}
+
+	// Messages are also sent in the other direction.
+	go func() {
+		_, err := responder.WriteMessage(wire.NewMsgPong(3), testPver,
+			wire.BaseEncoding)
+		done <- err
+	}()
+	_, msg, _, err := initiator.ReadMessage(testPver, wire.BaseEncoding)
+	if err != nil {
+		t.Fatalf("ReadMessage: unexpected error: %v", err)
+	}
+	if pong, ok := msg.(*wire.MsgPong); !ok || pong.Nonce != 3 {
+		t.Fatalf("ReadMessage: got %v", msg)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("WriteMessage: unexpected error: %v", err)
+	}
+}
+
+// TestShortMsgIDs ensures the short message IDs round trip.
+func TestShortMsgIDs(t *testing.T) {
+	if len(shortMsgIDs) != 29 || len(shortMsgIDsByCmd) != 28 {
+		t.Fatalf("got %d short IDs", len(shortMsgIDsByCmd))
+	}
+	for cmd, id := range shortMsgIDsByCmd {
+		if shortMsgIDs[id] != cmd {
+			t.Errorf("short ID %d: got %s, want %s", id,
+				shortMsgIDs[id], cmd)
+		}
+	}
+	if shortMsgIDsByCmd[wire.CmdAddrV2] != 28 {
+		t.Errorf("addrv2: got short ID %d", shortMsgIDsByCmd[wire.CmdAddrV2])
+	}
+}
+
+// TestTransportV1Fallback ensures a responder detects initiators using the v1
+// protocol and the v1 messages are read in full afterwards.
+func TestTransportV1Fallback(t *testing.T) {
+	outbound, inbound := connPair(t)
+	defer outbound.Close()
+	defer inbound.Close()
+
+	msg := testVersionMsg()
+	go wire.WriteMessage(outbound, msg, testPver, wire.MainNet)
+
+	responder := NewTransport(inbound, wire.MainNet, false)
+	if err := responder.Handshake(); err != ErrV1Peer {
+		t.Fatalf("Handshake: got %v, want %v", err, ErrV1Peer)
+	}
+	got, _, err := wire.ReadMessage(responder.V1Reader(), testPver,
+		wire.MainNet)
+	if err != nil {
+		t.Fatalf("ReadMessage: unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(got, msg) {
+		t.Fatalf("ReadMessage: got %v, want %v", got, msg)
+	}
+}
+
+// TestTransportV1Responder ensures an initiator detects responders which close
+// the connection in response to the public key like v1 responders do, while
+// timeouts are not mistaken for v1 responders.
+func TestTransportV1Responder(t *testing.T) {
+	// Responders using the v1 protocol disconnect after reading a message
+	// header with the wrong network magic.
+	outbound, inbound := connPair(t)
+	defer outbound.Close()
+	go func() {
+		var hdr [24]byte
+		io.ReadFull(inbound, hdr[:])
+		inbound.Close()
+	}()
+	initiator := NewTransport(outbound, wire.MainNet, true)
+	if err := initiator.Handshake(); err != ErrV1Responder {
+		t.Fatalf("Handshake: got %v, want %v", err, ErrV1Responder)
+	}
+
+	// Responders which do not reply in time are not v1 responders.
+	outbound, inbound = connPair(t)
+	defer outbound.Close()
+	defer inbound.Close()
+	outbound.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	initiator = NewTransport(outbound, wire.MainNet, true)
+	err := initiator.Handshake()
+	if err == nil || err == ErrV1Responder {
+		t.Fatalf("Handshake: got %v, want timeout", err)
+	}
+}
+
+// TestTransportErrors ensures tampered packets and missing garbage
+// terminators are detected.
+func TestTransportErrors(t *testing.T) {
+	initiator, responder := handshakePair(t)
+	defer initiator.w.(net.Conn).Close()
+	defer responder.w.(net.Conn).Close()
+
+	// Flip a bit of the encrypted packet contents.
+	var buf bytes.Buffer
+	initiator.w = &buf
+	if _, err := initiator.WriteMessage(wire.NewMsgPing(1), testPver,
+		wire.BaseEncoding); err != nil {
+		t.Fatalf("WriteMessage: unexpected error: %v", err)
+	}
+	packet := buf.Bytes()
+	packet[lengthFieldLen] ^= 1
+	responder.r.Reset(bytes.NewReader(packet))
+	_, _, _, err := responder.ReadMessage(testPver, wire.BaseEncoding)
+	if err != ErrDecrypt {
+		t.Fatalf("ReadMessage: got %v, want %v", err, ErrDecrypt)
+	}
+
+	// A responder which never receives the garbage terminator gives up
+	// after the maximum amount of garbage.
+	outbound, inbound := connPair(t)
+	defer outbound.Close()
+	defer inbound.Close()
+	go func() {
+		garbage := bytes.Repeat([]byte{0xaa}, 64+MaxGarbageLen+
+			GarbageTerminatorLen)
+		outbound.Write(garbage)
+		ioutil.ReadAll(outbound)
+	}()
+	responder = NewTransport(inbound, wire.MainNet, false)
+	if err := responder.Handshake(); err != ErrGarbageTerminator {
+		t.Fatalf("Handshake: got %v, want %v", err, ErrGarbageTerminator)
+	}
+}
+
+// TestTransportVectors ensures the session ID, garbage terminators and packets
+// of the BIP0324 packet encoding test vectors are derived, including packets
+// encrypted after the ciphers were rekeyed, and the packets are decrypted by
+// the other party.
+func TestTransportVectors(t *testing.T) {
+	tests := []struct {
+		priv       string
+		ours       string
+		theirs     string
+		initiating bool
+		idx        int
+		contents   string
+		ignore     bool
+		sessionID  string
+		sendTerm   string
+		recvTerm   string
+
+		// ciphertext is the end of the encrypted packet.
+		ciphertext string
+	}{{
+		priv: "61062ea5071d800bbfd59e2e8b53d47d194b095ae5a4df04936b4977" +
+			"2ef0d4d7",
+		ours: "ec0adff257bbfe500c188c80b4fdd640f6b45a482bbc15fc7cef5931" +
+			"deff0aa186f6eb9bba7b85dc4dcc28b28722de1e3d9108b985e29670" +
+			"45668f66098e475b",
+		theirs: "a4a94dfce69b4a2a0a099313d10f9f7e7d649d60501c9e1d274c30" +
+			"0e0d89aafaffffffffffffffffffffffffffffffffffffffffffffff" +
+			"ffffffffff8faf88d5",
+		initiating: true,
+		idx:        1,
+		contents:   "8e",
+		sessionID: "ce72dffb015da62b0d0f5474cab8bc72605225b0cee3f62312ec" +
+			"680ec5f41ba5",
+		sendTerm:   "faef555dfcdb936425d84aba524758f3",
+		recvTerm:   "02cb8ff24307a6e27de3b4e7ea3fa65b",
+		ciphertext: "7530d2a18720162ac09c25329a60d75adf36eda3c3",
+	}, {
+		priv: "1f9c581b35231838f0f17cf0c979835baccb7f3abbbb96ffcc318ab7" +
+			"1e6e126f",
+		ours: "a1855e10e94e00baa23041d916e259f7044e491da6171269694763f0" +
+			"18c7e63693d29575dcb464ac816baa1be353ba12e3876cba7628bd0b" +
+			"d8e755e721eb0140",
+		theirs: "ffffffffffffffffffffffffffffffffffffffffffffffffffffff" +
+			"fefffffc2f000000000000000000000000000000000000000000000" +
+			"00000000000000000000",
+		initiating: false,
+		idx:        999,
+		contents:   "3eb1d4e98035cfd8eeb29bac969ed3824a",
+		sessionID: "9267c54560607de73f18c563b76a2442718879c52dd39852885d" +
+			"4a3c9912c9ea",
+		sendTerm: "efb64fd80acd3825ac9bc2a67216535a",
+		recvTerm: "b3cb553453bceb002897e751ff7588bf",
+		ciphertext: "1da1bcf589f9b61872f45b7fa5371dd3f8bdf5d515b0c5f9fe9f" +
+			"0044afb8dc0aa1cd39a8c4",
+	}, {
+		priv: "6c77432d1fda31e9f942f8af44607e10f3ad38a65f8a4bddae823e5e" +
+			"ff90dc38",
+		ours: "d2685070c1e6376e633e825296634fd461fa9e5bdf2109bcebd735e5" +
+			"a91f3e587c5cb782abb797fbf6bb5074fd1542a474f2a45b673763ec" +
+			"2db7fb99b737bbb9",
+		theirs: "56bd0c06f10352c3a1a9f4b4c92f6fa2b26df124b57878353c1fc6" +
+			"91c51abea77c8817daeeb9fa546b77c8daf79d89b22b0e1b87574ece" +
+			"42371f00237aa9d83a",
+		initiating: false,
+		idx:        223,
+		contents: "7e0e78eb6990b059e6cf0ded66ea93ef82e72aa2f18ac24f2fc6eb" +
+			"ab561ae557420729da103f64cecfa20527e15f9fb669a49bbbf274ef" +
+			"0389b3e43c8c44e5f60bf2ac38e2b55e7ec4273dba15ba41d21f8f5b" +
+			"3ee1688b3c29951218caf847a97fb50d75a86515d445699497d96816" +
+			"4bf740012679b8962de573be941c62b7ef",
+		ignore: true,
+		sessionID: "7ec02fea8c1484e3d0875f978c5f36d63545e2e4acf563113944" +
+			"22f4b66af612",
+		sendTerm: "cf2e25f23501399f30738d7eee652b90",
+		recvTerm: "225a477a28a54ea7671d2b217a9c29db",
+		ciphertext: "729847a3e9eba7a5bff454b5de3b393431ee360736b6c030d7a5" +
+			"bd01d1203d2e98f528543fd2bf886ccaa1ada5e215a730a36b3f4abf" +
+			"c4e252c89eb01d9512f94916dae8a76bf16e4da28986ffe159090fe5" +
+			"267ee3394300b7ccf4dfad389a26321b3a3423e4594a82ccfbad16d6" +
+			"561ecb8772b0cb040280ff999a29e3d9d4fd",
+	}}
+
+	for i, test := range tests {
+		d, _ := hex.DecodeString(test.priv)
+		priv, _ := btcec.PrivKeyFromBytes(btcec.S256(), d)
+		var ours, theirs [btcec.EllSwiftPubKeyLen]byte
+		oursBytes, _ := hex.DecodeString(test.ours)
+		theirsBytes, _ := hex.DecodeString(test.theirs)
+		copy(ours[:], oursBytes)
+		copy(theirs[:], theirsBytes)
+		secret, err := btcec.V2ECDH(priv, &theirs, &ours, test.initiating)
+		if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+			continue
+		}
+
+		sender := NewTransport(nil, bip324TestNet, test.initiating)
+		sender.initCiphers(secret[:])
+		sessionID := sender.SessionID()
+		if got := hex.EncodeToString(sessionID[:]); got != test.sessionID {
+			t.Errorf("#%d: got session ID %s, want %s", i, got,
+				test.sessionID)
+		}
+		sendTerm := hex.EncodeToString(sender.sendGarbageTerminator[:])
+		recvTerm := hex.EncodeToString(sender.recvGarbageTerminator[:])
+		if sendTerm != test.sendTerm || recvTerm != test.recvTerm {
+			t.Errorf("#%d: got garbage terminators %s/%s, want "+
+				"%s/%s", i, sendTerm, recvTerm, test.sendTerm,
+				test.recvTerm)
+		}
+
+		// Encrypt the packet after idx empty packets.
+		var packets bytes.Buffer
+		for j := 0; j < test.idx; j++ {
+			packets.Write(sender.encryptPacket(nil, nil, false))
+		}
+		contents, _ := hex.DecodeString(test.contents)
+		packet := sender.encryptPacket(contents, nil, test.ignore)
+		packets.Write(packet)
+		got := hex.EncodeToString(packet)
+		if len(got) < len(test.ciphertext) ||
+			got[len(got)-len(test.ciphertext):] != test.ciphertext {
+
+			t.Errorf("#%d: got ciphertext %s, want it to end with %s",
+				i, got, test.ciphertext)
+			continue
+		}
+
+		// The other party decrypts all packets.
+		receiver := NewTransport(nil, bip324TestNet, !test.initiating)
+		receiver.initCiphers(secret[:])
+		receiver.r = bufio.NewReader(&packets)
+		for j := 0; j < test.idx; j++ {
+			if _, _, err := receiver.readPacket(); err != nil {
+				t.Fatalf("#%d: packet %d: unexpected error: %v",
+					i, j, err)
+			}
+		}
+		decrypted, ignore, err := receiver.readPacket()
+		if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+			continue
+		}
+		if !bytes.Equal(decrypted, contents) || ignore != test.ignore {
+			t.Errorf("#%d: got contents %x (ignore %v), want %x "+
+				"(ignore %v)", i, decrypted, ignore, contents,
+				test.ignore)
+		}
+	}
+}
@@ -57,6 +57,8 @@ const (
 	CmdCFilter      = "cfilter"
 	CmdCFHeaders    = "cfheaders"
 	CmdCFCheckpt    = "cfcheckpt"
+	CmdSendAddrV2   = "sendaddrv2"
+	CmdAddrV2       = "addrv2"
 )
 
 // MessageEncoding represents the wire message encoding format to be used.
@@ -180,6 +182,12 @@ func makeEmptyMessage(command string) (Message, error) {
 	case CmdCFCheckpt:
 		msg = &MsgCFCheckpt{}
 
+	case CmdSendAddrV2:
+		msg = &MsgSendAddrV2{}
+
+	case CmdAddrV2:
+		msg = &MsgAddrV2{}
+
 	default:
 		return nil, fmt.Errorf("unhandled command [%s]", command)
 	}
@@ -419,6 +427,44 @@ func ReadMessageWithEncodingN(r io.Reader, pver uint32, btcnet BitcoinNet,
 	return totalBytes, msg, payload, nil
 }
 
+// ReadMessagePayload creates a message of the type identified by the passed
+// command and decodes it from the passed payload.  It is used by transports
+// which do not frame messages with the message header, such as the BIP0324
+// v2 transport, and performs the same command and payload length checks as
+// ReadMessageWithEncodingN.
+func ReadMessagePayload(command string, payload []byte, pver uint32,
+	enc MessageEncoding) (Message, error) {
+
+	if len(payload) > MaxMessagePayload {
+		str := fmt.Sprintf("message payload is too large - %d bytes, "+
+			"but max message payload is %d bytes.", len(payload),
+			MaxMessagePayload)
+		return nil, messageError("ReadMessagePayload", str)
+	}
+	if !utf8.ValidString(command) {
+		str := fmt.Sprintf("invalid command %v", []byte(command))
+		return nil, messageError("ReadMessagePayload", str)
+	}
+	msg, err := makeEmptyMessage(command)
+	if err != nil {
+		return nil, messageError("ReadMessagePayload", err.Error())
+	}
+	mpl := msg.MaxPayloadLength(pver)
+	if uint32(len(payload)) > mpl {
+		str := fmt.Sprintf("payload exceeds max length - %v bytes, but "+
+			"max payload size for messages of type [%v] is %v.",
+			len(payload), command, mpl)
+		return nil, messageError("ReadMessagePayload", str)
+	}
+
+	// NOTE: This must be a *bytes.Buffer since the MsgVersion BtcDecode
+	// function requires it.
+	if err := msg.BtcDecode(bytes.NewBuffer(payload), pver, enc); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
 // ReadMessageN reads, validates, and parses the next bitcoin Message from r for
 // the provided protocol version and bitcoin network.  It returns the number of
 // bytes read in addition to the parsed Message and raw bytes which comprise the
@@ -0,0 +1,137 @@
+// Copyright (c) 2013-2016 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package wire
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/davecgh/go-spew/spew"
+)
+
+// TestAddrV2Wire tests the MsgAddrV2 wire encode and decode for addresses on
+// the various networks.
+func TestAddrV2Wire(t *testing.T) {
+	pver := ProtocolVersion
+	enc := BaseEncoding
+
+	ts := time.Unix(0x495fab29, 0) // 2009-01-03 12:15:05 -0600 CST
+	ipv4 := &NetAddressV2{
+		Timestamp: ts,
+		Services:  SFNodeNetwork,
+		NetworkID: NetIPv4,
+		Addr:      []byte{127, 0, 0, 1},
+		Port:      8333,
+	}
+	torV3 := &NetAddressV2{
+		Timestamp: ts,
+		Services:  SFNodeNetwork | SFNodeWitness,
+		NetworkID: NetTorV3,
+		Addr:      bytes.Repeat([]byte{0x5a}, 32),
+		Port:      8338,
+	}
+
+	msg := NewMsgAddrV2()
+	if cmd := msg.Command(); cmd != "addrv2" {
+		t.Errorf("NewMsgAddrV2: wrong command - got %v want addrv2", cmd)
+	}
+	if err := msg.AddAddresses(ipv4, torV3); err != nil {
+		t.Fatalf("AddAddresses: %v", err)
+	}
+
+	msgEncoded := []byte{
+		0x02,                   // Varint for number of addresses
+		0x29, 0xab, 0x5f, 0x49, // Timestamp
+		0x01,                   // Services varint
+		0x01,                   // Network ID
+		0x04,                   // Address size varint
+		0x7f, 0x00, 0x00, 0x01, // IP 127.0.0.1
+		0x20, 0x8d, // Port 8333 in big-endian
+		0x29, 0xab, 0x5f, 0x49, // Timestamp
+		0x09, // Services varint
+		0x04, // Network ID
+		0x20, // Address size varint
+	}
+	msgEncoded = append(msgEncoded, torV3.Addr...)
+	msgEncoded = append(msgEncoded, 0x20, 0x92) // Port 8338 in big-endian
+
+	var buf bytes.Buffer
+	if err := msg.BtcEncode(&buf, pver, enc); err != nil {
+		t.Fatalf("BtcEncode: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), msgEncoded) {
+		t.Fatalf("BtcEncode\n got: %s want: %s",
+			spew.Sdump(buf.Bytes()), spew.Sdump(msgEncoded))
+	}
+
+	var readmsg MsgAddrV2
+	if err := readmsg.BtcDecode(bytes.NewReader(msgEncoded), pver, enc); err != nil {
+		t.Fatalf("BtcDecode: %v", err)
+	}
+	if !reflect.DeepEqual(&readmsg, msg) {
+		t.Fatalf("BtcDecode\n got: %s want: %s", spew.Sdump(&readmsg),
+			spew.Sdump(msg))
+	}
+
+	// Older protocol versions must fail since the message didn't exist
+	// yet.
+	oldPver := AddrV2Version - 1
+	if err := msg.BtcEncode(&buf, oldPver, enc); err == nil {
+		t.Errorf("BtcEncode: expected error for protocol version %d",
+			oldPver)
+	}
+	if err := readmsg.BtcDecode(bytes.NewReader(msgEncoded), oldPver,
+		enc); err == nil {
+
+		t.Errorf("BtcDecode: expected error for protocol version %d",
+			oldPver)
+	}
+
+	// Addresses on unknown networks are decoded as is.
+	unknown := []byte{
+		0x01,                   // Varint for number of addresses
+		0x29, 0xab, 0x5f, 0x49, // Timestamp
+		0x00,             // Services varint
+		0x2a,             // Network ID
+		0x03,             // Address size varint
+		0x01, 0x02, 0x03, // Address
+		0x20, 0x8d, // Port 8333 in big-endian
+	}
+	if err := readmsg.BtcDecode(bytes.NewReader(unknown), pver, enc); err != nil {
+		t.Fatalf("BtcDecode: unexpected error for unknown network: %v",
+			err)
+	}
+	if na := readmsg.AddrList[0]; na.NetworkID.IsKnown() ||
+		!bytes.Equal(na.Addr, []byte{1, 2, 3}) {
+
+		t.Errorf("BtcDecode: unexpected address %v", spew.Sdump(na))
+	}
+
+	// Addresses on known networks with the wrong size and oversized
+	// addresses must be rejected.
+	badSize := append([]byte(nil), unknown...)
+	badSize[6] = byte(NetIPv4)
+	if err := readmsg.BtcDecode(bytes.NewReader(badSize), pver, enc); err == nil {
+		t.Errorf("BtcDecode: expected error for invalid address size")
+	}
+	oversized := []byte{
+		0x01,                   // Varint for number of addresses
+		0x29, 0xab, 0x5f, 0x49, // Timestamp
+		0x00,             // Services varint
+		0x2a,             // Network ID
+		0xfd, 0x01, 0x02, // Address size varint 513
+	}
+	if err := readmsg.BtcDecode(bytes.NewReader(oversized), pver, enc); err == nil {
+		t.Errorf("BtcDecode: expected error for oversized address")
+	}
+
+	// Messages with too many addresses must be rejected.
+	tooMany := []byte{0xfd, 0xe9, 0x03} // Varint for 1001 addresses
+	if err := readmsg.BtcDecode(bytes.NewReader(tooMany), pver, enc); err == nil {
+		t.Errorf("BtcDecode: expected error for too many addresses")
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright (c) 2016 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package wire
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestSendAddrV2 tests the MsgSendAddrV2 API against the latest protocol
+// version and the protocol version prior to AddrV2Version.
+func TestSendAddrV2(t *testing.T) {
+	pver := ProtocolVersion
+	enc := BaseEncoding
+
+	// Ensure the command is expected value.
+	wantCmd := "sendaddrv2"
+	msg := NewMsgSendAddrV2()
+	if cmd := msg.Command(); cmd != wantCmd {
+		t.Errorf("NewMsgSendAddrV2: wrong command - got %v want %v",
+			cmd, wantCmd)
+	}
+
+	// Ensure max payload is expected value.
+	if maxPayload := msg.MaxPayloadLength(pver); maxPayload != 0 {
+		t.Errorf("MaxPayloadLength: wrong max payload length for "+
+			"protocol version %d - got %v, want 0", pver, maxPayload)
+	}
+
+	// Test encode and decode with latest protocol version.
+	var buf bytes.Buffer
+	if err := msg.BtcEncode(&buf, pver, enc); err != nil {
+		t.Errorf("encode of MsgSendAddrV2 failed %v err <%v>", msg, err)
+	}
+	readmsg := NewMsgSendAddrV2()
+	if err := readmsg.BtcDecode(&buf, pver, enc); err != nil {
+		t.Errorf("decode of MsgSendAddrV2 failed [%v] err <%v>", buf, err)
+	}
+
+	// Older protocol versions should fail since the message didn't exist
+	// yet.
+	oldPver := AddrV2Version - 1
+	if err := msg.BtcEncode(&buf, oldPver, enc); err == nil {
+		t.Errorf("encode of MsgSendAddrV2 passed for old protocol "+
+			"version %v", oldPver)
+	}
+	if err := readmsg.BtcDecode(&buf, oldPver, enc); err == nil {
+		t.Errorf("decode of MsgSendAddrV2 passed for old protocol "+
+			"version %v", oldPver)
+	}
+}
@@ -0,0 +1,382 @@
+// Copyright (c) 2013-2016 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package wire
+
+import (
+	"bytes"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// NetworkID identifies the network an address in a NetAddressV2 belongs to as
+// defined by BIP0155.
+type NetworkID uint8
+
+const (
+	// NetIPv4 identifies an IPv4 address.
+	NetIPv4 NetworkID = 1
+
+	// NetIPv6 identifies an IPv6 address.
+	NetIPv6 NetworkID = 2
+
+	// NetTorV2 identifies a Tor v2 hidden service address.
+	NetTorV2 NetworkID = 3
+
+	// NetTorV3 identifies a Tor v3 hidden service address.
+	NetTorV3 NetworkID = 4
+
+	// NetI2P identifies an I2P address.
+	NetI2P NetworkID = 5
+
+	// NetCJDNS identifies a CJDNS address.
+	NetCJDNS NetworkID = 6
+)
+
+// MaxAddrV2Size is the maximum size of an address in a NetAddressV2 as
+// defined by BIP0155.
+const MaxAddrV2Size = 512
+
+// addrV2Sizes maps the known network IDs to the size of their addresses.
+var addrV2Sizes = map[NetworkID]int{
+	NetIPv4:  4,
+	NetIPv6:  16,
+	NetTorV2: 10,
+	NetTorV3: 32,
+	NetI2P:   32,
+	NetCJDNS: 16,
+}
+
+// netIDStrings is a map of network IDs back to their constant names for
+// pretty printing.
+var netIDStrings = map[NetworkID]string{
+	NetIPv4:  "IPv4",
+	NetIPv6:  "IPv6",
+	NetTorV2: "TorV2",
+	NetTorV3: "TorV3",
+	NetI2P:   "I2P",
+	NetCJDNS: "CJDNS",
+}
+
+// String returns the NetworkID in human-readable form.
+func (id NetworkID) String() string {
+	if s, ok := netIDStrings[id]; ok {
+		return s
+	}
+	return fmt.Sprintf("Unknown NetworkID (%d)", uint8(id))
+}
+
+// IsKnown returns whether or not the network ID is one of the networks
+// defined by BIP0155.
+func (id NetworkID) IsKnown() bool {
+	_, ok := addrV2Sizes[id]
+	return ok
+}
+
+var (
+	// onionCatPrefix is the IPv6 prefix used to embed Tor v2 addresses in
+	// legacy addresses.
+	onionCatPrefix = []byte{0xfd, 0x87, 0xd8, 0x7e, 0xeb, 0x43}
+
+	// addrV2Encoding is the base32 encoding used for Tor and I2P hosts.
+	addrV2Encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+const (
+	// torV3Version is the version byte of Tor v3 hidden service addresses.
+	torV3Version = 0x03
+
+	// torV3ChecksumLen is the length of the checksum in Tor v3 hidden
+	// service addresses.
+	torV3ChecksumLen = 2
+)
+
+// NetAddressV2 defines information about a peer on the network including the
+// time it was last seen, the services it supports, the network it belongs to,
+// its address on that network, and port.  Unlike NetAddress, it is able to
+// represent addresses which are not IP addresses, such as Tor v3 and I2P
+// addresses, as defined by BIP0155.
+type NetAddressV2 struct {
+	// Last time the address was seen.  This is encoded as a uint32 on the
+	// wire and therefore is limited to 2106.
+	Timestamp time.Time
+
+	// Bitfield which identifies the services supported by the address.
+	Services ServiceFlag
+
+	// NetworkID identifies the network of the address.
+	NetworkID NetworkID
+
+	// Addr is the raw address on the network identified by NetworkID.
+	Addr []byte
+
+	// Port the peer is using.  This is encoded in big endian on the wire
+	// which differs from most everything else.
+	Port uint16
+}
+
+// HasService returns whether the specified service is supported by the address.
+func (na *NetAddressV2) HasService(service ServiceFlag) bool {
+	return na.Services&service == service
+}
+
+// AddService adds service as a supported service by the peer generating the
+// message.
+func (na *NetAddressV2) AddService(service ServiceFlag) {
+	na.Services |= service
+}
+
+// IP returns the address as an IP address.  Tor v2 addresses are returned in
+// their OnionCat encoding.  Nil is returned for addresses which can not be
+// represented as an IP address.
+func (na *NetAddressV2) IP() net.IP {
+	if len(na.Addr) != addrV2Sizes[na.NetworkID] {
+		return nil
+	}
+	switch na.NetworkID {
+	case NetIPv4:
+		return net.IP(na.Addr).To16()
+	case NetIPv6, NetCJDNS:
+		return net.IP(na.Addr)
+	case NetTorV2:
+		ip := make(net.IP, 0, net.IPv6len)
+		ip = append(ip, onionCatPrefix...)
+		return append(ip, na.Addr...)
+	}
+	return nil
+}
+
+// Host returns the host of the address in the form used to dial it.  Tor
+// addresses are returned as .onion hosts and I2P addresses as .b32.i2p hosts.
+func (na *NetAddressV2) Host() string {
+	if len(na.Addr) != addrV2Sizes[na.NetworkID] {
+		return fmt.Sprintf("[%s:%x]", na.NetworkID, na.Addr)
+	}
+	switch na.NetworkID {
+	case NetTorV2:
+		return strings.ToLower(addrV2Encoding.EncodeToString(na.Addr)) +
+			".onion"
+	case NetTorV3:
+		checksum := torV3Checksum(na.Addr)
+		data := make([]byte, 0, len(na.Addr)+torV3ChecksumLen+1)
+		data = append(data, na.Addr...)
+		data = append(data, checksum[:]...)
+		data = append(data, torV3Version)
+		return strings.ToLower(addrV2Encoding.EncodeToString(data)) +
+			".onion"
+	case NetI2P:
+		return strings.ToLower(addrV2Encoding.EncodeToString(na.Addr)) +
+			".b32.i2p"
+	}
+	return na.IP().String()
+}
+
+// String returns the address as a host:port string.
+func (na *NetAddressV2) String() string {
+	return net.JoinHostPort(na.Host(), fmt.Sprint(na.Port))
+}
+
+// ToLegacy returns the address as a legacy NetAddress.  Nil is returned for
+// addresses which can not be represented by a legacy NetAddress.
+func (na *NetAddressV2) ToLegacy() *NetAddress {
+	ip := na.IP()
+	if ip == nil || na.NetworkID == NetCJDNS {
+		return nil
+	}
+	return &NetAddress{
+		Timestamp: na.Timestamp,
+		Services:  na.Services,
+		IP:        ip,
+		Port:      na.Port,
+	}
+}
+
+// NewNetAddressV2 returns a new NetAddressV2 using the provided network ID,
+// address, port, and supported services with the timestamp set to the current
+// time rounded to single second precision.
+func NewNetAddressV2(netID NetworkID, addr []byte, port uint16,
+	services ServiceFlag) *NetAddressV2 {
+
+	return &NetAddressV2{
+		Timestamp: time.Unix(time.Now().Unix(), 0),
+		Services:  services,
+		NetworkID: netID,
+		Addr:      addr,
+		Port:      port,
+	}
+}
+
+// NetAddressV2FromLegacy returns the passed legacy NetAddress as a
+// NetAddressV2.  OnionCat addresses are converted to Tor v2 addresses.
+func NetAddressV2FromLegacy(na *NetAddress) *NetAddressV2 {
+	na2 := &NetAddressV2{
+		Timestamp: na.Timestamp,
+		Services:  na.Services,
+		Port:      na.Port,
+	}
+	switch {
+	case na.IP.To4() != nil:
+		na2.NetworkID = NetIPv4
+		na2.Addr = []byte(na.IP.To4())
+	case len(na.IP) == net.IPv6len && bytes.HasPrefix(na.IP, onionCatPrefix):
+		na2.NetworkID = NetTorV2
+		na2.Addr = append([]byte(nil), na.IP[len(onionCatPrefix):]...)
+	default:
+		na2.NetworkID = NetIPv6
+		na2.Addr = []byte(na.IP.To16())
+		if na2.Addr == nil {
+			na2.Addr = make([]byte, net.IPv6len)
+		}
+	}
+	return na2
+}
+
+// NewNetAddressV2Host returns a new NetAddressV2 for the passed host, which
+// must be an IP address, a Tor v2 or v3 .onion host, or an I2P .b32.i2p host,
+// using the provided port and supported services.  IPv6 addresses in the
+// fc00::/8 range are treated as CJDNS addresses when cjdns is set.
+func NewNetAddressV2Host(host string, port uint16, services ServiceFlag,
+	cjdns bool) (*NetAddressV2, error) {
+
+	lower := strings.ToLower(host)
+	switch {
+	case strings.HasSuffix(lower, ".b32.i2p"):
+		data, err := addrV2Encoding.DecodeString(strings.ToUpper(
+			strings.TrimSuffix(lower, ".b32.i2p")))
+		if err != nil || len(data) != addrV2Sizes[NetI2P] {
+			return nil, fmt.Errorf("invalid i2p address %q", host)
+		}
+		return NewNetAddressV2(NetI2P, data, port, services), nil
+
+	case strings.HasSuffix(lower, ".onion"):
+		data, err := addrV2Encoding.DecodeString(strings.ToUpper(
+			strings.TrimSuffix(lower, ".onion")))
+		if err != nil {
+			return nil, fmt.Errorf("invalid onion address %q", host)
+		}
+		switch len(data) {
+		case addrV2Sizes[NetTorV2]:
+			return NewNetAddressV2(NetTorV2, data, port, services), nil
+
+		case addrV2Sizes[NetTorV3] + torV3ChecksumLen + 1:
+			pubKey := data[:addrV2Sizes[NetTorV3]]
+			checksum := torV3Checksum(pubKey)
+			if data[len(data)-1] != torV3Version ||
+				!bytes.Equal(data[len(pubKey):len(data)-1], checksum[:]) {
+
+				return nil, fmt.Errorf("invalid onion address %q", host)
+			}
+			return NewNetAddressV2(NetTorV3, pubKey, port, services), nil
+		}
+		return nil, fmt.Errorf("invalid onion address %q", host)
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %q", host)
+	}
+	na := NetAddressV2FromLegacy(NewNetAddressIPPort(ip, port, services))
+	if cjdns && na.NetworkID == NetIPv6 && na.Addr[0] == 0xfc {
+		na.NetworkID = NetCJDNS
+	}
+	return na, nil
+}
+
+// torV3Checksum returns the checksum of a Tor v3 hidden service address with
+// the passed public key.
+func torV3Checksum(pubKey []byte) [torV3ChecksumLen]byte {
+	h := sha3.New256()
+	h.Write([]byte(".onion checksum"))
+	h.Write(pubKey)
+	h.Write([]byte{torV3Version})
+
+	var checksum [torV3ChecksumLen]byte
+	copy(checksum[:], h.Sum(nil))
+	return checksum
+}
+
+// maxNetAddressV2Payload returns the max payload size for a NetAddressV2.
+func maxNetAddressV2Payload() uint32 {
+	// Timestamp 4 bytes + services varint + network id 1 byte + address
+	// size varint + address + port 2 bytes.
+	return 4 + MaxVarIntPayload + 1 + MaxVarIntPayload + MaxAddrV2Size + 2
+}
+
+// readNetAddressV2 reads an encoded NetAddressV2 from r.  Addresses on
+// networks which are not known are read without further validation while
+// addresses on known networks must have the size defined for the network.
+func readNetAddressV2(r io.Reader, pver uint32, na *NetAddressV2) error {
+	err := readElement(r, (*uint32Time)(&na.Timestamp))
+	if err != nil {
+		return err
+	}
+
+	services, err := ReadVarInt(r, pver)
+	if err != nil {
+		return err
+	}
+	na.Services = ServiceFlag(services)
+
+	var netID uint8
+	if err := readElement(r, &netID); err != nil {
+		return err
+	}
+	na.NetworkID = NetworkID(netID)
+
+	size, err := ReadVarInt(r, pver)
+	if err != nil {
+		return err
+	}
+	if size > MaxAddrV2Size {
+		str := fmt.Sprintf("address too large [size %v, max %v]", size,
+			MaxAddrV2Size)
+		return messageError("readNetAddressV2", str)
+	}
+	if want, ok := addrV2Sizes[na.NetworkID]; ok && int(size) != want {
+		str := fmt.Sprintf("invalid %s address size [size %v, want %v]",
+			na.NetworkID, size, want)
+		return messageError("readNetAddressV2", str)
+	}
+	na.Addr = make([]byte, size)
+	if _, err := io.ReadFull(r, na.Addr); err != nil {
+		return err
+	}
+
+	// Sigh.  Bitcoin protocol mixes little and big endian.
+	na.Port, err = binarySerializer.Uint16(r, bigEndian)
+	return err
+}
+
+// writeNetAddressV2 serializes a NetAddressV2 to w.
+func writeNetAddressV2(w io.Writer, pver uint32, na *NetAddressV2) error {
+	if len(na.Addr) > MaxAddrV2Size {
+		str := fmt.Sprintf("address too large [size %v, max %v]",
+			len(na.Addr), MaxAddrV2Size)
+		return messageError("writeNetAddressV2", str)
+	}
+
+	err := writeElement(w, uint32(na.Timestamp.Unix()))
+	if err != nil {
+		return err
+	}
+	if err := WriteVarInt(w, pver, uint64(na.Services)); err != nil {
+		return err
+	}
+	if err := writeElement(w, uint8(na.NetworkID)); err != nil {
+		return err
+	}
+	if err := WriteVarBytes(w, pver, na.Addr); err != nil {
+		return err
+	}
+
+	// Sigh.  Bitcoin protocol mixes little and big endian.
+	return binary.Write(w, bigEndian, na.Port)
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2013-2016 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package wire
+
+import (
+	"net"
+	"testing"
+)
+
+// TestNetAddressV2Host ensures hosts on the various networks are parsed into
+// the expected network and converted back to the same host.
+func TestNetAddressV2Host(t *testing.T) {
+	tests := []struct {
+		host   string
+		cjdns  bool
+		netID  NetworkID
+		legacy bool
+	}{
+		{host: "127.0.0.1", netID: NetIPv4, legacy: true},
+		{host: "2001:db8::1", netID: NetIPv6, legacy: true},
+		{host: "fc00::1", netID: NetIPv6, legacy: true},
+		{host: "fc00::1", cjdns: true, netID: NetCJDNS},
+		{host: "aaaaaaaaaaaaaaaa.onion", netID: NetTorV2, legacy: true},
+		{
+			host:  "pg6mmjiyjmcrsslvykfwnntlaru7p5svn6y2ymmju6nubxndf4pscryd.onion",
+			netID: NetTorV3,
+		},
+		{
+			host:  "ukeu3k5oycgaauneqgtnvselmt4yemvoilkln7jpvamvfx7dnkdq.b32.i2p",
+			netID: NetI2P,
+		},
+	}
+
+	for _, test := range tests {
+		na, err := NewNetAddressV2Host(test.host, 8338, SFNodeNetwork,
+			test.cjdns)
+		if err != nil {
+			t.Errorf("NewNetAddressV2Host(%s): unexpected error: %v",
+				test.host, err)
+			continue
+		}
+		if na.NetworkID != test.netID {
+			t.Errorf("NewNetAddressV2Host(%s): got network %v, want %v",
+				test.host, na.NetworkID, test.netID)
+		}
+		if host := na.Host(); host != test.host {
+			t.Errorf("Host: got %s, want %s", host, test.host)
+		}
+
+		legacy := na.ToLegacy()
+		if (legacy != nil) != test.legacy {
+			t.Errorf("ToLegacy(%s): got %v, want legacy %v", test.host,
+				legacy, test.legacy)
+			continue
+		}
+		if legacy == nil {
+			continue
+		}
+		back := NetAddressV2FromLegacy(legacy)
+		if back.NetworkID != na.NetworkID || back.Host() != na.Host() {
+			t.Errorf("NetAddressV2FromLegacy(%s): got %s (%v)",
+				test.host, back.Host(), back.NetworkID)
+		}
+	}
+
+	// Invalid hosts and Tor v3 addresses with a bad checksum or version
+	// must be rejected.
+	invalid := []string{
+		"",
+		"example.com",
+		"aaaa.onion",
+		"pg6mmjiyjmcrsslvykfwnntlaru7p5svn6y2ymmju6nubxndf4pscrya.onion",
+		"pg6mmjiyjmcrsslvykfwnntlaru7p5svn6y2ymmju6nubxndf4pscryc.onion",
+		"ukeu3k5oycgaauneqgtnvselmt4yemvoilkln7jpvamvfx7dnkd.b32.i2p",
+	}
+	for _, host := range invalid {
+		if _, err := NewNetAddressV2Host(host, 8338, 0, false); err == nil {
+			t.Errorf("NewNetAddressV2Host(%q): expected error", host)
+		}
+	}
+
+	// Legacy IPv4 addresses are represented with 4 bytes.
+	na := NetAddressV2FromLegacy(NewNetAddressIPPort(
+		net.ParseIP("10.0.0.1"), 8338, 0))
+	if na.NetworkID != NetIPv4 || len(na.Addr) != 4 {
+		t.Errorf("NetAddressV2FromLegacy: got %v %x", na.NetworkID, na.Addr)
+	}
+}
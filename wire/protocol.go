@@ -13,7 +13,7 @@ import (
 // XXX pedro: we will probably need to bump this.
 const (
 	// ProtocolVersion is the latest protocol version this package supports.
-	ProtocolVersion uint32 = 70016
+	ProtocolVersion uint32 = 70017
 
 	// MultipleAddressVersion is the protocol version which added multiple
 	// addresses per message (pver >= MultipleAddressVersion).
@@ -55,6 +55,11 @@ const (
 	// BTGHardForkVersion is the protocol version where BTG hard fork
 	// happens.
 	BTGHardForkVersion uint32 = 70016
+
+	// AddrV2Version is the protocol version which added the sendaddrv2
+	// and addrv2 messages (BIP0155).  Peers running an older version only
+	// accept a verack message after the version message.
+	AddrV2Version uint32 = 70017
 )
 
 // ServiceFlag identifies services supported by a bitcoin peer.
@@ -90,6 +95,10 @@ const (
 	// SFNode2X is a flag used to indicate a peer is running the Segwit2X
 	// software.
 	SFNode2X
+
+	// SFNodeP2PV2 is a flag used to indicate a peer supports the BIP0324
+	// v2 encrypted transport protocol.
+	SFNodeP2PV2 ServiceFlag = 1 << 11
 )
 
 // Map of service flags back to their constant names for pretty printing.
@@ -102,6 +111,7 @@ var sfStrings = map[ServiceFlag]string{
 	SFNodeBit5:    "SFNodeBit5",
 	SFNodeCF:      "SFNodeCF",
 	SFNode2X:      "SFNode2X",
+	SFNodeP2PV2:   "SFNodeP2PV2",
 }
 
 // orderedSFStrings is an ordered list of service flags from highest to
@@ -115,6 +125,7 @@ var orderedSFStrings = []ServiceFlag{
 	SFNodeBit5,
 	SFNodeCF,
 	SFNode2X,
+	SFNodeP2PV2,
 }
 
 // String returns the ServiceFlag in human-readable form.